@@ -0,0 +1,86 @@
+package topkapi
+
+// NewFromBacking creates a sketch of the dimensions in p, like
+// NewFromParams, keeping its counters, residuals and keys in the given
+// slices rather than allocating them, for callers that carve many small
+// sketches out of one arena to control the work of the garbage collector.
+// Every slice must hold exactly p.L rows of p.B buckets, one row after the
+// other, and is zeroed; only the key hashes and bitmaps of the candidates,
+// about a fifth of the memory of a sketch, are allocated. It returns an
+// error wrapping ErrInvalidParameter for slices of other lengths, and for
+// options that move the counters out of them, like WithExtraCounterRows or
+// WithLayout(ColumnMajor).
+//
+// The sketch owns the slices until Detach returns them. Reading or writing
+// them meanwhile corrupts the sketch, as do slices overlapping those of
+// another sketch. Methods that copy a sketch, like Clone and Grow, copy it
+// to memory of their own, and methods that replace its rows, like
+// UnmarshalBinary and ReadRow, leave the slices behind. MergeRows keeps
+// using the slices for the rows it keeps. Keys stay reachable through
+// objects as long as the slice is, so an arena keeps the keys of its
+// sketches alive until it is cleared.
+func NewFromBacking(p Params, cms []uint64, counts []int64, objects []interface{}, opts ...Option) (*Sketch, error) {
+	if p.B < 1 || p.L < 1 {
+		return nil, newError(ErrInvalidParameter, "topkapi: values of B and L should be >= 1")
+	}
+	if err := checkDimensions(p.B, p.L); err != nil {
+		return nil, err
+	}
+	if n := p.B * p.L; uint64(len(cms)) != n || uint64(len(counts)) != n || uint64(len(objects)) != n {
+		return nil, newError(ErrInvalidParameter, "topkapi: backing slices should hold %d buckets, found %d, %d and %d", n, len(cms), len(counts), len(objects))
+	}
+
+	for i := range cms {
+		cms[i] = 0
+	}
+	for i := range counts {
+		counts[i] = 0
+	}
+	for i := range objects {
+		objects[i] = nil
+	}
+
+	sk, err := backedSketch(p.B, p.L, cms, counts, objects).apply(opts)
+	if err != nil {
+		return nil, err
+	}
+	if c, _, _, ok := sk.backing(); !ok || &c[0] != &cms[0] {
+		return nil, newError(ErrInvalidParameter, "topkapi: options should keep the counters in the backing slices")
+	}
+	return sk, nil
+}
+
+// Detach returns the slices the sketch keeps its counters, residuals and
+// keys in, like those given to NewFromBacking, for the caller to reuse.
+// They hold the state the sketch was in, and the sketch drops its rows: it
+// must not be used afterwards. It returns nil slices, and leaves the sketch
+// as it is, if the sketch no longer keeps all of its rows in them, see
+// NewFromBacking.
+func (sk *Sketch) Detach() (cms []uint64, counts []int64, objects []interface{}) {
+	cms, counts, objects, ok := sk.backing()
+	if !ok {
+		return nil, nil, nil
+	}
+
+	sk.cms, sk.counts, sk.objects, sk.hashes, sk.occupied = counterMatrix{}, nil, nil, nil, nil
+	return cms, counts, objects
+}
+
+// backing returns the slices of l*b elements the counters, residuals and
+// keys of sk are kept in, row after row, if they are.
+func (sk *Sketch) backing() (cms []uint64, counts []int64, objects []interface{}, ok bool) {
+	n := sk.l * sk.b
+	if sk.cms.layout != RowMajor || uint64(sk.cms.rows) != sk.l || uint64(len(sk.cms.data)) != n ||
+		len(sk.counts) == 0 || uint64(cap(sk.counts[0])) < n || uint64(cap(sk.objects[0])) < n {
+		return nil, nil, nil, false
+	}
+
+	counts, objects = sk.counts[0][:n], sk.objects[0][:n]
+	for i := range sk.counts {
+		off := uint64(i) * sk.b
+		if &counts[off] != &sk.counts[i][0] || &objects[off] != &sk.objects[i][0] {
+			return nil, nil, nil, false
+		}
+	}
+	return sk.cms.data, counts, objects, true
+}
@@ -0,0 +1,111 @@
+package topkapi
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestNewFromBacking(t *testing.T) {
+	p := Params{B: 2000, L: 4}
+	n := p.B * p.L
+	var (
+		cms     = make([]uint64, 2*n)
+		counts  = make([]int64, 2*n)
+		objects = make([]interface{}, 2*n)
+	)
+	for i := range cms {
+		cms[i], counts[i], objects[i] = 1, 1, "stale"
+	}
+
+	// Two sketches of one arena count like sketches of their own
+	var backed, plain [2]*Sketch
+	for s := range backed {
+		from, to := uint64(s)*n, uint64(s+1)*n
+		var err error
+		if backed[s], err = NewFromBacking(p, cms[from:to], counts[from:to], objects[from:to], WithSeed(7)); err != nil {
+			t.Fatal(err)
+		}
+		plain[s], _ = NewFromParams(p, WithSeed(7))
+	}
+	for s := range backed {
+		for _, key := range zipfKeys(30000, 5000, int64(s+1)) {
+			backed[s].Insert(key, 1)
+			plain[s].Insert(key, 1)
+		}
+	}
+	for s := range backed {
+		assertSameResults(t, backed[s], plain[s])
+	}
+
+	got, _, _ := backed[1].Detach()
+	if &got[0] != &cms[n] || len(got) != int(n) {
+		t.Fatal("Expected the second sketch to detach its half of the arena")
+	}
+	var sum uint64
+	for _, c := range got[:p.B] {
+		sum += c
+	}
+	if sum != plain[1].Total() {
+		t.Errorf("Expected the detached counters to add up to %d, found %d", plain[1].Total(), sum)
+	}
+	if backed[1].cms.rows != 0 || backed[1].counts != nil {
+		t.Error("Expected a detached sketch to drop its rows")
+	}
+	assertSameResults(t, backed[0], plain[0])
+
+	// A sketch whose rows were replaced leaves the arena behind
+	data, _ := plain[1].MarshalBinary()
+	if err := backed[0].UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if c, _, _ := backed[0].Detach(); len(c) != int(n) || &c[0] == &cms[0] {
+		t.Error("Expected a decoded sketch to detach slices of its own")
+	}
+}
+
+func TestNewFromBackingAllocations(t *testing.T) {
+	p := Params{B: 50000, L: 4}
+	n := p.B * p.L
+	cms, counts, objects := make([]uint64, n), make([]int64, n), make([]interface{}, n)
+
+	allocated := func(f func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		f()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	backed := allocated(func() { NewFromBacking(p, cms, counts, objects) })
+	plain := allocated(func() { NewFromParams(p) })
+
+	// Only the key hashes and bitmaps are allocated
+	if hashes := 8 * n; backed > hashes+hashes/4 || plain < 4*hashes {
+		t.Errorf("Expected about %d bytes allocated for %d buckets, found %d, against %d without backing", hashes, n, backed, plain)
+	}
+}
+
+func TestNewFromBackingInvalid(t *testing.T) {
+	p := Params{B: 10, L: 2}
+	cms, counts, objects := make([]uint64, 20), make([]int64, 20), make([]interface{}, 20)
+	for name, f := range map[string]func() (*Sketch, error){
+		"short counters":  func() (*Sketch, error) { return NewFromBacking(p, cms[:19], counts, objects) },
+		"long residuals":  func() (*Sketch, error) { return NewFromBacking(p, cms, append(counts, 0), objects) },
+		"no keys":         func() (*Sketch, error) { return NewFromBacking(p, cms, counts, nil) },
+		"no rows":         func() (*Sketch, error) { return NewFromBacking(Params{B: 10}, nil, nil, nil) },
+		"extra rows":      func() (*Sketch, error) { return NewFromBacking(p, cms, counts, objects, WithExtraCounterRows(1)) },
+		"column-major":    func() (*Sketch, error) { return NewFromBacking(p, cms, counts, objects, WithLayout(ColumnMajor)) },
+		"failing options": func() (*Sketch, error) { return NewFromBacking(p, cms, counts, objects, WithCanonicalizer(nil)) },
+	} {
+		if sk, err := f(); sk != nil || !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("%s: expected an invalid parameter, found %v", name, err)
+		}
+	}
+
+	// A clone keeps its rows in memory of its own
+	sk, _ := NewFromBacking(p, cms, counts, objects)
+	if c, _, _ := sk.Clone().Detach(); c != nil {
+		t.Error("Expected no backing slices of a clone")
+	}
+}
@@ -0,0 +1,177 @@
+package topkapi
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// boundedKeyLen is the longest string key sketches of NewBounded hold.
+const boundedKeyLen = 64
+
+// NewBounded creates the sketch with the most buckets that fits in maxBytes,
+// for devices where memory is capped. Rows go first, from 4 down to 2, until
+// rows are at least 256 buckets wide.
+//
+// Sketches never grow: all counters are allocated up front, and the only
+// memory added while inserting is that of the keys the candidate slots
+// hold. NewBounded limits string keys to 64 bytes, truncating longer ones
+// unless WithMaxKeyLen asks to reject them, and sizes the sketch as if
+// every slot held a different key of that length, so MemoryUsed never
+// exceeds maxBytes however many keys are inserted. The guarantee covers
+// strings, booleans and numbers as keys; other keys are counted by the size
+// of their type and should not hold pointers.
+//
+// Options are applied as with the other constructors, and the memory of
+// those that allocate, like WithSpanTracking, is reserved from maxBytes.
+func NewBounded(maxBytes uint64, opts ...Option) (*Sketch, error) {
+	opts = append([]Option{WithMaxKeyLen(boundedKeyLen, TruncateLongKeys)}, opts...)
+
+	// The options tell what they allocate on a sketch too small to matter
+	probe, err := newSketch(1, 1).apply(opts)
+	if err != nil {
+		return nil, err
+	}
+	if probe.maxKeyLen > boundedKeyLen {
+		return nil, newError(ErrInvalidParameter, "topkapi: keys of NewBounded should be at most %d bytes", boundedKeyLen)
+	}
+
+	worst := func(b, l uint64) uint64 {
+		return probe.footprint(b, l) + l*b*keyFootprint(probe.maxKeyLen)
+	}
+	l := uint64(DefaultRows)
+	b := func(l uint64) uint64 {
+		// The footprint grows with b, so the widest fit is found by bisection
+		lo, hi := uint64(0), maxBytes/(l*slotSize)+1
+		for lo < hi {
+			mid := (lo + hi + 1) / 2
+			if worst(mid, l) <= maxBytes {
+				lo = mid
+			} else {
+				hi = mid - 1
+			}
+		}
+		return lo
+	}
+	for l > minRows && b(l) < 256 {
+		l--
+	}
+	if b(l) < 1 {
+		return nil, fmt.Errorf("%w: at least %d bytes are needed", insufficientBudget, worst(1, minRows))
+	}
+
+	if err := checkDimensions(b(l), l); err != nil {
+		return nil, err
+	}
+	return newSketch(b(l), l).apply(opts)
+}
+
+// MemoryUsed returns the bytes the sketch takes, as allocated by the Go
+// runtime: its counters and candidate slots, the keys they hold, and what
+// options like WithSpanTracking keep. Keys are counted by their type and, for
+// strings, their length, which undercounts keys holding pointers, like
+// structs with strings.
+func (sk *Sketch) MemoryUsed() uint64 {
+	mem, _ := sk.memoryUsed()
+	return mem
+}
+
+// BytesPerKey returns MemoryUsed per distinct candidate key, the Tracked of
+// Stats, or per key of 1 if there are none, for right-sizing sketches in
+// production: a sketch of many bytes per key is larger than its stream
+// needs, and one of few is near saturation, its buckets taken by
+// candidates. It is a snapshot, which falls as the sketch fills, so it
+// tells more of a sketch that has seen a representative part of its stream.
+func (sk *Sketch) BytesPerKey() float64 {
+	mem, keys := sk.memoryUsed()
+	if keys == 0 {
+		keys = 1
+	}
+	return float64(mem) / float64(keys)
+}
+
+// memoryUsed returns MemoryUsed, and the number of distinct candidate keys.
+func (sk *Sketch) memoryUsed() (uint64, int) {
+	mem := sk.footprint(sk.b, sk.l)
+
+	seen := make(map[interface{}]struct{})
+	for _, row := range sk.objects {
+		for _, obj := range row {
+			if obj == nil {
+				continue
+			}
+			if _, ok := seen[obj]; ok {
+				continue
+			}
+			seen[obj] = struct{}{}
+			if s, ok := obj.(string); ok {
+				mem += keyFootprint(len(s))
+			} else {
+				mem += allocSize(uint64(reflect.TypeOf(obj).Size()))
+			}
+		}
+	}
+
+	return mem, len(seen)
+}
+
+// footprint returns the bytes allocated for a sketch with the options of sk
+// and l rows of b buckets, without its keys.
+func (sk *Sketch) footprint(b, l uint64) uint64 {
+	rows := func(n, size uint64) uint64 {
+		return n*allocSize(size) + allocSize(n*uint64(unsafe.Sizeof([]uint64{})))
+	}
+	// Rows carved from a single slice, see backedSketch
+	flat := func(n, size uint64) uint64 {
+		return allocSize(n*size) + allocSize(n*uint64(unsafe.Sizeof([]uint64{})))
+	}
+
+	extra := uint64(sk.cms.rows) - sk.l
+	mem := allocSize(uint64(unsafe.Sizeof(Sketch{})))
+	mem += allocSize((l + extra) * 8 * b)          // cms, in one slice
+	mem += 2*flat(l, 8*b) + flat(l, 16*b)          // counts, hashes and objects
+	mem += rows(l, 8*((b+63)/64)) + allocSize(8*l) // occupied and conflicts
+	if sk.spans != nil {
+		mem += allocSize(uint64(unsafe.Sizeof(spanTracker{}))) + 2*rows(l, 8*b)
+	}
+	if sk.samples != nil {
+		mem += rows(l, 16*b)
+	}
+	if sk.thresholds != nil {
+		mem += allocSize(uint64(unsafe.Sizeof(thresholdHistogram{})))
+	}
+	if sk.top != nil {
+		// Entries and their scratch, and map entries for every tracked key
+		// and each of its buckets
+		m := uint64(sk.top.m)
+		mem += 2*allocSize(m*uint64(unsafe.Sizeof(trackedKey{}))) + m*(64+64*l)
+	}
+	if sk.dedup != nil {
+		mem += allocSize(uint64(unsafe.Sizeof(EventFilter{}))) + 2*allocSize(8*uint64(len(sk.dedup.gens[0])))
+	}
+
+	return mem
+}
+
+// keyFootprint returns the bytes allocated for a string key of n bytes held
+// in an interface: its header and its bytes.
+func keyFootprint(n int) uint64 {
+	return allocSize(16) + allocSize(uint64(n))
+}
+
+// allocSize bounds the bytes the Go runtime allocates for an object of n
+// bytes. Small objects are rounded up to size classes, which waste at most
+// an eighth, and large ones to pages of 8KB.
+func allocSize(n uint64) uint64 {
+	const page = 8192
+	switch {
+	case n == 0:
+		return 0
+	case n <= 16:
+		return (n + 7) / 8 * 8
+	case n <= 32768:
+		return (n + n/8 + 15) / 16 * 16
+	default:
+		return (n + page - 1) / page * page
+	}
+}
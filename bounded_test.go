@@ -0,0 +1,107 @@
+package topkapi
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNewBounded(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	key := func() string {
+		var b strings.Builder
+		for n := 8 + r.Intn(100); n > 0; n-- {
+			b.WriteByte(byte('a' + r.Intn(26)))
+		}
+		return b.String()
+	}
+
+	for _, tc := range []struct {
+		maxBytes uint64
+		opts     []Option
+	}{
+		{8 << 10, nil},
+		{64 << 10, nil},
+		{1 << 20, nil},
+		{4 << 20, nil},
+		{1 << 20, []Option{WithTopKTracking(20), WithSpanTracking(), WithSamples()}},
+		{1 << 20, []Option{WithExtraCounterRows(2), WithThresholdTracking()}},
+	} {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		sk, err := NewBounded(tc.maxBytes, tc.opts...)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", tc.maxBytes, err)
+		}
+		for n := 0; n < 200000; n++ {
+			k := key()
+			sk.InsertWithSample(k, 1, n)
+		}
+		if used := sk.MemoryUsed(); used > tc.maxBytes {
+			t.Errorf("%d bytes: %d×%d uses %d bytes", tc.maxBytes, sk.l, sk.b, used)
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		if after.HeapAlloc > before.HeapAlloc && after.HeapAlloc-before.HeapAlloc > tc.maxBytes {
+			t.Errorf("%d bytes: %d×%d allocates %d bytes", tc.maxBytes, sk.l, sk.b, after.HeapAlloc-before.HeapAlloc)
+		}
+		t.Logf("%d bytes: %d×%d uses %d bytes", tc.maxBytes, sk.l, sk.b, sk.MemoryUsed())
+		runtime.KeepAlive(sk)
+	}
+
+	if _, err := NewBounded(100); !errors.Is(err, insufficientBudget) {
+		t.Errorf("a budget of 100 bytes should be insufficient, got %v", err)
+	}
+	if _, err := NewBounded(1<<20, WithMaxKeyLen(128, RejectLongKeys)); err == nil {
+		t.Error("keys longer than 64 bytes should be refused")
+	}
+
+	// Rows give way to buckets when the budget is tight
+	small, _ := NewBounded(64 << 10)
+	large, _ := NewBounded(4 << 20)
+	if small.l >= large.l || large.l != DefaultRows {
+		t.Errorf("rows are %d for 64KB and %d for 4MB", small.l, large.l)
+	}
+}
+
+func TestMemoryUsed(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	empty := sk.MemoryUsed()
+	if empty < sk.l*sk.b*slotSize {
+		t.Errorf("an empty %d×%d sketch uses %d bytes", sk.l, sk.b, empty)
+	}
+
+	sk.Insert(strings.Repeat("x", 1000), 1)
+	sk.Insert(42, 1)
+	if used := sk.MemoryUsed(); used < empty+1000+8 {
+		t.Errorf("keys of 1008 bytes add %d bytes", used-empty)
+	}
+}
+
+func TestBytesPerKey(t *testing.T) {
+	sk, _ := New(0.01, 0.001)
+	if per := sk.BytesPerKey(); per != float64(sk.MemoryUsed()) {
+		t.Errorf("Expected the memory of an empty sketch per key of 1, found %v", per)
+	}
+
+	last := sk.BytesPerKey()
+	for n := 10; n <= 1000; n *= 10 {
+		for i := 0; i < n; i++ {
+			sk.Insert(fmt.Sprint("key", i), 1)
+		}
+		per := sk.BytesPerKey()
+		if tracked := sk.Stats().Tracked; per != float64(sk.MemoryUsed())/float64(tracked) {
+			t.Errorf("Expected %d bytes per %d keys, found %v", sk.MemoryUsed(), tracked, per)
+		}
+		if per >= last {
+			t.Errorf("Expected fewer bytes per key with %d keys than %v, found %v", n, last, per)
+		}
+		last = per
+	}
+}
@@ -0,0 +1,147 @@
+package topkapi
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CachedTopK serves the top-k of a ConcurrentSketch from a result computed in
+// the background, for hot paths that can tolerate a slightly stale answer.
+// Reads never lock: they load the last published result, which is replaced
+// as a whole and so is never seen partially built.
+//
+// The result is recomputed every interval, and additionally after a number
+// of inserts through the cache if WithRefreshAfterInserts is given.
+type CachedTopK struct {
+	sk       *ConcurrentSketch
+	k        int
+	interval time.Duration
+	clock    Clock
+
+	refreshAfter uint64
+	inserts      uint64 // since the last refresh, accessed atomically
+
+	result atomic.Value // *cachedResult
+
+	kick     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type cachedResult struct {
+	entries []LocalHeavyHitter
+	at      time.Time
+}
+
+// CacheOption configures a CachedTopK.
+type CacheOption func(*CachedTopK) error
+
+// WithRefreshAfterInserts also refreshes the result once n inserts have been
+// made through the cache since the last refresh.
+func WithRefreshAfterInserts(n uint64) CacheOption {
+	return func(c *CachedTopK) error {
+		if n < 1 {
+			return newError(ErrInvalidParameter, "topkapi: value of n should be >= 1")
+		}
+		c.refreshAfter = n
+		return nil
+	}
+}
+
+// WithCacheClock sets the clock driving refreshes and result ages.
+func WithCacheClock(clock Clock) CacheOption {
+	return func(c *CachedTopK) error {
+		if clock == nil {
+			return newError(ErrInvalidParameter, "topkapi: clock should not be nil")
+		}
+		c.clock = clock
+		return nil
+	}
+}
+
+// NewCachedTopK computes the first result and starts refreshing it every
+// interval on a background goroutine. Close stops it.
+func NewCachedTopK(sk *ConcurrentSketch, k int, interval time.Duration, opts ...CacheOption) (*CachedTopK, error) {
+	if k < 1 {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of k should be >= 1")
+	}
+	if interval <= 0 {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of interval should be > 0")
+	}
+
+	c := &CachedTopK{
+		sk:       sk,
+		k:        k,
+		interval: interval,
+		clock:    SystemClock,
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	c.refresh()
+	go c.run(c.clock.NewTicker(interval))
+
+	return c, nil
+}
+
+func (c *CachedTopK) run(ticker Ticker) {
+	defer close(c.done)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			c.refresh()
+		case <-c.kick:
+			c.refresh()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *CachedTopK) refresh() {
+	atomic.StoreUint64(&c.inserts, 0)
+	c.result.Store(&cachedResult{
+		entries: c.sk.TopK(c.k),
+		at:      c.clock.Now(),
+	})
+}
+
+// Insert inserts into the underlying sketch, taking its write lock.
+func (c *CachedTopK) Insert(key interface{}, count uint64) {
+	c.sk.Insert(key, count)
+
+	if c.refreshAfter > 0 && atomic.AddUint64(&c.inserts, 1) == c.refreshAfter {
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// TopK returns the last computed top-k and how long ago it was computed. The
+// slice is shared between callers and must not be modified.
+func (c *CachedTopK) TopK() ([]LocalHeavyHitter, time.Duration) {
+	res := c.result.Load().(*cachedResult)
+	return res.entries, c.clock.Now().Sub(res.at)
+}
+
+// Close stops the background refresh and waits for it to exit. The last
+// result can still be read afterwards.
+func (c *CachedTopK) Close() error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+
+	return nil
+}
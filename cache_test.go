@@ -0,0 +1,126 @@
+package topkapi
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func topKey(c *CachedTopK) interface{} {
+	res, _ := c.TopK()
+	if len(res) == 0 {
+		return nil
+	}
+	return res[0].Key
+}
+
+func TestCachedTopKInterval(t *testing.T) {
+	clock := newFakeClock()
+	sk, _ := New(0.01, 0.01)
+	c, err := NewCachedTopK(NewConcurrent(sk), 3, time.Second, WithCacheClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if res, age := c.TopK(); len(res) != 0 || age != 0 {
+		t.Fatalf("Expected fresh empty result, found %v aged %s", res, age)
+	}
+
+	c.Insert("a", 10)
+	clock.Advance(500 * time.Millisecond)
+	if res, age := c.TopK(); len(res) != 0 || age != 500*time.Millisecond {
+		t.Fatalf("Expected stale empty result aged 500ms, found %v aged %s", res, age)
+	}
+
+	// The tick at 1s is received by the refresh loop before Advance returns
+	clock.Advance(500 * time.Millisecond)
+	waitFor(t, func() bool { return topKey(c) == "a" })
+	if _, age := c.TopK(); age != 0 {
+		t.Errorf("Expected refreshed result aged 0, found %s", age)
+	}
+
+	c.Insert("b", 20)
+	clock.Advance(999 * time.Millisecond)
+	if topKey(c) != "a" {
+		t.Error("Expected no refresh before the interval elapsed")
+	}
+	clock.Advance(time.Millisecond)
+	waitFor(t, func() bool { return topKey(c) == "b" })
+}
+
+func TestCachedTopKAfterInserts(t *testing.T) {
+	clock := newFakeClock()
+	sk, _ := New(0.01, 0.01)
+	c, _ := NewCachedTopK(NewConcurrent(sk), 3, time.Hour, WithCacheClock(clock), WithRefreshAfterInserts(10))
+	defer c.Close()
+
+	for i := 0; i < 9; i++ {
+		c.Insert("a", 1)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if topKey(c) != nil {
+		t.Fatal("Expected no refresh before 10 inserts")
+	}
+	c.Insert("a", 1)
+	waitFor(t, func() bool { return topKey(c) == "a" })
+}
+
+func TestCachedTopKClose(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	c, _ := NewCachedTopK(NewConcurrent(sk), 3, time.Millisecond)
+	c.Insert("a", 1)
+	waitFor(t, func() bool { return topKey(c) == "a" })
+
+	c.Close()
+	c.Close()
+
+	c.Insert("b", 5)
+	time.Sleep(5 * time.Millisecond)
+	if topKey(c) != "a" {
+		t.Error("Expected no refresh after Close")
+	}
+}
+
+func TestCachedTopKConcurrent(t *testing.T) {
+	sk, _ := New(0.01, 0.001)
+	c, _ := NewCachedTopK(NewConcurrent(sk), 10, time.Millisecond, WithRefreshAfterInserts(100))
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				c.Insert(fmt.Sprint(w, i%50), 1)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				res, _ := c.TopK()
+				for j := 1; j < len(res); j++ {
+					if res[j].Count > res[j-1].Count {
+						t.Error("Expected a fully sorted result")
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
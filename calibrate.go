@@ -0,0 +1,209 @@
+package topkapi
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+var uncalibrated = newError(ErrInvalidParameter, "topkapi: no candidate size meets the target")
+
+// CalibrationTarget is the accuracy Calibrate looks for.
+type CalibrationTarget struct {
+	K int // number of heavy hitters
+
+	// Recall is the fraction of the exact top K the sketch must report in
+	// its TopK(K), in range of (0, 1].
+	Recall float64
+
+	// MaxError bounds the error of the estimates of the exact top K,
+	// relative to their exact count.
+	MaxError float64
+}
+
+// Calibration is the accuracy of a candidate size measured by Calibrate.
+type Calibration struct {
+	Params
+	Recall   float64
+	MaxError float64
+}
+
+// Calibrate finds the smallest sketch meeting target on a sample of the
+// real stream, as a more reliable alternative to SuggestParameters when the
+// skew of the stream is unknown. sample is called once and must call yield
+// with every key of the sample, each counting once. The whole sample is held
+// in memory, so keys must be usable as map keys.
+//
+// Sketches of 2 and 4 rows of a range of bucket counts, from 10 buckets per
+// heavy hitter up to what NewTopK would pick for the sample, are run over
+// the sample in parallel, GOMAXPROCS at a time, and compared against its
+// exact counts. Calibrate returns the Params of the one taking the least
+// memory that meets target, for NewFromParams, along with the accuracy
+// measured for every candidate, ordered by memory. A stream larger than the
+// sample needs more buckets, in proportion to the number of distinct keys.
+func Calibrate(sample func(yield func(key interface{}) bool), target CalibrationTarget) (Params, []Calibration, error) {
+	if target.K < 1 {
+		return Params{}, nil, newError(ErrInvalidParameter, "topkapi: value of K should be >= 1")
+	}
+	if target.Recall <= 0 || target.Recall > 1 {
+		return Params{}, nil, newError(ErrInvalidParameter, "topkapi: value of Recall should be in range of (0, 1]")
+	}
+	if target.MaxError < 0 {
+		return Params{}, nil, newError(ErrInvalidParameter, "topkapi: value of MaxError should be >= 0")
+	}
+	if uint64(target.K) > maxCounters/minBucketsPerKey {
+		return Params{}, nil, newError(ErrInvalidParameter, "topkapi: value of K is out of range")
+	}
+	if err := checkDimensions(minBucketsPerKey*uint64(target.K), 4); err != nil {
+		return Params{}, nil, err
+	}
+
+	var keys []interface{}
+	exact := make(map[interface{}]uint64)
+	sample(func(key interface{}) bool {
+		keys = append(keys, key)
+		exact[key]++
+		return true
+	})
+	if len(keys) == 0 {
+		return Params{}, nil, newError(ErrInvalidParameter, "topkapi: sample should not be empty")
+	}
+	top := exactTopK(exact, target.K)
+
+	cals := calibrationCandidates(uint64(target.K), uint64(len(keys)))
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, runtime.GOMAXPROCS(0))
+	)
+	for n := range cals {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(cal *Calibration) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			sk := newSketch(cal.B, cal.L)
+			for _, key := range keys {
+				sk.Insert(key, 1)
+			}
+			cal.Recall, cal.MaxError = sk.accuracy(exact, top, target.K)
+		}(&cals[n])
+	}
+	wg.Wait()
+
+	for _, cal := range cals {
+		if cal.Recall >= target.Recall && cal.MaxError <= target.MaxError {
+			return cal.Params, cals, nil
+		}
+	}
+
+	return Params{}, cals, fmt.Errorf("%w: recall %.2f with error %.2f", uncalibrated, target.Recall, target.MaxError)
+}
+
+// calibrationCandidates returns the candidate sizes of Calibrate ordered by
+// memory.
+func calibrationCandidates(k, n uint64) []Calibration {
+	max := topKBuckets(k, n)
+	var cals []Calibration
+	for b := minBucketsPerKey * k; ; b *= 2 {
+		for _, l := range []uint64{minRows, 4} {
+			cals = append(cals, Calibration{Params: params(b, l)})
+		}
+		if b >= max || checkDimensions(2*b, 4) != nil {
+			break
+		}
+	}
+
+	sort.SliceStable(cals, func(a, b int) bool {
+		return cals[a].Memory < cals[b].Memory
+	})
+
+	return cals
+}
+
+// exactTopK returns the keys with the k highest exact counts, and all keys
+// tied with the k-th.
+func exactTopK(exact map[interface{}]uint64, k int) []interface{} {
+	keys := make([]interface{}, 0, len(exact))
+	for key := range exact {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		return exact[keys[a]] > exact[keys[b]]
+	})
+
+	n := k
+	if n > len(keys) {
+		n = len(keys)
+	}
+	for n < len(keys) && exact[keys[n]] == exact[keys[n-1]] {
+		n++
+	}
+
+	return keys[:n]
+}
+
+// accuracy measures the recall of TopK(k) against the exact top, counting
+// keys tied with the k-th as hits, and the maximum relative error of the
+// estimates of the exact top.
+func (sk *Sketch) accuracy(exact map[interface{}]uint64, top []interface{}, k int) (recall, maxErr float64) {
+	least := exact[top[len(top)-1]]
+	var hits int
+	for _, hh := range sk.TopK(k) {
+		if exact[hh.Key] >= least {
+			hits++
+		}
+	}
+	want := k
+	if want > len(top) {
+		want = len(top)
+	}
+	recall = float64(hits) / float64(want)
+
+	for _, key := range top {
+		est, _ := sk.Count(key)
+		maxErr = math.Max(maxErr, math.Abs(float64(est)-float64(exact[key]))/float64(exact[key]))
+	}
+
+	return recall, maxErr
+}
+
+// AutotuneRecall is the fraction of the exact top k Autotune requires
+// sketches to report.
+const AutotuneRecall = 0.9
+
+// Autotune picks the epsilon and delta of New for the smallest sketch within
+// maxBytes that reports at least AutotuneRecall of the exact top targetK of
+// a sample of the stream, by running the candidates of Calibrate against
+// the sample. It returns 0, 0 if none fits or the sample is empty. The
+// estimates themselves are not checked; see Calibrate to bound their error
+// too.
+//
+// Autotuning takes a run over the sample for every candidate, so it is meant
+// as a one-time offline step, with a sample representative of the stream,
+// rather than to be run whenever a sketch is created.
+func Autotune(sample []interface{}, targetK int, maxBytes uint64) (epsilon, delta float64) {
+	if targetK < 1 || len(sample) == 0 {
+		return 0, 0
+	}
+
+	_, cals, _ := Calibrate(func(yield func(key interface{}) bool) {
+		for _, key := range sample {
+			if !yield(key) {
+				return
+			}
+		}
+	}, CalibrationTarget{K: targetK, Recall: AutotuneRecall, MaxError: math.Inf(1)})
+
+	for _, cal := range cals {
+		if cal.Memory <= maxBytes && cal.Recall >= AutotuneRecall {
+			// Off the exact values, so that New rounds to the same size
+			return 1 / (float64(cal.B) - 0.5), 2 / math.Exp(float64(cal.L)+0.5)
+		}
+	}
+
+	return 0, 0
+}
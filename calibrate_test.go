@@ -0,0 +1,117 @@
+package topkapi
+
+import (
+	"errors"
+	"testing"
+)
+
+func keySample(keys []string) func(yield func(key interface{}) bool) {
+	return func(yield func(key interface{}) bool) {
+		for _, key := range keys {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	sample := keySample(zipfKeys(50000, 10000, 13))
+	target := CalibrationTarget{K: 10, Recall: 0.9, MaxError: 0.05}
+
+	p, cals, err := Calibrate(sample, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cals) < 4 {
+		t.Fatalf("Expected several candidate sizes, found %v", cals)
+	}
+
+	var chosen *Calibration
+	for n := range cals {
+		cal := &cals[n]
+		if n > 0 && cal.Memory < cals[n-1].Memory {
+			t.Errorf("Expected candidates ordered by memory, found %v", cals)
+		}
+		meets := cal.Recall >= target.Recall && cal.MaxError <= target.MaxError
+		if meets && chosen == nil {
+			chosen = cal
+		}
+	}
+	if chosen == nil || chosen.Params != p {
+		t.Errorf("Expected the smallest candidate meeting the target, found %+v of %+v", p, cals)
+	}
+	// The smallest sketches are too small, and the largest meet the target
+	if first, last := cals[0], cals[len(cals)-1]; first.Params == p || last.Recall < target.Recall {
+		t.Errorf("Expected a range of accuracies, found %+v", cals)
+	}
+
+	sk, err := NewFromParams(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample(func(key interface{}) bool {
+		sk.Insert(key, 1)
+		return true
+	})
+	if top := sk.TopK(1); top[0].Key != "key0" {
+		t.Errorf("Expected key0 on top of a calibrated sketch, found %v", top)
+	}
+}
+
+func TestCalibrateUnreachable(t *testing.T) {
+	// Even the largest candidate sees collisions in every row
+	_, cals, err := Calibrate(keySample(zipfKeys(50000, 20000, 13)), CalibrationTarget{K: 1, Recall: 1, MaxError: 0})
+	if !errors.Is(err, uncalibrated) || len(cals) == 0 {
+		t.Errorf("Expected an exact target to be out of reach, found %v", err)
+	}
+
+	for _, target := range []CalibrationTarget{{K: 0, Recall: 1}, {K: 1, Recall: 0}, {K: 1, Recall: 1, MaxError: -1}} {
+		if _, _, err := Calibrate(keySample([]string{"a"}), target); err == nil {
+			t.Errorf("Expected error for %+v", target)
+		}
+	}
+	if _, _, err := Calibrate(keySample(nil), CalibrationTarget{K: 1, Recall: 1}); err == nil {
+		t.Error("Expected error for an empty sample")
+	}
+}
+
+func TestAutotune(t *testing.T) {
+	keys := zipfKeys(50000, 10000, 13)
+	sample := make([]interface{}, len(keys))
+	exact := make(map[interface{}]uint64)
+	for n, key := range keys {
+		sample[n] = key
+		exact[key]++
+	}
+
+	epsilon, delta := Autotune(sample, 10, 1<<20)
+	sk, err := New(delta, epsilon)
+	if err != nil {
+		t.Fatalf("Expected usable parameters, found epsilon %v and delta %v: %v", epsilon, delta, err)
+	}
+	if mem := sketchMemory(sk.b, sk.l); mem > 1<<20 {
+		t.Errorf("Expected at most 1MB, found %d×%d of %d bytes", sk.l, sk.b, mem)
+	}
+	for _, key := range sample {
+		sk.Insert(key, 1)
+	}
+	if recall, _ := sk.accuracy(exact, exactTopK(exact, 10), 10); recall < AutotuneRecall {
+		t.Errorf("Expected a recall of at least %v, found %v for %d×%d", AutotuneRecall, recall, sk.l, sk.b)
+	}
+
+	// The smallest sketch meeting the target
+	_, cals, _ := Calibrate(keySample(keys), CalibrationTarget{K: 10, Recall: AutotuneRecall})
+	for _, cal := range cals {
+		if cal.Memory < sketchMemory(sk.b, sk.l) && cal.Recall >= AutotuneRecall {
+			t.Errorf("Expected no smaller sketch meeting the target, found %+v", cal)
+		}
+	}
+
+	if epsilon, delta := Autotune(sample, 10, 1000); epsilon != 0 || delta != 0 {
+		t.Errorf("Expected nothing to fit 1000 bytes, found epsilon %v and delta %v", epsilon, delta)
+	}
+	if epsilon, delta := Autotune(nil, 10, 1<<20); epsilon != 0 || delta != 0 {
+		t.Errorf("Expected nothing for an empty sample, found epsilon %v and delta %v", epsilon, delta)
+	}
+}
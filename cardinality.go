@@ -0,0 +1,64 @@
+package topkapi
+
+import (
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of hash bits selecting a HyperLogLog register.
+// 2^12 registers give a standard error of 1.04/sqrt(4096), about 1.6%.
+const hllPrecision = 12
+
+// hll is a HyperLogLog register array estimating the number of distinct keys.
+type hll [1 << hllPrecision]uint8
+
+func (h *hll) add(hsum uint64) {
+	hsum = mix64(hsum ^ 0x2545f4914f6cdd1d)
+	idx := hsum >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(hsum<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h[idx] {
+		h[idx] = rank
+	}
+}
+
+func (h *hll) merge(other *hll) {
+	for i, r := range other {
+		if r > h[i] {
+			h[i] = r
+		}
+	}
+}
+
+func (h *hll) reset() {
+	*h = hll{}
+}
+
+func (h *hll) estimate() uint64 {
+	const m = float64(len(h))
+
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range h {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities
+		est = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(est + 0.5)
+}
+
+// Cardinality estimates the number of distinct keys inserted, within about
+// 1.6% (one standard error) for any cardinality. It is derived from a 4KiB
+// HyperLogLog fed the key hash Insert computes anyway, and survives Merge.
+func (sk *Sketch) Cardinality() uint64 {
+	return sk.distinct.estimate()
+}
@@ -0,0 +1,42 @@
+package topkapi
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCardinality(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		sk, _ := New(0.1, 0.1)
+		for i := 0; i < 3*n; i++ {
+			sk.Insert(fmt.Sprint("key", i%n), 1)
+		}
+
+		// Four standard errors
+		est := sk.Cardinality()
+		if lo, hi := float64(n)*0.935, float64(n)*1.065; float64(est) < lo || float64(est) > hi {
+			t.Errorf("Expected cardinality of %d within [%.0f, %.0f], found %d", n, lo, hi, est)
+		}
+	}
+}
+
+func TestCardinalityMerge(t *testing.T) {
+	sk1, _ := New(0.1, 0.1)
+	sk2, _ := New(0.1, 0.1)
+	for i := 0; i < 20000; i++ {
+		sk1.Insert(i, 1)
+		sk2.Insert(i+10000, 1)
+	}
+
+	if err := sk1.Merge(sk2); err != nil {
+		t.Fatal(err)
+	}
+	if est := sk1.Cardinality(); est < 28000 || est > 32000 {
+		t.Errorf("Expected merged cardinality ~30000, found %d", est)
+	}
+
+	sk1.Reset()
+	if est := sk1.Cardinality(); est != 0 {
+		t.Errorf("Expected cardinality 0 after Reset, found %d", est)
+	}
+}
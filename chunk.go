@@ -0,0 +1,225 @@
+package topkapi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Row chunk layout, all integers are varints unless noted:
+//
+//	size      uvarint, bytes of the body
+//	body:
+//	  version   byte
+//	  b, l, rows, seed, hash, bucketing  uvarint, as in MarshalBinary
+//	  row       uvarint, the index of the row
+//	  cms       b uvarint
+//	  counts    b zigzag varint, for rows holding candidates
+//	  objects   b encoded keys, for rows holding candidates
+//	  conflicts uvarint, for rows holding candidates
+//	  total, evictions  uvarint, in row 0 only
+//	  hll       4096 raw bytes, in row 0 only
+//	checksum  4 bytes little endian CRC-32C of the body
+//
+// Every chunk carries the dimensions, so a chunk is never read into a sketch
+// it doesn't belong to, and row 0 carries the state of the whole sketch too.
+const chunkVersion = 1
+
+// maxChunkRows bounds the rows a chunk may claim its sketch has.
+const maxChunkRows = 1 << 10
+
+// WriteRow writes row of the sketch to w as a chunk that ReadRow reads
+// back, so that a large sketch can be stored as one object per row, and a
+// checkpoint rewrites only the rows that changed. Rows are numbered from 0
+// to Stats().CounterRows-1, extra counter rows last. Row 0 also carries the
+// total, the eviction count and the cardinality registers, so it should be
+// written along with any other row. Keys must be of the types MarshalBinary
+// supports, and options are not part of the chunk.
+//
+// Every insert counts in every row, so rows change one at a time only
+// where the sketch does, like after MergeRows or when a row is restored;
+// under a stream of inserts, all of them change.
+//
+// To assemble a full sketch, read every chunk into a zero Sketch, which
+// takes on the dimensions of the first chunk, or into a sketch of the same
+// dimensions, like one of Parse(sk.Spec()):
+//
+//	var sk topkapi.Sketch
+//	for _, r := range chunks {
+//		if _, err := sk.ReadRow(r); err != nil {
+//			return err
+//		}
+//	}
+func (sk *Sketch) WriteRow(w io.Writer, row int) error {
+	if row < 0 || row >= sk.cms.rows {
+		return newError(ErrInvalidParameter, "topkapi: value of row should be in range of [0, %d)", sk.cms.rows)
+	}
+
+	var err error
+	body := []byte{chunkVersion}
+	for _, v := range []uint64{sk.b, sk.l, uint64(sk.cms.rows), sk.seed, uint64(sk.hashVersion), consistentBit(sk.consistent), uint64(row)} {
+		body = appendUvarint(body, v)
+	}
+	for j := uint64(0); j < sk.b; j++ {
+		body = appendUvarint(body, sk.cms.get(row, j))
+	}
+	if row < len(sk.counts) {
+		for _, c := range sk.counts[row] {
+			body = appendVarint(body, c)
+		}
+		for _, obj := range sk.objects[row] {
+			if body, err = appendKey(body, obj); err != nil {
+				return err
+			}
+		}
+		body = appendUvarint(body, sk.conflicts[row])
+	}
+	if row == 0 {
+		body = appendUvarint(body, sk.total)
+		body = appendUvarint(body, sk.evictions)
+		body = append(body, sk.distinct[:]...)
+	}
+
+	chunk := appendUvarint(make([]byte, 0, len(body)+binary.MaxVarintLen64+4), uint64(len(body)))
+	chunk = append(append(chunk, body...), checksum(body)...)
+	_, err = w.Write(chunk)
+	return err
+}
+
+// ReadRow reads a chunk written by WriteRow from r, without reading past
+// it, and sets the row it holds, which it returns. A zero Sketch takes on
+// the dimensions of the chunk first, with every other row empty; any other
+// sketch must have the dimensions, seed, hash version and bucketing of the
+// chunk, or ReadRow returns ErrIncompatibleSketches. A damaged chunk is an
+// error wrapping ErrCorruptData, and a chunk of a newer format
+// ErrUnsupportedVersion; the sketch is left as it was either way.
+func (sk *Sketch) ReadRow(r io.Reader) (int, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r}
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, chunkError(err)
+	}
+
+	// The chunk is read as it arrives, so a corrupt size can't make it
+	// allocate more than there is
+	data, err := io.ReadAll(io.LimitReader(r, int64(size)+4))
+	if err != nil {
+		return 0, err
+	}
+	if size > uint64(len(data)) || uint64(len(data))-size != 4 {
+		return 0, fmt.Errorf("%w: chunk cut short", ErrCorruptData)
+	}
+	body := data[:size]
+	if crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(data[size:]) {
+		return 0, fmt.Errorf("%w: chunk checksum mismatch", ErrCorruptData)
+	}
+
+	if len(body) == 0 {
+		return 0, ErrCorruptData
+	}
+	if body[0] < 1 || body[0] > chunkVersion {
+		return 0, fmt.Errorf("%w: chunk version %d", ErrUnsupportedVersion, body[0])
+	}
+	d := decoder{data: body[1:]}
+	b, l, rows, seed, hash, bucketing, row := d.uvarint(), d.uvarint(), d.uvarint(), d.uvarint(), d.uvarint(), d.uvarint(), d.uvarint()
+	if d.err == nil && (hash > uint64(HashV1) || bucketing > 1) {
+		return 0, fmt.Errorf("%w: hash version %d, bucketing %d", ErrUnsupportedVersion, hash, bucketing)
+	}
+	// Every counter takes at least a byte, which bounds the allocation of a
+	// row; no sketch has anywhere near maxChunkRows rows
+	if d.err != nil || b == 0 || l == 0 || rows < l || rows > maxChunkRows || row >= rows || b > uint64(len(d.data)) {
+		return 0, ErrCorruptData
+	}
+
+	cms := make([]uint64, b)
+	for j := range cms {
+		cms[j] = d.uvarint()
+	}
+	var (
+		counts    []int64
+		objects   []interface{}
+		conflicts uint64
+	)
+	if row < l {
+		counts, objects = make([]int64, b), make([]interface{}, b)
+		for j := range counts {
+			counts[j] = d.varint()
+		}
+		for j := range objects {
+			objects[j] = d.key()
+		}
+		conflicts = d.uvarint()
+	}
+	var total, evictions uint64
+	var registers hll
+	if row == 0 {
+		total, evictions = d.uvarint(), d.uvarint()
+		d.read(registers[:])
+	}
+	if d.err != nil || len(d.data) != 0 {
+		return 0, ErrCorruptData
+	}
+
+	if sk.b == 0 {
+		empty := newSketch(b, l)
+		empty.seed, empty.hashVersion, empty.consistent = seed, HashVersion(hash), bucketing == 1
+		empty.cms = newCounterMatrix(int(rows), b, RowMajor)
+		sk.decoded(empty)
+	} else if sk.b != b || sk.l != l || uint64(sk.cms.rows) != rows || sk.seed != seed ||
+		uint64(sk.hashVersion) != hash || consistentBit(sk.consistent) != bucketing {
+		return 0, ErrIncompatibleSketches
+	}
+
+	sk.cms.setRow(int(row), cms)
+	if row < l {
+		sk.counts[row], sk.objects[row], sk.conflicts[row] = counts, objects, conflicts
+		for j, obj := range objects {
+			if obj == nil {
+				sk.hashes[row][j] = 0
+				sk.occupied[row][j/64] &^= 1 << (uint64(j) % 64)
+			} else {
+				sk.hashes[row][j] = sk.hashKey(obj)
+				sk.occupy(int(row), uint64(j))
+			}
+			if sk.samples != nil {
+				sk.samples[row][j] = nil
+			}
+		}
+	}
+	if row == 0 {
+		sk.total, sk.evictions, sk.distinct = total, evictions, registers
+	}
+
+	if sk.top != nil {
+		sk.top.rebuild(sk)
+	}
+	if sk.thresholds != nil {
+		sk.thresholds.rebuild(sk)
+	}
+
+	return int(row), nil
+}
+
+// chunkError maps the error of reading the size of a chunk.
+func chunkError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: chunk cut short", ErrCorruptData)
+	}
+	return err
+}
+
+// byteReader reads single bytes off a reader that can't, without reading
+// ahead.
+type byteReader struct {
+	r io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(br.r, b[:])
+	return b[0], err
+}
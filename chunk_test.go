@@ -0,0 +1,147 @@
+package topkapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+// checkpoint writes every row of sk to store, replacing only the chunks
+// that changed, and returns the number replaced.
+func checkpoint(t *testing.T, sk *Sketch, store map[int][]byte) int {
+	replaced := 0
+	for row := 0; row < sk.Stats().CounterRows; row++ {
+		var buf bytes.Buffer
+		if err := sk.WriteRow(&buf, row); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(store[row], buf.Bytes()) {
+			store[row] = buf.Bytes()
+			replaced++
+		}
+	}
+	return replaced
+}
+
+func TestWriteRowReadRow(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithExtraCounterRows(2), WithSeed(7), WithConsistentBuckets())
+	keys := zipfKeys(20000, 2000, 1)
+	for _, key := range keys[:10000] {
+		sk.Insert(key, 1)
+	}
+
+	store := make(map[int][]byte)
+	if n, rows := checkpoint(t, sk, store), sk.Stats().CounterRows; n != rows {
+		t.Fatalf("Expected %d chunks, wrote %d", rows, n)
+	}
+	if n := checkpoint(t, sk, store); n != 0 {
+		t.Errorf("Expected no chunk to change without inserts, %d did", n)
+	}
+
+	// Only the chunks of changed rows are read into the replica
+	var replica Sketch
+	for row := range store {
+		if got, err := replica.ReadRow(bytes.NewReader(store[row])); err != nil || got != row {
+			t.Fatalf("Expected row %d, found %d, %v", row, got, err)
+		}
+	}
+	for _, key := range keys[10000:] {
+		sk.Insert(key, 1)
+	}
+	sk.Insert("new", 500)
+	before := make(map[int][]byte, len(store))
+	for row, chunk := range store {
+		before[row] = chunk
+	}
+	checkpoint(t, sk, store)
+	for row, chunk := range store {
+		if !bytes.Equal(before[row], chunk) {
+			if _, err := replica.ReadRow(bytes.NewReader(chunk)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if replica.StateHash() != sk.StateHash() {
+		t.Error("Expected the replica to have the state of the sketch")
+	}
+	if !reflect.DeepEqual(replica.Result(1), sk.Result(1)) {
+		t.Error("Expected the replica to have the result of the sketch")
+	}
+	if replica.Cardinality() != sk.Cardinality() || replica.Total() != sk.Total() {
+		t.Errorf("Expected the cardinality and total of the sketch, found %d and %d", replica.Cardinality(), replica.Total())
+	}
+}
+
+func TestReadRowStream(t *testing.T) {
+	sk, _ := New(0.1, 0.1)
+	sk.Insert("a", 3)
+	sk.Insert(int64(-4), 2)
+
+	var stream bytes.Buffer
+	for row := 0; row < sk.Stats().CounterRows; row++ {
+		if err := sk.WriteRow(&stream, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Chunks are read one after the other, without reading ahead
+	r := iotest.OneByteReader(&stream)
+	var dec Sketch
+	for row := 0; row < sk.Stats().CounterRows; row++ {
+		if got, err := dec.ReadRow(r); err != nil || got != row {
+			t.Fatalf("Expected row %d, found %d, %v", row, got, err)
+		}
+	}
+	if _, err := dec.ReadRow(r); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last chunk, found %v", err)
+	}
+	if dec.StateHash() != sk.StateHash() {
+		t.Error("Expected the decoded sketch to have the state of the sketch")
+	}
+}
+
+func TestReadRowErrors(t *testing.T) {
+	sk, _ := New(0.1, 0.1)
+	sk.Insert("a", 3)
+	var buf bytes.Buffer
+	sk.WriteRow(&buf, 1)
+	chunk := buf.Bytes()
+
+	if err := sk.WriteRow(&buf, 2); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("Expected row 2 of 2 to be out of range, found %v", err)
+	}
+
+	other := newSketch(20, 2)
+	if _, err := other.ReadRow(bytes.NewReader(chunk)); !errors.Is(err, ErrIncompatibleSketches) {
+		t.Errorf("Expected a chunk of other dimensions to be incompatible, found %v", err)
+	}
+
+	var dec Sketch
+	for n := 0; n < len(chunk); n++ {
+		if _, err := dec.ReadRow(bytes.NewReader(chunk[:n])); !errors.Is(err, ErrCorruptData) && !(n == 0 && err == io.EOF) {
+			t.Errorf("Expected a chunk cut at %d to be corrupt, found %v", n, err)
+		}
+	}
+	bad := append([]byte(nil), chunk...)
+	bad[len(bad)/2] ^= 1
+	if _, err := dec.ReadRow(bytes.NewReader(bad)); !errors.Is(err, ErrCorruptData) {
+		t.Errorf("Expected a damaged chunk to be corrupt, found %v", err)
+	}
+
+	future := append([]byte(nil), chunk...)
+	_, n := binary.Uvarint(future)
+	future[n] = chunkVersion + 1
+	body := future[n : len(future)-4]
+	copy(future[len(future)-4:], checksum(body))
+	if _, err := dec.ReadRow(bytes.NewReader(future)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected a chunk of a newer version to be unsupported, found %v", err)
+	}
+	if dec.b != 0 {
+		t.Error("Expected the sketch to be left as it was")
+	}
+}
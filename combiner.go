@@ -0,0 +1,90 @@
+package topkapi
+
+// KV is a key and the count to insert it with.
+type KV struct {
+	Key   interface{}
+	Count uint64
+}
+
+// Combiner exposes sketches as the accumulator of a combine function, in
+// the shape map-reduce frameworks like Apache Beam expect from a CombineFn.
+// The framework may add inputs and merge accumulators in any order and
+// grouping.
+//
+// Merging sketches is commutative: any two sketches merge into the same
+// sketch in either order. It is associative for the counters, and so for all
+// estimates, but not quite for candidates. When three sketches hold different
+// candidates in a bucket, which one survives can depend on the grouping, as
+// it does for inserts in a different order. The heavy hitters, which win
+// their buckets by a margin, are unaffected.
+type Combiner struct {
+	k, approxCorpusSize uint64
+	delta               float64
+	opts                []Option
+}
+
+// NewCombiner creates a Combiner whose accumulators are created with
+// NewTopK(k, approxCorpusSize, delta, opts...).
+func NewCombiner(k, approxCorpusSize uint64, delta float64, opts ...Option) (*Combiner, error) {
+	if _, err := NewTopK(k, approxCorpusSize, delta, opts...); err != nil {
+		return nil, err
+	}
+
+	return &Combiner{
+		k:                k,
+		approxCorpusSize: approxCorpusSize,
+		delta:            delta,
+		opts:             opts,
+	}, nil
+}
+
+// CreateAccumulator returns an empty sketch.
+func (c *Combiner) CreateAccumulator() *Sketch {
+	// The parameters were validated by NewCombiner
+	sk, _ := NewTopK(c.k, c.approxCorpusSize, c.delta, c.opts...)
+	return sk
+}
+
+// AddInput inserts in into acc.
+func (c *Combiner) AddInput(acc *Sketch, in KV) *Sketch {
+	acc.Insert(in.Key, in.Count)
+	return acc
+}
+
+// MergeAccumulators merges all accumulators into the first one.
+func (c *Combiner) MergeAccumulators(accs []*Sketch) (*Sketch, error) {
+	if len(accs) == 0 {
+		return c.CreateAccumulator(), nil
+	}
+
+	if accs[0] == nil {
+		return nil, nilSketch
+	}
+	for _, acc := range accs[1:] {
+		if err := accs[0].Merge(acc); err != nil {
+			return nil, err
+		}
+	}
+
+	return accs[0], nil
+}
+
+// ExtractOutput returns the top k heavy hitters of acc.
+func (c *Combiner) ExtractOutput(acc *Sketch, k int) []LocalHeavyHitter {
+	return acc.TopK(k)
+}
+
+// EncodeAccumulator encodes acc with MarshalBinary.
+func (c *Combiner) EncodeAccumulator(acc *Sketch) ([]byte, error) {
+	return acc.MarshalBinary()
+}
+
+// DecodeAccumulator decodes an accumulator encoded by EncodeAccumulator.
+func (c *Combiner) DecodeAccumulator(data []byte) (*Sketch, error) {
+	acc := c.CreateAccumulator()
+	if err := acc.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return acc, nil
+}
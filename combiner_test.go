@@ -0,0 +1,127 @@
+package topkapi
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+// copyAccumulator copies acc through the coder hooks.
+func copyAccumulator(t *testing.T, c *Combiner, acc *Sketch) *Sketch {
+	t.Helper()
+	data, err := c.EncodeAccumulator(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := c.DecodeAccumulator(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+func mergeAll(t *testing.T, c *Combiner, accs ...*Sketch) *Sketch {
+	t.Helper()
+	cps := make([]*Sketch, len(accs))
+	for i, acc := range accs {
+		cps[i] = copyAccumulator(t, c, acc)
+	}
+	res, err := c.MergeAccumulators(cps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// randomAccumulators builds n accumulators from one skewed random stream,
+// spreading the inputs randomly, and returns the exact counts of the stream.
+func randomAccumulators(c *Combiner, seed int64, n int) ([]*Sketch, map[uint64]uint64) {
+	rnd := rand.New(rand.NewSource(seed))
+	z := rand.NewZipf(rnd, 1.5, 1, 5000)
+
+	accs := make([]*Sketch, n)
+	for i := range accs {
+		accs[i] = c.CreateAccumulator()
+	}
+	exact := make(map[uint64]uint64)
+	for i := 0; i < 20000; i++ {
+		key := z.Uint64()
+		count := uint64(1 + rnd.Intn(3))
+		exact[key] += count
+		acc := accs[rnd.Intn(n)]
+		c.AddInput(acc, KV{Key: key, Count: count})
+	}
+
+	return accs, exact
+}
+
+func TestCombinerLaws(t *testing.T) {
+	c, err := NewCombiner(10, 20000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	law := func(seed int64) bool {
+		accs, exact := randomAccumulators(c, seed, 3)
+		a, b, d := accs[0], accs[1], accs[2]
+
+		// Commutativity holds for the complete state
+		assertSameState(t, mergeAll(t, c, a, b), mergeAll(t, c, b, a))
+
+		// The empty accumulator is the identity
+		assertSameState(t, mergeAll(t, c, a, c.CreateAccumulator()), a)
+		assertSameState(t, mergeAll(t, c, c.CreateAccumulator(), a), a)
+
+		// Associativity holds for counters, and so for every estimate
+		left := mergeAll(t, c, mergeAll(t, c, a, b), d)
+		right := mergeAll(t, c, a, mergeAll(t, c, b, d))
+		for i := 0; i < left.cms.rows; i++ {
+			for j := uint64(0); j < left.b; j++ {
+				if left.cms.get(i, j) != right.cms.get(i, j) {
+					t.Errorf("Expected counters to be independent of grouping, seed %d", seed)
+					return false
+				}
+			}
+		}
+
+		// The heavy hitters come out the same for any grouping
+		flat := mergeAll(t, c, a, b, d)
+		for _, acc := range []*Sketch{left, right, flat} {
+			for i, hh := range c.ExtractOutput(acc, 3) {
+				want := c.ExtractOutput(flat, 3)[i]
+				if hh != want {
+					t.Errorf("Expected top %d to be %v, found %v, seed %d", i, want, hh, seed)
+					return false
+				}
+				if hh.Count < exact[hh.Key.(uint64)] {
+					t.Errorf("Expected %v to be at least %d, seed %d", hh, exact[hh.Key.(uint64)], seed)
+					return false
+				}
+			}
+		}
+
+		return !t.Failed()
+	}
+
+	if err := quick.Check(law, &quick.Config{MaxCount: 20}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCombinerMergeAccumulators(t *testing.T) {
+	c, _ := NewCombiner(10, 1000, 0.01)
+
+	empty, err := c.MergeAccumulators(nil)
+	if err != nil || len(empty.Result(1)) != 0 {
+		t.Errorf("Expected empty accumulator, found %v %v", empty, err)
+	}
+
+	other, _ := New(0.1, 0.1)
+	if _, err := c.MergeAccumulators([]*Sketch{c.CreateAccumulator(), other}); err == nil {
+		t.Error("Expected error merging a foreign sketch")
+	}
+
+	if _, err := NewCombiner(0, 1000, 0.01); err == nil {
+		t.Error("Expected error for invalid parameters")
+	}
+}
@@ -0,0 +1,264 @@
+package topkapi
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrentSketch guards a Sketch with a read/write lock so that it can be
+// shared between goroutines. Queries take the read lock and may run in
+// parallel; Insert, Merge and Reset take the write lock.
+//
+// Queries that are slow on large sketches, like Result, still hold off
+// writers for their whole duration. For read-heavy use the sketch can
+// publish snapshots, see Publish, which are queried without any locking.
+type ConcurrentSketch struct {
+	mu sync.RWMutex
+	sk *Sketch
+
+	snapshot atomic.Value // *Sketch
+}
+
+// NewConcurrent wraps sk. The caller must not use sk directly afterwards.
+func NewConcurrent(sk *Sketch) *ConcurrentSketch {
+	return &ConcurrentSketch{sk: sk}
+}
+
+// Insert ...
+func (c *ConcurrentSketch) Insert(key interface{}, count uint64) {
+	c.mu.Lock()
+	c.sk.Insert(key, count)
+	c.mu.Unlock()
+}
+
+// Add applies a signed correction under the write lock, see Sketch.Add.
+func (c *ConcurrentSketch) Add(key interface{}, delta int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sk.Add(key, delta)
+}
+
+// Merge merges other into the sketch. other must not be modified concurrently.
+func (c *ConcurrentSketch) Merge(other *Sketch) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sk.Merge(other)
+}
+
+// Reset ...
+func (c *ConcurrentSketch) Reset() {
+	c.mu.Lock()
+	c.sk.Reset()
+	c.mu.Unlock()
+}
+
+// Decay decays the sketch under the write lock, see Sketch.Decay, so that
+// inserts and queries never see a partially decayed sketch. It holds off
+// writers for a full pass over the counters, so call it from a goroutine of
+// its own, like one driven by a time.Ticker, rather than from one that
+// inserts.
+func (c *ConcurrentSketch) Decay(factor float64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sk.Decay(factor)
+}
+
+// DecayPerKey decays the sketch under the write lock like Decay, see
+// Sketch.DecayPerKey. factor is called with the lock held, so it must not
+// use the sketch.
+func (c *ConcurrentSketch) DecayPerKey(factor func(key interface{}) float64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sk.DecayPerKey(factor)
+}
+
+// Result ...
+func (c *ConcurrentSketch) Result(threshold uint64) []LocalHeavyHitter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sk.Result(threshold)
+}
+
+// TopK ...
+func (c *ConcurrentSketch) TopK(k int) []LocalHeavyHitter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sk.TopK(k)
+}
+
+// TopKWhere ...
+func (c *ConcurrentSketch) TopKWhere(k int, pred func(key interface{}) bool) []LocalHeavyHitter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sk.TopKWhere(k, pred)
+}
+
+// Count ...
+func (c *ConcurrentSketch) Count(key interface{}) (uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sk.Count(key)
+}
+
+// Stats ...
+func (c *ConcurrentSketch) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sk.Stats()
+}
+
+// Publish replaces the snapshot with a copy of the current sketch. Writers
+// are held off while the sketch is copied, which is much faster than a
+// Result scan.
+func (c *ConcurrentSketch) Publish() {
+	c.mu.RLock()
+	snap := c.sk.Clone()
+	c.mu.RUnlock()
+
+	c.snapshot.Store(snap)
+}
+
+// PublishEvery calls Publish every interval on a background goroutine until
+// the returned function is called. Snapshots are then at most interval old,
+// plus the time it takes to copy the sketch. The interval follows the clock
+// of the sketch, see WithClock.
+func (c *ConcurrentSketch) PublishEvery(interval time.Duration) (stop func(), err error) {
+	if interval <= 0 {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of interval should be > 0")
+	}
+
+	var (
+		ticker = c.clock().NewTicker(interval)
+		done   = make(chan struct{})
+		once   sync.Once
+	)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				c.Publish()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}, nil
+}
+
+// clock returns the clock of the sketch.
+func (c *ConcurrentSketch) clock() Clock {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sk.timeSource()
+}
+
+// LiveTopK checks the top k every interval on a background goroutine and
+// sends it on the returned channel whenever it changed materially since it
+// was last sent, until the returned function is called, which closes the
+// channel. The first top k is always sent.
+//
+// The top k changed materially when more than churn of its keys, a
+// fraction in range of [0, 1), are not in the one last sent. Changes in
+// counts or order alone are not sent, and 0 sends any change of keys. The
+// channel holds a single top k: one the receiver hasn't taken yet by the
+// next change is replaced, so a slow receiver only ever sees the latest,
+// and what it is compared with is always the last one sent. The interval
+// follows the clock of the sketch, see WithClock.
+func (c *ConcurrentSketch) LiveTopK(k int, interval time.Duration, churn float64) (updates <-chan []LocalHeavyHitter, stop func(), err error) {
+	if k < 1 {
+		return nil, nil, newError(ErrInvalidParameter, "topkapi: value of k should be >= 1")
+	}
+	if interval <= 0 {
+		return nil, nil, newError(ErrInvalidParameter, "topkapi: value of interval should be > 0")
+	}
+	if !(churn >= 0 && churn < 1) {
+		return nil, nil, newError(ErrInvalidParameter, "topkapi: value of churn should be in range of [0, 1)")
+	}
+
+	var (
+		ch     = make(chan []LocalHeavyHitter, 1)
+		ticker = c.clock().NewTicker(interval)
+		done   = make(chan struct{})
+		once   sync.Once
+	)
+
+	go func() {
+		defer close(ch)
+		defer ticker.Stop()
+
+		var last map[interface{}]struct{}
+		for {
+			top := c.TopK(k)
+			if last == nil || churned(last, top, churn) {
+				last = make(map[interface{}]struct{}, len(top))
+				for _, hh := range top {
+					last[hh.Key] = struct{}{}
+				}
+
+				// Replace a top k not taken yet
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- top
+			}
+
+			select {
+			case <-ticker.C():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return ch, func() {
+		once.Do(func() {
+			close(done)
+		})
+	}, nil
+}
+
+// churned reports whether more than churn of the keys of top are not in last.
+func churned(last map[interface{}]struct{}, top []LocalHeavyHitter, churn float64) bool {
+	var changed int
+	for _, hh := range top {
+		if _, ok := last[hh.Key]; !ok {
+			changed++
+		}
+	}
+	if len(top) < len(last) {
+		changed += len(last) - len(top)
+	}
+
+	n := len(top)
+	if n < len(last) {
+		n = len(last)
+	}
+	return changed > 0 && float64(changed) > churn*float64(n)
+}
+
+// Snapshot returns the last published snapshot, publishing the first one if
+// there is none yet. It must not be modified, but can be queried from any
+// number of goroutines without locking.
+func (c *ConcurrentSketch) Snapshot() *Sketch {
+	if snap, ok := c.snapshot.Load().(*Sketch); ok {
+		return snap
+	}
+
+	c.Publish()
+	return c.snapshot.Load().(*Sketch)
+}
+
+// SnapshotResult is Result on the last published snapshot. It never blocks
+// writers.
+func (c *ConcurrentSketch) SnapshotResult(threshold uint64) []LocalHeavyHitter {
+	return c.Snapshot().Result(threshold)
+}
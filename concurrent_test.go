@@ -0,0 +1,236 @@
+package topkapi
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentSketch(t *testing.T) {
+	sk, _ := New(0.01, 0.001)
+	c := NewConcurrent(sk)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Insert(fmt.Sprint(i%10), 1)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				c.TopK(5)
+				c.Count("1")
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, hh := range c.Result(1) {
+		if hh.Count != 400 {
+			t.Errorf("Expected '%s'=400, found %d", hh.Key, hh.Count)
+		}
+	}
+}
+
+func TestConcurrentSketchSnapshot(t *testing.T) {
+	sk, _ := New(0.01, 0.001)
+	c := NewConcurrent(sk)
+	c.Insert("a", 1)
+
+	if res := c.SnapshotResult(1); len(res) != 1 || res[0].Count != 1 {
+		t.Fatalf("Expected first snapshot to be published on demand, found %v", res)
+	}
+
+	c.Insert("a", 1)
+	if res := c.SnapshotResult(1); res[0].Count != 1 {
+		t.Errorf("Expected stale snapshot until published, found %v", res)
+	}
+	c.Publish()
+	if res := c.SnapshotResult(1); res[0].Count != 2 {
+		t.Errorf("Expected published snapshot, found %v", res)
+	}
+}
+
+func TestConcurrentSketchPublishEvery(t *testing.T) {
+	clock := newFakeClock()
+	sk, _ := New(0.01, 0.001, WithTopKTracking(5), WithClock(clock))
+	c := NewConcurrent(sk)
+	if _, err := c.PublishEvery(0); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("Expected an interval of 0 to be invalid, found %v", err)
+	}
+	stop, err := c.PublishEvery(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Publish concurrently with the inserts a number of times
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			clock.Advance(time.Second)
+		}
+	}()
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				c.Insert(fmt.Sprint(w, i%20), 1)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				c.SnapshotResult(1)
+				c.Snapshot().TopK(5)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The second tick is only taken once the first one published
+	clock.Advance(2 * time.Second)
+	for _, hh := range c.SnapshotResult(1) {
+		if hh.Count != 100 {
+			t.Errorf("Expected '%s'=100 in a snapshot published after the inserts, found %d", hh.Key, hh.Count)
+		}
+	}
+	stop()
+	stop()
+}
+
+func TestConcurrentSketchDecay(t *testing.T) {
+	sk, _ := New(0.01, 0.001)
+	c := NewConcurrent(sk)
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				c.Insert(fmt.Sprint(i%50), 3)
+			}
+		}()
+	}
+	go func() {
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Decay(0.9)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// A partially decayed sketch would have residuals over their counters,
+	// or a total over its first row
+	for i := 0; i < 50; i++ {
+		c.Publish()
+		snap := c.Snapshot()
+		var sum uint64
+		for _, cnt := range snap.cms.row(0) {
+			sum += cnt
+		}
+		if sum != snap.Total() {
+			t.Fatalf("Expected total %d to match the first row, found %d", sum, snap.Total())
+		}
+		for r := range snap.counts {
+			for j, cnt := range snap.counts[r] {
+				if snap.objects[r][j] != nil && uint64(cnt) > snap.cms.get(r, uint64(j)) {
+					t.Fatalf("Expected residual %d within counter %d", cnt, snap.cms.get(r, uint64(j)))
+				}
+			}
+		}
+	}
+	wg.Wait()
+	close(done)
+
+	before, _ := c.Count("7")
+	if err := c.Decay(0.5); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := c.Count("7"); after != before/2 {
+		t.Errorf("Expected count %d to be halved, found %d", before, after)
+	}
+}
+
+func TestConcurrentSketchLiveTopK(t *testing.T) {
+	clock := newFakeClock()
+	sk, _ := New(0.01, 0.001, WithClock(clock))
+	c := NewConcurrent(sk)
+	for i := 0; i < 5; i++ {
+		c.Insert(fmt.Sprint("steady", i), uint64(100-i))
+	}
+
+	for _, test := range []struct {
+		k        int
+		interval time.Duration
+		churn    float64
+	}{
+		{0, time.Second, 0.1},
+		{5, 0, 0.1},
+		{5, time.Second, -0.1},
+		{5, time.Second, 1},
+		{5, time.Second, math.NaN()},
+	} {
+		if _, _, err := c.LiveTopK(test.k, test.interval, test.churn); !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("Expected k=%d, interval %v and churn %v to be invalid, found %v", test.k, test.interval, test.churn, err)
+		}
+	}
+
+	updates, stop, err := c.LiveTopK(5, time.Second, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func() []LocalHeavyHitter {
+		t.Helper()
+		select {
+		case top := <-updates:
+			return top
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a top k to be sent")
+			return nil
+		}
+	}
+
+	if top := receive(); len(top) != 5 || top[0].Key != "steady0" {
+		t.Fatalf("Expected the first top k to be sent right away, found %v", top)
+	}
+
+	// Counts growing within the same keys aren't a material change. The
+	// second tick is only taken once the first one was checked
+	c.Insert("steady4", 50)
+	clock.Advance(2 * time.Second)
+	select {
+	case top := <-updates:
+		t.Errorf("Expected no update for the same keys, found %v", top)
+	default:
+	}
+
+	c.Insert("dominant", 1000)
+	clock.Advance(time.Second)
+	if top := receive(); top[0].Key != "dominant" {
+		t.Errorf("Expected a new dominant key to be sent, found %v", top)
+	}
+
+	stop()
+	stop()
+	for range updates {
+	}
+}
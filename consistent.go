@@ -0,0 +1,124 @@
+package topkapi
+
+// WithConsistentBuckets assigns keys to buckets with jump consistent hashing
+// instead of modulo hashing, so that Grow keeps most keys in their buckets.
+//
+// Growing a row from b to n buckets moves a key to a new bucket with
+// probability 1 - b/n, against almost every key with modulo hashing, whose
+// buckets all change with b. Keys that move without being the candidate of
+// their bucket lose their counts in that row. The price is on every insert
+// and lookup, which take O(log b) steps per row to find the bucket instead
+// of a single division.
+//
+// The bucketing decides where every key is, so only sketches bucketing
+// alike can be merged, and it is part of the binary encoding.
+func WithConsistentBuckets() Option {
+	return func(sk *Sketch) error {
+		sk.consistent = true
+		return nil
+	}
+}
+
+// jumpBucket is the jump consistent hash of Lamping and Veach, mapping h to
+// one of n buckets.
+func jumpBucket(h, n uint64) uint64 {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		h = h*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((h>>33)+1)))
+	}
+	return uint64(b)
+}
+
+// Grow returns a copy of sk with b buckets per row, which must be more
+// than it has, to keep counting a stream that turned out larger than sk was
+// sized for.
+//
+// Counters stay at their index, so keys staying in their bucket keep their
+// counts. Candidates that move carry the counters of their old buckets to
+// their new ones in every row, so their estimates still never undercount,
+// and keep their residuals; of candidates moving into the same bucket the
+// one with the larger residual takes it. Keys that aren't candidates lose
+// their counts in the rows where they move, and may be undercounted, which
+// is why sketches that may grow should use WithConsistentBuckets. Spans
+// start over, and everything else, like the total and the cardinality, is
+// kept.
+func (sk *Sketch) Grow(b uint64) (*Sketch, error) {
+	if b <= sk.b {
+		return nil, newError(ErrInvalidParameter, "topkapi: sketch should grow to more buckets")
+	}
+	if err := checkDimensions(b, uint64(sk.cms.rows)); err != nil {
+		return nil, err
+	}
+
+	g := *sk
+	fresh := newSketch(b, sk.l)
+	g.b = b
+	g.counts, g.objects, g.hashes, g.occupied = fresh.counts, fresh.objects, fresh.hashes, fresh.occupied
+	g.cms = sk.cms.resized(sk.cms.rows, b, sk.cms.layout)
+	g.conflicts = append([]uint64(nil), sk.conflicts...)
+	if sk.dedup != nil {
+		g.dedup = sk.dedup.clone()
+	}
+	if sk.spans != nil {
+		g.spans = newSpanTracker(g.l, b)
+	}
+	if sk.samples != nil {
+		WithSamples()(&g)
+	}
+
+	moved := make(map[uint64]bool)
+	for i := range sk.objects {
+		for j, obj := range sk.objects[i] {
+			if obj == nil {
+				continue
+			}
+			hsum := sk.hashes[i][j]
+			if !moved[hsum] {
+				moved[hsum] = true
+				g.carry(sk, hsum)
+			}
+
+			to := g.bucket(hsum, i)
+			if g.objects[i][to] != nil && g.counts[i][to] >= sk.counts[i][j] {
+				continue
+			}
+			g.objects[i][to] = obj
+			g.hashes[i][to] = hsum
+			g.counts[i][to] = sk.counts[i][j]
+			g.occupy(i, to)
+			if g.samples != nil {
+				g.samples[i][to] = sk.samples[i][j]
+			}
+		}
+	}
+
+	if sk.top != nil {
+		g.top = newTopTracker(sk.top.m, g.slots(sk.top.m))
+		g.top.rebuild(&g)
+	}
+	if sk.thresholds != nil {
+		g.thresholds = &thresholdHistogram{}
+		g.thresholds.rebuild(&g)
+	}
+
+	return &g, nil
+}
+
+// carry adds the counters of the key hash in its buckets of old, a smaller
+// sketch, to its buckets in sk, in every row where they differ.
+func (sk *Sketch) carry(old *Sketch, hsum uint64) {
+	for i := 0; i < sk.cms.rows; i++ {
+		from, to := old.bucket(hsum, i), sk.bucket(hsum, i)
+		if from == to {
+			continue
+		}
+		c := old.cms.get(i, from)
+		if sum := sk.cms.get(i, to) + c; sum >= c {
+			sk.cms.set(i, to, sum)
+		} else {
+			sk.saturate(i, to)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package topkapi
+
+import "testing"
+
+func TestJumpBucket(t *testing.T) {
+	const n = 100000
+	moved := 0
+	for h := uint64(0); h < n; h++ {
+		hsum := mix64(h)
+		from, to := jumpBucket(hsum, 100), jumpBucket(hsum, 125)
+		if from >= 100 || to >= 125 {
+			t.Fatalf("Expected buckets in range, found %d and %d", from, to)
+		}
+		if from != to {
+			// Keys only ever move to the new buckets
+			if to < 100 {
+				t.Fatalf("Expected %d to move to a new bucket, found %d", h, to)
+			}
+			moved++
+		}
+	}
+	// One in five keys moves to the 25 new buckets
+	if moved < n/5-n/100 || moved > n/5+n/100 {
+		t.Errorf("Expected about %d keys to move, found %d", n/5, moved)
+	}
+}
+
+func TestGrow(t *testing.T) {
+	keys := zipfKeys(50000, 5000, 3)
+	exact := exactCount(keys)
+
+	preserved := make(map[bool]int)
+	for _, consistent := range []bool{false, true} {
+		sk := newSketch(500, 4)
+		if consistent {
+			WithConsistentBuckets()(sk)
+		}
+		for _, key := range keys {
+			sk.Insert(key, 1)
+		}
+		before, _ := sk.Count("key0")
+
+		g, err := sk.Grow(600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.b != 600 || g.Total() != sk.Total() || sk.b != 500 {
+			t.Fatalf("Expected 600 buckets and a total of %d, found %d and %d", sk.Total(), g.b, g.Total())
+		}
+
+		// The dominant key keeps its estimate
+		if c, ok := g.Count("key0"); !ok || c < exact["key0"] || c > before {
+			t.Errorf("Expected key0 to stay a candidate with an estimate between %d and %d, found %d", exact["key0"], before, c)
+		}
+		for key := range exact {
+			est, _ := sk.Count(key)
+			if c, _ := g.Count(key); c == est {
+				preserved[consistent]++
+			}
+		}
+
+		// The grown sketch keeps counting
+		g.Insert("key0", 10)
+		if c, _ := g.Count("key0"); c < exact["key0"]+10 {
+			t.Errorf("Expected key0 to count on, found %d", c)
+		}
+	}
+
+	if preserved[true] <= preserved[false] {
+		t.Errorf("Expected consistent buckets to preserve more estimates than modulo hashing, found %d and %d", preserved[true], preserved[false])
+	}
+	// Estimates are kept where a key stays in its bucket in every row
+	if preserved[true] < len(exact)/3 {
+		t.Errorf("Expected consistent buckets to preserve a third of the estimates, found %d of %d", preserved[true], len(exact))
+	}
+
+	if _, err := newSketch(10, 2).Grow(10); err == nil {
+		t.Error("Expected an error growing to as many buckets")
+	}
+}
+
+func TestConsistentBucketsEncoding(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithConsistentBuckets())
+	for _, key := range zipfKeys(5000, 500, 4) {
+		sk.Insert(key, 1)
+	}
+
+	data, err := sk.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored Sketch
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.consistent || restored.StateHash() != sk.StateHash() {
+		t.Error("Expected the sketch to decode with consistent buckets")
+	}
+
+	modulo, _ := New(0.01, 0.01)
+	if err := modulo.Merge(sk); err != ErrIncompatibleSketches {
+		t.Errorf("Expected sketches bucketing differently to be incompatible, found %v", err)
+	}
+	if err := sk.Clone().Merge(&restored); err != nil {
+		t.Errorf("Expected sketches bucketing alike to merge, found %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package topkapi
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Decay scales every counter of the sketch by factor, which must be in
+// range of (0, 1], so that older inserts weigh less than recent ones. Called
+// periodically, for instance with 0.5 every hour, it turns the sketch into
+// a summary of recent traffic with exponentially fading history.
+//
+// Counters are rounded down, so a candidate whose bucket decays to zero is
+// dropped, and Total becomes the sum of the decayed counters, which may be
+// a little less than Total times factor. The cardinality estimate, the
+// eviction count and spans are not decayed.
+func (sk *Sketch) Decay(factor float64) error {
+	if !(factor > 0 && factor <= 1) {
+		return newError(ErrInvalidParameter, "topkapi: value of factor should be in range of (0, 1]")
+	}
+	if factor == 1 {
+		return nil
+	}
+
+	for i := 0; i < sk.cms.rows; i++ {
+		for j := uint64(0); j < sk.b; j++ {
+			sk.cms.set(i, j, uint64(float64(sk.cms.get(i, j))*factor))
+		}
+	}
+	for i := range sk.counts {
+		for j := range sk.counts[i] {
+			if sk.objects[i][j] == nil {
+				continue
+			}
+			sk.counts[i][j] = int64(float64(sk.counts[i][j]) * factor)
+			if sk.cms.get(i, uint64(j)) == 0 {
+				sk.vacate(i, uint64(j))
+			}
+		}
+	}
+	sk.decayed()
+
+	return nil
+}
+
+// DecayPerKey is like Decay with a factor of its own for every candidate,
+// as factor returns it for the key, so that keys of some categories fade
+// faster than others, like info messages against errors. factor is called
+// once per candidate, before anything is decayed, and DecayPerKey returns
+// an error wrapping ErrInvalidParameter and leaves the sketch as it was if
+// it returns a factor out of range of (0, 1].
+//
+// A bucket counts every key hashed to it, but decays by the factor of its
+// candidate only, so other keys sharing the bucket decay at the rate of the
+// candidate. A bucket of an extra counter row decays by the factor of the
+// candidate hashed to it with the highest estimate, ties going to the
+// smaller key hash. Buckets no candidate claims decay by the largest factor
+// returned, so no key fades faster than its own factor would have it in
+// those; in a sketch without candidates, nothing decays.
+func (sk *Sketch) DecayPerKey(factor func(key interface{}) float64) error {
+	type decay struct {
+		hsum     uint64
+		factor   float64
+		estimate uint64
+	}
+	var (
+		keys = make(map[interface{}]decay)
+		rest float64
+	)
+	for i := range sk.objects {
+		for w, word := range sk.occupied[i] {
+			for ; word != 0; word &= word - 1 {
+				j := w*64 + bits.TrailingZeros64(word)
+				key := sk.objects[i][j]
+				if _, ok := keys[key]; ok {
+					continue
+				}
+				f := factor(key)
+				if !(f > 0 && f <= 1) {
+					return newError(ErrInvalidParameter, "topkapi: factor of %v should be in range of (0, 1], found %v", key, f)
+				}
+				hsum := sk.hashes[i][j]
+				keys[key] = decay{hsum, f, sk.counterMin(hsum)}
+				rest = math.Max(rest, f)
+			}
+		}
+	}
+	if rest == 0 {
+		return nil
+	}
+
+	// Extra counter rows hold no candidates, so the buckets of the keys are
+	// found, against estimates taken before any counter changes
+	type claim struct {
+		estimate uint64
+		hsum     uint64
+		factor   float64
+	}
+	claims := make([]map[uint64]claim, sk.cms.rows)
+	for i := len(sk.counts); i < sk.cms.rows; i++ {
+		claims[i] = make(map[uint64]claim)
+		for _, d := range keys {
+			j := sk.bucket(d.hsum, i)
+			if cl, ok := claims[i][j]; !ok || d.estimate > cl.estimate || d.estimate == cl.estimate && d.hsum < cl.hsum {
+				claims[i][j] = claim{d.estimate, d.hsum, d.factor}
+			}
+		}
+	}
+
+	for i := 0; i < sk.cms.rows; i++ {
+		for j := uint64(0); j < sk.b; j++ {
+			f := rest
+			if i < len(sk.counts) {
+				if key := sk.objects[i][j]; key != nil {
+					f = keys[key].factor
+				}
+			} else if cl, ok := claims[i][j]; ok {
+				f = cl.factor
+			}
+			if f == 1 {
+				continue
+			}
+
+			c := uint64(float64(sk.cms.get(i, j)) * f)
+			sk.cms.set(i, j, c)
+			if i >= len(sk.counts) || sk.objects[i][j] == nil {
+				continue
+			}
+			sk.counts[i][j] = int64(float64(sk.counts[i][j]) * f)
+			if c == 0 {
+				sk.vacate(i, j)
+			}
+		}
+	}
+	sk.decayed()
+
+	return nil
+}
+
+// decayed sets the total to the decayed counters, and rebuilds what
+// follows the estimates.
+func (sk *Sketch) decayed() {
+	// Every insert adds to a single bucket of the first row
+	sk.total = 0
+	for j := uint64(0); j < sk.b; j++ {
+		sk.total += sk.cms.get(0, j)
+	}
+
+	if sk.top != nil {
+		sk.top.rebuild(sk)
+	}
+	if sk.thresholds != nil {
+		sk.thresholds.rebuild(sk)
+	}
+}
@@ -0,0 +1,95 @@
+package topkapi
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDecay(t *testing.T) {
+	sk, _ := New(0.01, 0.001, WithTopKTracking(5), WithThresholdTracking())
+	sk.Insert("a", 100)
+	sk.Insert("b", 41)
+	sk.Insert("c", 1)
+
+	if err := sk.Decay(0.5); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]uint64{"a": 50, "b": 20} {
+		if c, ok := sk.Count(key); c != want || !ok {
+			t.Errorf("Expected %s=%d after decay, found %d (%v)", key, want, c, ok)
+		}
+	}
+	if _, ok := sk.Count("c"); ok {
+		t.Error("Expected a candidate decayed to zero to be dropped")
+	}
+	if sk.Total() != 70 {
+		t.Errorf("Expected total 70 after decay, found %d", sk.Total())
+	}
+	if top := sk.TopK(5); len(top) != 2 || top[0].Key != "a" || top[0].Count != 50 {
+		t.Errorf("Expected tracked top-k to be decayed, found %v", top)
+	}
+
+	// A decayed candidate is evicted sooner
+	sk.Insert("d", 51)
+	if top := sk.TopK(1); top[0].Key != "d" {
+		t.Errorf("Expected d to outweigh decayed a, found %v", top)
+	}
+
+	for _, factor := range []float64{0, -1, 1.5} {
+		if err := sk.Decay(factor); err == nil {
+			t.Errorf("Expected error decaying by %v", factor)
+		}
+	}
+}
+
+func TestDecayPerKey(t *testing.T) {
+	sk, _ := New(0.001, 0.001, WithExtraCounterRows(2), WithTopKTracking(10))
+	for n := 0; n < 5; n++ {
+		sk.Insert(fmt.Sprint("error:", n), 1000)
+		sk.Insert(fmt.Sprint("info:", n), 1000)
+	}
+
+	// Errors keep half their weight over 6 decays, infos over one
+	slow, fast := math.Pow(0.5, 1.0/6), 0.5
+	byCategory := func(key interface{}) float64 {
+		if strings.HasPrefix(key.(string), "error:") {
+			return slow
+		}
+		return fast
+	}
+	for round := 1; round <= 3; round++ {
+		if err := sk.DecayPerKey(byCategory); err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < 5; n++ {
+			for key, factor := range map[string]float64{fmt.Sprint("error:", n): slow, fmt.Sprint("info:", n): fast} {
+				want := 1000 * math.Pow(factor, float64(round))
+				if c, ok := sk.Count(key); !ok || math.Abs(float64(c)-want) > float64(round) {
+					t.Errorf("Expected %s=%.0f after %d decays, found %d (%v)", key, want, round, c, ok)
+				}
+			}
+		}
+	}
+	if top := sk.TopK(5); !strings.HasPrefix(top[4].Key.(string), "error:") {
+		t.Errorf("Expected the errors on top after decay, found %v", top)
+	}
+	var want uint64
+	for _, c := range sk.cms.row(0) {
+		want += c
+	}
+	if sk.Total() != want {
+		t.Errorf("Expected a total of %d, found %d", want, sk.Total())
+	}
+
+	// A factor out of range leaves the sketch as it was
+	before := sk.StateHash()
+	if err := sk.DecayPerKey(func(key interface{}) float64 { return byCategory(key) * 3 }); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("Expected a factor out of range to be invalid, found %v", err)
+	}
+	if sk.StateHash() != before {
+		t.Error("Expected the sketch to be left as it was")
+	}
+}
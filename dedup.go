@@ -0,0 +1,203 @@
+package topkapi
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// EventFilter remembers recently seen event IDs so redelivered events can be
+// skipped. It is a pair of bloom filters: inserts go to the current one, and
+// once that holds capacity IDs the older one is dropped and a fresh one takes
+// its place. At least the last capacity IDs, and at most the last 2*capacity,
+// are remembered.
+//
+// Being a bloom filter, it reports IDs it has never seen as duplicates at the
+// configured false positive rate, so a small fraction of genuine events is
+// dropped. It never lets a remembered duplicate through.
+type EventFilter struct {
+	capacity uint64
+	k        uint64 // bits set per ID
+	n        uint64 // IDs in the current generation
+	cur      int
+	gens     [2][]uint64
+}
+
+// maxBloomHashes bounds the bits set per ID, which bloomSize only exceeds for
+// false positive rates below 2^-64.
+const maxBloomHashes = 64
+
+// NewEventFilter creates an EventFilter remembering at least capacity event
+// IDs, wrongly reporting unseen IDs as duplicates with the given probability.
+func NewEventFilter(capacity int, falsePositiveRate float64) (*EventFilter, error) {
+	if capacity < 1 {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of capacity should be >= 1")
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of falsePositiveRate should be in range of (0, 1)")
+	}
+
+	// Lookups consult both generations, so each gets half the budget
+	m, k := bloomSize(uint64(capacity), falsePositiveRate/2)
+	if m > 64*maxCounters {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of capacity is out of range")
+	}
+	words := (uint64(m) + 63) / 64
+
+	return &EventFilter{
+		capacity: uint64(capacity),
+		k:        uint64(k),
+		gens:     [2][]uint64{make([]uint64, words), make([]uint64, words)},
+	}, nil
+}
+
+// bloomSize returns the bits of a bloom filter holding n items with false
+// positive rate p, and the bits set per item.
+func bloomSize(n uint64, p float64) (m, k float64) {
+	m = math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	return m, math.Min(maxBloomHashes, math.Max(1, math.Round(m/float64(n)*math.Ln2)))
+}
+
+// Seen reports whether id was seen before, and remembers it if not.
+func (f *EventFilter) Seen(id uint64) bool {
+	h1 := mix64(id)
+	h2 := mix64(id^0x6a09e667f3bcc909) | 1
+
+	if f.contains(f.gens[0], h1, h2) || f.contains(f.gens[1], h1, h2) {
+		return true
+	}
+
+	if f.n >= f.capacity {
+		f.cur ^= 1
+		for i := range f.gens[f.cur] {
+			f.gens[f.cur][i] = 0
+		}
+		f.n = 0
+	}
+
+	bits := f.gens[f.cur]
+	size := uint64(len(bits)) * 64
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % size
+		bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.n++
+
+	return false
+}
+
+func (f *EventFilter) contains(bits []uint64, h1, h2 uint64) bool {
+	size := uint64(len(bits)) * 64
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % size
+		if bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *EventFilter) clone() *EventFilter {
+	cp := *f
+	for g := range f.gens {
+		cp.gens[g] = append([]uint64(nil), f.gens[g]...)
+	}
+	return &cp
+}
+
+// Reset forgets all event IDs.
+func (f *EventFilter) Reset() {
+	for _, bits := range f.gens {
+		for i := range bits {
+			bits[i] = 0
+		}
+	}
+	f.n = 0
+	f.cur = 0
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (f *EventFilter) MarshalBinary() ([]byte, error) {
+	words := len(f.gens[0])
+	buf := make([]byte, 8*(5+2*words))
+	binary.LittleEndian.PutUint64(buf[0:], f.capacity)
+	binary.LittleEndian.PutUint64(buf[8:], f.k)
+	binary.LittleEndian.PutUint64(buf[16:], f.n)
+	binary.LittleEndian.PutUint64(buf[24:], uint64(f.cur))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(words))
+	off := 40
+	for _, bits := range f.gens {
+		for _, w := range bits {
+			binary.LittleEndian.PutUint64(buf[off:], w)
+			off += 8
+		}
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (f *EventFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 8*5 {
+		return newError(ErrCorruptData, "topkapi: event filter data too short")
+	}
+
+	var (
+		capacity = binary.LittleEndian.Uint64(data[0:])
+		k        = binary.LittleEndian.Uint64(data[8:])
+		n        = binary.LittleEndian.Uint64(data[16:])
+		cur      = binary.LittleEndian.Uint64(data[24:])
+		words    = binary.LittleEndian.Uint64(data[32:])
+	)
+	data = data[40:]
+	// Words are checked against the length before multiplying, which could
+	// wrap around
+	if capacity == 0 || k == 0 || k > maxBloomHashes || n > capacity || cur > 1 ||
+		words == 0 || words > uint64(len(data))/16 || uint64(len(data)) != 16*words {
+		return newError(ErrCorruptData, "topkapi: corrupt event filter data")
+	}
+
+	f.capacity, f.k, f.n, f.cur = capacity, k, n, int(cur)
+	for g := range f.gens {
+		f.gens[g] = make([]uint64, words)
+		for i := range f.gens[g] {
+			f.gens[g][i] = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		}
+	}
+
+	return nil
+}
+
+// WithEventFilter deduplicates InsertOnce calls by event ID through f. The
+// filter becomes part of the sketch: Reset clears it too.
+func WithEventFilter(f *EventFilter) Option {
+	return func(sk *Sketch) error {
+		if f == nil {
+			return newError(ErrInvalidParameter, "topkapi: event filter should not be nil")
+		}
+		sk.dedup = f
+		return nil
+	}
+}
+
+// InsertOnce inserts key unless an event with the same ID was seen recently,
+// and reports whether it was inserted. Without an event filter configured,
+// see WithEventFilter, every event is inserted.
+func (sk *Sketch) InsertOnce(eventID uint64, key interface{}, count uint64) bool {
+	if sk.dedup != nil && sk.dedup.Seen(eventID) {
+		sk.deduped++
+		return false
+	}
+
+	sk.accepted++
+	sk.Insert(key, count)
+
+	return true
+}
+
+// DedupStats returns the number of events InsertOnce accepted and skipped
+// as duplicates, including those of merged sketches.
+func (sk *Sketch) DedupStats() (accepted, deduped uint64) {
+	return sk.accepted, sk.deduped
+}
@@ -0,0 +1,139 @@
+package topkapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestInsertOnceDuplicates(t *testing.T) {
+	words := loadWords()
+	for _, p := range []int{2, 3, 5, 7, 11, 13, 17, 23} {
+		for i := p; i < len(words); i += p {
+			words[i] = words[p]
+		}
+	}
+
+	filter, err := NewEventFilter(10000, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deduped, _ := NewTopK(10, uint64(len(words)), 0.01, WithEventFilter(filter))
+	plain, _ := NewTopK(10, uint64(len(words)), 0.01)
+
+	// Redeliver 10% of the events shortly after the original
+	rnd := rand.New(rand.NewSource(1))
+	var redelivered int
+	for i, w := range words {
+		deduped.InsertOnce(uint64(i), w, 1)
+		plain.InsertOnce(uint64(i), w, 1)
+		if i > 100 && rnd.Intn(10) == 0 {
+			j := i - rnd.Intn(100)
+			deduped.InsertOnce(uint64(j), words[j], 1)
+			plain.InsertOnce(uint64(j), words[j], 1)
+			redelivered++
+		}
+	}
+
+	accepted, skipped := deduped.DedupStats()
+	if skipped < uint64(redelivered) || skipped > uint64(redelivered)+uint64(len(words))/100 {
+		t.Errorf("Expected ~%d duplicates skipped, found %d", redelivered, skipped)
+	}
+	if accepted+skipped != uint64(len(words)+redelivered) {
+		t.Errorf("Expected %d events, found %d", len(words)+redelivered, accepted+skipped)
+	}
+	if accepted, skipped := plain.DedupStats(); skipped != 0 || accepted != uint64(len(words)+redelivered) {
+		t.Errorf("Expected all events accepted without filter, found %d/%d", accepted, skipped)
+	}
+
+	exact := exactCount(words)
+	for _, hh := range deduped.TopK(8) {
+		want := exact[hh.Key.(string)]
+		if hh.Count > want+want/100 || hh.Count < want-want/100 {
+			t.Errorf("Expected '%s' within 1%% of %d, found %d", hh.Key, want, hh.Count)
+		}
+	}
+	for _, hh := range plain.TopK(8) {
+		want := exact[hh.Key.(string)]
+		if hh.Count < want+want/20 {
+			t.Errorf("Expected '%s' to be inflated by redelivery above %d, found %d", hh.Key, want, hh.Count)
+		}
+	}
+
+	deduped.Reset()
+	if accepted, skipped := deduped.DedupStats(); accepted != 0 || skipped != 0 {
+		t.Errorf("Expected stats cleared by Reset, found %d/%d", accepted, skipped)
+	}
+	if !deduped.InsertOnce(0, "a", 1) {
+		t.Error("Expected event filter cleared by Reset")
+	}
+}
+
+func TestEventFilterRotation(t *testing.T) {
+	f, _ := NewEventFilter(100, 0.01)
+	for id := uint64(0); id < 100; id++ {
+		f.Seen(id)
+	}
+	for id := uint64(0); id < 100; id++ {
+		if !f.Seen(id) {
+			t.Fatalf("Expected id %d to be remembered", id)
+		}
+	}
+
+	// Two more generations push the first IDs out
+	for id := uint64(1000); id < 1200; id++ {
+		f.Seen(id)
+	}
+	var remembered int
+	for id := uint64(0); id < 100; id++ {
+		if f.Seen(id) {
+			remembered++
+		}
+	}
+	if remembered > 10 {
+		t.Errorf("Expected first generation forgotten, %d%% still remembered", remembered)
+	}
+}
+
+func TestEventFilterMarshal(t *testing.T) {
+	f, _ := NewEventFilter(1000, 0.01)
+	for id := uint64(0); id < 1500; id++ {
+		f.Seen(id)
+	}
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g EventFilter
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	for id := uint64(500); id < 1500; id++ {
+		if !g.Seen(id) {
+			t.Fatalf("Expected id %d to survive round trip", id)
+		}
+	}
+
+	if err := g.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("Expected error on truncated data")
+	}
+
+	// Headers that would allocate or loop without bound
+	for name, h := range map[string][5]uint64{
+		"words":    {1, 1, 0, 0, 1 << 60},
+		"k":        {1, 1 << 62, 0, 0, 1},
+		"n":        {1, 1, 2, 0, 1},
+		"capacity": {0, 1, 0, 0, 1},
+	} {
+		// 16*words wraps around to the 0 bytes that follow for 1<<60
+		buf := make([]byte, 40+16*(h[4]%(1<<60)))
+		for i, v := range h {
+			binary.LittleEndian.PutUint64(buf[8*i:], v)
+		}
+		if err := g.UnmarshalBinary(buf); !errors.Is(err, ErrCorruptData) {
+			t.Errorf("Expected %s to be rejected, found %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package topkapi
+
+import "strings"
+
+// InsertDistinct inserts every distinct key of keys once with count, like
+// the terms of a document to count the documents every term occurs in
+// rather than its occurrences. Keys are told apart as Insert tells them
+// apart, after the canonicalizer and the key length limit, so keys Insert
+// would count as one are inserted once. A count of zero is a no-op.
+func (sk *Sketch) InsertDistinct(keys []interface{}, count uint64) {
+	sk.insertDistinct(keys, sk.sampled(count), sk.hashKey)
+}
+
+func (sk *Sketch) insertDistinct(keys []interface{}, count uint64, hash func(key interface{}) uint64) {
+	if count == 0 {
+		return
+	}
+
+	// Keys are found by hash, and those sharing a hash compared
+	seen := make(map[uint64][]interface{}, len(keys))
+	for _, key := range keys {
+		key, ok := sk.limit(sk.canonical(key))
+		if !ok {
+			sk.rejected++
+			continue
+		}
+		hsum := hash(key)
+		if containsKey(seen[hsum], key) {
+			continue
+		}
+		seen[hsum] = append(seen[hsum], key)
+
+		sk.insert(key, hsum, count)
+	}
+}
+
+func containsKey(keys []interface{}, key interface{}) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// InsertDistinctStrings is InsertDistinct for string keys, normalized like
+// InsertString does. Without a canonicalizer, keys are told apart as
+// strings, and only distinct ones are converted to the interface values
+// the sketch holds.
+func (sk *Sketch) InsertDistinctStrings(keys []string, count uint64) {
+	if count = sk.sampled(count); count == 0 {
+		return
+	}
+	if sk.canonicalize != nil {
+		boxed := make([]interface{}, len(keys))
+		for n, key := range keys {
+			boxed[n] = sk.normalized(key)
+		}
+		sk.insertDistinct(boxed, count, sk.hashKey)
+		return
+	}
+
+	seen := make(map[string]struct{}, len(keys))
+	for _, s := range keys {
+		s = sk.normalized(s)
+		if sk.foldCase {
+			s = strings.ToLower(s)
+		}
+		s, ok := sk.limitString(s)
+		if !ok {
+			sk.rejected++
+			continue
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+
+		var key interface{} = s
+		sk.insert(key, sk.hashKey(key), count)
+	}
+}
@@ -0,0 +1,62 @@
+package topkapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInsertDistinct(t *testing.T) {
+	docs := []string{
+		"the cat sat on the mat the end",
+		"the dog sat",
+		"a cat and a dog and a cat",
+	}
+	want := map[string]uint64{"the": 2, "cat": 2, "sat": 2, "dog": 2, "a": 1, "and": 1, "on": 1, "mat": 1, "end": 1}
+
+	boxed, _ := New(0.01, 0.01)
+	strs, _ := New(0.01, 0.01)
+	canonical, _ := New(0.01, 0.01, WithCanonicalizer(func(key interface{}) interface{} { return key }))
+	for _, doc := range docs {
+		terms := strings.Fields(doc)
+		keys := make([]interface{}, len(terms))
+		for n, term := range terms {
+			keys[n] = term
+		}
+		boxed.InsertDistinct(keys, 1)
+		strs.InsertDistinctStrings(terms, 1)
+		canonical.InsertDistinctStrings(terms, 1)
+	}
+
+	for _, sk := range []*Sketch{boxed, strs, canonical} {
+		for term, n := range want {
+			if c, _ := sk.Count(term); c != n {
+				t.Errorf("Expected %q in %d documents, found %d", term, n, c)
+			}
+		}
+		if sk.Total() != 13 {
+			t.Errorf("Expected 13 distinct terms over all documents, found %d", sk.Total())
+		}
+	}
+
+	// Keys Insert counts as one are inserted once
+	numeric, _ := New(0.01, 0.01, WithNumericKeys(false))
+	numeric.InsertDistinct([]interface{}{int8(1), 1, uint64(1), 2}, 1)
+	if c, _ := numeric.Count(1); c != 1 {
+		t.Errorf("Expected numeric keys of one value to be inserted once, found %d", c)
+	}
+	truncated, _ := New(0.01, 0.01, WithMaxKeyLen(3, TruncateLongKeys))
+	truncated.InsertDistinctStrings([]string{"abcd", "abce", "abc"}, 1)
+	if c, _ := truncated.Count("abc"); c != 1 {
+		t.Errorf("Expected keys truncated alike to be inserted once, found %d", c)
+	}
+}
+
+func TestInsertDistinctHashCollision(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+
+	// Every key hashes alike, yet distinct keys are all inserted
+	sk.insertDistinct([]interface{}{"a", "b", "a", "c", "b"}, 1, func(interface{}) uint64 { return 42 })
+	if sk.Total() != 3 {
+		t.Errorf("Expected 3 distinct keys, found %d", sk.Total())
+	}
+}
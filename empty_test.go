@@ -0,0 +1,145 @@
+package topkapi
+
+import (
+	"testing"
+)
+
+// emptySketches constructs a fresh sketch with every constructor.
+var emptySketches = map[string]func() (*Sketch, error){
+	"New": func() (*Sketch, error) {
+		return New(0.01, 0.01)
+	},
+	"NewTopK": func() (*Sketch, error) {
+		return NewTopK(10, 10000, 0.01)
+	},
+	"WithTopKTracking": func() (*Sketch, error) {
+		return New(0.01, 0.01, WithTopKTracking(10))
+	},
+	"WithExtraCounterRows": func() (*Sketch, error) {
+		return NewTopK(10, 10000, 0.01, WithExtraCounterRows(2))
+	},
+	"Combiner": func() (*Sketch, error) {
+		c, err := NewCombiner(10, 10000, 0.01)
+		if err != nil {
+			return nil, err
+		}
+		return c.CreateAccumulator(), nil
+	},
+}
+
+// assertEmpty checks every query against an empty sketch.
+func assertEmpty(t *testing.T, sk *Sketch) {
+	t.Helper()
+
+	if !sk.Empty() || sk.Total() != 0 {
+		t.Errorf("Expected empty sketch, found total %d", sk.Total())
+	}
+	for _, threshold := range []uint64{0, 1} {
+		if res := sk.Result(threshold); res == nil || len(res) != 0 {
+			t.Errorf("Expected empty non-nil Result(%d), found %#v", threshold, res)
+		}
+	}
+	if res := sk.ResultWhere(0, func(interface{}) bool { return true }); res == nil || len(res) != 0 {
+		t.Errorf("Expected empty non-nil ResultWhere, found %#v", res)
+	}
+	for _, k := range []int{-1, 0, 1, 10, 1000} {
+		if res := sk.TopK(k); res == nil || len(res) != 0 {
+			t.Errorf("Expected empty non-nil TopK(%d), found %#v", k, res)
+		}
+	}
+	for _, key := range []interface{}{"a", 0, nil} {
+		if c, ok := sk.Count(key); c != 0 || ok {
+			t.Errorf("Expected Count(%v) = (0, false), found (%d, %v)", key, c, ok)
+		}
+		if s, ok := sk.Share(key); s != 0 || ok {
+			t.Errorf("Expected Share(%v) = (0, false), found (%f, %v)", key, s, ok)
+		}
+	}
+	if st := sk.Stats(); st.Candidates != 0 || st.Tracked != 0 || st.Fill != 0 || st.Total != 0 || st.Buckets != int(sk.b) {
+		t.Errorf("Expected zero fill, found %+v", st)
+	}
+	if sk.Evictions() != 0 || sk.Cardinality() != 0 {
+		t.Errorf("Expected no evictions and cardinality 0, found %d and %d", sk.Evictions(), sk.Cardinality())
+	}
+	if accepted, deduped := sk.DedupStats(); accepted != 0 || deduped != 0 {
+		t.Errorf("Expected no dedup stats, found %d/%d", accepted, deduped)
+	}
+	if exact, ok := sk.ExactIfUnsaturated(); !ok || len(exact) != 0 {
+		t.Errorf("Expected exact empty map, found %v (%v)", exact, ok)
+	}
+	if sk.Epsilon() != 1/float64(sk.b) || sk.Delta() <= 0 || sk.Delta() >= 1 {
+		t.Errorf("Expected parameters of the empty sketch, found epsilon %f and delta %f", sk.Epsilon(), sk.Delta())
+	}
+}
+
+func TestEmptySketch(t *testing.T) {
+	for name, construct := range emptySketches {
+		t.Run(name, func(t *testing.T) {
+			sk, err := construct()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEmpty(t, sk)
+
+			other, _ := construct()
+			if err := sk.Merge(other); err != nil {
+				t.Fatal(err)
+			}
+			assertEmpty(t, sk)
+
+			assertEmpty(t, sk.Clone())
+
+			data, err := sk.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dec Sketch
+			if err := dec.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			assertSameState(t, sk, &dec)
+			assertEmpty(t, &dec)
+
+			sk.Insert("a", 1)
+			sk.Reset()
+			assertEmpty(t, sk)
+
+			c := NewConcurrent(sk)
+			if res := c.Result(0); res == nil || len(res) != 0 {
+				t.Errorf("Expected empty non-nil concurrent Result, found %#v", res)
+			}
+			if res := c.TopK(10); res == nil || len(res) != 0 {
+				t.Errorf("Expected empty non-nil concurrent TopK, found %#v", res)
+			}
+			if c, ok := c.Count("a"); c != 0 || ok {
+				t.Errorf("Expected concurrent Count = (0, false), found (%d, %v)", c, ok)
+			}
+			assertEmpty(t, c.Snapshot())
+		})
+	}
+}
+
+func TestEmptyMergeIntoNonEmpty(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithTopKTracking(5))
+	sk.Insert("a", 3)
+	empty, _ := New(0.01, 0.01)
+
+	if err := sk.Merge(empty); err != nil {
+		t.Fatal(err)
+	}
+	if res := sk.TopK(5); len(res) != 1 || res[0].Count != 3 {
+		t.Errorf("Expected merging an empty sketch to change nothing, found %v", res)
+	}
+
+	if err := empty.Merge(sk); err != nil {
+		t.Fatal(err)
+	}
+	if res := empty.TopK(5); len(res) != 1 || res[0].Count != 3 || empty.Total() != 3 {
+		t.Errorf("Expected empty sketch to take on the other, found %v", res)
+	}
+
+	small, _ := New(0.1, 0.1)
+	if err := small.Merge(empty); err != ErrIncompatibleSketches {
+		t.Errorf("Expected incompatible dimensions to be reported for empty sketches, found %v", err)
+	}
+}
@@ -0,0 +1,450 @@
+package topkapi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// Binary format, all integers are varints unless noted:
+//
+//	version   byte
+//	b, l      uvarint
+//	rows      uvarint, number of counter rows (l plus extra counter rows)
+//	seed      uvarint
+//	hash      uvarint, the HashVersion
+//	bucketing uvarint, 1 for WithConsistentBuckets, 0 for modulo hashing
+//	total     uvarint
+//	cms       rows*b uvarint
+//	counts    l*b zigzag varint
+//	objects   l*b encoded keys
+//	evictions, conflicts[l]  uvarint
+//	hll       4096 raw bytes
+//	checksum  4 bytes little endian CRC-32C of everything before it
+//
+// Keys are a type tag followed by the value, see appendKey. Key hashes are
+// not stored but recomputed on decoding.
+//
+// Sketches are always encoded in the current version, and every earlier
+// version is still decoded:
+//
+//	1  no seed, hash and total. Decodes with seed 0, which every sketch had
+//	   before WithSeed, the HashStructure hash version, and the total
+//	   derived from the first counter row, which every insert added its
+//	   count to.
+//	2  no hash. Decodes with the HashStructure hash version.
+//	3  no bucketing. Decodes with modulo hashing.
+const formatVersion = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	tagNil byte = iota
+	tagString
+	tagBool
+	tagInt
+	tagInt8
+	tagInt16
+	tagInt32
+	tagInt64
+	tagUint
+	tagUint8
+	tagUint16
+	tagUint32
+	tagUint64
+	tagFloat32
+	tagFloat64
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler. Keys must be strings,
+// booleans, or integer or floating point numbers, or it returns an error
+// wrapping ErrUnsupportedKeyType. Options given at construction, like
+// WithTopKTracking, are not part of the encoding.
+func (sk *Sketch) MarshalBinary() ([]byte, error) {
+	var err error
+
+	buf := []byte{formatVersion}
+	buf = appendUvarint(buf, sk.b)
+	buf = appendUvarint(buf, sk.l)
+	buf = appendUvarint(buf, uint64(sk.cms.rows))
+	buf = appendUvarint(buf, sk.seed)
+	buf = appendUvarint(buf, uint64(sk.hashVersion))
+	buf = appendUvarint(buf, consistentBit(sk.consistent))
+	buf = appendUvarint(buf, sk.total)
+	for i := 0; i < sk.cms.rows; i++ {
+		for j := uint64(0); j < sk.b; j++ {
+			buf = appendUvarint(buf, sk.cms.get(i, j))
+		}
+	}
+	for _, row := range sk.counts {
+		for _, c := range row {
+			buf = appendVarint(buf, c)
+		}
+	}
+	for _, row := range sk.objects {
+		for _, obj := range row {
+			if buf, err = appendKey(buf, obj); err != nil {
+				return nil, err
+			}
+		}
+	}
+	buf = appendUvarint(buf, sk.evictions)
+	for _, c := range sk.conflicts {
+		buf = appendUvarint(buf, c)
+	}
+	buf = append(buf, sk.distinct[:]...)
+
+	return append(buf, checksum(buf)...), nil
+}
+
+// checksum returns the encoded checksum trailing data.
+func checksum(data []byte) []byte {
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(data, castagnoli))
+	return sum[:]
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. The sketch takes on
+// the dimensions and contents of the encoded one, but keeps its own options.
+// Data of a newer format version is ErrUnsupportedVersion, and data that
+// can't be decoded otherwise is ErrCorruptData; the sketch is left as it
+// was.
+func (sk *Sketch) UnmarshalBinary(data []byte) error {
+	dec, err := decodeSketch(data)
+	if err != nil {
+		sk.event(EventDecodeFailure, -1, -1, "%v", err)
+		return err
+	}
+	sk.decoded(dec)
+
+	return nil
+}
+
+// MergeSerialized merges the sketches encoded by MarshalBinary in blobs, as
+// a reduce step receives them from its workers, into a new sketch: the
+// first one, decoded, with every other one merged into it like by Merge.
+// The sketches after the first are decoded into one scratch sketch in
+// turn, rather than each into a sketch of its own. The sketch has no
+// options, like one of UnmarshalBinary into a zero Sketch. It returns an
+// error wrapping ErrInvalidParameter without blobs, the error of
+// UnmarshalBinary for a blob that can't be decoded, and
+// ErrIncompatibleSketches for a sketch of other dimensions than the first,
+// along with the index of the blob.
+func MergeSerialized(blobs [][]byte) (*Sketch, error) {
+	if len(blobs) == 0 {
+		return nil, newError(ErrInvalidParameter, "topkapi: no sketches to merge")
+	}
+
+	sk, err := decodeSketch(blobs[0])
+	if err != nil {
+		return nil, fmt.Errorf("topkapi: sketch 0: %w", err)
+	}
+	var scratch *Sketch
+	for i, data := range blobs[1:] {
+		if scratch, err = decodeSketchInto(data, scratch); err != nil {
+			return nil, fmt.Errorf("topkapi: sketch %d: %w", i+1, err)
+		}
+		if err := sk.Merge(scratch); err != nil {
+			return nil, fmt.Errorf("topkapi: sketch %d: %w", i+1, err)
+		}
+	}
+
+	return sk, nil
+}
+
+// decoded takes on the dimensions and contents of dec.
+func (sk *Sketch) decoded(dec *Sketch) {
+	sk.l, sk.b, sk.seed, sk.hashVersion, sk.consistent = dec.l, dec.b, dec.seed, dec.hashVersion, dec.consistent
+	sk.cms, sk.counts, sk.objects, sk.hashes, sk.occupied = dec.cms.relayout(sk.cms.layout), dec.counts, dec.objects, dec.hashes, dec.occupied
+	sk.total, sk.evictions, sk.conflicts, sk.distinct = dec.total, dec.evictions, dec.conflicts, dec.distinct
+
+	if sk.top != nil {
+		sk.top.rebuild(sk)
+	}
+	if sk.thresholds != nil {
+		sk.thresholds.rebuild(sk)
+	}
+	if sk.spans != nil {
+		sk.spans = newSpanTracker(sk.l, sk.b)
+	}
+	if sk.samples != nil {
+		WithSamples()(sk)
+	}
+}
+
+func decodeSketch(data []byte) (*Sketch, error) {
+	return decodeSketchInto(data, nil)
+}
+
+// decodeSketchInto is like decodeSketch, but decodes into scratch, a sketch
+// returned by an earlier call, rather than into a new sketch if it has the
+// dimensions of the data.
+func decodeSketchInto(data []byte, scratch *Sketch) (*Sketch, error) {
+	if len(data) < 5 {
+		return nil, ErrCorruptData
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, castagnoli) != sum {
+		return nil, ErrCorruptData
+	}
+	version := body[0]
+	if version < 1 || version > formatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	d := decoder{data: body[1:]}
+	var (
+		b           = d.uvarint()
+		l           = d.uvarint()
+		rows        = d.uvarint()
+		seed, total uint64
+		hash        = HashStructure
+		bucketing   uint64
+	)
+	if version >= 2 {
+		seed = d.uvarint()
+	}
+	if version >= 3 {
+		hash = HashVersion(d.uvarint())
+	}
+	if version >= 4 {
+		bucketing = d.uvarint()
+	}
+	if version >= 2 {
+		total = d.uvarint()
+	}
+	if d.err == nil && hash != HashStructure && hash != HashV1 {
+		return nil, fmt.Errorf("%w: hash version %d", ErrUnsupportedVersion, hash)
+	}
+	if d.err == nil && bucketing > 1 {
+		return nil, fmt.Errorf("%w: bucketing %d", ErrUnsupportedVersion, bucketing)
+	}
+	// Every counter takes at least a byte, which bounds the allocation
+	if d.err != nil || b == 0 || l == 0 || rows < l || rows > uint64(len(d.data)) || b > uint64(len(d.data))/rows {
+		return nil, ErrCorruptData
+	}
+
+	sk := scratch
+	if sk != nil && sk.b == b && sk.l == l && uint64(sk.cms.rows) == rows {
+		sk.Reset()
+	} else {
+		sk = newSketch(b, l)
+		if rows > l {
+			sk.cms = newCounterMatrix(int(rows), b, RowMajor)
+		}
+	}
+	sk.seed, sk.total, sk.hashVersion, sk.consistent = seed, total, hash, bucketing == 1
+	for i := 0; i < sk.cms.rows; i++ {
+		for j := uint64(0); j < b; j++ {
+			sk.cms.set(i, j, d.uvarint())
+		}
+	}
+	for _, row := range sk.counts {
+		for j := range row {
+			row[j] = d.varint()
+		}
+	}
+
+	// A residual is never negative nor above its counter, and only a
+	// candidate has one
+	hashes := make(map[interface{}]uint64)
+	for i, row := range sk.objects {
+		for j := range row {
+			obj, residual := d.key(), sk.counts[i][j]
+			if residual < 0 || uint64(residual) > sk.cms.get(i, uint64(j)) || obj == nil && residual != 0 {
+				return nil, ErrCorruptData
+			}
+			if obj == nil {
+				continue
+			}
+			hsum, ok := hashes[obj]
+			if !ok {
+				hsum = sk.hashKey(obj)
+				hashes[obj] = hsum
+			}
+			row[j] = obj
+			sk.hashes[i][j] = hsum
+			sk.occupy(i, uint64(j))
+		}
+	}
+
+	sk.evictions = d.uvarint()
+	for i := range sk.conflicts {
+		sk.conflicts[i] = d.uvarint()
+	}
+	d.read(sk.distinct[:])
+
+	if version == 1 {
+		// Every insert adds its count to one bucket of each row
+		for j := uint64(0); j < b; j++ {
+			sk.total += sk.cms.get(0, j)
+		}
+	}
+
+	if d.err != nil || len(d.data) != 0 {
+		return nil, ErrCorruptData
+	}
+
+	return sk, nil
+}
+
+// consistentBit encodes the bucketing, see WithConsistentBuckets.
+func consistentBit(consistent bool) uint64 {
+	if consistent {
+		return 1
+	}
+	return 0
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func appendKey(buf []byte, key interface{}) ([]byte, error) {
+	switch k := key.(type) {
+	case nil:
+		return append(buf, tagNil), nil
+	case string:
+		buf = appendUvarint(append(buf, tagString), uint64(len(k)))
+		return append(buf, k...), nil
+	case bool:
+		if k {
+			return append(buf, tagBool, 1), nil
+		}
+		return append(buf, tagBool, 0), nil
+	case int:
+		return appendVarint(append(buf, tagInt), int64(k)), nil
+	case int8:
+		return appendVarint(append(buf, tagInt8), int64(k)), nil
+	case int16:
+		return appendVarint(append(buf, tagInt16), int64(k)), nil
+	case int32:
+		return appendVarint(append(buf, tagInt32), int64(k)), nil
+	case int64:
+		return appendVarint(append(buf, tagInt64), k), nil
+	case uint:
+		return appendUvarint(append(buf, tagUint), uint64(k)), nil
+	case uint8:
+		return appendUvarint(append(buf, tagUint8), uint64(k)), nil
+	case uint16:
+		return appendUvarint(append(buf, tagUint16), uint64(k)), nil
+	case uint32:
+		return appendUvarint(append(buf, tagUint32), uint64(k)), nil
+	case uint64:
+		return appendUvarint(append(buf, tagUint64), k), nil
+	case float32:
+		return appendUvarint(append(buf, tagFloat32), uint64(math.Float32bits(k))), nil
+	case float64:
+		return appendUvarint(append(buf, tagFloat64), math.Float64bits(k)), nil
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKeyType, key)
+	}
+}
+
+// decoder reads from data until the first error, which sticks.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = ErrCorruptData
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = ErrCorruptData
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) read(p []byte) {
+	if d.err != nil {
+		return
+	}
+	if len(d.data) < len(p) {
+		d.err = ErrCorruptData
+		return
+	}
+	copy(p, d.data)
+	d.data = d.data[len(p):]
+}
+
+// bytes reads a length prefixed byte string.
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.data)) {
+		d.err = ErrCorruptData
+		return nil
+	}
+	p := d.data[:n]
+	d.data = d.data[n:]
+	return p
+}
+
+func (d *decoder) key() interface{} {
+	var tag [1]byte
+	if d.read(tag[:]); d.err != nil {
+		return nil
+	}
+
+	switch tag[0] {
+	case tagNil:
+		return nil
+	case tagString:
+		return string(d.bytes())
+	case tagBool:
+		var v [1]byte
+		d.read(v[:])
+		return v[0] != 0
+	case tagInt:
+		return int(d.varint())
+	case tagInt8:
+		return int8(d.varint())
+	case tagInt16:
+		return int16(d.varint())
+	case tagInt32:
+		return int32(d.varint())
+	case tagInt64:
+		return d.varint()
+	case tagUint:
+		return uint(d.uvarint())
+	case tagUint8:
+		return uint8(d.uvarint())
+	case tagUint16:
+		return uint16(d.uvarint())
+	case tagUint32:
+		return uint32(d.uvarint())
+	case tagUint64:
+		return d.uvarint()
+	case tagFloat32:
+		return math.Float32frombits(uint32(d.uvarint()))
+	case tagFloat64:
+		return math.Float64frombits(d.uvarint())
+	default:
+		d.err = ErrCorruptData
+		return nil
+	}
+}
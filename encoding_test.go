@@ -0,0 +1,279 @@
+package topkapi
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// assertSameState checks that two sketches hold exactly the same data.
+func assertSameState(t *testing.T, a, b *Sketch) {
+	t.Helper()
+
+	if a.b != b.b || a.l != b.l || a.cms.rows != b.cms.rows {
+		t.Fatalf("Expected dimensions %dx%d+%d, found %dx%d+%d", a.l, a.b, a.cms.rows, b.l, b.b, b.cms.rows)
+	}
+	for i := 0; i < a.cms.rows; i++ {
+		for j := uint64(0); j < a.b; j++ {
+			if a.cms.get(i, j) != b.cms.get(i, j) {
+				t.Fatalf("Expected cms[%d][%d]=%d, found %d", i, j, a.cms.get(i, j), b.cms.get(i, j))
+			}
+		}
+	}
+	for i := range a.counts {
+		for j := range a.counts[i] {
+			if a.counts[i][j] != b.counts[i][j] || a.objects[i][j] != b.objects[i][j] || a.hashes[i][j] != b.hashes[i][j] {
+				t.Fatalf("Expected slot [%d][%d] to be %v=%d, found %v=%d", i, j, a.objects[i][j], a.counts[i][j], b.objects[i][j], b.counts[i][j])
+			}
+		}
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	words := loadWords()
+	sk, _ := NewTopK(20, uint64(len(words)), 0.01, WithExtraCounterRows(1))
+	for _, w := range words {
+		sk.Insert(w, 1)
+	}
+	sk.Insert(42, 3)
+	sk.Insert(uint8(7), 1)
+	sk.Insert(1.5, 2)
+	sk.Insert(true, 1)
+
+	data, err := sk.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dec Sketch
+	if err := dec.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	assertSameState(t, sk, &dec)
+	if dec.Evictions() != sk.Evictions() || dec.Cardinality() != sk.Cardinality() {
+		t.Error("Expected statistics to survive round trip")
+	}
+	if c, _ := dec.Count(42); c < 3 {
+		t.Errorf("Expected int key to survive round trip, found count %d", c)
+	}
+
+	// The receiver keeps its options
+	tracked, _ := New(0.5, 0.5, WithTopKTracking(10))
+	if err := tracked.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTopK(t, tracked, 10)
+}
+
+func TestMergeSerialized(t *testing.T) {
+	var blobs [][]byte
+	for w := int64(1); w <= 5; w++ {
+		sk, _ := NewTopK(20, 100000, 0.01, WithExtraCounterRows(1))
+		for _, key := range zipfKeys(20000, 2000, w) {
+			sk.Insert(key, 1)
+		}
+		if w == 3 {
+			// An empty blob among them, like an idle worker
+			sk.Reset()
+		}
+		data, _ := sk.MarshalBinary()
+		blobs = append(blobs, data)
+	}
+
+	merged, err := MergeSerialized(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want Sketch
+	for _, data := range blobs {
+		var dec Sketch
+		if err := dec.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if want.b == 0 {
+			want = dec
+		} else if err := want.Merge(&dec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertSameResults(t, merged, &want)
+
+	other, _ := New(0.1, 0.1)
+	incompatible, _ := other.MarshalBinary()
+	for _, c := range []struct {
+		blobs [][]byte
+		err   error
+	}{
+		{nil, ErrInvalidParameter},
+		{[][]byte{blobs[0], blobs[1][:10]}, ErrCorruptData},
+		{[][]byte{blobs[0][1:], blobs[1]}, ErrCorruptData},
+		{[][]byte{blobs[0], incompatible}, ErrIncompatibleSketches},
+	} {
+		if sk, err := MergeSerialized(c.blobs); sk != nil || !errors.Is(err, c.err) {
+			t.Errorf("Expected %v, found %v", c.err, err)
+		}
+	}
+}
+
+func BenchmarkMergeSerialized(b *testing.B) {
+	var blobs [][]byte
+	for w := int64(1); w <= 8; w++ {
+		sk, _ := NewTopK(20, 1000000, 0.01)
+		for _, key := range zipfKeys(100000, 10000, w) {
+			sk.Insert(key, 1)
+		}
+		data, _ := sk.MarshalBinary()
+		blobs = append(blobs, data)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MergeSerialized(blobs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUnmarshalBinaryCorrupt(t *testing.T) {
+	sk, _ := New(0.1, 0.1)
+	sk.Insert("a", 1)
+	data, _ := sk.MarshalBinary()
+
+	// Residuals below zero or above their counter, or without a key
+	var residuals [][]byte
+	for _, r := range []int64{-1, 2} {
+		bad := sk.Clone()
+		for j := range bad.counts[0] {
+			if bad.objects[0][j] != nil {
+				bad.counts[0][j] = r
+			}
+		}
+		enc, _ := bad.MarshalBinary()
+		residuals = append(residuals, enc)
+	}
+	empty := newSketch(sk.b, sk.l)
+	empty.counts[0][0] = 1
+	empty.cms.set(0, 0, 1)
+	enc, _ := empty.MarshalBinary()
+	residuals = append(residuals, enc)
+
+	var dec Sketch
+	for _, bad := range append([][]byte{nil, data[:4], data[:len(data)-1], append([]byte{data[0] ^ 1}, data[1:]...)}, residuals...) {
+		if err := dec.UnmarshalBinary(bad); !errors.Is(err, ErrCorruptData) {
+			t.Errorf("Expected corrupt data error, found %v", err)
+		}
+	}
+}
+
+func TestUnmarshalBinaryVersion(t *testing.T) {
+	sk, _ := New(0.1, 0.1)
+	data, _ := sk.MarshalBinary()
+
+	data[0] = 99
+	data, _ = resum(data)
+
+	var dec Sketch
+	if err := dec.UnmarshalBinary(data); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected unsupported version error, found %v", err)
+	}
+}
+
+// resum recomputes the checksum of tampered data.
+func resum(data []byte) ([]byte, error) {
+	body := data[:len(data)-4]
+	return append(body, checksum(body)...), nil
+}
+
+func TestMarshalBinaryUnsupportedKey(t *testing.T) {
+	sk, _ := New(0.1, 0.1)
+	sk.Insert(struct{ A int }{1}, 1)
+
+	if _, err := sk.MarshalBinary(); !errors.Is(err, ErrUnsupportedKeyType) {
+		t.Errorf("Expected unsupported key error, found %v", err)
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the testdata fixtures of the current version")
+
+// fixtureSketch returns the sketch the testdata fixtures were encoded from.
+func fixtureSketch(opts ...Option) *Sketch {
+	sk, _ := New(0.05, 0.01, opts...)
+	for i, key := range zipfKeys(5000, 300, 7) {
+		sk.Insert(key, uint64(1+i%3))
+	}
+	sk.Insert(42, 7)
+	sk.Insert(true, 2)
+	sk.Insert(1.5, 3)
+	return sk
+}
+
+func fixturePath(version int) string {
+	return fmt.Sprintf("testdata/sketch-v%d.bin", version)
+}
+
+func TestUpdateFixture(t *testing.T) {
+	if !*update {
+		t.Skip("run with -update to rewrite the fixture")
+	}
+
+	data, err := fixtureSketch(WithSeed(7)).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fixturePath(formatVersion), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeFixtures(t *testing.T) {
+	for _, fixture := range []struct {
+		version  int
+		seed     uint64
+		hash     HashVersion
+		distinct uint64
+		top      []LocalHeavyHitter
+	}{
+		{1, 0, HashStructure, 290, []LocalHeavyHitter{{Key: "key0", Count: 2073, Rows: 3}, {Key: "key1", Count: 1032, Rows: 3}, {Key: "key2", Count: 565, Rows: 3}, {Key: "key3", Count: 485, Rows: 3}, {Key: "key5", Count: 362, Rows: 3}}},
+		{2, 7, HashStructure, 290, []LocalHeavyHitter{{Key: "key0", Count: 2058, Rows: 3}, {Key: "key1", Count: 1011, Rows: 3}, {Key: "key2", Count: 654, Rows: 2}, {Key: "key3", Count: 481, Rows: 3}, {Key: "key4", Count: 356, Rows: 3}}},
+		{3, 7, HashV1, 296, []LocalHeavyHitter{{Key: "key0", Count: 2051, Rows: 3}, {Key: "key1", Count: 1022, Rows: 3}, {Key: "key2", Count: 579, Rows: 3}, {Key: "key3", Count: 537, Rows: 2}, {Key: "key4", Count: 349, Rows: 3}}},
+		{4, 7, HashV1, 296, []LocalHeavyHitter{{Key: "key0", Count: 2051, Rows: 3}, {Key: "key1", Count: 1022, Rows: 3}, {Key: "key2", Count: 579, Rows: 3}, {Key: "key3", Count: 537, Rows: 2}, {Key: "key4", Count: 349, Rows: 3}}},
+	} {
+		data, err := ioutil.ReadFile(fixturePath(fixture.version))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sk, _ := New(0.5, 0.5)
+		if err := sk.UnmarshalBinary(data); err != nil {
+			t.Errorf("Expected version %d to decode, found %v", fixture.version, err)
+			continue
+		}
+
+		if sk.seed != fixture.seed || sk.hashVersion != fixture.hash {
+			t.Errorf("Expected version %d to decode with seed %d and hash version %d, found %d and %d", fixture.version, fixture.seed, fixture.hash, sk.seed, sk.hashVersion)
+		}
+		if sk.Total() != 10011 || sk.Cardinality() != fixture.distinct {
+			t.Errorf("Expected version %d to decode total 10011 and %d distinct, found %d and %d", fixture.version, fixture.distinct, sk.Total(), sk.Cardinality())
+		}
+		top := sk.TopK(len(fixture.top))
+		if !reflect.DeepEqual(top, fixture.top) {
+			t.Errorf("Expected version %d to decode top %v, found %v", fixture.version, fixture.top, top)
+		}
+		if c, _ := sk.Count(42); c < 7 {
+			t.Errorf("Expected version %d to decode 42 at least 7 times, found %d", fixture.version, c)
+		}
+
+		// The upgraded sketch keeps counting, and merges with new sketches
+		fresh := fixtureSketch(WithSeed(fixture.seed), WithHashVersion(fixture.hash))
+		if err := sk.Merge(fresh); err != nil {
+			t.Errorf("Expected version %d to merge with a new sketch, found %v", fixture.version, err)
+		}
+		if c, _ := sk.Count("key0"); c != 2*fixture.top[0].Count {
+			t.Errorf("Expected version %d to count key0 %d times after merging, found %d", fixture.version, 2*fixture.top[0].Count, c)
+		}
+	}
+}
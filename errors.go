@@ -0,0 +1,61 @@
+package topkapi
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Every error of the package, other than those of the io.Writer, io.Reader
+// or file it was given, falls in one of these categories, which errors.Is
+// tells apart:
+//
+//	if errors.Is(err, topkapi.ErrCorruptData) {
+//		// discard the snapshot and start over
+//	}
+//
+// The errors carry messages of their own with the details. Constructors and
+// options return ErrInvalidParameter rather than panic on values out of
+// range, merges ErrIncompatibleSketches, and decoders ErrCorruptData or
+// ErrUnsupportedVersion. Keys that can't be counted are rejected by Insert,
+// reported by TryInsert, and ignored by lookups like Count.
+var (
+	// ErrInvalidParameter is returned by constructors and options given
+	// values out of range, like an epsilon of 0 or a nil sketch.
+	ErrInvalidParameter = errors.New("topkapi: invalid parameter")
+
+	// ErrIncompatibleSketches is returned by Merge and the like for sketches
+	// that differ in dimensions, seed, hash version or bucketing.
+	ErrIncompatibleSketches = errors.New("topkapi: incompatible sketches")
+
+	// ErrUnsupportedKeyType is returned for keys that can't be compared or
+	// hashed, like slices, maps and functions, or that can't be encoded.
+	ErrUnsupportedKeyType = errors.New("topkapi: unsupported key type")
+
+	// ErrCorruptData is returned when decoding data that is truncated, has
+	// a bad checksum or is otherwise malformed.
+	ErrCorruptData = errors.New("topkapi: corrupt sketch data")
+
+	// ErrUnsupportedVersion is returned when decoding data of an unknown,
+	// presumably newer, format version.
+	ErrUnsupportedVersion = errors.New("topkapi: unsupported sketch format version")
+)
+
+// kindError is an error of one of the categories above with a message of its
+// own.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// newError returns an error of the given category with a formatted message.
+func newError(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,128 @@
+package topkapi
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestErrorCategories(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	sk.Insert("a", 1)
+	data, _ := sk.MarshalBinary()
+	future := append([]byte(nil), data...)
+	future[0] = formatVersion + 1
+	future, _ = resum(future)
+
+	_, newErr := New(0, 0.01)
+	_, topKErr := NewTopK(0, 1000, 0.01)
+	_, paramsErr := NewFromParams(Params{B: 1 << 62, L: 4})
+	_, optionErr := New(0.01, 0.01, WithTopKTracking(0))
+	_, specErr := Parse("b=10")
+	_, textErr := ParseText(strings.NewReader("not a dump"))
+	var dec Sketch
+
+	for _, tt := range []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"New", newErr, ErrInvalidParameter},
+		{"NewTopK", topKErr, ErrInvalidParameter},
+		{"NewFromParams", paramsErr, ErrInvalidParameter},
+		{"option", optionErr, ErrInvalidParameter},
+		{"Parse", specErr, ErrInvalidParameter},
+		{"nil merge", sk.Merge(nil), ErrInvalidParameter},
+		{"Merge", sk.Merge(newSketch(10, 2)), ErrIncompatibleSketches},
+		{"AddSketch", sk.AddSketch(newSketch(10, 2)), ErrIncompatibleSketches},
+		{"MergeRows", sk.MergeRows(newSketch(10, 2)), ErrIncompatibleSketches},
+		{"TryInsert", sk.TryInsert([]int{1}, 1), ErrUnsupportedKeyType},
+		{"UnmarshalBinary", dec.UnmarshalBinary(data[:len(data)/2]), ErrCorruptData},
+		{"ParseText", textErr, ErrCorruptData},
+		{"Replay", func() error {
+			_, err := sk.Replay(bytes.NewReader([]byte{5, 1, 2, 3, 4, 5, 0, 0, 0, 0, 7}))
+			return err
+		}(), ErrCorruptData},
+		{"version", dec.UnmarshalBinary(future), ErrUnsupportedVersion},
+	} {
+		if !errors.Is(tt.err, tt.kind) {
+			t.Errorf("%s: expected an error of %q, found %v", tt.name, tt.kind, tt.err)
+		}
+		for _, other := range []error{ErrInvalidParameter, ErrIncompatibleSketches, ErrUnsupportedKeyType, ErrCorruptData, ErrUnsupportedVersion} {
+			if other != tt.kind && errors.Is(tt.err, other) {
+				t.Errorf("%s: expected %v not to be of %q", tt.name, tt.err, other)
+			}
+		}
+	}
+}
+
+func TestTryInsert(t *testing.T) {
+	type wrapped struct{ Key interface{} }
+
+	sk, _ := New(0.01, 0.01)
+	for _, key := range []interface{}{[]byte("a"), map[string]int{"a": 1}, func() {}, make(chan int), wrapped{[]int{1}}, [1]interface{}{[]int{1}}} {
+		if err := sk.TryInsert(key, 1); !errors.Is(err, ErrUnsupportedKeyType) {
+			t.Errorf("Expected %T to be unsupported, found %v", key, err)
+		}
+		// Twice, as comparing with the first one would panic
+		sk.Insert(key, 1)
+		if c, ok := sk.Count(key); c != 0 || ok {
+			t.Errorf("Expected Count of %T to be (0, false), found (%d, %v)", key, c, ok)
+		}
+	}
+	if st := sk.Stats(); st.Rejected != 12 || st.Total != 0 {
+		t.Errorf("Expected 12 rejected inserts and nothing counted, found %+v", st)
+	}
+
+	for _, key := range []interface{}{"a", 1, 2.5, true, wrapped{"a"}, &wrapped{}, [2]int{1, 2}, complex(1, 2)} {
+		if err := sk.TryInsert(key, 2); err != nil {
+			t.Errorf("Expected %T to be supported, found %v", key, err)
+		}
+		if c, ok := sk.Count(key); c != 2 || !ok {
+			t.Errorf("Expected Count of %v to be (2, true), found (%d, %v)", key, c, ok)
+		}
+	}
+	if err := sk.TryInsert([]int{1}, 0); err != nil {
+		t.Errorf("Expected a count of zero to be a no-op, found %v", err)
+	}
+}
+
+// maxInt is the largest int, 32 bits wide on some platforms.
+const maxInt = int(^uint(0) >> 1)
+
+func TestNoPanics(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	sk.Insert("a", 1)
+
+	for name, f := range map[string]func() error{
+		"tiny epsilon":   func() error { _, err := New(0.01, 1e-300); return err },
+		"huge corpus":    func() error { _, err := NewTopK(1<<40, math.MaxUint64, 0.01); return err },
+		"tiny corpus":    func() error { _, err := NewTopK(5, 1, 0.01); return err },
+		"huge budget":    func() error { _, err := NewBounded(math.MaxUint64); return err },
+		"huge grow":      func() error { _, err := sk.Grow(1 << 62); return err },
+		"huge extra":     func() error { _, err := New(0.01, 0.01, WithExtraCounterRows(maxInt)); return err },
+		"huge filter":    func() error { _, err := NewEventFilter(maxInt, 0.5); return err },
+		"nil AddSketch":  func() error { return sk.AddSketch(nil) },
+		"nil MergeRows":  func() error { return sk.MergeRows(nil) },
+		"nil concurrent": func() error { return NewConcurrent(sk).Merge(nil) },
+		"nil payload":    func() error { _, err := NewPayload(nil); return err },
+	} {
+		if err := f(); !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("%s: expected an invalid parameter, found %v", name, err)
+		}
+	}
+
+	tracked, err := New(0.01, 0.01, WithTopKTracking(maxInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked.Insert("a", 1)
+	if res := tracked.Clone().TopK(maxInt); len(res) != 1 {
+		t.Errorf("Expected a single heavy hitter, found %v", res)
+	}
+	if c := sk.KthCount(maxInt); c != 0 {
+		t.Errorf("Expected no count for a k beyond the candidates, found %d", c)
+	}
+}
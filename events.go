@@ -0,0 +1,114 @@
+package topkapi
+
+import (
+	"fmt"
+	"math"
+)
+
+// EventKind tells what an Event is about.
+type EventKind int
+
+const (
+	// EventEvictions is reported every EvictionEventInterval evictions, so
+	// that their rate can be watched for storms of keys displacing heavy
+	// hitters.
+	EventEvictions EventKind = iota + 1
+
+	// EventSaturated is reported when a counter reaches the largest count
+	// it holds, at which it stays rather than wrapping around.
+	EventSaturated
+
+	// EventIncompatibleMerge is reported when a merge is refused because
+	// the sketches differ in dimensions, seed or hash version.
+	EventIncompatibleMerge
+
+	// EventDecodeFailure is reported when UnmarshalBinary fails.
+	EventDecodeFailure
+
+	// EventMismatchedMerge is reported when a merge combines sketches that
+	// map keys differently, like with different key normalizers. The merge
+	// goes ahead, and the warning handler is called too.
+	EventMismatchedMerge
+)
+
+// EvictionEventInterval is the number of evictions per EventEvictions.
+const EvictionEventInterval = 10000
+
+func (k EventKind) String() string {
+	switch k {
+	case EventEvictions:
+		return "evictions"
+	case EventSaturated:
+		return "saturated"
+	case EventIncompatibleMerge:
+		return "incompatible merge"
+	case EventDecodeFailure:
+		return "decode failure"
+	case EventMismatchedMerge:
+		return "mismatched merge"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event is a notable change of a sketch, see WithEventHandler.
+type Event struct {
+	Kind        EventKind
+	Row, Bucket int // of the counter concerned, or -1
+	Message     string
+}
+
+// WithEventHandler calls handle with every Event of the sketch, for logging
+// or alerting. Events are rare: evictions are reported once per
+// EvictionEventInterval, and a counter only saturates once. handle is
+// called from the method causing the event, so it should return quickly, and
+// it must be safe for concurrent use with RowLockedSketch, whose inserts
+// run in parallel. Without a handler events cost nothing.
+func WithEventHandler(handle func(Event)) Option {
+	return func(sk *Sketch) error {
+		sk.events = handle
+		return nil
+	}
+}
+
+// event reports an event if there is a handler.
+func (sk *Sketch) event(kind EventKind, row, bucket int, format string, args ...interface{}) {
+	if sk.events != nil {
+		sk.events(Event{Kind: kind, Row: row, Bucket: bucket, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// addEvictions adds n evictions, reporting every EvictionEventInterval-th.
+func (sk *Sketch) addEvictions(n uint64) {
+	old := sk.evictions
+	sk.evictions += n
+	if sk.events != nil && old/EvictionEventInterval != sk.evictions/EvictionEventInterval {
+		sk.event(EventEvictions, -1, -1, "%d evictions over a total of %d", sk.evictions, sk.total)
+	}
+}
+
+// addTotal adds n to the total, which saturates like the counters.
+func (sk *Sketch) addTotal(n uint64) {
+	if sk.total += n; sk.total < n {
+		sk.total = math.MaxUint64
+	}
+}
+
+// saturate sets the counter of row i, bucket j, to its largest value, for
+// a count that would overflow it.
+func (sk *Sketch) saturate(i int, j uint64) {
+	if sk.cms.get(i, j) != math.MaxUint64 {
+		sk.event(EventSaturated, i, int(j), "counter saturated at %d", uint64(math.MaxUint64))
+	}
+	sk.cms.set(i, j, math.MaxUint64)
+}
+
+// incompatibleMerge reports and returns the refusal to merge other.
+func (sk *Sketch) incompatibleMerge(other *Sketch) error {
+	if other == nil {
+		return nilSketch
+	}
+	sk.event(EventIncompatibleMerge, -1, -1, "merging %d×%d seed %d hash %d into %d×%d seed %d hash %d",
+		other.cms.rows, other.b, other.seed, other.hashVersion, sk.cms.rows, sk.b, sk.seed, sk.hashVersion)
+	return ErrIncompatibleSketches
+}
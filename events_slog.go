@@ -0,0 +1,22 @@
+//go:build go1.21
+// +build go1.21
+
+package topkapi
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogEventHandler returns a handler for WithEventHandler logging every
+// event to logger at the warning level, with its kind and, where there is
+// one, the row and bucket of its counter as attributes.
+func SlogEventHandler(logger *slog.Logger) func(Event) {
+	return func(e Event) {
+		attrs := []slog.Attr{slog.String("kind", e.Kind.String())}
+		if e.Row >= 0 {
+			attrs = append(attrs, slog.Int("row", e.Row), slog.Int("bucket", e.Bucket))
+		}
+		logger.LogAttrs(context.Background(), slog.LevelWarn, "topkapi: "+e.Message, attrs...)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build go1.21
+// +build go1.21
+
+package topkapi
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogEventHandler(t *testing.T) {
+	var buf bytes.Buffer
+	sk, _ := New(0.01, 0.01, WithEventHandler(SlogEventHandler(slog.New(slog.NewTextHandler(&buf, nil)))))
+	other, _ := New(0.1, 0.1)
+	sk.Merge(other)
+
+	if line := buf.String(); !strings.Contains(line, "level=WARN") || !strings.Contains(line, `kind="incompatible merge"`) || strings.Contains(line, "row=") {
+		t.Errorf("Expected the incompatible merge to be logged, found %q", line)
+	}
+}
@@ -0,0 +1,58 @@
+package topkapi
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestWithEventHandler(t *testing.T) {
+	var events []Event
+	sk, _ := New(0.01, 0.01, WithEventHandler(func(e Event) { events = append(events, e) }))
+
+	// Counters stop at their largest value, and saturate once
+	sk.Insert("a", math.MaxUint64-1)
+	sk.Insert("a", 5)
+	sk.Insert("a", 5)
+	if c, _ := sk.Count("a"); c != math.MaxUint64 || sk.Total() != math.MaxUint64 {
+		t.Errorf("Expected a saturated count and total, found %d and %d", c, sk.Total())
+	}
+	if len(events) != sk.cms.rows {
+		t.Fatalf("Expected a saturation per row, found %v", events)
+	}
+	for i, e := range events {
+		if e.Kind != EventSaturated || e.Row != i || e.Bucket != int(sk.bucket(sk.hashKey("a"), i)) {
+			t.Errorf("Expected row %d to saturate, found %+v", i, e)
+		}
+	}
+
+	events = nil
+	other, _ := New(0.1, 0.1)
+	if err := sk.Merge(other); !errors.Is(err, ErrIncompatibleSketches) {
+		t.Fatalf("Expected incompatible sketches, got %v", err)
+	}
+	if len(events) != 1 || events[0].Kind != EventIncompatibleMerge || events[0].Row != -1 {
+		t.Errorf("Expected an incompatible merge, found %v", events)
+	}
+
+	events = nil
+	if err := sk.UnmarshalBinary([]byte{formatVersion, 1}); err == nil {
+		t.Fatal("Expected corrupt data")
+	}
+	if len(events) != 1 || events[0].Kind != EventDecodeFailure {
+		t.Errorf("Expected a decode failure, found %v", events)
+	}
+
+	var evictions int
+	churn, _ := New(0.1, 0.1, WithEventHandler(func(e Event) {
+		if e.Kind == EventEvictions {
+			evictions++
+		}
+	}))
+	for i := 0; i < 100000; i++ {
+		churn.Insert(i, 1)
+	}
+	if want := int(churn.Evictions() / EvictionEventInterval); evictions != want {
+		t.Errorf("Expected %d eviction events for %d evictions, found %d", want, churn.Evictions(), evictions)
+	}
+}
@@ -0,0 +1,84 @@
+package topkapi
+
+// EvictionPolicy decides what happens when a key is inserted into a bucket
+// held by another candidate, trading how fast a bucket follows a change in
+// the stream against how much of the count it loses hopping between keys.
+//
+// It is only consulted on Insert; empty buckets are always taken by the
+// first key inserted into them, and Merge compares residuals regardless of
+// the policy.
+type EvictionPolicy interface {
+	// Contest returns the residual of the bucket after count occurrences of
+	// another key are inserted into a bucket whose candidate has residual
+	// left, and whether the other key takes over the bucket with it.
+	Contest(residual int64, count uint64) (left int64, evict bool)
+}
+
+// DecrementEviction is the default policy, that of Misra-Gries: the count
+// of the other key is subtracted from the residual, and once the residual
+// goes below zero, the other key takes over with what is left. A bucket
+// changes hands as soon as another key outweighs its candidate.
+type DecrementEviction struct{}
+
+// Contest implements EvictionPolicy.
+func (DecrementEviction) Contest(residual int64, count uint64) (int64, bool) {
+	left := residual - int64(count)
+	if left < 0 {
+		return -left, true
+	}
+	return left, false
+}
+
+// DrainEviction subtracts the count of the other key from the residual, but
+// not below zero, and only lets it take over the bucket when the residual
+// is already zero, with its full count. A single large insert can't take a
+// bucket from its candidate, which evicts less on streams with bursty
+// counts, at the cost of being slower to follow a new heavy hitter. With
+// counts of one it evicts exactly like DecrementEviction.
+type DrainEviction struct{}
+
+// Contest implements EvictionPolicy.
+func (DrainEviction) Contest(residual int64, count uint64) (int64, bool) {
+	switch {
+	case residual == 0:
+		return int64(count), true
+	case residual > int64(count):
+		return residual - int64(count), false
+	default:
+		return 0, false
+	}
+}
+
+// FullCountEviction subtracts the count of the other key from the residual
+// like DecrementEviction, but once the other key outweighs the candidate it
+// takes over the bucket with its full count rather than with what is left.
+//
+// DecrementEviction leaves a new candidate with the margin it won the bucket
+// by, which is right for counts of one, but with large weights per insert,
+// like byte totals, a heavy key winning its bucket back by a small margin is
+// displaced again by the next heavy insert of another key, and buckets
+// thrash between keys. With its full count, the heavy key holds on to the
+// bucket until another key outweighs that insert. The residual is still a
+// lower bound on the count of the new candidate, which the insert alone
+// accounts for.
+type FullCountEviction struct{}
+
+// Contest implements EvictionPolicy.
+func (FullCountEviction) Contest(residual int64, count uint64) (int64, bool) {
+	if left := residual - int64(count); left >= 0 {
+		return left, false
+	}
+	return int64(count), true
+}
+
+// WithEvictionPolicy contests buckets held by another candidate with p
+// instead of DecrementEviction.
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(sk *Sketch) error {
+		if p == nil {
+			return newError(ErrInvalidParameter, "topkapi: eviction policy should not be nil")
+		}
+		sk.eviction = p
+		return nil
+	}
+}
@@ -0,0 +1,110 @@
+package topkapi
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	// A single bucket per row, so that every key contests the same bucket
+	for _, test := range []struct {
+		policy EvictionPolicy
+		after  []LocalHeavyHitter // candidate after every insert
+	}{
+		{DecrementEviction{}, []LocalHeavyHitter{{Key: "a", Count: 3, Rows: 1}, {Key: "b", Count: 2, Rows: 1}, {Key: "b", Count: 3, Rows: 1}, {Key: "b", Count: 1, Rows: 1}}},
+		{DrainEviction{}, []LocalHeavyHitter{{Key: "a", Count: 3, Rows: 1}, {Key: "a", Count: 0, Rows: 1}, {Key: "b", Count: 1, Rows: 1}, {Key: "b", Count: 0, Rows: 1}}},
+		{FullCountEviction{}, []LocalHeavyHitter{{Key: "a", Count: 3, Rows: 1}, {Key: "b", Count: 5, Rows: 1}, {Key: "b", Count: 6, Rows: 1}, {Key: "b", Count: 4, Rows: 1}}},
+	} {
+		sk, _ := newSketch(1, 1).apply([]Option{WithEvictionPolicy(test.policy)})
+		for n, ins := range []LocalHeavyHitter{{Key: "a", Count: 3}, {Key: "b", Count: 5}, {Key: "b", Count: 1}, {Key: "a", Count: 2}} {
+			sk.Insert(ins.Key, ins.Count)
+			if obj, res := sk.objects[0][0], sk.counts[0][0]; obj != test.after[n].Key || res != int64(test.after[n].Count) {
+				t.Errorf("%T: expected %v=%d after insert %d, found %v=%d", test.policy, test.after[n].Key, test.after[n].Count, n, obj, res)
+			}
+		}
+	}
+
+	if _, err := New(0.01, 0.01, WithEvictionPolicy(nil)); err == nil {
+		t.Error("Expected error for a nil eviction policy")
+	}
+}
+
+func TestEvictionPoliciesOnStream(t *testing.T) {
+	// Counts of 1 to 5, so that draining a candidate differs from
+	// decrementing it
+	keys := zipfKeys(50000, 5000, 11)
+	exact := make(map[string]uint64)
+	for i, key := range keys {
+		exact[key] += uint64(1 + i%5)
+	}
+
+	var states []uint64
+	var evictions []uint64
+	for _, policy := range []EvictionPolicy{nil, DecrementEviction{}, DrainEviction{}} {
+		var opts []Option
+		if policy != nil {
+			opts = append(opts, WithEvictionPolicy(policy))
+		}
+		sk, _ := NewTopK(10, 150000, 0.01, opts...)
+		for i, key := range keys {
+			sk.Insert(key, uint64(1+i%5))
+		}
+
+		// Every policy finds the heavy hitters, with estimates that never
+		// undercount
+		for _, hh := range sk.TopK(5) {
+			if hh.Count < exact[hh.Key.(string)] {
+				t.Errorf("%T: expected %v >= %d, found %d", policy, hh.Key, exact[hh.Key.(string)], hh.Count)
+			}
+		}
+		for i, key := range []string{"key0", "key1", "key2"} {
+			if top := sk.TopK(3); top[i].Key != key {
+				t.Errorf("%T: expected %s at rank %d, found %v", policy, key, i, top)
+			}
+		}
+		states = append(states, sk.StateHash())
+		evictions = append(evictions, sk.Evictions())
+	}
+
+	if states[0] != states[1] {
+		t.Error("Expected DecrementEviction to be the default")
+	}
+	if states[2] == states[0] {
+		t.Error("Expected DrainEviction to hold different candidates")
+	}
+	if evictions[2] >= evictions[0] {
+		t.Errorf("Expected DrainEviction to evict less than %d, found %d", evictions[0], evictions[2])
+	}
+}
+
+func TestFullCountEvictionLargeWeights(t *testing.T) {
+	// Byte totals of a dominant key and of two other keys per round, each
+	// lighter than it but together heavier, in a single bucket
+	held := make(map[string]int)
+	evictions := make(map[string]uint64)
+	for _, policy := range []EvictionPolicy{DecrementEviction{}, FullCountEviction{}} {
+		name := fmt.Sprintf("%T", policy)
+		sk, _ := newSketch(1, 1).apply([]Option{WithEvictionPolicy(policy)})
+		rnd := rand.New(rand.NewSource(1))
+		for round := 0; round < 1000; round++ {
+			sk.Insert("dominant", 1000000)
+			for n := 0; n < 2; n++ {
+				sk.Insert(fmt.Sprint("other", rnd.Intn(1000)), uint64(300000+rnd.Intn(600000)))
+			}
+			if sk.objects[0][0] == "dominant" {
+				held[name]++
+			}
+		}
+		evictions[name] = sk.Evictions()
+	}
+
+	// Winning the bucket back by a small margin, the dominant key mostly
+	// loses it again right away
+	if d, f := held["topkapi.DecrementEviction"], held["topkapi.FullCountEviction"]; d > 100 || f < 250 {
+		t.Errorf("Expected the dominant key to hold its bucket in at most 100 rounds with DecrementEviction and at least 250 with FullCountEviction, found %d and %d", d, f)
+	}
+	if d, f := evictions["topkapi.DecrementEviction"], evictions["topkapi.FullCountEviction"]; f >= d {
+		t.Errorf("Expected FullCountEviction to evict less than %d, found %d", d, f)
+	}
+}
@@ -0,0 +1,94 @@
+package topkapi_test
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wardbekker/topkapi"
+)
+
+const corpus = `the quick brown fox jumps over the lazy dog
+the dog barks and the fox runs
+a quick fox is a happy fox`
+
+func ExampleNewTopK() {
+	words := strings.Fields(corpus)
+	sk, err := topkapi.NewTopK(3, uint64(len(words)), 0.01)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, word := range words {
+		sk.Insert(word, 1)
+	}
+
+	// Ties are ordered by key hash, so always come out the same
+	for _, hh := range sk.TopK(3) {
+		fmt.Println(hh.Key, hh.Count)
+	}
+	// Output:
+	// fox 4
+	// the 4
+	// dog 2
+}
+
+func ExampleSketch_Result() {
+	sk, _ := topkapi.New(0.01, 0.01)
+	for _, word := range strings.Fields(corpus) {
+		sk.Insert(word, 1)
+	}
+
+	// Every key seen at least 3 times
+	for _, hh := range sk.Result(3) {
+		fmt.Println(hh.Key, hh.Count)
+	}
+	// Output:
+	// fox 4
+	// the 4
+}
+
+func ExampleSketch_Merge() {
+	lines := strings.Split(corpus, "\n")
+
+	// Two partitions of the corpus, counted separately
+	first, _ := topkapi.New(0.01, 0.01)
+	second, _ := topkapi.New(0.01, 0.01)
+	for _, word := range strings.Fields(lines[0]) {
+		first.Insert(word, 1)
+	}
+	for _, word := range strings.Fields(strings.Join(lines[1:], " ")) {
+		second.Insert(word, 1)
+	}
+
+	if err := first.Merge(second); err != nil {
+		panic(err)
+	}
+	for _, hh := range first.TopK(2) {
+		fmt.Println(hh.Key, hh.Count)
+	}
+	// Output:
+	// fox 4
+	// the 4
+}
+
+func ExampleSketch_MarshalBinary() {
+	sk, _ := topkapi.New(0.01, 0.01)
+	for _, word := range strings.Fields(corpus) {
+		sk.Insert(word, 1)
+	}
+
+	data, err := sk.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+
+	// The receiver takes on the dimensions of the encoded sketch
+	var restored topkapi.Sketch
+	if err := restored.UnmarshalBinary(data); err != nil {
+		panic(err)
+	}
+	c, _ := restored.Count("fox")
+	fmt.Println(restored.Total(), c)
+	// Output:
+	// 23 4
+}
@@ -0,0 +1,110 @@
+package topkapi
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ResultUnordered calls emit once for every heavy hitter Result would
+// return, in no particular order, and stops at the first error emit returns,
+// which it returns. Unlike Result and ResultStream it needs no memory beyond
+// the entry being emitted, whatever the number of candidates, and visits
+// the sketch once.
+func (sk *Sketch) ResultUnordered(threshold uint64, emit func(hh LocalHeavyHitter) error) error {
+	var err error
+	sk.scanUntil(threshold, nil, func(hh LocalHeavyHitter, _ uint64) bool {
+		err = emit(hh)
+		return err == nil
+	})
+
+	return err
+}
+
+// WriteCSV writes the heavy hitters with an estimate of at least threshold
+// to w as CSV, one "key,count,rows" record per candidate after a header, in
+// no particular order. Keys are formatted with fmt.Sprint. Records are
+// streamed with ResultUnordered through a small buffer.
+func (sk *Sketch) WriteCSV(w io.Writer, threshold uint64) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"key", "count", "rows"}); err != nil {
+		return err
+	}
+
+	record := make([]string, 3)
+	err := sk.ResultUnordered(threshold, func(hh LocalHeavyHitter) error {
+		record[0] = fmt.Sprint(hh.Key)
+		record[1] = strconv.FormatUint(hh.Count, 10)
+		record[2] = strconv.Itoa(hh.Rows)
+		return cw.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// TopKJSON encodes TopK(k) as a compact JSON array of {"key","count"}
+// objects, in order, with keys formatted with fmt.Sprint, for consumers
+// that only display the top k and don't need the sketch itself.
+func (sk *Sketch) TopKJSON(k int) ([]byte, error) {
+	type entry struct {
+		Key   string `json:"key"`
+		Count uint64 `json:"count"`
+	}
+
+	top := sk.TopK(k)
+	entries := make([]entry, len(top))
+	for n, hh := range top {
+		entries[n] = entry{Key: fmt.Sprint(hh.Key), Count: hh.Count}
+	}
+
+	return json.Marshal(entries)
+}
+
+// CandidateDetail is a candidate slot of the sketch, as exported by
+// ExportCandidates.
+type CandidateDetail struct {
+	Key      interface{}
+	Hash     uint64 // of the key, see HashKey
+	Row      int
+	Bucket   uint64
+	Residual int64  // the Misra-Gries count of the key in the bucket
+	CMS      uint64 // the count-min counter of the bucket
+}
+
+// ExportCandidates returns every occupied candidate slot, ordered by row,
+// then by bucket, for checking a sketch against exact counts. A key held in
+// several rows is exported once per row. It copies the whole candidate
+// matrix, so it is meant for debugging rather than for serving queries.
+//
+// The estimate Result reports for a key is the lowest counter of its
+// buckets, among which are those exported in the rows holding it; the
+// counters of buckets of the key held by other keys are exported along
+// with those. Only buckets without a candidate, which have no counts unless
+// WithMinCount kept keys from taking them, and extra counter rows are not
+// exported.
+func (sk *Sketch) ExportCandidates() []CandidateDetail {
+	var cds []CandidateDetail
+	for i := range sk.objects {
+		for j, obj := range sk.objects[i] {
+			if obj == nil {
+				continue
+			}
+			cds = append(cds, CandidateDetail{
+				Key:      obj,
+				Hash:     sk.hashes[i][j],
+				Row:      i,
+				Bucket:   uint64(j),
+				Residual: sk.counts[i][j],
+				CMS:      sk.cms.get(i, uint64(j)),
+			})
+		}
+	}
+
+	return cds
+}
@@ -0,0 +1,178 @@
+package topkapi
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestResultUnordered(t *testing.T) {
+	sk, _ := New(0.001, 0.0001)
+	for _, key := range zipfKeys(300000, 50000, 1) {
+		sk.Insert(key, 1)
+	}
+
+	want := make(map[interface{}]LocalHeavyHitter)
+	for _, hh := range sk.Result(2) {
+		want[hh.Key] = hh
+	}
+
+	got := make(map[interface{}]LocalHeavyHitter)
+	err := sk.ResultUnordered(2, func(hh LocalHeavyHitter) error {
+		if _, dup := got[hh.Key]; dup {
+			t.Fatalf("Expected '%s' to be emitted once", hh.Key)
+		}
+		got[hh.Key] = hh
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d heavy hitters, found %d", len(want), len(got))
+	}
+	for key, hh := range want {
+		if got[key] != hh {
+			t.Errorf("Expected %v, found %v", hh, got[key])
+		}
+	}
+
+	stop := errors.New("stop")
+	var calls int
+	err = sk.ResultUnordered(2, func(LocalHeavyHitter) error {
+		if calls++; calls == 5 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || calls != 5 {
+		t.Errorf("Expected to stop with the emit error after 5 calls, found %v after %d", err, calls)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	sk, _ := New(0.01, 0.001)
+	for _, key := range zipfKeys(100000, 5000, 2) {
+		sk.Insert(key, 1)
+	}
+	sk.Insert("with,comma", 1000)
+
+	var buf bytes.Buffer
+	if err := sk.WriteCSV(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sk.Result(1)
+	if len(records) != len(want)+1 || records[0][0] != "key" {
+		t.Fatalf("Expected a header and %d records, found %d", len(want), len(records))
+	}
+
+	byKey := make(map[string]LocalHeavyHitter)
+	for _, hh := range want {
+		byKey[hh.Key.(string)] = hh
+	}
+	for _, rec := range records[1:] {
+		hh, ok := byKey[rec[0]]
+		if !ok {
+			t.Fatalf("Unexpected key '%s'", rec[0])
+		}
+		if rec[1] != strconv.FormatUint(hh.Count, 10) || rec[2] != strconv.Itoa(hh.Rows) {
+			t.Errorf("Expected %v, found %v", hh, rec)
+		}
+	}
+}
+
+func TestExportCandidates(t *testing.T) {
+	sk, _ := New(0.01, 0.001)
+	for _, key := range zipfKeys(50000, 5000, 1) {
+		sk.Insert(key, 1)
+	}
+	cds := sk.ExportCandidates()
+
+	type slot struct {
+		row    int
+		bucket uint64
+	}
+	counters := make(map[slot]uint64)
+	for n, cd := range cds {
+		if n > 0 && (cd.Row < cds[n-1].Row || cd.Row == cds[n-1].Row && cd.Bucket <= cds[n-1].Bucket) {
+			t.Fatalf("Expected slots ordered by row and bucket, found %+v after %+v", cd, cds[n-1])
+		}
+		counters[slot{cd.Row, cd.Bucket}] = cd.CMS
+	}
+
+	// Every key is estimated by the lowest counter of its buckets, which
+	// are derived from its hash as the sketch does
+	var rs []rankedHitter
+	index := make(map[interface{}]int)
+	for _, cd := range cds {
+		if n, ok := index[cd.Key]; ok {
+			rs[n].Rows++
+			continue
+		}
+		count := uint64(math.MaxUint64)
+		for i := 0; i < int(sk.l); i++ {
+			if c := counters[slot{i, sk.bucket(cd.Hash, i)}]; c < count {
+				count = c
+			}
+		}
+		index[cd.Key] = len(rs)
+		rs = append(rs, rankedHitter{LocalHeavyHitter{Key: cd.Key, Count: count, Rows: 1}, cd.Hash})
+	}
+	sort.Sort(rankedOrder(rs))
+
+	want := sk.Result(1)
+	if len(rs) != len(want) {
+		t.Fatalf("Expected %d heavy hitters, reconstructed %d", len(want), len(rs))
+	}
+	for n, hh := range want {
+		if rs[n].LocalHeavyHitter != hh {
+			t.Errorf("Expected %v, reconstructed %v", hh, rs[n].LocalHeavyHitter)
+		}
+	}
+}
+
+func TestTopKJSON(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	for _, key := range zipfKeys(20000, 1000, 1) {
+		sk.Insert(key, 1)
+	}
+	sk.Insert(42, 1000)
+
+	data, err := sk.TopKJSON(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []struct {
+		Key   string
+		Count uint64
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Expected %s to parse: %v", data, err)
+	}
+
+	top := sk.TopK(10)
+	if len(entries) != len(top) {
+		t.Fatalf("Expected %d entries, found %s", len(top), data)
+	}
+	for n, hh := range top {
+		if entries[n].Key != fmt.Sprint(hh.Key) || entries[n].Count != hh.Count {
+			t.Errorf("Expected %v at %d, found %+v", hh, n, entries[n])
+		}
+	}
+
+	empty, _ := New(0.01, 0.01)
+	if data, _ := empty.TopKJSON(10); string(data) != "[]" {
+		t.Errorf("Expected an empty array, found %s", data)
+	}
+}
@@ -0,0 +1,118 @@
+package topkapi
+
+import "sort"
+
+// ExtractCandidates returns a new sketch, with the dimensions and options of
+// sk, seeded with the candidates of sk accepted by pred. It is meant for
+// drilling down into keys found to be heavy, merging fresh measurements into
+// what sk already knows about them.
+//
+// The extracted sketch is not a filtered copy of sk. It is the sketch of a
+// stream in which every accepted candidate occurs exactly as often as sk can
+// vouch for: its largest residual count over all rows. Residuals are lower
+// bounds, so estimates start out at or below the true counts, never above,
+// and counts of keys sk doesn't hold as candidates are lost.
+func (sk *Sketch) ExtractCandidates(pred func(key interface{}) bool) (*Sketch, error) {
+	if pred == nil {
+		return nil, newError(ErrInvalidParameter, "topkapi: predicate should not be nil")
+	}
+
+	return sk.reseeded(func(key interface{}) (interface{}, bool) {
+		return key, pred(key)
+	}), nil
+}
+
+// RemapKeys returns a new sketch, with the dimensions and options of sk,
+// seeded with the candidates of sk under the keys f maps them to, skipping
+// those for which f returns false. It migrates a sketch to a new key type,
+// like a struct replacing a string that joined its fields, which hashes and
+// compares differently, so the old keys can't be looked up anymore.
+//
+// Like ExtractCandidates, every candidate occurs in the new sketch as often
+// as its largest residual count, and candidates mapped to the same key add
+// up. The counters of sk, with the counts of colliding keys and of keys that
+// aren't candidates, aren't carried over, so estimates start out at their
+// lower bounds.
+func (sk *Sketch) RemapKeys(f func(old interface{}) (new interface{}, ok bool)) (*Sketch, error) {
+	if f == nil {
+		return nil, newError(ErrInvalidParameter, "topkapi: key mapping should not be nil")
+	}
+
+	return sk.reseeded(func(key interface{}) (interface{}, bool) {
+		key, ok := f(key)
+		if !ok {
+			return nil, false
+		}
+		key, ok = sk.limit(sk.canonical(key))
+		return key, ok && key != nil
+	}), nil
+}
+
+// reseeded returns an empty copy of sk into which every candidate is
+// inserted with its largest residual count, under the key pick returns for
+// it, or not at all if pick returns false.
+func (sk *Sketch) reseeded(pick func(key interface{}) (interface{}, bool)) *Sketch {
+	type seed struct {
+		key    interface{}
+		hsum   uint64
+		count  int64
+		sample interface{}
+	}
+	best := make(map[interface{}]seed) // by candidate of sk
+	picked := make(map[interface{}]bool)
+	for i := range sk.objects {
+		for j, obj := range sk.objects[i] {
+			if obj == nil {
+				continue
+			}
+			ok, seen := picked[obj]
+			if !seen {
+				var key interface{}
+				if key, ok = pick(obj); ok {
+					best[obj] = seed{key: key}
+				}
+				picked[obj] = ok
+			}
+			if s := best[obj]; ok && sk.counts[i][j] > s.count {
+				best[obj] = seed{key: s.key, count: sk.counts[i][j], sample: sk.sampleOf(obj, sk.hashes[i][j], 0)}
+			}
+		}
+	}
+
+	seeds := make(map[interface{}]seed, len(best))
+	for _, s := range best {
+		if s.count <= 0 {
+			continue
+		}
+		if add, ok := seeds[s.key]; ok {
+			if add.count > s.count {
+				s.sample = add.sample
+			}
+			s.count += add.count
+		}
+		s.hsum = sk.hashKey(s.key)
+		seeds[s.key] = s
+	}
+
+	// Which of two seeds sharing a bucket keeps it depends on the order
+	// they are inserted in, so make it deterministic
+	sorted := make([]seed, 0, len(seeds))
+	for _, s := range seeds {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		if sorted[a].count != sorted[b].count {
+			return sorted[a].count > sorted[b].count
+		}
+		return sorted[a].hsum < sorted[b].hsum
+	})
+
+	ex := sk.Clone()
+	ex.Reset()
+	for _, s := range sorted {
+		ex.insert(s.key, s.hsum, uint64(s.count))
+		ex.setSample(s.key, s.hsum, s.sample)
+	}
+
+	return ex
+}
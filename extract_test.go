@@ -0,0 +1,136 @@
+package topkapi
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// hostPaths returns n requests as "host/path" keys, with most of them to
+// api.example.com.
+func hostPaths(n int, seed int64) []string {
+	rnd := rand.New(rand.NewSource(seed))
+	z := rand.NewZipf(rnd, 1.3, 1, 200)
+
+	keys := make([]string, n)
+	for i := range keys {
+		host := "api.example.com"
+		if rnd.Intn(3) == 0 {
+			host = fmt.Sprint("host", rnd.Intn(50), ".org")
+		}
+		keys[i] = fmt.Sprint(host, "/path", z.Uint64())
+	}
+
+	return keys
+}
+
+func TestExtractCandidates(t *testing.T) {
+	isAPI := func(key interface{}) bool {
+		return strings.HasPrefix(key.(string), "api.example.com/")
+	}
+
+	sk, _ := NewTopK(10, 100000, 0.01, WithTopKTracking(10))
+	before := hostPaths(50000, 1)
+	for _, key := range before {
+		sk.Insert(key, 1)
+	}
+
+	ex, err := sk.ExtractCandidates(isAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.b != sk.b || ex.l != sk.l || ex.top == nil {
+		t.Fatal("Expected a sketch with the dimensions and options of the original")
+	}
+
+	exactBefore := exactCount(before)
+	for _, hh := range ex.Result(1) {
+		if !isAPI(hh.Key) {
+			t.Errorf("Expected only api.example.com keys, found '%s'", hh.Key)
+		}
+		if want := exactBefore[hh.Key.(string)]; hh.Count > want {
+			t.Errorf("Expected seeded '%s' to be a lower bound of %d, found %d", hh.Key, want, hh.Count)
+		}
+	}
+
+	// Fresh targeted measurements go on top of the seed
+	after := hostPaths(50000, 2)
+	var fresh []string
+	for _, key := range after {
+		if isAPI(key) {
+			ex.Insert(key, 1)
+			fresh = append(fresh, key)
+		}
+	}
+
+	exactFresh := exactCount(fresh)
+	bound := uint64(ex.Epsilon() * float64(ex.Total()))
+	top := ex.TopK(10)
+	if len(top) != 10 {
+		t.Fatalf("Expected 10 heavy hitters, found %d", len(top))
+	}
+	for _, hh := range top {
+		key := hh.Key.(string)
+		lo, hi := exactFresh[key], exactFresh[key]+exactBefore[key]+bound
+		if hh.Count < lo || hh.Count > hi {
+			t.Errorf("Expected '%s' within [%d, %d], found %d", key, lo, hi, hh.Count)
+		}
+		if seed, _ := sk.Count(key); hh.Count < exactFresh[key]+seed/2 {
+			t.Errorf("Expected '%s' to keep most of its seed %d on top of %d, found %d", key, seed, exactFresh[key], hh.Count)
+		}
+	}
+
+	if _, err := sk.ExtractCandidates(nil); err == nil {
+		t.Error("Expected error for nil predicate")
+	}
+}
+
+func TestRemapKeys(t *testing.T) {
+	type series struct{ Tenant, Metric string }
+
+	sk, _ := NewTopK(10, 100000, 0.01)
+	for _, key := range zipfKeys(50000, 1000, 3) {
+		sk.Insert("acme:"+key, 1)
+	}
+	sk.Insert("dropped:key0", 100000)
+
+	remapped, err := sk.RemapKeys(func(old interface{}) (interface{}, bool) {
+		parts := strings.SplitN(old.(string), ":", 2)
+		return series{parts[0], parts[1]}, parts[0] != "dropped"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remapped.b != sk.b || remapped.l != sk.l {
+		t.Fatal("Expected a sketch with the dimensions of the original")
+	}
+
+	// The top keys survive in the same order, at their lower bounds
+	before := sk.TopK(11)[1:]
+	after := remapped.TopK(10)
+	for i, hh := range before {
+		want := series{"acme", strings.TrimPrefix(hh.Key.(string), "acme:")}
+		if after[i].Key != want {
+			t.Fatalf("Expected %v at rank %d, found %v", want, i, after[i].Key)
+		}
+		if after[i].Count > hh.Count {
+			t.Errorf("Expected %v to start at most at %d, found %d", want, hh.Count, after[i].Count)
+		}
+	}
+	if c, _ := remapped.Count(series{"dropped", "key0"}); c != 0 {
+		t.Errorf("Expected the dropped key not to be carried over, found %d", c)
+	}
+
+	// Keys mapped alike add up
+	merged, _ := sk.RemapKeys(func(old interface{}) (interface{}, bool) {
+		return "all", true
+	})
+	if top := merged.TopK(2); len(top) != 1 || top[0].Key != "all" || top[0].Count < 100000 {
+		t.Errorf("Expected every key to add up to all, found %v", top)
+	}
+
+	if _, err := sk.RemapKeys(nil); err == nil {
+		t.Error("Expected an error for a nil mapping")
+	}
+}
@@ -0,0 +1,273 @@
+package topkapi
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// HitterFilter is a snapshot of the top keys of a sketch, to count a second
+// stream by the keys that are heavy in the first: find the top k of stream
+// A, then only count the events of stream B whose key Contains reports.
+// It holds the hashes of the keys, not the keys, and never changes once
+// built, so it is safe for concurrent use and can be sent to the machines
+// reading stream B with MarshalBinary.
+//
+// Contains transforms keys like the sketch looks them up, with its case
+// folding, numeric keys and key length limit, and never reports a key the
+// sketch counts as one of the snapshot missing. A canonicalizer can't be
+// encoded, so the filter doesn't apply it: canonicalize keys before passing
+// them to Contains, as for InsertHashed. An exact filter
+// wrongly reports another key only if its 64-bit hash is that of a key of
+// the snapshot; a bloom filter, see HitterBloomFilter, does so at the rate
+// it was built with.
+type HitterFilter struct {
+	hashVersion HashVersion
+	form        keyForm
+	n           uint64 // keys in the snapshot
+
+	hashes map[uint64]struct{} // of the keys, for an exact filter
+	k      uint64              // bits set per key, 0 for an exact filter
+	bits   []uint64            // of a bloom filter
+}
+
+// HitterFilter returns an exact filter of the k heavy hitters TopK(k)
+// returns. It is empty if k < 1.
+func (sk *Sketch) HitterFilter(k int) *HitterFilter {
+	top := sk.hitterHashes(k)
+	f := &HitterFilter{hashVersion: sk.hashVersion, form: sk.keyForm(), hashes: make(map[uint64]struct{}, len(top))}
+	for _, hsum := range top {
+		f.hashes[hsum] = struct{}{}
+	}
+	f.n = uint64(len(f.hashes))
+	return f
+}
+
+// HitterBloomFilter is like HitterFilter, with a bloom filter wrongly
+// reporting other keys with the given probability, which takes a fraction
+// of the memory of an exact filter for large k: about 10 bits per key at a
+// rate of 0.01, against the 64 bits of a hash and the overhead of a map.
+func (sk *Sketch) HitterBloomFilter(k int, falsePositiveRate float64) (*HitterFilter, error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of falsePositiveRate should be in range of (0, 1)")
+	}
+
+	top := sk.hitterHashes(k)
+	n := uint64(len(top))
+	if n == 0 {
+		n = 1
+	}
+	m, bits := bloomSize(n, falsePositiveRate)
+	if m > 64*maxCounters {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of falsePositiveRate is out of range")
+	}
+
+	f := &HitterFilter{hashVersion: sk.hashVersion, form: sk.keyForm(), n: uint64(len(top)), k: uint64(bits), bits: make([]uint64, (uint64(m)+63)/64)}
+	size := uint64(len(f.bits)) * 64
+	for _, hsum := range top {
+		h1, h2 := bloomHashes(hsum)
+		for i := uint64(0); i < f.k; i++ {
+			bit := (h1 + i*h2) % size
+			f.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+
+	return f, nil
+}
+
+// hitterHashes returns the key hashes of TopK(k).
+func (sk *Sketch) hitterHashes(k int) []uint64 {
+	top := sk.TopK(k)
+	hashes := make([]uint64, len(top))
+	for i, hh := range top {
+		hashes[i] = sk.hashKey(hh.Key)
+	}
+	return hashes
+}
+
+// bloomHashes derives the two hashes a bloom filter probes with from the
+// hash of a key.
+func bloomHashes(hsum uint64) (h1, h2 uint64) {
+	return mix64(hsum), mix64(hsum^0x6a09e667f3bcc909) | 1
+}
+
+// Contains reports whether key is one of the keys of the snapshot, after
+// the key transforms of the sketch but its canonicalizer, see HitterFilter.
+// Keys the sketch can't count never are.
+func (f *HitterFilter) Contains(key interface{}) bool {
+	key, ok := f.form.apply(key)
+	if !ok {
+		return false
+	}
+	return f.ContainsHash(hashVersioned(key, f.hashVersion))
+}
+
+// keyForm holds the key transforms of a sketch that a HitterFilter applies
+// and encodes: all but the canonicalizer.
+type keyForm struct {
+	foldCase, numericKeys, integralFloats bool
+	maxKeyLen                             int
+	keyLenPolicy                          KeyLenPolicy
+}
+
+// Flags of a keyForm in the encoding of a HitterFilter.
+const (
+	formFoldCase = 1 << iota
+	formNumericKeys
+	formIntegralFloats
+	formRejectLongKeys
+)
+
+func (sk *Sketch) keyForm() keyForm {
+	return keyForm{sk.foldCase, sk.numericKeys, sk.integralFloats, sk.maxKeyLen, sk.keyLenPolicy}
+}
+
+// apply transforms key like the sketch of the form looks it up, see limit.
+func (k keyForm) apply(key interface{}) (interface{}, bool) {
+	if k == (keyForm{}) {
+		return key, supportedKey(key)
+	}
+	sk := Sketch{foldCase: k.foldCase, numericKeys: k.numericKeys, integralFloats: k.integralFloats, maxKeyLen: k.maxKeyLen, keyLenPolicy: k.keyLenPolicy}
+	return sk.limit(sk.canonical(key))
+}
+
+// word packs the form into the first word of the encoding, along with the
+// hash version: the version in the low byte, the flags in the next and the
+// key length limit in the high half.
+func (k keyForm) word(hash HashVersion) (uint64, error) {
+	if uint64(k.maxKeyLen) > math.MaxUint32 {
+		return 0, newError(ErrInvalidParameter, "topkapi: key length limit %d is too large to encode", k.maxKeyLen)
+	}
+	var flags uint64
+	if k.foldCase {
+		flags |= formFoldCase
+	}
+	if k.numericKeys {
+		flags |= formNumericKeys
+	}
+	if k.integralFloats {
+		flags |= formIntegralFloats
+	}
+	if k.keyLenPolicy == RejectLongKeys {
+		flags |= formRejectLongKeys
+	}
+	return uint64(hash) | flags<<8 | uint64(k.maxKeyLen)<<32, nil
+}
+
+// unpackForm reverses word, reporting false for words no form packs to.
+func unpackForm(w uint64) (HashVersion, keyForm, bool) {
+	hash, flags, n := w&0xff, w>>8&0xffffff, w>>32
+	k := keyForm{
+		foldCase:       flags&formFoldCase != 0,
+		numericKeys:    flags&formNumericKeys != 0,
+		integralFloats: flags&formIntegralFloats != 0,
+		maxKeyLen:      int(n),
+	}
+	if flags&formRejectLongKeys != 0 {
+		k.keyLenPolicy = RejectLongKeys
+	}
+	ok := hash <= uint64(HashV1) && flags < formRejectLongKeys<<1 &&
+		(!k.integralFloats || k.numericKeys) && (k.keyLenPolicy == TruncateLongKeys || n > 0)
+	return HashVersion(hash), k, ok
+}
+
+// ContainsHash is like Contains for the hash of a key, as returned by
+// HashKey of a sketch with the hash version of the filter.
+func (f *HitterFilter) ContainsHash(hsum uint64) bool {
+	if f.k == 0 {
+		_, ok := f.hashes[hsum]
+		return ok
+	}
+
+	h1, h2 := bloomHashes(hsum)
+	size := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of keys of the snapshot, fewer than k if the
+// sketch held fewer candidates.
+func (f *HitterFilter) Len() int {
+	return int(f.n)
+}
+
+// HashVersion returns the hash version keys are hashed with, that of the
+// sketch the filter was built from.
+func (f *HitterFilter) HashVersion() HashVersion {
+	return f.hashVersion
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The hashes of an exact
+// filter are written in order, so equal filters encode alike. It returns an
+// error wrapping ErrInvalidParameter for a key length limit above 4 GiB.
+func (f *HitterFilter) MarshalBinary() ([]byte, error) {
+	head, err := f.form.word(f.hashVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	words := f.bits
+	if f.k == 0 {
+		words = make([]uint64, 0, len(f.hashes))
+		for hsum := range f.hashes {
+			words = append(words, hsum)
+		}
+		sort.Slice(words, func(a, b int) bool { return words[a] < words[b] })
+	}
+
+	buf := make([]byte, 8*(4+len(words)))
+	binary.LittleEndian.PutUint64(buf[0:], head)
+	binary.LittleEndian.PutUint64(buf[8:], f.k)
+	binary.LittleEndian.PutUint64(buf[16:], f.n)
+	binary.LittleEndian.PutUint64(buf[24:], uint64(len(words)))
+	off := 32
+	for _, w := range words {
+		binary.LittleEndian.PutUint64(buf[off:], w)
+		off += 8
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (f *HitterFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 8*4 {
+		return newError(ErrCorruptData, "topkapi: hitter filter data too short")
+	}
+
+	var (
+		hash, form, known = unpackForm(binary.LittleEndian.Uint64(data[0:]))
+		k                 = binary.LittleEndian.Uint64(data[8:])
+		n                 = binary.LittleEndian.Uint64(data[16:])
+		words             = binary.LittleEndian.Uint64(data[24:])
+	)
+	data = data[32:]
+	if !known || words != uint64(len(data))/8 || uint64(len(data))%8 != 0 ||
+		k == 0 && words != n || k != 0 && (words == 0 || k > maxBloomHashes) {
+		return newError(ErrCorruptData, "topkapi: corrupt hitter filter data")
+	}
+
+	g := HitterFilter{hashVersion: hash, form: form, n: n, k: k}
+	if k == 0 {
+		g.hashes = make(map[uint64]struct{}, words)
+		for ; len(data) > 0; data = data[8:] {
+			g.hashes[binary.LittleEndian.Uint64(data)] = struct{}{}
+		}
+		if uint64(len(g.hashes)) != n {
+			return newError(ErrCorruptData, "topkapi: corrupt hitter filter data")
+		}
+	} else {
+		g.bits = make([]uint64, words)
+		for i := range g.bits {
+			g.bits[i] = binary.LittleEndian.Uint64(data[8*i:])
+		}
+	}
+	*f = g
+
+	return nil
+}
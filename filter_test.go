@@ -0,0 +1,192 @@
+package topkapi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHitterFilter(t *testing.T) {
+	sk, _ := New(0.001, 0.01)
+	first := zipfKeys(100000, 10000, 1)
+	for _, key := range first {
+		sk.Insert(key, 1)
+	}
+	top := sk.TopK(100)
+	f := sk.HitterFilter(100)
+	if f.Len() != len(top) {
+		t.Fatalf("Expected %d keys, found %d", len(top), f.Len())
+	}
+
+	inTop := make(map[interface{}]bool, len(top))
+	for _, hh := range top {
+		inTop[hh.Key] = true
+		if !f.Contains(hh.Key) || !f.ContainsHash(sk.HashKey(hh.Key)) {
+			t.Errorf("Expected '%v' of the top 100 to be contained", hh.Key)
+		}
+	}
+	for _, key := range zipfKeys(100000, 20000, 2) {
+		if f.Contains(key) != inTop[key] {
+			t.Errorf("Expected '%s' to be contained %v", key, inTop[key])
+		}
+	}
+
+	// The filter is a snapshot
+	sk.Insert("new", 1000000)
+	if f.Contains("new") {
+		t.Error("Expected a key inserted afterwards not to be contained")
+	}
+
+	if f.Contains([]byte("a")) || f.Contains(map[string]int{}) {
+		t.Error("Expected unsupported keys not to be contained")
+	}
+	if f := sk.HitterFilter(0); f.Len() != 0 || f.Contains("new") {
+		t.Error("Expected an empty filter for k < 1")
+	}
+}
+
+func TestHitterBloomFilter(t *testing.T) {
+	sk, _ := New(0.01, 0.0001)
+	for i := 0; i < 5000; i++ {
+		sk.Insert(fmt.Sprint("key", i), uint64(i%7+1))
+	}
+	top := sk.TopK(2000)
+	f, err := sk.HitterBloomFilter(2000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 2000 || len(top) != 2000 {
+		t.Fatalf("Expected 2000 keys, found %d of %d", f.Len(), len(top))
+	}
+	for _, hh := range top {
+		if !f.Contains(hh.Key) {
+			t.Fatalf("Expected '%v' of the top 2000 to be contained", hh.Key)
+		}
+	}
+
+	var positives int
+	const n = 100000
+	for i := 0; i < n; i++ {
+		if f.Contains(fmt.Sprint("other", i)) {
+			positives++
+		}
+	}
+	if rate := float64(positives) / n; rate > 0.015 {
+		t.Errorf("Expected a false positive rate of about 0.01, found %.4f", rate)
+	}
+	if exact, bloom := 8*len(top), 8*len(f.bits); bloom > exact/5 {
+		t.Errorf("Expected the bloom filter to be a fraction of %d bytes, found %d", exact, bloom)
+	}
+
+	for _, p := range []float64{0, 1, -1} {
+		if _, err := sk.HitterBloomFilter(10, p); !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("Expected a rate of %v to be invalid, found %v", p, err)
+		}
+	}
+}
+
+func TestHitterFilterMarshal(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithHashVersion(HashStructure))
+	for i := 0; i < 1000; i++ {
+		sk.Insert(i%50, uint64(i%50))
+	}
+	top := sk.TopK(20)
+	bloom, _ := sk.HitterBloomFilter(20, 0.001)
+
+	for _, f := range []*HitterFilter{sk.HitterFilter(20), bloom} {
+		data, err := f.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var g HitterFilter
+		if err := g.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if g.Len() != 20 || g.HashVersion() != HashStructure {
+			t.Errorf("Expected 20 keys hashed with hashstructure, found %d and %v", g.Len(), g.HashVersion())
+		}
+		for _, hh := range top {
+			if !g.Contains(hh.Key) {
+				t.Errorf("Expected '%v' to survive the round trip", hh.Key)
+			}
+		}
+		if again, _ := g.MarshalBinary(); string(again) != string(data) {
+			t.Error("Expected the filter to encode alike after the round trip")
+		}
+
+		for _, bad := range [][]byte{data[:len(data)-1], data[:len(data)-8], data[:31]} {
+			if err := g.UnmarshalBinary(bad); !errors.Is(err, ErrCorruptData) {
+				t.Errorf("Expected truncated data to be corrupt, found %v", err)
+			}
+		}
+	}
+}
+
+func TestHitterFilterKeyForms(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	bounded := func() (*Sketch, error) { return NewBounded(1 << 20) }
+	for name, c := range map[string]struct {
+		sketch func() (*Sketch, error)
+		insert interface{}
+		in     []interface{} // looked up like the inserted key
+		out    []interface{}
+	}{
+		"case folding": {
+			func() (*Sketch, error) { return New(0.01, 0.01, WithCaseInsensitiveKeys()) },
+			"GET /index", []interface{}{"GET /Index", "get /index"}, []interface{}{"GET /other"},
+		},
+		"numeric keys": {
+			func() (*Sketch, error) { return New(0.01, 0.01, WithNumericKeys(true)) },
+			7, []interface{}{int8(7), uint64(7), 7.0}, []interface{}{7.5, "7"},
+		},
+		"truncated keys": {bounded, long, []interface{}{long, long[:boundedKeyLen] + "y"}, []interface{}{long[:boundedKeyLen-1]}},
+		"rejected keys": {
+			func() (*Sketch, error) { return New(0.01, 0.01, WithMaxKeyLen(8, RejectLongKeys)) },
+			"short", []interface{}{"short"}, []interface{}{"longer than 8"},
+		},
+	} {
+		sk, err := c.sketch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sk.Insert(c.insert, 10)
+		bloom, _ := sk.HitterBloomFilter(10, 0.001)
+		for _, f := range []*HitterFilter{sk.HitterFilter(10), bloom} {
+			data, err := f.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var g HitterFilter
+			if err := g.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []*HitterFilter{f, &g} {
+				for _, key := range c.in {
+					if _, tracked := sk.Count(key); !tracked || !f.Contains(key) {
+						t.Errorf("%s: expected %v to be contained like it is tracked", name, key)
+					}
+				}
+				for _, key := range c.out {
+					if f.Contains(key) {
+						t.Errorf("%s: expected %v not to be contained", name, key)
+					}
+				}
+			}
+		}
+	}
+
+	// The canonicalizer is up to the caller
+	sk, _ := New(0.01, 0.01, WithCanonicalizer(func(key interface{}) interface{} { return fmt.Sprint(key) }))
+	sk.Insert(5, 1)
+	if f := sk.HitterFilter(1); f.Contains(5) || !f.Contains("5") {
+		t.Error("Expected the filter to look up canonical keys only")
+	}
+
+	var g HitterFilter
+	data, _ := sk.HitterFilter(1).MarshalBinary()
+	data[1] = 0xff
+	if err := g.UnmarshalBinary(data); !errors.Is(err, ErrCorruptData) {
+		t.Errorf("Expected unknown key transforms to be corrupt, found %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+//go:build go1.18
+// +build go1.18
+
+package topkapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// fuzzInsert is an insert decoded from fuzzer input by fuzzStream.
+type fuzzInsert struct {
+	key   string
+	count uint64
+	side  bool
+}
+
+// fuzzSketch builds an empty sketch of few buckets from the first byte of
+// data, so that keys collide, and returns the rest of data.
+func fuzzSketch(data []byte) (*Sketch, []byte, error) {
+	var cfg byte
+	if len(data) > 0 {
+		cfg, data = data[0], data[1:]
+	}
+	p := Params{B: 1 + uint64(cfg>>4), L: 1 + uint64(cfg>>2&3)}
+	opts := []Option{WithSeed(uint64(cfg & 1))}
+	if cfg&2 != 0 {
+		opts = append(opts, WithExtraCounterRows(1), WithLayout(ColumnMajor))
+	}
+	sk, err := NewFromParams(p, opts...)
+	return sk, data, err
+}
+
+// fuzzStream decodes data into inserts: a byte whose low bits are the length
+// of the key and whose high bit is its side, the key, and the count as a
+// uvarint.
+func fuzzStream(data []byte) []fuzzInsert {
+	var stream []fuzzInsert
+	for len(data) > 0 {
+		n := int(data[0] & 7)
+		if len(data) < 1+n {
+			break
+		}
+		in := fuzzInsert{key: string(data[1 : 1+n]), side: data[0]&0x80 != 0}
+		data = data[1+n:]
+		var size int
+		if in.count, size = binary.Uvarint(data); size <= 0 {
+			break
+		}
+		data = data[size:]
+		stream = append(stream, in)
+	}
+	return stream
+}
+
+// checkTotal returns an error unless every row of counters adds up to the
+// total of sk, both saturating.
+func checkTotal(sk *Sketch, total uint64) error {
+	if sk.Total() != total {
+		return fmt.Errorf("total %d, should be %d", sk.Total(), total)
+	}
+	for i := 0; i < sk.cms.rows; i++ {
+		var sum uint64
+		for _, c := range sk.cms.row(i) {
+			sum = saturatingAdd(sum, c)
+		}
+		if sum != total {
+			return fmt.Errorf("row %d: counters add up to %d, should be %d", i, sum, total)
+		}
+	}
+	return nil
+}
+
+// The seed corpora of the fuzz targets are in testdata/fuzz.
+
+func FuzzInsert(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sk, data, err := fuzzSketch(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total uint64
+		exact := make(map[string]uint64)
+		for _, in := range fuzzStream(data) {
+			sk.Insert(in.key, in.count)
+			total = saturatingAdd(total, in.count)
+			exact[in.key] = saturatingAdd(exact[in.key], in.count)
+		}
+
+		if err := sk.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkTotal(sk, total); err != nil {
+			t.Fatal(err)
+		}
+		// Count-min estimates never fall short of the exact counts
+		for key, c := range exact {
+			if est, _ := sk.Count(key); est < c || est > total {
+				t.Fatalf("Expected the count of %q in [%d, %d], found %d", key, c, total, est)
+			}
+		}
+		for _, hh := range sk.Result(0) {
+			if hh.Count < exact[hh.Key.(string)] {
+				t.Fatalf("Expected the count of %q at least %d, found %d", hh.Key, exact[hh.Key.(string)], hh.Count)
+			}
+		}
+	})
+}
+
+func FuzzMerge(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		a, data, err := fuzzSketch(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := a.Clone()
+		var total uint64
+		for _, in := range fuzzStream(data) {
+			if in.side {
+				b.Insert(in.key, in.count)
+			} else {
+				a.Insert(in.key, in.count)
+			}
+			total = saturatingAdd(total, in.count)
+		}
+
+		ab, ba := a.Clone(), b.Clone()
+		if err := ab.Merge(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := ba.Merge(a); err != nil {
+			t.Fatal(err)
+		}
+		for _, sk := range []*Sketch{ab, ba} {
+			if err := sk.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if err := checkTotal(sk, total); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Counters add up alike either way, and candidates merge alike up to
+		// the statistics of the merge
+		if !reflect.DeepEqual(ab.cms, ba.cms) || !reflect.DeepEqual(ab.counts, ba.counts) || !reflect.DeepEqual(ab.objects, ba.objects) {
+			t.Fatal("Expected merging to be commutative")
+		}
+		if ra, rb := ab.Result(0), ba.Result(0); !reflect.DeepEqual(ra, rb) {
+			t.Fatalf("Expected equal results either way, found %v and %v", ra, rb)
+		}
+	})
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	// Along with the sketches of every format version
+	for v := 1; v <= formatVersion; v++ {
+		data, err := ioutil.ReadFile(fmt.Sprintf("testdata/sketch-v%d.bin", v))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Mutations rarely keep the checksum, so decode the data checksummed
+		// anew as well
+		fixed := data
+		if len(data) >= 5 {
+			fixed, _ = resum(append([]byte(nil), data...))
+		}
+
+		for _, data := range [][]byte{data, fixed} {
+			var sk Sketch
+			if err := sk.UnmarshalBinary(data); err != nil {
+				if !errors.Is(err, ErrCorruptData) && !errors.Is(err, ErrUnsupportedVersion) {
+					t.Fatalf("Expected corrupt data or an unsupported version, found %v", err)
+				}
+				continue
+			}
+
+			if err := sk.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			enc, err := sk.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dec Sketch
+			if err := dec.UnmarshalBinary(enc); err != nil {
+				t.Fatalf("Expected a decoded sketch to decode again, found %v", err)
+			}
+			if again, _ := dec.MarshalBinary(); string(again) != string(enc) {
+				t.Fatal("Expected a decoded sketch to encode alike again")
+			}
+			sk.Result(0)
+			sk.Stats()
+			if err := sk.Merge(&dec); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package topkapi
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/mitchellh/hashstructure"
+
+	"github.com/wardbekker/topkapi/internal/keyhash"
+)
+
+// HashVersion identifies the algorithm keys are hashed with. It decides
+// which bucket every key goes to, so only sketches hashing alike can be
+// merged. It is part of the binary encoding.
+type HashVersion int
+
+const (
+	// HashStructure hashes every key with hashstructure v1. It is the
+	// algorithm of sketches encoded before hash versions were recorded, and
+	// its output may change with other major versions of hashstructure.
+	HashStructure HashVersion = iota
+
+	// HashV1 hashes strings, byte slices, booleans and numbers with an
+	// algorithm of its own, see internal/keyhash, which is much faster and
+	// never changes. Other keys, like structs, are hashed with hashstructure.
+	HashV1
+
+	// DefaultHashVersion is the algorithm of new sketches.
+	DefaultHashVersion = HashV1
+)
+
+// WithHashVersion hashes keys with the given algorithm instead of
+// DefaultHashVersion, as needed to merge with sketches of older versions
+// of this package.
+func WithHashVersion(v HashVersion) Option {
+	return func(sk *Sketch) error {
+		if v != HashStructure && v != HashV1 {
+			return newError(ErrInvalidParameter, "topkapi: unknown hash version")
+		}
+		sk.hashVersion = v
+		return nil
+	}
+}
+
+// hashKey returns the 64-bit hash of a key the bucket indices are derived from.
+func (sk *Sketch) hashKey(key interface{}) uint64 {
+	return hashVersioned(key, sk.hashVersion)
+}
+
+func hashVersioned(key interface{}, v HashVersion) uint64 {
+	if v == HashV1 {
+		if hsum, ok := keyhash.Hash(key); ok {
+			return hsum
+		}
+	}
+
+	// Keys are checked by supportedKey, which leaves hashstructure nothing
+	// to fail on
+	hsum, _ := hashstructure.Hash(key, nil)
+	return hsum
+}
+
+// supportedKey reports whether key can be counted: compared with other keys
+// and used as a map key without a panic, and hashed. Slices, maps,
+// functions, channels and unsafe pointers can't be, nor can arrays, structs
+// and interfaces holding them. Pointers are, by the value they point to.
+func supportedKey(key interface{}) bool {
+	switch key.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return true
+	}
+
+	t := reflect.TypeOf(key)
+	support, ok := keyTypes.Load(t)
+	if !ok {
+		support, _ = keyTypes.LoadOrStore(t, typeSupport(t))
+	}
+	switch support.(keySupport) {
+	case unsupportedType:
+		return false
+	case valuesVary:
+		return supportedValue(reflect.ValueOf(key))
+	}
+	return true
+}
+
+// keySupport tells whether keys of a type can be counted, see supportedKey.
+type keySupport int
+
+const (
+	supportedType keySupport = iota
+	unsupportedType
+	valuesVary // the type holds interfaces, whose values decide
+)
+
+// keyTypes caches the keySupport of every key type seen.
+var keyTypes sync.Map
+
+func typeSupport(t reflect.Type) keySupport {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return unsupportedType
+	case reflect.Interface:
+		return valuesVary
+	case reflect.Array:
+		return typeSupport(t.Elem())
+	case reflect.Struct:
+		support := supportedType
+		for i := 0; i < t.NumField(); i++ {
+			switch typeSupport(t.Field(i).Type) {
+			case unsupportedType:
+				return unsupportedType
+			case valuesVary:
+				support = valuesVary
+			}
+		}
+		return support
+	}
+	return supportedType
+}
+
+func supportedValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return false
+	case reflect.Interface:
+		return v.IsNil() || supportedValue(v.Elem())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !supportedValue(v.Index(i)) {
+				return false
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !supportedValue(v.Field(i)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// keyError returns the error of TryInsert for key, nil if it is supported.
+func keyError(key interface{}) error {
+	if supportedKey(key) {
+		return nil
+	}
+	return fmt.Errorf("%w: %T", ErrUnsupportedKeyType, key)
+}
+
+// HashKey returns the hash InsertHashed expects for key. It is the same for
+// every sketch with the same hash version, so it can be computed once
+// wherever the key is produced.
+func (sk *Sketch) HashKey(key interface{}) uint64 {
+	return sk.hashKey(key)
+}
+
+// HashKey returns the hash InsertHashed expects for key in sketches of the
+// DefaultHashVersion, see Sketch.HashKey.
+func HashKey(key interface{}) uint64 {
+	return hashVersioned(key, DefaultHashVersion)
+}
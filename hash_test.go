@@ -0,0 +1,60 @@
+package topkapi
+
+import "testing"
+
+// TestHashVersions pins the hash of every version, so that a refactoring
+// can't silently move keys to other buckets and break merging with sketches
+// that are already encoded.
+func TestHashVersions(t *testing.T) {
+	for _, test := range []struct {
+		key       interface{}
+		structure uint64
+		v1        uint64
+	}{
+		{"", 0xcbf29ce484222325, 0xe9e0033e3badaf36},
+		{"a", 0xaf63bd4c8601b7be, 0xadad675e28e312b4},
+		{"topkapi", 0xfef41270577ef587, 0x7fbcd89cdc8df95d},
+		{"heavy hitter", 0x2586979c2851fae6, 0xd9a33dace08f6ba4},
+		{int(5), 0xce2b8e7e8ef71b7e, 0xc3c5b825ea11bd60},
+		{int64(5), 0xce2b8e7e8ef71b7e, 0xc3c5b825ea11bd60},
+		{uint8(5), 0xaf63bd4c8601b7da, 0xc3c5b825ea11bd60},
+		{int(-1), 0xd65de7467f38b96d, 0x52d02b55d4a68c52},
+		{true, 0xaf63bd4c8601b7de, 0xea9452213ba060b5},
+		{1.5, 0xa8c7b0322819bf52, 0x4256ca081bc9ebbc},
+		// Structs fall back to hashstructure
+		{struct{ A int }{1}, 0xd8fe6e939517cbfe, 0xd8fe6e939517cbfe},
+	} {
+		if h := hashVersioned(test.key, HashStructure); h != test.structure {
+			t.Errorf("Expected %T(%v) to hash to %#x with hashstructure, found %#x", test.key, test.key, test.structure, h)
+		}
+		if h := hashVersioned(test.key, HashV1); h != test.v1 {
+			t.Errorf("Expected %T(%v) to hash to %#x with v1, found %#x", test.key, test.key, test.v1, h)
+		}
+	}
+
+	if HashKey("a") != 0xadad675e28e312b4 {
+		t.Error("Expected HashKey to use the default hash version")
+	}
+	legacy, _ := New(0.01, 0.01, WithHashVersion(HashStructure))
+	if legacy.HashKey("a") != 0xaf63bd4c8601b7be {
+		t.Error("Expected Sketch.HashKey to use the hash version of the sketch")
+	}
+}
+
+func TestWithHashVersion(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	legacy, _ := New(0.01, 0.01, WithHashVersion(HashStructure))
+	for _, s := range []*Sketch{sk, legacy} {
+		s.Insert("a", 2)
+		if c, ok := s.Count("a"); c != 2 || !ok {
+			t.Errorf("Expected a=2, found %d (%v)", c, ok)
+		}
+	}
+
+	if err := sk.Merge(legacy); err != ErrIncompatibleSketches {
+		t.Errorf("Expected error merging sketches of different hash versions, found %v", err)
+	}
+	if _, err := New(0.01, 0.01, WithHashVersion(HashV1+1)); err == nil {
+		t.Error("Expected error for an unknown hash version")
+	}
+}
@@ -0,0 +1,109 @@
+package topkapi
+
+import "sort"
+
+// HybridSketch counts the first n distinct keys it sees exactly, in a map,
+// and overflows all later keys into a Sketch. Exact keys never reach the
+// sketch, so they don't inflate the estimates of the others either.
+//
+// The cap is on distinct keys, not on counts: once n keys are held, they are
+// held for good and every new key goes to the sketch, however heavy it turns
+// out to be. That works best when the hot set is small and stable, and is
+// seen early, like the endpoints of a service.
+type HybridSketch struct {
+	n     int
+	exact map[interface{}]uint64
+	sk    *Sketch
+}
+
+// NewHybrid creates a HybridSketch counting up to n distinct keys exactly
+// and the rest in sk. The canonicalizer and key length limit of sk apply to
+// the exact keys too.
+func NewHybrid(n int, sk *Sketch) (*HybridSketch, error) {
+	if n < 0 {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of n should be >= 0")
+	}
+	if sk == nil {
+		return nil, nilSketch
+	}
+
+	return &HybridSketch{
+		n:     n,
+		exact: make(map[interface{}]uint64, n),
+		sk:    sk,
+	}, nil
+}
+
+// Insert ...
+func (h *HybridSketch) Insert(key interface{}, count uint64) {
+	if count == 0 {
+		return
+	}
+
+	ck, ok := h.sk.limit(h.sk.canonical(key))
+	if ok {
+		if _, exact := h.exact[ck]; exact || len(h.exact) < h.n {
+			h.exact[ck] += count
+			return
+		}
+	}
+
+	h.sk.Insert(key, count)
+}
+
+// Count returns the count of key, and whether it is exact. Keys counted by
+// the sketch report its estimate, see Sketch.Count.
+func (h *HybridSketch) Count(key interface{}) (uint64, bool) {
+	if ck, ok := h.sk.limit(h.sk.canonical(key)); ok {
+		if count, exact := h.exact[ck]; exact {
+			return count, true
+		}
+	}
+
+	count, _ := h.sk.Count(key)
+	return count, false
+}
+
+// Result returns the exact keys and the candidates of the sketch with a
+// count of at least threshold, ordered by descending count. Exact keys
+// report 0 Rows, as no row holds them.
+func (h *HybridSketch) Result(threshold uint64) []LocalHeavyHitter {
+	return h.withExact(h.sk.Result(threshold), threshold, -1)
+}
+
+// TopK returns the k keys with the highest counts, exact or estimated,
+// ordered by descending count.
+func (h *HybridSketch) TopK(k int) []LocalHeavyHitter {
+	return h.withExact(h.sk.TopK(k), 1, k)
+}
+
+// withExact adds the exact keys with a count of at least threshold to res,
+// sorts it and keeps the first k entries, or all if k < 0.
+func (h *HybridSketch) withExact(res []LocalHeavyHitter, threshold uint64, k int) []LocalHeavyHitter {
+	for key, count := range h.exact {
+		if count >= threshold {
+			res = append(res, LocalHeavyHitter{Key: key, Count: count})
+		}
+	}
+
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Count > res[b].Count
+	})
+	if k >= 0 && k < len(res) {
+		res = res[:k]
+	}
+
+	return res
+}
+
+// Sketch returns the sketch holding the keys beyond the first n.
+func (h *HybridSketch) Sketch() *Sketch {
+	return h.sk
+}
+
+// Reset clears the exact counts and the sketch. The next n distinct keys
+// inserted are counted exactly.
+func (h *HybridSketch) Reset() {
+	h.exact = make(map[interface{}]uint64, h.n)
+	h.sk.Reset()
+}
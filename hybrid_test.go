@@ -0,0 +1,69 @@
+package topkapi
+
+import (
+	"testing"
+)
+
+func TestHybridSketch(t *testing.T) {
+	words := loadWords()
+	for _, p := range []int{2, 3, 5, 7, 11, 13, 17, 23} {
+		for i := p; i < len(words); i += p {
+			words[i] = words[p]
+		}
+	}
+
+	sk, _ := NewTopK(10, uint64(len(words)), 0.01)
+	h, err := NewHybrid(100, sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range words {
+		h.Insert(w, 1)
+	}
+
+	exact := exactCount(words)
+	var exactKeys int
+	for _, w := range words[:1000] {
+		if c, ok := h.Count(w); ok {
+			exactKeys++
+			if c != exact[w] {
+				t.Errorf("Expected exact count %d for '%s', found %d", exact[w], w, c)
+			}
+		}
+	}
+	if len(h.exact) != 100 || exactKeys == 0 {
+		t.Errorf("Expected 100 exact keys, found %d", len(h.exact))
+	}
+
+	// The heavy hitters are in the first words, and all exact
+	for _, hh := range h.TopK(5) {
+		if hh.Count != exact[hh.Key.(string)] {
+			t.Errorf("Expected exact count %d for '%s', found %d", exact[hh.Key.(string)], hh.Key, hh.Count)
+		}
+	}
+
+	res := h.Result(1)
+	for i := 1; i < len(res); i++ {
+		if res[i].Count > res[i-1].Count {
+			t.Fatal("Expected Result ordered by descending count")
+		}
+	}
+	if len(res) <= 100 {
+		t.Errorf("Expected candidates of the sketch besides the exact keys, found %d", len(res))
+	}
+
+	h.Reset()
+	if res := h.Result(1); len(res) != 0 {
+		t.Errorf("Expected no results after Reset, found %d", len(res))
+	}
+}
+
+func TestNewHybridInvalid(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	if _, err := NewHybrid(-1, sk); err == nil {
+		t.Error("Expected error for negative n")
+	}
+	if _, err := NewHybrid(10, nil); err == nil {
+		t.Error("Expected error for nil sketch")
+	}
+}
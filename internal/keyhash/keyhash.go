@@ -0,0 +1,115 @@
+// Package keyhash hashes the common key types of a sketch, strings, byte
+// slices, booleans and numbers, without reflection.
+//
+// The algorithm decides which bucket every key goes to, so sketches hashed
+// differently can't be merged. It must never change: a different algorithm
+// is a new version, chosen with topkapi.WithHashVersion.
+package keyhash
+
+import "math"
+
+// Seeds separating the hashes of different kinds of keys
+const (
+	seedString uint64 = 0x243f6a8885a308d3
+	seedInt    uint64 = 0x13198a2e03707344
+	seedBool   uint64 = 0xa4093822299f31d0
+	seedFloat  uint64 = 0x082efa98ec4e6c89
+)
+
+// Hash returns the hash of key, and false if key is not of a supported type.
+// Integers of every type hash by value, so int(5) and uint8(5) hash alike,
+// as do a string and a byte slice with the same bytes.
+func Hash(key interface{}) (uint64, bool) {
+	switch k := key.(type) {
+	case string:
+		return String(k), true
+	case []byte:
+		return Bytes(k), true
+	case bool:
+		if k {
+			return mix(seedBool ^ 1), true
+		}
+		return mix(seedBool), true
+	case int:
+		return Int(int64(k)), true
+	case int8:
+		return Int(int64(k)), true
+	case int16:
+		return Int(int64(k)), true
+	case int32:
+		return Int(int64(k)), true
+	case int64:
+		return Int(k), true
+	case uint:
+		return Uint(uint64(k)), true
+	case uint8:
+		return Uint(uint64(k)), true
+	case uint16:
+		return Uint(uint64(k)), true
+	case uint32:
+		return Uint(uint64(k)), true
+	case uint64:
+		return Uint(k), true
+	case float32:
+		return Float(float64(k)), true
+	case float64:
+		return Float(k), true
+	}
+
+	return 0, false
+}
+
+// String hashes s 8 bytes at a time.
+func String(s string) uint64 {
+	h := seedString ^ uint64(len(s))
+	for ; len(s) >= 8; s = s[8:] {
+		h = mix(h ^ (uint64(s[0]) | uint64(s[1])<<8 | uint64(s[2])<<16 | uint64(s[3])<<24 |
+			uint64(s[4])<<32 | uint64(s[5])<<40 | uint64(s[6])<<48 | uint64(s[7])<<56))
+	}
+
+	var tail uint64
+	for i := 0; i < len(s); i++ {
+		tail |= uint64(s[i]) << (8 * i)
+	}
+	return mix(h ^ tail)
+}
+
+// Bytes hashes b like String.
+func Bytes(b []byte) uint64 {
+	h := seedString ^ uint64(len(b))
+	for ; len(b) >= 8; b = b[8:] {
+		h = mix(h ^ (uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
+			uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56))
+	}
+
+	var tail uint64
+	for i := 0; i < len(b); i++ {
+		tail |= uint64(b[i]) << (8 * i)
+	}
+	return mix(h ^ tail)
+}
+
+// Int hashes a signed integer like Uint hashes its two's complement.
+func Int(v int64) uint64 {
+	return mix(seedInt ^ uint64(v))
+}
+
+// Uint hashes an unsigned integer.
+func Uint(v uint64) uint64 {
+	return mix(seedInt ^ v)
+}
+
+// Float hashes a floating point number by its bits, so 0 and -0 differ.
+func Float(f float64) uint64 {
+	return mix(seedFloat ^ math.Float64bits(f))
+}
+
+// mix is the splitmix64 finalizer.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,50 @@
+package keyhash
+
+import "testing"
+
+func TestHash(t *testing.T) {
+	for _, test := range []struct {
+		key  interface{}
+		hash uint64
+	}{
+		{"topkapi", 0x7fbcd89cdc8df95d},
+		{[]byte("topkapi"), 0x7fbcd89cdc8df95d},
+		{"heavy hitter", 0xd9a33dace08f6ba4},
+		{[]byte("heavy hitter"), 0xd9a33dace08f6ba4},
+		{int8(5), 0xc3c5b825ea11bd60},
+		{uint64(5), 0xc3c5b825ea11bd60},
+		{int64(-1), 0x52d02b55d4a68c52},
+		{false, 0x8aad5d95d1c4ac92},
+		{float32(1.5), 0x4256ca081bc9ebbc},
+	} {
+		h, ok := Hash(test.key)
+		if !ok || h != test.hash {
+			t.Errorf("Expected %T(%v) to hash to %#x, found %#x (%v)", test.key, test.key, test.hash, h, ok)
+		}
+	}
+
+	if _, ok := Hash(struct{}{}); ok {
+		t.Error("Expected structs not to be supported")
+	}
+}
+
+func TestStringLengths(t *testing.T) {
+	// Every length has its own tail handling, and a trailing zero byte
+	// still counts
+	seen := make(map[uint64]int)
+	s := ""
+	for n := 0; n <= 32; n++ {
+		if prev, ok := seen[String(s)]; ok {
+			t.Errorf("Expected lengths %d and %d to hash differently", prev, n)
+		}
+		seen[String(s)] = n
+		s += "\x00"
+	}
+}
+
+func BenchmarkString(b *testing.B) {
+	s := "/api/v1/users/1234567/profile?expand=settings"
+	for i := 0; i < b.N; i++ {
+		String(s)
+	}
+}
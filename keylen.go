@@ -0,0 +1,71 @@
+package topkapi
+
+import "unicode/utf8"
+
+// KeyLenPolicy decides what happens to string keys longer than the limit
+// set by WithMaxKeyLen.
+type KeyLenPolicy int
+
+const (
+	// TruncateLongKeys counts a long key as its first bytes, cut back to
+	// the last complete UTF-8 sequence within the limit. Long keys sharing
+	// a prefix are counted as one.
+	TruncateLongKeys KeyLenPolicy = iota
+
+	// RejectLongKeys drops long keys. Insert ignores them and Count
+	// reports (0, false); the number of rejected inserts is in Stats.
+	RejectLongKeys
+)
+
+// WithMaxKeyLen limits string keys to n bytes, so that untrusted input can't
+// make the sketch hold on to arbitrarily large keys. The limit is applied to
+// keys after the canonicalizer, by Insert, InsertHashed and Count. Keys of
+// other types are not affected.
+func WithMaxKeyLen(n int, policy KeyLenPolicy) Option {
+	return func(sk *Sketch) error {
+		if n < 1 {
+			return newError(ErrInvalidParameter, "topkapi: value of n should be >= 1")
+		}
+		if policy != TruncateLongKeys && policy != RejectLongKeys {
+			return newError(ErrInvalidParameter, "topkapi: unknown key length policy")
+		}
+		sk.maxKeyLen = n
+		sk.keyLenPolicy = policy
+		return nil
+	}
+}
+
+// limit applies the key length limit to key. It returns the key to use, and
+// false if key is rejected, for its length or for being of a type that can't
+// be counted, see supportedKey.
+func (sk *Sketch) limit(key interface{}) (interface{}, bool) {
+	s, ok := key.(string)
+	if !ok {
+		return key, supportedKey(key)
+	}
+	if sk.maxKeyLen == 0 || len(s) <= sk.maxKeyLen {
+		return key, true
+	}
+	if s, ok = sk.limitString(s); !ok {
+		return nil, false
+	}
+	return s, true
+}
+
+// limitString is limit for a string key.
+func (sk *Sketch) limitString(s string) (string, bool) {
+	if sk.maxKeyLen == 0 || len(s) <= sk.maxKeyLen {
+		return s, true
+	}
+	if sk.keyLenPolicy == RejectLongKeys {
+		return "", false
+	}
+
+	n := sk.maxKeyLen
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	// Copy, so the sketch doesn't keep the whole key alive
+	return string([]byte(s[:n])), true
+}
@@ -0,0 +1,71 @@
+package topkapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaxKeyLenTruncate(t *testing.T) {
+	sk, err := New(0.01, 0.01, WithMaxKeyLen(8, TruncateLongKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	huge := strings.Repeat("a", 1<<20)
+	sk.Insert(huge, 1)
+	sk.Insert("aaaaaaaab", 1)
+	sk.Insert("short", 1)
+	sk.InsertHashed(huge, HashKey(huge), 1)
+	// A multi-byte rune straddling the limit is dropped entirely
+	sk.Insert("aaaaaaa€", 1)
+
+	res := sk.Result(1)
+	want := map[interface{}]uint64{"aaaaaaaa": 3, "short": 1, "aaaaaaa": 1}
+	if len(res) != len(want) {
+		t.Fatalf("Expected %v, found %v", want, res)
+	}
+	for _, hh := range res {
+		if want[hh.Key] != hh.Count {
+			t.Errorf("Expected %q=%d, found %d", hh.Key, want[hh.Key], hh.Count)
+		}
+	}
+	if c, ok := sk.Count(huge); c != 3 || !ok {
+		t.Errorf("Expected Count to truncate like Insert, found (%d, %v)", c, ok)
+	}
+	if st := sk.Stats(); st.Rejected != 0 {
+		t.Errorf("Expected nothing rejected, found %d", st.Rejected)
+	}
+}
+
+func TestMaxKeyLenReject(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithMaxKeyLen(8, RejectLongKeys))
+
+	huge := strings.Repeat("a", 1<<20)
+	sk.Insert(huge, 1)
+	sk.InsertHashed(huge, HashKey(huge), 1)
+	sk.Insert("aaaaaaaa", 1)
+	sk.Insert(42, 1)
+
+	if res := sk.Result(1); len(res) != 2 {
+		t.Errorf("Expected only the short keys, found %v", res)
+	}
+	if c, ok := sk.Count(huge); c != 0 || ok {
+		t.Errorf("Expected Count of a long key to be (0, false), found (%d, %v)", c, ok)
+	}
+	if st := sk.Stats(); st.Rejected != 2 || st.Total != 2 {
+		t.Errorf("Expected 2 rejected and 2 counted, found %+v", st)
+	}
+	sk.Reset()
+	if st := sk.Stats(); st.Rejected != 0 {
+		t.Errorf("Expected Reset to clear rejected, found %d", st.Rejected)
+	}
+}
+
+func TestMaxKeyLenInvalid(t *testing.T) {
+	if _, err := New(0.01, 0.01, WithMaxKeyLen(0, TruncateLongKeys)); err == nil {
+		t.Error("Expected error for zero limit")
+	}
+	if _, err := New(0.01, 0.01, WithMaxKeyLen(8, KeyLenPolicy(7))); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
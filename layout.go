@@ -0,0 +1,171 @@
+package topkapi
+
+// Layout is the order the count-min counters of a sketch are kept in
+// memory, see WithLayout. It changes nothing but the speed of a sketch:
+// results, encodings and state hashes are the same in either layout, and
+// sketches of different layouts merge.
+type Layout int
+
+const (
+	// RowMajor keeps the b counters of each row next to each other. Scans
+	// of whole rows, like those of Result, Merge and MarshalBinary, read
+	// memory in order. It is the default.
+	RowMajor Layout = iota
+
+	// ColumnMajor keeps the counters of a bucket in all rows next to each
+	// other, so that operations on one bucket across the rows, like Grow
+	// of a sketch with consistent buckets, touch fewer cache lines. Insert
+	// touches a bucket of its own in every row either way.
+	ColumnMajor
+)
+
+func (layout Layout) String() string {
+	switch layout {
+	case RowMajor:
+		return "row-major"
+	case ColumnMajor:
+		return "column-major"
+	}
+	return "unknown"
+}
+
+// WithLayout keeps the counters of the sketch in the given layout. Which
+// one is faster depends on the workload and the machine, as measured by
+// BenchmarkLayout for inserts, queries, results and merges; on sketches of
+// common sizes the layouts are about even, within the noise of a run.
+// Candidates are kept by row in either layout.
+func WithLayout(layout Layout) Option {
+	return func(sk *Sketch) error {
+		if layout != RowMajor && layout != ColumnMajor {
+			return newError(ErrInvalidParameter, "topkapi: unknown layout %d", int(layout))
+		}
+		sk.cms = sk.cms.relayout(layout)
+		return nil
+	}
+}
+
+// Layout returns the layout of the counters of the sketch, see WithLayout.
+func (sk *Sketch) Layout() Layout {
+	return sk.cms.layout
+}
+
+// counterMatrix holds the counter rows of a sketch in one slice, counter j
+// of row i at i*rs+j*cs. A view of the first rows of a matrix keeps its
+// strides, see head.
+type counterMatrix struct {
+	data   []uint64
+	rows   int
+	b      uint64
+	rs, cs uint64 // strides of rows and buckets
+	layout Layout
+}
+
+// newCounterMatrix returns a matrix of rows zero counter rows of b buckets.
+func newCounterMatrix(rows int, b uint64, layout Layout) counterMatrix {
+	data := make([]uint64, uint64(rows)*b)
+	if layout == ColumnMajor {
+		return counterMatrix{data: data, rows: rows, b: b, rs: 1, cs: uint64(rows), layout: ColumnMajor}
+	}
+	return rowMajorMatrix(data, rows, b)
+}
+
+// rowMajorMatrix returns a matrix of the counter rows in data, one after
+// the other, like they are encoded.
+func rowMajorMatrix(data []uint64, rows int, b uint64) counterMatrix {
+	return counterMatrix{data: data, rows: rows, b: b, rs: b, cs: 1, layout: RowMajor}
+}
+
+// get returns counter j of row i.
+func (m counterMatrix) get(i int, j uint64) uint64 {
+	return m.data[uint64(i)*m.rs+j*m.cs]
+}
+
+// set sets counter j of row i to c.
+func (m counterMatrix) set(i int, j uint64, c uint64) {
+	m.data[uint64(i)*m.rs+j*m.cs] = c
+}
+
+// copyRow copies row i into dst, which must hold b counters.
+func (m counterMatrix) copyRow(dst []uint64, i int) {
+	if m.cs == 1 {
+		copy(dst, m.data[uint64(i)*m.rs:])
+		return
+	}
+	for j, off := 0, uint64(i)*m.rs; j < len(dst); j, off = j+1, off+m.cs {
+		dst[j] = m.data[off]
+	}
+}
+
+// row returns a copy of row i.
+func (m counterMatrix) row(i int) []uint64 {
+	row := make([]uint64, m.b)
+	m.copyRow(row, i)
+	return row
+}
+
+// setRow copies src into row i.
+func (m counterMatrix) setRow(i int, src []uint64) {
+	if m.cs == 1 {
+		copy(m.data[uint64(i)*m.rs:uint64(i)*m.rs+uint64(len(src))], src)
+		return
+	}
+	for j, off := 0, uint64(i)*m.rs; j < len(src); j, off = j+1, off+m.cs {
+		m.data[off] = src[j]
+	}
+}
+
+// relayout returns a copy of m in the given layout, or m if it is in it
+// already.
+func (m counterMatrix) relayout(layout Layout) counterMatrix {
+	if m.layout == layout {
+		return m
+	}
+	return m.resized(m.rows, m.b, layout)
+}
+
+// resized returns a copy of m with the given rows, buckets and layout. Rows
+// and buckets m lacks are zero, and those it has beyond are dropped.
+func (m counterMatrix) resized(rows int, b uint64, layout Layout) counterMatrix {
+	r := newCounterMatrix(rows, b, layout)
+	row := make([]uint64, m.b)
+	if b < m.b {
+		row = row[:b]
+	}
+	for i := 0; i < rows && i < m.rows; i++ {
+		m.copyRow(row, i)
+		r.setRow(i, row)
+	}
+	return r
+}
+
+// extended returns a copy of m with n more zero rows.
+func (m counterMatrix) extended(n int) counterMatrix {
+	return m.resized(m.rows+n, m.b, m.layout)
+}
+
+// head returns a view of the first rows of m, sharing its counters.
+func (m counterMatrix) head(rows int) counterMatrix {
+	m.rows = rows
+	if m.cs == 1 {
+		m.data = m.data[:uint64(rows)*m.rs]
+	}
+	return m
+}
+
+// clone returns a copy of m that shares nothing with it.
+func (m counterMatrix) clone() counterMatrix {
+	if m.cs == 1 {
+		m.data = append([]uint64(nil), m.data...)
+		return m
+	}
+	return m.resized(m.rows, m.b, m.layout)
+}
+
+// clear zeroes every counter of m.
+func (m counterMatrix) clear() {
+	for i := 0; i < m.rows; i++ {
+		for j, off := uint64(0), uint64(i)*m.rs; j < m.b; j, off = j+1, off+m.cs {
+			m.data[off] = 0
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package topkapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLayoutDifferential(t *testing.T) {
+	configs := map[string][]Option{
+		"plain":      nil,
+		"extra rows": {WithExtraCounterRows(2)},
+		"consistent": {WithConsistentBuckets(), WithSeed(3)},
+		"tracked":    {WithTopKTracking(10), WithThresholdTracking(), WithMinCount(2)},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			var sketches [2]*Sketch
+			for i, layout := range []Layout{RowMajor, ColumnMajor} {
+				sk, err := New(0.01, 0.002, append([]Option{WithLayout(layout)}, opts...)...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				other, _ := New(0.01, 0.002, append([]Option{WithLayout(1 - layout)}, opts...)...)
+				for j, key := range zipfKeys(50000, 3000, 1) {
+					if j%3 == 0 {
+						other.Insert(key, 2)
+					} else {
+						sk.Insert(key, 1)
+					}
+				}
+				sk.Add("key1", -40)
+				if err := sk.Merge(other); err != nil {
+					t.Fatal(err)
+				}
+				sk.Decay(0.9)
+				sk.DecayPerKey(func(key interface{}) float64 { return float64(len(key.(string))%3+1) / 3 })
+				if sketches[i], err = sk.Grow(2 * sk.b); err != nil {
+					t.Fatal(err)
+				}
+				if sketches[i].Layout() != layout {
+					t.Errorf("Expected Grow to keep the %v layout, found %v", layout, sketches[i].Layout())
+				}
+			}
+			assertSameResults(t, sketches[0], sketches[1])
+		})
+	}
+}
+
+func TestLayoutRows(t *testing.T) {
+	sketches := make([]*Sketch, 2)
+	for i, layout := range []Layout{RowMajor, ColumnMajor} {
+		// Extra rows before the layout are laid out alike
+		sk, _ := New(0.001, 0.01, WithExtraCounterRows(1), WithLayout(layout), WithExtraCounterRows(1))
+		edge, _ := New(0.1, 0.01)
+		for _, key := range zipfKeys(20000, 500, 2) {
+			sk.Insert(key, 1)
+			edge.Insert(key, 1)
+		}
+		if err := sk.MergeRows(edge); err != nil {
+			t.Fatal(err)
+		}
+		sketches[i] = sk.Clone()
+		if sketches[i].Layout() != layout {
+			t.Errorf("Expected a clone to keep the %v layout, found %v", layout, sketches[i].Layout())
+		}
+
+		sk.Reset()
+		for r := 0; r < sk.cms.rows; r++ {
+			for _, c := range sk.cms.row(r) {
+				if c != 0 {
+					t.Fatalf("Expected a reset %v sketch to be empty, found %d in row %d", layout, c, r)
+				}
+			}
+		}
+	}
+	assertSameResults(t, sketches[0], sketches[1])
+}
+
+func TestWithLayout(t *testing.T) {
+	if _, err := New(0.01, 0.01, WithLayout(Layout(2))); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("Expected an unknown layout to be invalid, found %v", err)
+	}
+	if sk, _ := New(0.01, 0.01); sk.Layout() != RowMajor {
+		t.Errorf("Expected the row-major layout by default, found %v", sk.Layout())
+	}
+
+	// The encoding is that of either layout, and decodes into the layout of
+	// the receiver
+	sk, _ := New(0.01, 0.01, WithLayout(ColumnMajor))
+	for i := 0; i < 1000; i++ {
+		sk.Insert(i%77, uint64(i))
+	}
+	data, _ := sk.MarshalBinary()
+	var plain Sketch
+	if err := plain.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	columns, _ := New(0.5, 0.5, WithLayout(ColumnMajor))
+	if err := columns.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if plain.Layout() != RowMajor || columns.Layout() != ColumnMajor {
+		t.Errorf("Expected the layouts of the receivers, found %v and %v", plain.Layout(), columns.Layout())
+	}
+	assertSameResults(t, &plain, columns)
+	assertSameResults(t, sk, columns)
+
+	if s := fmt.Sprint(RowMajor, ColumnMajor, Layout(7)); s != "row-major column-major unknown" {
+		t.Errorf("Expected the names of the layouts, found %q", s)
+	}
+}
+
+// assertSameResults checks that two sketches answer and encode alike.
+func assertSameResults(t *testing.T, a, b *Sketch) {
+	t.Helper()
+
+	assertSameState(t, a, b)
+	if a.StateHash() != b.StateHash() {
+		t.Error("Expected equal state hashes")
+	}
+	if ra, rb := a.Result(0), b.Result(0); !reflect.DeepEqual(ra, rb) || len(ra) == 0 && !a.Empty() {
+		t.Errorf("Expected equal results, found %v and %v", ra, rb)
+	}
+	if sa, sb := a.Stats(), b.Stats(); !reflect.DeepEqual(sa, sb) {
+		t.Errorf("Expected equal stats, found %+v and %+v", sa, sb)
+	}
+	for _, key := range []interface{}{"key0", "key1", "key99", "missing", 5} {
+		ca, oka := a.Count(key)
+		cb, okb := b.Count(key)
+		if ca != cb || oka != okb {
+			t.Errorf("Expected equal counts of %v, found %d and %d", key, ca, cb)
+		}
+	}
+
+	da, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := b.MarshalBinary()
+	var ta, tb bytes.Buffer
+	a.DumpText(&ta)
+	b.DumpText(&tb)
+	if !bytes.Equal(da, db) || ta.String() != tb.String() {
+		t.Error("Expected equal encodings")
+	}
+}
+
+func BenchmarkLayout(b *testing.B) {
+	keys := zipfKeys(1000000, 100000, 1)
+	for _, layout := range []Layout{RowMajor, ColumnMajor} {
+		b.Run("insert/"+layout.String(), func(b *testing.B) {
+			sk, _ := NewTopK(100, 10000000, 0.01, WithLayout(layout), WithExtraCounterRows(2))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sk.Insert(keys[i%len(keys)], 1)
+			}
+		})
+
+		sk, _ := NewTopK(100, 10000000, 0.01, WithLayout(layout), WithExtraCounterRows(2))
+		other, _ := NewTopK(100, 10000000, 0.01, WithLayout(layout), WithExtraCounterRows(2))
+		for i, key := range keys {
+			if i%2 == 0 {
+				sk.Insert(key, 1)
+			} else {
+				other.Insert(key, 1)
+			}
+		}
+		b.Run("query/"+layout.String(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sk.Count(keys[i%len(keys)])
+			}
+		})
+		b.Run("result/"+layout.String(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sk.TopK(100)
+			}
+		})
+		b.Run("merge/"+layout.String(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := sk.Merge(other); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package topkapi
+
+// BucketLocation describes the bucket a key maps to in one row.
+type BucketLocation struct {
+	Row      int
+	Bucket   int
+	Count    uint64      // count-min counter of the bucket
+	Object   interface{} // candidate holding the bucket, nil for extra counter rows
+	Residual int64       // Misra-Gries count of the candidate
+}
+
+// Locate returns the bucket key maps to in every counter row, including
+// extra counter rows, along with what the bucket currently holds. It is
+// meant for diagnosing collisions: a key whose buckets are held by other
+// keys, or whose counters are much larger than its count, shares them with
+// heavier keys. The key is canonicalized like Count does.
+func (sk *Sketch) Locate(key interface{}) []BucketLocation {
+	key, ok := sk.limit(sk.canonical(key))
+	if !ok {
+		return []BucketLocation{}
+	}
+	hsum := sk.hashKey(key)
+
+	locs := make([]BucketLocation, sk.cms.rows)
+	for i := range locs {
+		hi := sk.bucket(hsum, i)
+		locs[i] = BucketLocation{Row: i, Bucket: int(hi), Count: sk.cms.get(i, hi)}
+		if i < int(sk.l) {
+			locs[i].Object = sk.objects[i][hi]
+			locs[i].Residual = sk.counts[i][hi]
+		}
+	}
+
+	return locs
+}
+
+// NotHeld is the Misra-Gries count MisraGriesCounts reports for a row where
+// the key doesn't hold its bucket. Actual counts are never negative.
+const NotHeld int64 = -1
+
+// MisraGriesCounts returns the Misra-Gries count of key in every row holding
+// candidates, the residual its bucket keeps for it, as opposed to the
+// count-min counter Count is based on. Rows where another key, or no key at
+// all, holds the bucket report NotHeld. It exposes the internal estimator,
+// for analysis and for comparing with other algorithms.
+func (sk *Sketch) MisraGriesCounts(key interface{}) []int64 {
+	counts := make([]int64, sk.l)
+	key, ok := sk.limit(sk.canonical(key))
+	hsum := sk.hashKey(key)
+	for i := range counts {
+		hi := sk.bucket(hsum, i)
+		if !ok || key == nil || !sk.holds(i, hi, key, hsum) {
+			counts[i] = NotHeld
+			continue
+		}
+		counts[i] = sk.counts[i][hi]
+	}
+
+	return counts
+}
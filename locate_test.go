@@ -0,0 +1,77 @@
+package topkapi
+
+import (
+	"testing"
+)
+
+func TestLocate(t *testing.T) {
+	sk, _ := New(0.1, 0.01, WithExtraCounterRows(1))
+	sk.Insert("heavy", 10)
+	sk.Insert("light", 1)
+
+	for _, key := range []string{"heavy", "light"} {
+		locs := sk.Locate(key)
+		if len(locs) != sk.cms.rows {
+			t.Fatalf("Expected a location per counter row, found %d", len(locs))
+		}
+
+		hsum := sk.hashKey(key)
+		for i, loc := range locs {
+			if loc.Row != i || loc.Bucket != int(sk.bucket(hsum, i)) {
+				t.Errorf("Expected '%s' in row %d bucket %d, found %+v", key, i, sk.bucket(hsum, i), loc)
+			}
+			if loc.Count != sk.cms.get(i, uint64(loc.Bucket)) {
+				t.Errorf("Expected counter %d, found %d", sk.cms.get(i, uint64(loc.Bucket)), loc.Count)
+			}
+			if i >= int(sk.l) {
+				if loc.Object != nil || loc.Residual != 0 {
+					t.Errorf("Expected no candidate in extra row %d, found %+v", i, loc)
+				}
+				continue
+			}
+			if loc.Object != sk.objects[i][loc.Bucket] || loc.Residual != sk.counts[i][loc.Bucket] {
+				t.Errorf("Expected candidate of row %d, found %+v", i, loc)
+			}
+		}
+	}
+
+	// The counters Locate reports are those Insert updates
+	before := sk.Locate("new")
+	sk.Insert("new", 3)
+	for i, loc := range sk.Locate("new") {
+		if loc.Count != before[i].Count+3 {
+			t.Errorf("Expected Insert to add 3 to row %d bucket %d, found %d -> %d", i, loc.Bucket, before[i].Count, loc.Count)
+		}
+	}
+}
+
+func TestMisraGriesCounts(t *testing.T) {
+	sk := newSketch(100, 3)
+	sk.Insert("a", 5)
+
+	// Hand the bucket of "a" in the middle row to another key, which has
+	// outweighed it by 2
+	hi := sk.bucket(sk.hashKey("a"), 1)
+	y := 0
+	for sk.bucket(sk.hashKey(y), 1) != hi {
+		y++
+	}
+	sk.objects[1][hi], sk.hashes[1][hi], sk.counts[1][hi] = y, sk.hashKey(y), 2
+
+	for key, want := range map[interface{}][]int64{
+		"a":     {5, NotHeld, 5},
+		"never": {NotHeld, NotHeld, NotHeld},
+		nil:     {NotHeld, NotHeld, NotHeld},
+	} {
+		got := sk.MisraGriesCounts(key)
+		if len(got) != len(want) {
+			t.Fatalf("Expected a count per row, found %v", got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Expected %v to have Misra-Gries counts %v, found %v", key, want, got)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package topkapi
+
+import (
+	"fmt"
+	"log"
+)
+
+// MergeVerbose merges other into sk like Merge, logging the dimensions of
+// both sketches to logger, or to the standard logger if it is nil, for
+// operators combining sketches of many origins. When they can't be merged
+// it also logs every value that differs and how the sketches could be
+// combined instead, like with MergeRows or AbsorbTopK, and returns the
+// error of Merge.
+func (sk *Sketch) MergeVerbose(other *Sketch, logger *log.Logger) error {
+	if logger == nil {
+		logger = log.Default()
+	}
+	if other == nil {
+		logger.Print("topkapi: merge: other sketch is nil")
+		return nilSketch
+	}
+
+	logger.Printf("topkapi: merge: sketch %s", sk.dimensions())
+	logger.Printf("topkapi: merge: other  %s", other.dimensions())
+	if !sk.incompatible(other) {
+		logger.Print("topkapi: merge: dimensions match")
+		return sk.Merge(other)
+	}
+
+	for _, d := range []struct {
+		name      string
+		ours, its interface{}
+	}{
+		{"b", sk.b, other.b},
+		{"l", sk.l, other.l},
+		{"counter rows", sk.cms.rows, other.cms.rows},
+		{"seed", sk.seed, other.seed},
+		{"hash version", sk.hashVersion, other.hashVersion},
+		{"bucketing", bucketing(sk.consistent), bucketing(other.consistent)},
+	} {
+		if d.ours != d.its {
+			logger.Printf("topkapi: merge: mismatched %s: %v and %v", d.name, d.ours, d.its)
+		}
+	}
+	logger.Printf("topkapi: merge: %s", sk.remedy(other))
+
+	return sk.Merge(other)
+}
+
+// dimensions describes what decides whether sk can be merged.
+func (sk *Sketch) dimensions() string {
+	return fmt.Sprintf("b=%d l=%d counter rows=%d seed=%d hash version=%d bucketing=%s",
+		sk.b, sk.l, sk.cms.rows, sk.seed, sk.hashVersion, bucketing(sk.consistent))
+}
+
+// remedy suggests how to combine sk and other, which can't be merged.
+func (sk *Sketch) remedy(other *Sketch) string {
+	const absorb = "AbsorbTopK(other, k) inserts the top k of other, approximately"
+	if sk.seed != other.seed || sk.hashVersion != other.hashVersion || sk.consistent != other.consistent {
+		return "the sketches hash keys to different buckets; " + absorb
+	}
+
+	merge := "Merge"
+	if sk.cms.rows != other.cms.rows {
+		merge = "MergeRows"
+	}
+	// Only consistent buckets grow without dropping the counts of keys that
+	// aren't candidates
+	switch {
+	case sk.b != other.b && !sk.consistent:
+		return "the sketches have different buckets; " + absorb
+	case sk.b < other.b:
+		return fmt.Sprintf("g, _ := sk.Grow(%d); g.%s(other), or %s", other.b, merge, absorb)
+	case sk.b > other.b:
+		return fmt.Sprintf("g, _ := other.Grow(%d); sk.%s(g), or %s", sk.b, merge, absorb)
+	}
+	rows := sk.l
+	if other.l < rows {
+		rows = other.l
+	}
+	return fmt.Sprintf("MergeRows(other) merges the %d rows both have, dropping the others and extra counter rows", rows)
+}
+
+// bucketing names the bucketing of a sketch, see WithConsistentBuckets.
+func bucketing(consistent bool) string {
+	if consistent {
+		return "consistent"
+	}
+	return "modulo"
+}
@@ -0,0 +1,417 @@
+package topkapi
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// mergeCase is a random weighted stream, split arbitrarily across two
+// sketches and also inserted whole into a third.
+type mergeCase struct {
+	a, b, whole *Sketch
+	exact       map[uint64]uint64
+}
+
+func newMergeCase(t *testing.T, seed int64) mergeCase {
+	rnd := rand.New(rand.NewSource(seed))
+	var (
+		distinct = 2 + uint64(rnd.Intn(5000))
+		z        = rand.NewZipf(rnd, 1.01+2*rnd.Float64(), 1, distinct-1)
+		maxCount = 1 + rnd.Intn(20)
+		split    = rnd.Float64()
+		n        = 1 + rnd.Intn(20000)
+	)
+
+	mc := mergeCase{exact: make(map[uint64]uint64)}
+	for _, sk := range []**Sketch{&mc.a, &mc.b, &mc.whole} {
+		var err error
+		if *sk, err = NewTopK(10, 20000, 0.01); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		key, count := z.Uint64(), uint64(1+rnd.Intn(maxCount))
+		mc.exact[key] += count
+		mc.whole.Insert(key, count)
+		if rnd.Float64() < split {
+			mc.a.Insert(key, count)
+		} else {
+			mc.b.Insert(key, count)
+		}
+	}
+
+	return mc
+}
+
+// majorities returns, for every row, the keys holding a strict majority of
+// the counts in their bucket. Misra-Gries guarantees these are the
+// candidates of their buckets, merged or not.
+func majorities(sk *Sketch, exact map[uint64]uint64) []map[uint64]uint64 {
+	maj := make([]map[uint64]uint64, sk.l)
+	for i := range maj {
+		maj[i] = make(map[uint64]uint64)
+		for key, count := range exact {
+			hi := sk.bucket(sk.hashKey(key), i)
+			if 2*count > sk.cms.get(i, hi) {
+				maj[i][key] = hi
+			}
+		}
+	}
+
+	return maj
+}
+
+// TestMergeHarness documents what Merge guarantees. The merge of two
+// sketches has exactly the counters of a sketch of the whole stream, so
+// every estimate is the same. Candidates can differ, but never for a key that
+// owns the majority of its bucket, and the top-k agrees within the error
+// bound.
+func TestMergeHarness(t *testing.T) {
+	law := func(seed int64) bool {
+		mc := newMergeCase(t, seed)
+		if err := mc.a.Merge(mc.b); err != nil {
+			t.Fatal(err)
+		}
+		merged := mc.a
+
+		// The counters and so every estimate match those of the whole stream
+		if merged.Total() != mc.whole.Total() {
+			t.Logf("seed %d: expected total %d, found %d", seed, mc.whole.Total(), merged.Total())
+			return false
+		}
+		for key := range mc.exact {
+			got, _ := merged.Count(key)
+			want, _ := mc.whole.Count(key)
+			if got != want || got < mc.exact[key] {
+				t.Logf("seed %d: expected estimate %d >= %d for %d, found %d", seed, want, mc.exact[key], key, got)
+				return false
+			}
+		}
+
+		// Keys owning the majority of a bucket hold that bucket
+		for i, maj := range majorities(merged, mc.exact) {
+			for key, hi := range maj {
+				if merged.objects[i][hi] != key {
+					t.Logf("seed %d: expected %d=%d to hold bucket [%d][%d] of %d, found %v", seed, key, mc.exact[key], i, hi, merged.cms.get(i, hi), merged.objects[i][hi])
+					return false
+				}
+			}
+		}
+
+		// Within the error bound, the top-k is that of the whole stream
+		bound := uint64(merged.Epsilon() * float64(merged.Total()))
+		got, want := merged.TopK(10), mc.whole.TopK(10)
+		if len(got) != len(want) {
+			t.Logf("seed %d: expected %d heavy hitters, found %d", seed, len(want), len(got))
+			return false
+		}
+		for r := range want {
+			if got[r].Count+bound < want[r].Count {
+				t.Logf("seed %d: expected count %d at rank %d, found %d", seed, want[r].Count, r, got[r].Count)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	cfg := &quick.Config{MaxCount: 50, Rand: rand.New(rand.NewSource(1))}
+	if err := quick.Check(law, cfg); err != nil {
+		t.Error(err)
+	}
+}
+
+// naiveMerge is the straightforward Merge, or AddSketch with add, visiting
+// every bucket.
+func naiveMerge(sk, other *Sketch, add bool) {
+	for i := range sk.counts {
+		for j := range sk.counts[i] {
+			cnt, ocnt := sk.counts[i][j], other.counts[i][j]
+			switch {
+			case other.objects[i][j] == nil:
+			case sk.sameCandidate(other, i, j):
+				sk.counts[i][j] += ocnt
+			case sk.objects[i][j] == nil:
+				sk.adopt(other, i, j, ocnt)
+			case add:
+				sk.conflicts[i]++
+				if !sk.dominates(other, i, j) {
+					sk.evictions++
+					sk.adopt(other, i, j, cnt+ocnt)
+				}
+				sk.counts[i][j] = cnt + ocnt
+			default:
+				sk.conflicts[i]++
+				sk.evictions++
+				if sk.dominates(other, i, j) {
+					sk.counts[i][j] = cnt - ocnt
+				} else {
+					sk.adopt(other, i, j, ocnt-cnt)
+				}
+			}
+		}
+	}
+	for i := 0; i < sk.cms.rows; i++ {
+		for j := uint64(0); j < sk.b; j++ {
+			sk.cms.set(i, j, sk.cms.get(i, j)+other.cms.get(i, j))
+		}
+	}
+	sk.total += other.total
+	sk.evictions += other.evictions
+	for i := range sk.conflicts {
+		sk.conflicts[i] += other.conflicts[i]
+	}
+}
+
+// TestMergeDifferential checks that Merge and AddSketch, which only visit
+// occupied buckets, come out exactly like naiveMerge.
+func TestMergeDifferential(t *testing.T) {
+	law := func(seed int64) bool {
+		mc := newMergeCase(t, seed)
+		for _, add := range []bool{false, true} {
+			got, want := mc.a.Clone(), mc.a.Clone()
+			var err error
+			if add {
+				err = got.AddSketch(mc.b)
+			} else {
+				err = got.Merge(mc.b)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			naiveMerge(want, mc.b, add)
+
+			assertSameState(t, want, got)
+			if got.total != want.total || got.evictions != want.evictions {
+				t.Logf("seed %d: expected total %d and %d evictions, found %d and %d", seed, want.total, want.evictions, got.total, got.evictions)
+				return false
+			}
+			for i := range got.objects {
+				if got.conflicts[i] != want.conflicts[i] {
+					t.Logf("seed %d: expected %d conflicts in row %d, found %d", seed, want.conflicts[i], i, got.conflicts[i])
+					return false
+				}
+				for j, obj := range got.objects[i] {
+					if occupied := got.occupied[i][j/64]&(1<<(j%64)) != 0; occupied != (obj != nil) {
+						t.Logf("seed %d: expected bucket [%d][%d] to be occupied %v", seed, i, j, obj != nil)
+						return false
+					}
+				}
+			}
+		}
+
+		return true
+	}
+
+	cfg := &quick.Config{MaxCount: 20, Rand: rand.New(rand.NewSource(2))}
+	if err := quick.Check(law, cfg); err != nil {
+		t.Error(err)
+	}
+}
+
+// mergeOutcomes is what a merge does with every field of Sketch, as
+// mergeMeta documents. TestMergeMetadata fails for a field missing here.
+var mergeOutcomes = map[string]string{
+	"l": "equal", "b": "equal", "seed": "equal", "hashVersion": "equal", "consistent": "equal",
+	"cms": "row", "counts": "row", "objects": "row", "hashes": "row", "occupied": "row", "conflicts": "row",
+	"total": "sum", "evictions": "sum", "rejected": "sum", "accepted": "sum", "deduped": "sum",
+	"distinct": "union", "spans": "appended", "samples": "row",
+	"canonicalize": "warning", "numericKeys": "warning", "integralFloats": "warning", "foldCase": "warning",
+	"normalize": "warning", "normalizer": "warning",
+	"warn": "receiver", "events": "receiver", "maxKeyLen": "receiver", "keyLenPolicy": "receiver",
+	"minCount": "receiver", "eviction": "receiver", "clock": "receiver", "sampling": "receiver", "sampleSeq": "receiver",
+	"dedup": "receiver",
+	"top":   "rebuilt", "thresholds": "rebuilt", "sizing": "receiver",
+}
+
+// TestMergeMetadata is the compatibility matrix of Merge: for every field
+// merged other than per row, two sketches differ in that field only, and
+// the merge must sum, unite, warn or refuse as mergeMeta documents.
+func TestMergeMetadata(t *testing.T) {
+	var fields []string
+	typ := reflect.TypeOf(Sketch{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		fields = append(fields, name)
+		if _, ok := mergeOutcomes[name]; !ok {
+			t.Errorf("Expected a merge outcome for the field %s, see mergeMeta", name)
+		}
+	}
+	if len(fields) != len(mergeOutcomes) {
+		sort.Strings(fields)
+		t.Errorf("Expected a merge outcome for the fields %s only", strings.Join(fields, ", "))
+	}
+
+	upper := func(key interface{}) interface{} {
+		if s, ok := key.(string); ok {
+			return strings.ToUpper(s)
+		}
+		return key
+	}
+	for _, test := range []struct {
+		name    string
+		a, b    []Option
+		prepare func(a, b *Sketch)
+		err     error // of Merge
+		warning error
+		check   func(a *Sketch) bool
+	}{
+		{name: "total", prepare: func(a, b *Sketch) { a.Insert("x", 3); b.Insert("y", 4) },
+			check: func(a *Sketch) bool { return a.Total() == 7 }},
+		{name: "saturated total", prepare: func(a, b *Sketch) { a.Insert("x", 3); b.Insert("y", math.MaxUint64) },
+			check: func(a *Sketch) bool { return a.Total() == math.MaxUint64 }},
+		{name: "evictions", prepare: func(a, b *Sketch) { a.evictions, b.evictions = 2, 5 },
+			check: func(a *Sketch) bool { return a.Stats().Evictions == 7 }},
+		{name: "rejected", prepare: func(a, b *Sketch) { a.rejected, b.rejected = 1, 2 },
+			check: func(a *Sketch) bool { return a.Stats().Rejected == 3 }},
+		{name: "dedup stats", prepare: func(a, b *Sketch) { a.accepted, a.deduped, b.accepted, b.deduped = 1, 2, 3, 4 },
+			check: func(a *Sketch) bool { accepted, deduped := a.DedupStats(); return accepted == 4 && deduped == 6 }},
+		{name: "conflicts", prepare: func(a, b *Sketch) { b.Insert("x", 1); a.conflicts[0], b.conflicts[0] = 1, 2 },
+			check: func(a *Sketch) bool { return a.conflicts[0] == 3 }},
+		{name: "cardinality", prepare: func(a, b *Sketch) {
+			for i := 0; i < 1000; i++ {
+				a.Insert(i, 1)
+				b.Insert(i+500, 1)
+			}
+		}, check: func(a *Sketch) bool {
+			whole, _ := New(0.01, 0.01)
+			for i := 0; i < 1500; i++ {
+				whole.Insert(i, 1)
+			}
+			return a.distinct == whole.distinct
+		}},
+		{name: "spans", a: []Option{WithSpanTracking()}, b: []Option{WithSpanTracking()},
+			prepare: func(a, b *Sketch) { a.Insert("x", 1); b.Insert("y", 1); b.Insert("x", 1) },
+			check:   func(a *Sketch) bool { first, last, _ := a.Span("x"); return first == 1 && last == 3 }},
+		{name: "normalizer", a: []Option{WithKeyNormalizer(normalizeHost)}, warning: mismatchedNormalizers},
+		{name: "canonicalizer", b: []Option{WithCanonicalizer(upper)}, warning: mismatchedKeyForms},
+		{name: "case folding", a: []Option{WithCaseInsensitiveKeys()}, warning: mismatchedKeyForms},
+		{name: "numeric keys", a: []Option{WithNumericKeys(false)}, b: []Option{WithNumericKeys(true)}, warning: mismatchedKeyForms},
+		{name: "empty other", a: []Option{WithCaseInsensitiveKeys()}, prepare: func(a, b *Sketch) { a.Insert("x", 1); b.rejected = 1 },
+			warning: mismatchedKeyForms, check: func(a *Sketch) bool { return a.Total() == 1 && a.rejected == 1 }},
+		{name: "receiver options", b: []Option{WithMinCount(5), WithMaxKeyLen(3, RejectLongKeys)},
+			prepare: func(a, b *Sketch) { b.Insert("x", 10) },
+			check:   func(a *Sketch) bool { return a.minCount == 0 && a.maxKeyLen == 0 }},
+		{name: "seed", b: []Option{WithSeed(1)}, err: ErrIncompatibleSketches},
+		{name: "hash version", b: []Option{WithHashVersion(HashStructure)}, err: ErrIncompatibleSketches},
+		{name: "bucketing", b: []Option{WithConsistentBuckets()}, err: ErrIncompatibleSketches},
+		{name: "rows", b: []Option{WithExtraCounterRows(1)}, err: ErrIncompatibleSketches},
+	} {
+		var (
+			warnings []error
+			events   []Event
+		)
+		a, _ := New(0.01, 0.01, append([]Option{
+			WithWarningHandler(func(err error) { warnings = append(warnings, err) }),
+			WithEventHandler(func(e Event) { events = append(events, e) }),
+		}, test.a...)...)
+		b, _ := New(0.01, 0.01, test.b...)
+		if test.prepare == nil {
+			a.Insert("x", 1)
+			b.Insert("x", 1)
+		} else {
+			test.prepare(a, b)
+		}
+
+		if err := a.Merge(b); err != test.err {
+			t.Errorf("%s: expected the merge to return %v, found %v", test.name, test.err, err)
+		}
+		if test.err != nil {
+			if len(events) != 1 || events[0].Kind != EventIncompatibleMerge {
+				t.Errorf("%s: expected an incompatible merge event, found %v", test.name, events)
+			}
+			continue
+		}
+
+		switch {
+		case test.warning == nil && (len(warnings) != 0 || len(events) != 0):
+			t.Errorf("%s: expected no warning, found %v and %v", test.name, warnings, events)
+		case test.warning != nil && (len(warnings) != 1 || !errors.Is(warnings[0], test.warning)):
+			t.Errorf("%s: expected a warning of %v, found %v", test.name, test.warning, warnings)
+		case test.warning != nil && (len(events) != 1 || events[0].Kind != EventMismatchedMerge):
+			t.Errorf("%s: expected a mismatched merge event, found %v", test.name, events)
+		}
+		if test.check != nil && !test.check(a) {
+			t.Errorf("%s: expected the documented outcome, found %+v", test.name, a.Stats())
+		}
+	}
+}
+
+func TestMergeVerbose(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		other *Sketch
+		err   error
+		logs  []string
+	}{
+		{"match", newSketch(100, 4), nil, []string{
+			"topkapi: merge: sketch b=100 l=4 counter rows=4 seed=0 hash version=1 bucketing=modulo\n",
+			"topkapi: merge: dimensions match\n",
+		}},
+		{"rows", newSketch(100, 3), ErrIncompatibleSketches, []string{
+			"topkapi: merge: other  b=100 l=3 counter rows=3 seed=0 hash version=1 bucketing=modulo\n",
+			"topkapi: merge: mismatched l: 4 and 3\n",
+			"topkapi: merge: mismatched counter rows: 4 and 3\n",
+			"MergeRows(other) merges the 3 rows both have",
+		}},
+		{"buckets", newSketch(200, 3), ErrIncompatibleSketches, []string{
+			"topkapi: merge: mismatched b: 100 and 200\n",
+			"the sketches have different buckets; AbsorbTopK(other, k)",
+		}},
+		{"seed", func() *Sketch { sk := newSketch(100, 4); sk.seed = 7; return sk }(), ErrIncompatibleSketches, []string{
+			"topkapi: merge: mismatched seed: 0 and 7\n",
+			"the sketches hash keys to different buckets; AbsorbTopK(other, k)",
+		}},
+		{"nil", nil, nilSketch, []string{"topkapi: merge: other sketch is nil\n"}},
+	} {
+		sk := newSketch(100, 4)
+		sk.Insert("a", 1)
+		if test.other != nil {
+			test.other.Insert("a", 2)
+		}
+
+		var buf bytes.Buffer
+		if err := sk.MergeVerbose(test.other, log.New(&buf, "", 0)); err != test.err {
+			t.Errorf("%s: expected %v, found %v", test.name, test.err, err)
+		}
+		for _, line := range test.logs {
+			if !strings.Contains(buf.String(), line) {
+				t.Errorf("%s: expected %q in the log, found:\n%s", test.name, line, buf.String())
+			}
+		}
+
+		want := uint64(1)
+		if test.err == nil {
+			want = 3
+		}
+		if c, _ := sk.Count("a"); c != want {
+			t.Errorf("%s: expected a count of %d, found %d", test.name, want, c)
+		}
+	}
+
+	// Consistent buckets can grow to those of the other sketch
+	consistent := func(b, l uint64) *Sketch {
+		sk, _ := NewFromParams(Params{B: b, L: l}, WithConsistentBuckets())
+		return sk
+	}
+	for _, test := range []struct {
+		sk, other *Sketch
+		want      string
+	}{
+		{consistent(100, 4), consistent(200, 3), "g, _ := sk.Grow(200); g.MergeRows(other), or AbsorbTopK(other, k)"},
+		{consistent(100, 4), consistent(50, 4), "g, _ := other.Grow(100); sk.Merge(g), or AbsorbTopK(other, k)"},
+	} {
+		if got := test.sk.remedy(test.other); !strings.HasPrefix(got, test.want) {
+			t.Errorf("Expected %q, found %q", test.want, got)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package topkapi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"reflect"
+	"unsafe"
+)
+
+// Mapped file layout, all integers are 8 bytes little endian unless noted:
+//
+//	magic     4 bytes "TKMF"
+//	version   4 bytes
+//	b, l, rows, seed, hash, bucketing, total, evictions
+//	conflicts l
+//	hll       4096 raw bytes
+//	cms       rows*b
+//	counts    l*b, two's complement
+//	objects   l*b encoded keys, see appendKey
+//
+// The counters start at a multiple of 8 bytes, so they can be used in place
+// where the file is mapped.
+const (
+	mappedMagic   = "TKMF"
+	mappedVersion = 1
+	mappedHeader  = 8 + 8*8
+)
+
+var (
+	readOnlySketch = newError(ErrInvalidParameter, "topkapi: sketch is mapped read-only")
+	closedSketch   = newError(ErrInvalidParameter, "topkapi: sketch is closed")
+)
+
+// SaveFile writes the sketch to the file at path in a fixed layout that
+// OpenFileMapped can query in place. Keys must be of the types
+// MarshalBinary supports. Options are not saved.
+func (sk *Sketch) SaveFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	var word [8]byte
+	put := func(v uint64) {
+		binary.LittleEndian.PutUint64(word[:], v)
+		w.Write(word[:])
+	}
+
+	w.WriteString(mappedMagic)
+	binary.LittleEndian.PutUint32(word[:4], mappedVersion)
+	w.Write(word[:4])
+	for _, v := range []uint64{sk.b, sk.l, uint64(sk.cms.rows), sk.seed, uint64(sk.hashVersion), consistentBit(sk.consistent), sk.total, sk.evictions} {
+		put(v)
+	}
+	for _, c := range sk.conflicts {
+		put(c)
+	}
+	w.Write(sk.distinct[:])
+	for i := 0; i < sk.cms.rows; i++ {
+		for j := uint64(0); j < sk.b; j++ {
+			put(sk.cms.get(i, j))
+		}
+	}
+	for _, row := range sk.counts {
+		for _, c := range row {
+			put(uint64(c))
+		}
+	}
+
+	var buf []byte
+	for _, row := range sk.objects {
+		for _, obj := range row {
+			if buf, err = appendKey(buf[:0], obj); err != nil {
+				f.Close()
+				return err
+			}
+			w.Write(buf)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// MappedSketch is a read-only sketch whose counters are those of a file
+// written by SaveFile, mapped into memory, so that many large sketches can
+// be queried at once while the pages of buckets not queried can be dropped
+// from memory. Candidate keys are loaded onto the heap.
+//
+// Queries may run from any number of goroutines, but not concurrently with
+// Close. Insert and Merge return an error. On platforms other than Linux,
+// macOS, the BSDs and Windows, the file is read into memory instead.
+type MappedSketch struct {
+	sk   *Sketch
+	data []byte // mapped file, nil once closed
+}
+
+// OpenFileMapped maps the file at path, written by SaveFile, for queries. It
+// must be closed to unmap it. The sketch has the default options. Besides
+// the errors of opening and mapping the file, it returns ErrCorruptData or
+// ErrUnsupportedVersion like UnmarshalBinary. Opening reads every counter
+// once, to check the residuals against them, see Validate.
+func OpenFileMapped(path string) (*MappedSketch, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < mappedHeader || int64(int(fi.Size())) != fi.Size() {
+		return nil, ErrCorruptData
+	}
+
+	data, err := mapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+	sk, err := mappedSketch(data)
+	if err != nil {
+		unmapFile(data)
+		return nil, err
+	}
+
+	return &MappedSketch{sk: sk, data: data}, nil
+}
+
+// mappedSketch returns a sketch whose counters are views of data.
+func mappedSketch(data []byte) (*Sketch, error) {
+	if string(data[:4]) != mappedMagic {
+		return nil, ErrCorruptData
+	}
+	if v := binary.LittleEndian.Uint32(data[4:8]); v != mappedVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, v)
+	}
+
+	off := 8
+	next := func() uint64 {
+		v := binary.LittleEndian.Uint64(data[off:])
+		off += 8
+		return v
+	}
+	b, l, rows, seed, hash, bucketing, total, evictions := next(), next(), next(), next(), next(), next(), next(), next()
+	if b == 0 || l == 0 || rows < l || hash > uint64(HashV1) || bucketing > 1 {
+		return nil, ErrCorruptData
+	}
+	// Every counter and key takes at least a byte, which bounds the sizes
+	size := uint64(len(data))
+	if rows > size || b > size/rows/8 || l > size/8 || size-uint64(off) < 8*l+uint64(len(hll{})) {
+		return nil, ErrCorruptData
+	}
+	words := func(n uint64) []byte {
+		if uint64(len(data)-off) < n*8 {
+			return nil
+		}
+		view := data[off : off+int(n)*8]
+		off += int(n) * 8
+		return view
+	}
+
+	sk := &Sketch{
+		l:           l,
+		b:           b,
+		seed:        seed,
+		hashVersion: HashVersion(hash),
+		consistent:  bucketing == 1,
+		total:       total,
+		evictions:   evictions,
+		counts:      make([][]int64, l),
+		objects:     make([][]interface{}, l),
+		hashes:      make([][]uint64, l),
+		occupied:    make([][]uint64, l),
+		conflicts:   make([]uint64, l),
+	}
+	for i := range sk.conflicts {
+		sk.conflicts[i] = next()
+	}
+	off += copy(sk.distinct[:], data[off:])
+
+	view := words(rows * b)
+	if view == nil {
+		return nil, ErrCorruptData
+	}
+	sk.cms = rowMajorMatrix(uint64s(view), int(rows), b)
+	for i := range sk.counts {
+		view := words(b)
+		if view == nil {
+			return nil, ErrCorruptData
+		}
+		sk.counts[i] = int64s(view)
+	}
+
+	d := decoder{data: data[off:]}
+	hashes := make(map[interface{}]uint64)
+	for i := range sk.objects {
+		sk.objects[i] = make([]interface{}, b)
+		sk.hashes[i] = make([]uint64, b)
+		sk.occupied[i] = make([]uint64, (b+63)/64)
+		for j := range sk.objects[i] {
+			obj := d.key()
+			if obj == nil {
+				continue
+			}
+			hsum, ok := hashes[obj]
+			if !ok {
+				hsum = sk.hashKey(obj)
+				hashes[obj] = hsum
+			}
+			sk.objects[i][j] = obj
+			sk.hashes[i][j] = hsum
+			sk.occupy(i, uint64(j))
+		}
+	}
+	if d.err != nil || len(d.data) != 0 {
+		return nil, ErrCorruptData
+	}
+	// The file has no checksum, so check the residuals like decodeSketch
+	if err := sk.Validate(); err != nil {
+		return nil, err
+	}
+
+	return sk, nil
+}
+
+// littleEndian reports whether the counters of a mapped file can be used in
+// place, rather than decoded.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// uint64s returns the little endian words of p, which must start at a
+// multiple of 8 bytes, in place if possible.
+func uint64s(p []byte) []uint64 {
+	n := len(p) / 8
+	if !littleEndian || n == 0 {
+		words := make([]uint64, n)
+		for i := range words {
+			words[i] = binary.LittleEndian.Uint64(p[8*i:])
+		}
+		return words
+	}
+
+	var words []uint64
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&words))
+	h.Data, h.Len, h.Cap = uintptr(unsafe.Pointer(&p[0])), n, n
+	return words
+}
+
+// int64s is like uint64s, for two's complement words.
+func int64s(p []byte) []int64 {
+	words := uint64s(p)
+	return *(*[]int64)(unsafe.Pointer(&words))
+}
+
+// Count returns the estimate of key, see Sketch.Count. It returns 0 and
+// false once the sketch is closed.
+func (m *MappedSketch) Count(key interface{}) (uint64, bool) {
+	if m.data == nil {
+		return 0, false
+	}
+	return m.sk.Count(key)
+}
+
+// Result returns the heavy hitters, see Sketch.Result. It returns an empty
+// result once the sketch is closed.
+func (m *MappedSketch) Result(threshold uint64) []LocalHeavyHitter {
+	if m.data == nil {
+		return []LocalHeavyHitter{}
+	}
+	return m.sk.Result(threshold)
+}
+
+// TopK returns the k heavy hitters with the highest estimates, see
+// Sketch.TopK. It returns an empty result once the sketch is closed.
+func (m *MappedSketch) TopK(k int) []LocalHeavyHitter {
+	if m.data == nil {
+		return []LocalHeavyHitter{}
+	}
+	return m.sk.TopK(k)
+}
+
+// Total returns the sum of all inserted counts, see Sketch.Total.
+func (m *MappedSketch) Total() uint64 {
+	return m.sk.Total()
+}
+
+// Insert returns an error wrapping ErrInvalidParameter, as the sketch is
+// read-only.
+func (m *MappedSketch) Insert(key interface{}, count uint64) error {
+	return readOnlySketch
+}
+
+// Merge returns an error wrapping ErrInvalidParameter, as the sketch is
+// read-only.
+func (m *MappedSketch) Merge(other *Sketch) error {
+	return readOnlySketch
+}
+
+// Close unmaps the file. The sketch can't be queried afterwards. It returns
+// an error wrapping ErrInvalidParameter if the sketch is already closed.
+func (m *MappedSketch) Close() error {
+	if m.data == nil {
+		return closedSketch
+	}
+	data := m.data
+	m.data, m.sk.cms, m.sk.counts = nil, counterMatrix{}, nil
+	return unmapFile(data)
+}
@@ -0,0 +1,128 @@
+package topkapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOpenFileMapped(t *testing.T) {
+	sk, _ := New(0.01, 0.001, WithExtraCounterRows(1), WithSeed(5))
+	keys := zipfKeys(50000, 5000, 9)
+	for _, key := range keys {
+		sk.Insert(key, 1)
+	}
+	sk.Insert(-7, 300)
+	sk.Insert(2.5, 200)
+
+	path := filepath.Join(t.TempDir(), "sketch.tkm")
+	if err := sk.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	m, err := OpenFileMapped(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries answer like the sketch that was saved
+	if m.sk.StateHash() != sk.StateHash() {
+		t.Error("Expected the mapped sketch to have the state of the saved one")
+	}
+	if top, want := m.TopK(10), sk.TopK(10); !reflect.DeepEqual(top, want) {
+		t.Errorf("Expected %v, found %v", want, top)
+	}
+	if res, want := m.Result(100), sk.Result(100); !reflect.DeepEqual(res, want) {
+		t.Errorf("Expected %v, found %v", want, res)
+	}
+	for _, key := range []interface{}{keys[0], keys[1], -7, 2.5, "unseen"} {
+		c, ok := m.Count(key)
+		wc, wok := sk.Count(key)
+		if c != wc || ok != wok {
+			t.Errorf("Expected %v=%d (%t), found %d (%t)", key, wc, wok, c, ok)
+		}
+	}
+	if m.Total() != sk.Total() {
+		t.Errorf("Expected a total of %d, found %d", sk.Total(), m.Total())
+	}
+
+	if err := m.Insert("a", 1); !errors.Is(err, readOnlySketch) || !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("Expected Insert to fail, found %v", err)
+	}
+	if err := m.Merge(sk); !errors.Is(err, readOnlySketch) || !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("Expected Merge to fail, found %v", err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := m.Count(keys[0]); c != 0 || ok || len(m.TopK(1)) != 0 {
+		t.Error("Expected nothing from a closed sketch")
+	}
+	if err := m.Close(); !errors.Is(err, closedSketch) || !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("Expected closing twice to fail, found %v", err)
+	}
+}
+
+func TestOpenFileMappedCorrupt(t *testing.T) {
+	sk, _ := New(0.1, 0.1)
+	sk.Insert("a", 1)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sketch.tkm")
+	if err := sk.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, broken := range map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("XXXX"), data[4:]...),
+		"truncated": data[:len(data)-1],
+		"trailing":  append(append([]byte(nil), data...), 0),
+		"header":    data[:mappedHeader+8],
+	} {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, broken, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenFileMapped(p); !errors.Is(err, ErrCorruptData) {
+			t.Errorf("Expected %s to be corrupt, found %v", name, err)
+		}
+	}
+
+	// Residuals out of range of their counters, at the bucket of a and at
+	// an empty one
+	b, rows := binary.LittleEndian.Uint64(data[8:]), binary.LittleEndian.Uint64(data[24:])
+	counts := mappedHeader + 8*int(sk.l) + len(hll{}) + 8*int(rows*b)
+	hi := sk.bucket(sk.hashKey("a"), 0)
+	for name, j := range map[string]uint64{"residual": hi, "keyless residual": (hi + 1) % b} {
+		broken := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint64(broken[counts+8*int(j):], 2)
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, broken, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenFileMapped(p); !errors.Is(err, ErrCorruptData) {
+			t.Errorf("Expected %s to be corrupt, found %v", name, err)
+		}
+	}
+
+	version := append([]byte(nil), data...)
+	version[4] = 9
+	if err := ioutil.WriteFile(path, version, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileMapped(path); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected an unsupported version, found %v", err)
+	}
+
+	if _, err := OpenFileMapped(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file, found %v", err)
+	}
+}
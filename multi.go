@@ -0,0 +1,187 @@
+package topkapi
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A multi sketch is encoded as a version byte followed by the number of
+// dimensions, and for each dimension in order of name its name and sketch,
+// both prefixed with their length as uvarint. Every sketch carries its own
+// version and checksum.
+const multiFormatVersion = 1
+
+var mismatchedDimensions = newError(ErrIncompatibleSketches, "topkapi: mismatched dimensions")
+
+// MultiSketch finds the heavy hitters of several dimensions of one stream of
+// events, like the top URLs, client addresses and user agents of a request
+// log, with one sketch per dimension sized for it.
+type MultiSketch struct {
+	names []string // sorted
+	dims  map[string]*Sketch
+}
+
+// NewMulti creates a MultiSketch counting each dimension in its sketch.
+func NewMulti(dims map[string]*Sketch) (*MultiSketch, error) {
+	if len(dims) == 0 {
+		return nil, newError(ErrInvalidParameter, "topkapi: at least one dimension is required")
+	}
+
+	ms := &MultiSketch{dims: make(map[string]*Sketch, len(dims))}
+	for name, sk := range dims {
+		if sk == nil {
+			return nil, newError(ErrInvalidParameter, "topkapi: sketch of dimension %q should not be nil", name)
+		}
+		ms.names = append(ms.names, name)
+		ms.dims[name] = sk
+	}
+	sort.Strings(ms.names)
+
+	return ms, nil
+}
+
+// Insert adds count occurrences of an event, inserting the value of every
+// dimension into its sketch. Dimensions missing from the event are left
+// alone, and fields that aren't a dimension are ignored.
+func (ms *MultiSketch) Insert(event map[string]interface{}, count uint64) {
+	for _, name := range ms.names {
+		if key, ok := event[name]; ok {
+			ms.dims[name].Insert(key, count)
+		}
+	}
+}
+
+// TopK returns the top k heavy hitters of a dimension, see Sketch.TopK. It
+// returns an empty, non-nil slice for an unknown dimension.
+func (ms *MultiSketch) TopK(dimension string, k int) []LocalHeavyHitter {
+	sk, ok := ms.dims[dimension]
+	if !ok {
+		return []LocalHeavyHitter{}
+	}
+
+	return sk.TopK(k)
+}
+
+// Dimensions returns the names of the dimensions, in order.
+func (ms *MultiSketch) Dimensions() []string {
+	return append([]string(nil), ms.names...)
+}
+
+// Sketch returns the sketch of a dimension, or nil for an unknown one.
+func (ms *MultiSketch) Sketch(dimension string) *Sketch {
+	return ms.dims[dimension]
+}
+
+// Merge merges every dimension of other into the dimension of ms with the
+// same name. Both must have the same dimensions, and the sketches of the
+// same dimension must be compatible, see Sketch.Merge. Nothing is merged if
+// either is not the case.
+func (ms *MultiSketch) Merge(other *MultiSketch) error {
+	if other == nil {
+		return newError(ErrInvalidParameter, "topkapi: multi-dimensional sketch should not be nil")
+	}
+	if err := ms.matches(other.names); err != nil {
+		return err
+	}
+	for _, name := range ms.names {
+		if sk := ms.dims[name]; sk.incompatible(other.dims[name]) {
+			return fmt.Errorf("%w: dimension %q", sk.incompatibleMerge(other.dims[name]), name)
+		}
+	}
+
+	for _, name := range ms.names {
+		if err := ms.dims[name].Merge(other.dims[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reset empties every dimension.
+func (ms *MultiSketch) Reset() {
+	for _, sk := range ms.dims {
+		sk.Reset()
+	}
+}
+
+// matches checks that names are the dimensions of ms.
+func (ms *MultiSketch) matches(names []string) error {
+	if len(names) != len(ms.names) {
+		return fmt.Errorf("%w: %q and %q", mismatchedDimensions, ms.names, names)
+	}
+	for i := range names {
+		if names[i] != ms.names[i] {
+			return fmt.Errorf("%w: %q and %q", mismatchedDimensions, ms.names, names)
+		}
+	}
+
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, encoding all dimensions
+// into one blob. Keys must be of the types Sketch.MarshalBinary supports.
+func (ms *MultiSketch) MarshalBinary() ([]byte, error) {
+	buf := []byte{multiFormatVersion}
+	buf = appendUvarint(buf, uint64(len(ms.names)))
+	for _, name := range ms.names {
+		data, err := ms.dims[name].MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("topkapi: dimension %q: %w", name, err)
+		}
+		buf = appendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = appendUvarint(buf, uint64(len(data)))
+		buf = append(buf, data...)
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. The encoded
+// dimensions must be those of ms, and are decoded into its sketches like
+// Sketch.UnmarshalBinary. ms is left unchanged on error.
+func (ms *MultiSketch) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return ErrCorruptData
+	}
+	if data[0] != multiFormatVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[0])
+	}
+
+	d := decoder{data: data[1:]}
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.data)) {
+		return ErrCorruptData
+	}
+
+	var (
+		names = make([]string, n)
+		dec   = make([]*Sketch, n)
+	)
+	for i := range names {
+		names[i] = string(d.bytes())
+		blob := d.bytes()
+		if d.err != nil {
+			return ErrCorruptData
+		}
+
+		sk, err := decodeSketch(blob)
+		if err != nil {
+			return fmt.Errorf("topkapi: dimension %q: %w", names[i], err)
+		}
+		dec[i] = sk
+	}
+	if len(d.data) != 0 {
+		return ErrCorruptData
+	}
+	if err := ms.matches(names); err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		ms.dims[name].decoded(dec[i])
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package topkapi
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// requestLog returns n synthetic request events, each dimension skewed
+// differently.
+func requestLog(n int, seed int64) []map[string]interface{} {
+	rnd := rand.New(rand.NewSource(seed))
+	urls := rand.NewZipf(rnd, 1.2, 1, 2000)
+	ips := rand.NewZipf(rnd, 1.5, 2, 10000)
+	agents := rand.NewZipf(rnd, 2, 1, 50)
+
+	events := make([]map[string]interface{}, n)
+	for i := range events {
+		ip := ips.Uint64()
+		events[i] = map[string]interface{}{
+			"url":    fmt.Sprintf("/page/%d", urls.Uint64()),
+			"ip":     fmt.Sprintf("10.0.%d.%d", ip/256, ip%256),
+			"agent":  fmt.Sprintf("agent-%d", agents.Uint64()),
+			"status": 200,
+		}
+	}
+	// Not every event has every dimension
+	delete(events[0], "agent")
+
+	return events
+}
+
+func newRequestSketch() *MultiSketch {
+	url, _ := NewTopK(10, 20000, 0.01)
+	ip, _ := NewTopK(20, 20000, 0.01)
+	agent, _ := New(0.01, 0.01)
+	ms, _ := NewMulti(map[string]*Sketch{"url": url, "ip": ip, "agent": agent})
+	return ms
+}
+
+func TestMultiSketch(t *testing.T) {
+	ms := newRequestSketch()
+	separate := map[string]*Sketch{}
+	separate["url"], _ = NewTopK(10, 20000, 0.01)
+	separate["ip"], _ = NewTopK(20, 20000, 0.01)
+	separate["agent"], _ = New(0.01, 0.01)
+
+	for _, event := range requestLog(20000, 1) {
+		ms.Insert(event, 1)
+		for name, sk := range separate {
+			if key, ok := event[name]; ok {
+				sk.Insert(key, 1)
+			}
+		}
+	}
+
+	if dims := ms.Dimensions(); !reflect.DeepEqual(dims, []string{"agent", "ip", "url"}) {
+		t.Errorf("Expected sorted dimensions, found %v", dims)
+	}
+	for name, sk := range separate {
+		if got, want := ms.TopK(name, 10), sk.TopK(10); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected top %s to be %v, found %v", name, want, got)
+		}
+	}
+	if res := ms.TopK("status", 10); res == nil || len(res) != 0 {
+		t.Errorf("Expected no heavy hitters of an unknown dimension, found %v", res)
+	}
+	if total := ms.Sketch("agent").Total(); total != 19999 {
+		t.Errorf("Expected the event without agent to be skipped, found %d agents", total)
+	}
+}
+
+func TestMultiSketchMerge(t *testing.T) {
+	events := requestLog(20000, 2)
+	whole, a, b := newRequestSketch(), newRequestSketch(), newRequestSketch()
+	for i, event := range events {
+		whole.Insert(event, 1)
+		if i%2 == 0 {
+			a.Insert(event, 1)
+		} else {
+			b.Insert(event, 1)
+		}
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range whole.Dimensions() {
+		for _, hh := range whole.TopK(name, 5) {
+			if c, _ := a.Sketch(name).Count(hh.Key); c != hh.Count {
+				t.Errorf("Expected merged %s %v=%d, found %d", name, hh.Key, hh.Count, c)
+			}
+		}
+	}
+
+	url, _ := NewTopK(10, 20000, 0.01)
+	other, _ := NewMulti(map[string]*Sketch{"url": url})
+	if err := a.Merge(other); !errors.Is(err, mismatchedDimensions) {
+		t.Errorf("Expected mismatched dimensions error, found %v", err)
+	}
+
+	small, _ := New(0.1, 0.1)
+	ip, _ := NewTopK(20, 20000, 0.01)
+	agent, _ := New(0.01, 0.01)
+	other, _ = NewMulti(map[string]*Sketch{"url": small, "ip": ip, "agent": agent})
+	ip.Insert("10.0.0.1", 1)
+	before := a.Sketch("ip").Total()
+	if err := a.Merge(other); !errors.Is(err, ErrIncompatibleSketches) {
+		t.Errorf("Expected incompatible sketches error, found %v", err)
+	}
+	if a.Sketch("ip").Total() != before {
+		t.Error("Expected nothing to be merged from incompatible dimensions")
+	}
+}
+
+func TestMultiSketchMarshalBinary(t *testing.T) {
+	ms := newRequestSketch()
+	for _, event := range requestLog(5000, 3) {
+		ms.Insert(event, 1)
+	}
+
+	data, err := ms.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := newRequestSketch()
+	if err := dec.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range ms.Dimensions() {
+		assertSameState(t, ms.Sketch(name), dec.Sketch(name))
+	}
+
+	url, _ := NewTopK(10, 20000, 0.01)
+	other, _ := NewMulti(map[string]*Sketch{"url": url})
+	if err := other.UnmarshalBinary(data); !errors.Is(err, mismatchedDimensions) {
+		t.Errorf("Expected mismatched dimensions error, found %v", err)
+	}
+
+	for _, bad := range [][]byte{nil, data[:len(data)/2], append(append([]byte(nil), data...), 0)} {
+		if err := dec.UnmarshalBinary(bad); !errors.Is(err, ErrCorruptData) {
+			t.Errorf("Expected corrupt data error, found %v", err)
+		}
+	}
+	future := append([]byte{multiFormatVersion + 1}, data[1:]...)
+	if err := dec.UnmarshalBinary(future); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected unsupported version error, found %v", err)
+	}
+}
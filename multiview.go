@@ -0,0 +1,171 @@
+package topkapi
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// MultiView answers queries over several compatible sketches, like one per
+// region, as if they were merged into one, without merging or copying them.
+// It reads the sketches at query time, so it always sees their latest
+// inserts, at the cost of querying every one of them.
+//
+// The candidates of the view are those of all sketches, and an estimate is
+// the sum of the count-min estimates of the sketches. Merging the sketches
+// instead adds up their counters before taking the minimum, so estimates of
+// the view never undercount and never exceed those of the merged sketch, and
+// the view reports every key the merged sketch does, along with candidates
+// the merged sketch would have dropped.
+type MultiView struct {
+	sketches []*Sketch
+	locks    []sync.Locker // read lock of each sketch, nil if unshared
+}
+
+// NewMultiView creates a MultiView of sketches, which must be compatible,
+// see Sketch.Merge. The sketches must not be modified while the view is
+// queried; see NewConcurrentMultiView for sketches that are.
+func NewMultiView(sketches ...*Sketch) (*MultiView, error) {
+	return newMultiView(sketches, nil)
+}
+
+// NewConcurrentMultiView creates a MultiView of the sketches of shared
+// ConcurrentSketches, which must be compatible, see Sketch.Merge. Queries
+// take the read lock of one sketch at a time, so they hold off writers as
+// little as possible, but don't see all sketches at the same instant.
+func NewConcurrentMultiView(sketches ...*ConcurrentSketch) (*MultiView, error) {
+	sks := make([]*Sketch, len(sketches))
+	locks := make([]sync.Locker, len(sketches))
+	for n, c := range sketches {
+		if c == nil {
+			return nil, nilSketch
+		}
+		sks[n], locks[n] = c.sk, c.mu.RLocker()
+	}
+
+	return newMultiView(sks, locks)
+}
+
+func newMultiView(sketches []*Sketch, locks []sync.Locker) (*MultiView, error) {
+	if len(sketches) == 0 {
+		return nil, newError(ErrInvalidParameter, "topkapi: at least one sketch is required")
+	}
+	for n, sk := range sketches {
+		if sk == nil {
+			return nil, nilSketch
+		}
+		if sk.incompatible(sketches[0]) {
+			return nil, fmt.Errorf("%w: sketch %d", ErrIncompatibleSketches, n)
+		}
+	}
+
+	return &MultiView{sketches: sketches, locks: locks}, nil
+}
+
+// read calls fn with every sketch under its read lock.
+func (v *MultiView) read(fn func(sk *Sketch)) {
+	for n, sk := range v.sketches {
+		if v.locks != nil {
+			v.locks[n].Lock()
+		}
+		fn(sk)
+		if v.locks != nil {
+			v.locks[n].Unlock()
+		}
+	}
+}
+
+// Count returns the sum of the estimates of key in all sketches, see
+// Sketch.Count, and whether it is a candidate in any of them.
+func (v *MultiView) Count(key interface{}) (uint64, bool) {
+	var (
+		sum     uint64
+		tracked bool
+	)
+	v.read(func(sk *Sketch) {
+		c, ok := sk.Count(key)
+		sum = saturatingAdd(sum, c)
+		tracked = tracked || ok
+	})
+
+	return sum, tracked
+}
+
+// Result returns the candidates of any sketch with an estimate of at least
+// threshold, ordered like Sketch.Result. Rows is the largest number of rows
+// holding the key in any sketch.
+func (v *MultiView) Result(threshold uint64) []LocalHeavyHitter {
+	rs := v.ranked(threshold)
+
+	res := make([]LocalHeavyHitter, len(rs))
+	for i := range rs {
+		res[i] = rs[i].LocalHeavyHitter
+	}
+
+	return res
+}
+
+// TopK returns the k candidates with the highest estimates, ordered like
+// Sketch.TopK. It returns an empty, non-nil slice if there are none or k < 1.
+func (v *MultiView) TopK(k int) []LocalHeavyHitter {
+	if k < 1 {
+		return []LocalHeavyHitter{}
+	}
+
+	rs := v.ranked(1)
+	if len(rs) > k {
+		rs = rs[:k]
+	}
+	res := make([]LocalHeavyHitter, len(rs))
+	for i := range rs {
+		res[i] = rs[i].LocalHeavyHitter
+	}
+
+	return res
+}
+
+// ranked collects the candidates of all sketches, and returns those with an
+// estimate of at least threshold in order.
+func (v *MultiView) ranked(threshold uint64) []rankedHitter {
+	index := make(map[interface{}]int)
+	var rs []rankedHitter
+	v.read(func(sk *Sketch) {
+		sk.scan(1, nil, func(hh LocalHeavyHitter, hsum uint64) {
+			n, ok := index[hh.Key]
+			if !ok {
+				index[hh.Key] = len(rs)
+				rs = append(rs, rankedHitter{LocalHeavyHitter{Key: hh.Key, Rows: hh.Rows, Sample: hh.Sample}, hsum})
+				return
+			}
+			if hh.Rows > rs[n].Rows {
+				rs[n].Rows = hh.Rows
+			}
+		})
+	})
+
+	// Compatible sketches hash alike, so the key hashes hold in all of them
+	v.read(func(sk *Sketch) {
+		for n := range rs {
+			rs[n].Count = saturatingAdd(rs[n].Count, sk.counterMin(rs[n].hsum))
+		}
+	})
+
+	kept := rs[:0]
+	for _, r := range rs {
+		if r.Count >= threshold {
+			kept = append(kept, r)
+		}
+	}
+	sort.Sort(rankedOrder(kept))
+
+	return kept
+}
+
+// saturatingAdd returns a+b, or the largest uint64 if it overflows.
+func saturatingAdd(a, b uint64) uint64 {
+	if a+b < a {
+		return math.MaxUint64
+	}
+	return a + b
+}
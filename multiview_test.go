@@ -0,0 +1,103 @@
+package topkapi
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestMultiView(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		regions := make([]*Sketch, 4)
+		for n := range regions {
+			regions[n], _ = New(0.01, 0.01)
+		}
+		keys := zipfKeys(40000, 3000, seed)
+		for _, key := range keys {
+			regions[rnd.Intn(len(regions))].Insert(key, 1)
+		}
+		exact := exactCount(keys)
+
+		merged := regions[0].Clone()
+		for _, sk := range regions[1:] {
+			if err := merged.Merge(sk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		view, err := NewMultiView(regions...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Estimates lie between the true counts and those of the merged sketch
+		res := view.Result(1)
+		found := make(map[interface{}]LocalHeavyHitter, len(res))
+		for _, hh := range res {
+			found[hh.Key] = hh
+			upper, _ := merged.Count(hh.Key)
+			if hh.Count < exact[hh.Key.(string)] || hh.Count > upper {
+				t.Fatalf("Seed %d: expected %v between %d and %d, found %d", seed, hh.Key, exact[hh.Key.(string)], upper, hh.Count)
+			}
+			if c, ok := view.Count(hh.Key); c != hh.Count || !ok {
+				t.Errorf("Seed %d: expected Count of %v to match its result %d, found %d", seed, hh.Key, hh.Count, c)
+			}
+		}
+		for _, hh := range merged.Result(1) {
+			if _, ok := found[hh.Key]; !ok {
+				t.Errorf("Seed %d: expected %v of the merged sketch in the view", seed, hh.Key)
+			}
+		}
+
+		// The heavy hitters are the same
+		top, want := view.TopK(5), merged.TopK(5)
+		for i := range want {
+			if top[i].Key != want[i].Key {
+				t.Errorf("Seed %d: expected %v at rank %d, found %v", seed, want[i].Key, i, top[i].Key)
+			}
+		}
+		if len(view.Result(top[0].Count+1)) != 0 {
+			t.Errorf("Seed %d: expected nothing above the top count", seed)
+		}
+
+		// The view doesn't modify the sketches
+		if regions[0].Total()+regions[1].Total()+regions[2].Total()+regions[3].Total() != merged.Total() {
+			t.Errorf("Seed %d: expected the sketches to be left alone", seed)
+		}
+	}
+
+	if _, err := NewMultiView(newSketch(10, 2), newSketch(20, 2)); err == nil {
+		t.Error("Expected incompatible sketches to be rejected")
+	}
+	if _, err := NewMultiView(); err == nil {
+		t.Error("Expected an error without sketches")
+	}
+}
+
+func TestConcurrentMultiView(t *testing.T) {
+	a, b := NewConcurrent(newSketch(100, 3)), NewConcurrent(newSketch(100, 3))
+	view, err := NewConcurrentMultiView(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range []*ConcurrentSketch{a, b} {
+		wg.Add(1)
+		go func(c *ConcurrentSketch) {
+			defer wg.Done()
+			for _, key := range zipfKeys(10000, 100, 1) {
+				c.Insert(key, 1)
+			}
+		}(c)
+	}
+	for i := 0; i < 100; i++ {
+		view.TopK(3)
+		view.Count("key0")
+	}
+	wg.Wait()
+
+	if c, ok := view.Count("key0"); !ok || c < 2*exactCount(zipfKeys(10000, 100, 1))["key0"] {
+		t.Errorf("Expected key0 counted in both sketches, found %d", c)
+	}
+}
@@ -0,0 +1,230 @@
+package topkapi
+
+import (
+	"log"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// Option configures optional behaviour of a Sketch. Options are passed to
+// the constructors and applied in order after the sketch has been sized.
+type Option func(*Sketch) error
+
+func (sk *Sketch) apply(opts []Option) (*Sketch, error) {
+	for _, opt := range opts {
+		if err := opt(sk); err != nil {
+			return nil, err
+		}
+	}
+
+	return sk, nil
+}
+
+// WithCanonicalizer maps every key to a canonical form before it is hashed or
+// stored, so keys that differ only in fields irrelevant to counting end up
+// as one. It is applied consistently by Insert and by every method that
+// looks up a key, and results report the canonical form.
+func WithCanonicalizer(canonicalize func(key interface{}) interface{}) Option {
+	return func(sk *Sketch) error {
+		if canonicalize == nil {
+			return newError(ErrInvalidParameter, "topkapi: canonicalizer should not be nil")
+		}
+		sk.canonicalize = canonicalize
+		return nil
+	}
+}
+
+// canonical returns the form key is stored under.
+func (sk *Sketch) canonical(key interface{}) interface{} {
+	if sk.canonicalize != nil {
+		key = sk.canonicalize(key)
+	}
+	if sk.numericKeys {
+		key = sk.numeric(key)
+	}
+	if s, ok := key.(string); ok && sk.foldCase {
+		if lower := strings.ToLower(s); lower != s {
+			key = lower
+		}
+	}
+	return key
+}
+
+// WithCaseInsensitiveKeys counts string keys regardless of case, as their
+// lower case with strings.ToLower, so that "Apple" and "apple" are one key.
+// It applies to keys of type string only, after the canonicalizer, if any,
+// and results report the lower case. Like the canonicalizer, it is applied
+// by Insert and by every method that looks up a key, but not by
+// InsertHashed.
+func WithCaseInsensitiveKeys() Option {
+	return func(sk *Sketch) error {
+		sk.foldCase = true
+		return nil
+	}
+}
+
+// WithNumericKeys counts integers of every type as one key per value, like
+// int(5), int64(5) and uint8(5), which otherwise are different keys. They
+// are stored as int64, or as uint64 if too large for int64. With floats,
+// floating point numbers holding an integer are counted as that integer too.
+// Numbers are converted after the canonicalizer, if any.
+func WithNumericKeys(floats bool) Option {
+	return func(sk *Sketch) error {
+		sk.numericKeys = true
+		sk.integralFloats = floats
+		return nil
+	}
+}
+
+// numeric returns the canonical form of a numeric key, see WithNumericKeys.
+func (sk *Sketch) numeric(key interface{}) interface{} {
+	switch k := key.(type) {
+	case int:
+		return int64(k)
+	case int8:
+		return int64(k)
+	case int16:
+		return int64(k)
+	case int32:
+		return int64(k)
+	case uint:
+		return unsigned(uint64(k))
+	case uint8:
+		return int64(k)
+	case uint16:
+		return int64(k)
+	case uint32:
+		return int64(k)
+	case uint64:
+		return unsigned(k)
+	case float32:
+		if sk.integralFloats {
+			return integral(float64(k))
+		}
+	case float64:
+		if sk.integralFloats {
+			return integral(k)
+		}
+	}
+	return key
+}
+
+// unsigned returns v as int64 if it fits.
+func unsigned(v uint64) interface{} {
+	if v > math.MaxInt64 {
+		return v
+	}
+	return int64(v)
+}
+
+// integral returns f as an integer if it holds one.
+func integral(f float64) interface{} {
+	switch {
+	case f != math.Trunc(f):
+		return f
+	case f >= -(1<<63) && f < 1<<63:
+		return int64(f)
+	case f >= 0 && f < 1<<64:
+		return uint64(f)
+	}
+	return f
+}
+
+// WithExtraCounterRows adds n rows of plain count-min counters. Insert updates
+// them like the regular rows, but they don't track candidates, and estimates
+// take the minimum over all counter rows. A counter row costs a quarter of
+// the memory of a regular row, whose buckets also hold a candidate key and
+// its count, so extra rows are a cheap way to reduce overestimation.
+func WithExtraCounterRows(n int) Option {
+	return func(sk *Sketch) error {
+		if n < 0 {
+			return newError(ErrInvalidParameter, "topkapi: value of n should be >= 0")
+		}
+		if err := checkDimensions(sk.b, uint64(sk.cms.rows)+uint64(n)); err != nil {
+			return err
+		}
+		sk.cms = sk.cms.extended(n)
+		return nil
+	}
+}
+
+// WithSeed changes the bucket every key is assigned to, so that keys
+// colliding in one sketch are unlikely to collide again in a sketch with
+// another seed. Only sketches with the same seed can be merged. The default
+// seed is 0.
+func WithSeed(seed uint64) Option {
+	return func(sk *Sketch) error {
+		sk.seed = seed
+		return nil
+	}
+}
+
+// WithMinCount leaves keys out of the candidates until their estimate
+// reaches n. Below that, Insert only adds to the counters, so keys seen only a
+// few times, like the singletons of a long tail, don't displace candidates
+// or wear down their residuals. Such keys still have an estimate, see Count,
+// but don't appear in Result or TopK. The floor applies to the estimate,
+// which includes the counts of colliding keys, so keys reach it sooner in a
+// crowded sketch.
+func WithMinCount(n uint64) Option {
+	return func(sk *Sketch) error {
+		sk.minCount = n
+		return nil
+	}
+}
+
+// WithKeyNormalizer normalizes string keys passed to InsertString,
+// CountString and CountReader, for example to lowercase hosts or strip
+// query parameters, before the canonicalizer is applied. Insert and Count
+// take keys as they are.
+//
+// The sketch records the name of the normalizer function, and Merge warns
+// when combining sketches with different normalizers. Normalizers created by
+// the same function literal share a name.
+func WithKeyNormalizer(normalize func(key string) string) Option {
+	return func(sk *Sketch) error {
+		if normalize == nil {
+			return newError(ErrInvalidParameter, "topkapi: normalizer should not be nil")
+		}
+		sk.normalize = normalize
+		sk.normalizer = funcName(normalize)
+		return nil
+	}
+}
+
+// funcName returns the name of the function f, "" if it is nil.
+func funcName(f interface{}) string {
+	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+}
+
+// normalized returns key normalized by the key normalizer, if any.
+func (sk *Sketch) normalized(key string) string {
+	if sk.normalize == nil {
+		return key
+	}
+	return sk.normalize(key)
+}
+
+// WithWarningHandler passes problems that don't make an operation fail, like
+// merging sketches with different key normalizers, to handle instead of
+// the standard logger.
+func WithWarningHandler(handle func(err error)) Option {
+	return func(sk *Sketch) error {
+		if handle == nil {
+			return newError(ErrInvalidParameter, "topkapi: warning handler should not be nil")
+		}
+		sk.warn = handle
+		return nil
+	}
+}
+
+// warning reports err to the warning handler.
+func (sk *Sketch) warning(err error) {
+	if sk.warn == nil {
+		log.Print(err)
+		return
+	}
+	sk.warn(err)
+}
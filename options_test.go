@@ -0,0 +1,231 @@
+package topkapi
+
+import (
+	"math"
+	"testing"
+)
+
+type request struct {
+	Path      string
+	RequestID int
+}
+
+func TestWithCanonicalizer(t *testing.T) {
+	stripID := func(key interface{}) interface{} {
+		r := key.(request)
+		r.RequestID = 0
+		return r
+	}
+	sk, err := New(0.01, 0.01, WithCanonicalizer(stripID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sk.Insert(request{Path: "/a", RequestID: 1}, 1)
+	sk.Insert(request{Path: "/a", RequestID: 2}, 1)
+	sk.Insert(request{Path: "/b", RequestID: 3}, 1)
+
+	res := sk.Result(1)
+	if len(res) != 2 {
+		t.Fatalf("Expected 2 keys, found %v", res)
+	}
+	if res[0].Key != (request{Path: "/a"}) || res[0].Count != 2 {
+		t.Errorf("Expected canonical /a with count 2, found %v", res[0])
+	}
+}
+
+func TestWithCanonicalizerNil(t *testing.T) {
+	if _, err := New(0.01, 0.01, WithCanonicalizer(nil)); err == nil {
+		t.Error("Expected error for nil canonicalizer")
+	}
+}
+
+// overestimation sums how much the top results overcount their keys.
+func overestimation(exact map[string]uint64, result []LocalHeavyHitter) uint64 {
+	var over uint64
+	for _, hh := range result {
+		over += hh.Count - exact[hh.Key.(string)]
+	}
+
+	return over
+}
+
+func TestWithExtraCounterRows(t *testing.T) {
+	words := loadWords()
+	exact := exactCount(words)
+
+	plain := newSketch(2000, 2)
+	full := newSketch(2000, 6)
+	extra, err := newSketch(2000, 2).apply([]Option{WithExtraCounterRows(4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range words {
+		plain.Insert(w, 1)
+		extra.Insert(w, 1)
+		full.Insert(w, 1)
+	}
+
+	// Four extra counter rows cost as much memory as one full row
+	plainOver := overestimation(exact, plain.TopK(50))
+	extraOver := overestimation(exact, extra.TopK(50))
+	fullOver := overestimation(exact, full.TopK(50))
+	if extraOver >= plainOver*9/10 {
+		t.Errorf("Expected extra counter rows to reduce overestimation by 10%%, found %d vs %d", extraOver, plainOver)
+	}
+	if extraOver > fullOver {
+		t.Errorf("Expected extra counter rows to do as well as four full rows, found %d vs %d", extraOver, fullOver)
+	}
+
+	for _, hh := range extra.TopK(20) {
+		count, tracked := extra.Count(hh.Key)
+		if !tracked || count != hh.Count {
+			t.Errorf("Expected Count('%s') to be %d and tracked, found %d %v", hh.Key, hh.Count, count, tracked)
+		}
+		if count < exact[hh.Key.(string)] {
+			t.Errorf("Expected Count('%s') >= %d, found %d", hh.Key, exact[hh.Key.(string)], count)
+		}
+	}
+	if extra.Delta() >= plain.Delta() {
+		t.Errorf("Expected extra rows to lower delta, found %f vs %f", extra.Delta(), plain.Delta())
+	}
+}
+
+func TestWithExtraCounterRowsMerge(t *testing.T) {
+	words := loadWords()
+	slices := split(words, 2)
+	opts := []Option{WithExtraCounterRows(2)}
+
+	sk1, _ := newSketch(4000, 2).apply(opts)
+	sk2, _ := newSketch(4000, 2).apply(opts)
+	whole, _ := newSketch(4000, 2).apply(opts)
+	for _, w := range slices[0] {
+		sk1.Insert(w, 1)
+		whole.Insert(w, 1)
+	}
+	for _, w := range slices[1] {
+		sk2.Insert(w, 1)
+		whole.Insert(w, 1)
+	}
+
+	if err := sk1.Merge(sk2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i < 4; i++ {
+		for j := uint64(0); j < whole.b; j++ {
+			if sk1.cms.get(i, j) != whole.cms.get(i, j) {
+				t.Fatalf("Expected merged counter row %d to equal the single sketch", i)
+			}
+		}
+	}
+
+	if err := sk1.Merge(newSketch(4000, 2)); err == nil {
+		t.Error("Expected error merging sketches with different counter rows")
+	}
+}
+
+func TestWithSeed(t *testing.T) {
+	a, _ := New(0.01, 0.01)
+	b, _ := New(0.01, 0.01, WithSeed(1))
+
+	moved := 0
+	for i := 0; i < 100; i++ {
+		hsum := a.hashKey(i)
+		if a.bucket(hsum, 0) != b.bucket(hsum, 0) {
+			moved++
+		}
+	}
+	if moved < 90 {
+		t.Errorf("Expected another seed to move most keys to another bucket, found %d of 100", moved)
+	}
+
+	b.Insert("a", 3)
+	if c, _ := b.Count("a"); c != 3 {
+		t.Errorf("Expected seeded sketch to count a=3, found %d", c)
+	}
+	if err := a.Merge(b); err != ErrIncompatibleSketches {
+		t.Errorf("Expected error merging sketches with different seeds, found %v", err)
+	}
+}
+
+func TestWithNumericKeys(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithNumericKeys(false))
+	sk.Insert(int(5), 1)
+	sk.Insert(int64(5), 1)
+	sk.Insert(uint64(5), 1)
+	sk.Insert(5.0, 1)
+
+	res := sk.Result(1)
+	if len(res) != 2 || res[0].Key != int64(5) || res[0].Count != 3 || res[1].Key != 5.0 {
+		t.Errorf("Expected integers to count as int64(5)=3 apart from 5.0, found %v", res)
+	}
+	if c, _ := sk.Count(uint8(5)); c != 3 {
+		t.Errorf("Expected uint8(5) to count 3, found %d", c)
+	}
+
+	sk, _ = New(0.01, 0.01, WithNumericKeys(true))
+	for _, key := range []interface{}{int32(-7), -7.0, float32(-7), 7.5, uint64(math.MaxUint64), float64(1 << 63), math.NaN()} {
+		sk.Insert(key, 1)
+	}
+	for key, want := range map[interface{}]uint64{int64(-7): 3, 7.5: 1, uint64(math.MaxUint64): 1, uint64(1 << 63): 1} {
+		if c, _ := sk.Count(key); c != want {
+			t.Errorf("Expected %T(%v) to count %d, found %d", key, key, want, c)
+		}
+	}
+
+	// Off by default, the keys contend for the same buckets
+	sk, _ = New(0.01, 0.01)
+	sk.Insert(int(5), 1)
+	sk.Insert(int64(5), 1)
+	if _, ok := sk.Count(int64(5)); ok {
+		t.Error("Expected int and int64 to be different keys by default")
+	}
+}
+
+func TestWithCaseInsensitiveKeys(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithCaseInsensitiveKeys())
+	for _, key := range []string{"Apple", "apple", "APPLE", "aPpLe", "pear"} {
+		sk.Insert(key, 1)
+	}
+	sk.InsertDistinctStrings([]string{"Pear", "PEAR"}, 1)
+	sk.Insert(42, 1)
+
+	res := sk.Result(1)
+	if len(res) != 3 || res[0].Key != "apple" || res[0].Count != 4 || res[1].Key != "pear" || res[1].Count != 2 {
+		t.Errorf("Expected apple=4 and pear=2 in lower case, found %v", res)
+	}
+	if c, _ := sk.Count("ApPlE"); c != 4 {
+		t.Errorf("Expected lookups regardless of case, found %d", c)
+	}
+	if c, _ := sk.Count(42); c != 1 {
+		t.Errorf("Expected other keys to be unaffected, found %d", c)
+	}
+}
+
+func TestWithMinCount(t *testing.T) {
+	sk, _ := New(0.01, 0.0001, WithMinCount(3))
+	for i := 0; i < 1000; i++ {
+		sk.Insert(i, 1)
+		if i%10 == 0 {
+			sk.Insert("frequent", 1)
+		}
+	}
+
+	res := sk.Result(1)
+	if len(res) != 1 || res[0].Key != "frequent" || res[0].Count != 100 {
+		t.Errorf("Expected only frequent=100 to be a candidate, found %v", res)
+	}
+	if c, ok := sk.Count(7); ok || c < 1 {
+		t.Errorf("Expected a singleton to be estimated but not a candidate, found %d (%v)", c, ok)
+	}
+
+	// A key becomes a candidate once it reaches the floor
+	sk.Insert("late", 2)
+	if _, ok := sk.Count("late"); ok {
+		t.Error("Expected late=2 not to be a candidate")
+	}
+	sk.Insert("late", 1)
+	if _, ok := sk.Count("late"); !ok {
+		t.Error("Expected late=3 to be a candidate")
+	}
+}
@@ -0,0 +1,82 @@
+// Package otel reports the state of a sketch as OpenTelemetry metrics. It is
+// a module of its own, so that topkapi itself doesn't depend on
+// OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/wardbekker/topkapi"
+)
+
+// Sketch wraps a sketch, measuring the time spent in Insert and reporting
+// the number of distinct candidates, the total and the evictions whenever
+// the meter collects. It doesn't replace the sketch: every other method is
+// that of topkapi.ConcurrentSketch, as collection runs concurrently with
+// inserts.
+type Sketch struct {
+	*topkapi.ConcurrentSketch
+
+	inserted     metric.Float64Counter
+	registration metric.Registration
+}
+
+// Instrument wraps sk and registers its metrics with meter. The caller must
+// not use sk directly afterwards. Reporting scans the candidates of the
+// sketch, like topkapi.Sketch.Stats, once per collection.
+func Instrument(sk *topkapi.Sketch, meter metric.Meter) (*Sketch, error) {
+	inserted, err := meter.Float64Counter("topkapi.insert.duration",
+		metric.WithDescription("Time spent inserting into the sketch"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	tracked, err := meter.Int64ObservableGauge("topkapi.distinct_tracked",
+		metric.WithDescription("Distinct keys held as candidates"))
+	if err != nil {
+		return nil, err
+	}
+	total, err := meter.Int64ObservableGauge("topkapi.total",
+		metric.WithDescription("Sum of all counts inserted into the sketch"))
+	if err != nil {
+		return nil, err
+	}
+	evictions, err := meter.Int64ObservableGauge("topkapi.evictions",
+		metric.WithDescription("Candidates displaced by another key"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sketch{
+		ConcurrentSketch: topkapi.NewConcurrent(sk),
+		inserted:         inserted,
+	}
+	s.registration, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		st := s.Stats()
+		o.ObserveInt64(tracked, int64(st.Tracked))
+		o.ObserveInt64(total, int64(st.Total))
+		o.ObserveInt64(evictions, int64(st.Evictions))
+		return nil
+	}, tracked, total, evictions)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Insert inserts into the sketch and adds the time it took to the insert
+// duration.
+func (s *Sketch) Insert(key interface{}, count uint64) {
+	start := time.Now()
+	s.ConcurrentSketch.Insert(key, count)
+	s.inserted.Add(context.Background(), time.Since(start).Seconds())
+}
+
+// Close unregisters the metrics of the sketch. The sketch can still be used.
+func (s *Sketch) Close() error {
+	return s.registration.Unregister()
+}
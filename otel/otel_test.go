@@ -0,0 +1,80 @@
+package otel
+
+import (
+	"context"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/wardbekker/topkapi"
+)
+
+// collect returns the collected metrics by name.
+func collect(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Aggregation {
+	t.Helper()
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]metricdata.Aggregation)
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			found[m.Name] = m.Data
+		}
+	}
+	return found
+}
+
+func gauge(t *testing.T, found map[string]metricdata.Aggregation, name string) int64 {
+	t.Helper()
+
+	g, ok := found[name].(metricdata.Gauge[int64])
+	if !ok || len(g.DataPoints) != 1 {
+		t.Fatalf("Expected gauge %s, found %v", name, found[name])
+	}
+	return g.DataPoints[0].Value
+}
+
+func TestInstrument(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	sk, _ := topkapi.New(0.01, 0.01)
+	s, err := Instrument(sk, meter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		s.Insert(i%10, 2)
+	}
+
+	found := collect(t, reader)
+	if tracked := gauge(t, found, "topkapi.distinct_tracked"); tracked != 10 {
+		t.Errorf("Expected 10 distinct tracked keys, found %d", tracked)
+	}
+	if total := gauge(t, found, "topkapi.total"); total != 2000 {
+		t.Errorf("Expected total 2000, found %d", total)
+	}
+	if evictions := gauge(t, found, "topkapi.evictions"); evictions != int64(s.Stats().Evictions) {
+		t.Errorf("Expected %d evictions, found %d", s.Stats().Evictions, evictions)
+	}
+	sum, ok := found["topkapi.insert.duration"].(metricdata.Sum[float64])
+	if !ok || len(sum.DataPoints) != 1 || sum.DataPoints[0].Value <= 0 {
+		t.Errorf("Expected insert duration, found %v", found["topkapi.insert.duration"])
+	}
+
+	// The wrapped sketch keeps working
+	if c, _ := s.Count(3); c != 200 {
+		t.Errorf("Expected 3=200, found %d", c)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := collect(t, reader)["topkapi.total"].(metricdata.Gauge[int64]); ok && len(g.DataPoints) > 0 {
+		t.Errorf("Expected no observations after Close, found %v", g.DataPoints)
+	}
+}
@@ -0,0 +1,43 @@
+package topkapi
+
+import "sort"
+
+// ResultWithOverrides is like Result, but reports the count in exact instead
+// of the estimate for every candidate found in it, like the exact counts of
+// a few keys tracked elsewhere. Candidates are ranked and compared to
+// threshold by the counts reported, so an overridden key may fall below or
+// rise above threshold. Keys of exact are canonicalized like those of
+// Insert, and keys that aren't candidates aren't reported.
+func (sk *Sketch) ResultWithOverrides(threshold uint64, exact map[interface{}]uint64) []LocalHeavyHitter {
+	overrides := make(map[interface{}]uint64, len(exact))
+	for key, c := range exact {
+		if key, ok := sk.limit(sk.canonical(key)); ok && key != nil {
+			overrides[key] = c
+		}
+	}
+
+	// An exact count may exceed the estimate, so overridden candidates are
+	// found whatever their estimate
+	scanned := threshold
+	if len(overrides) > 0 {
+		scanned = 1
+	}
+
+	var rs []rankedHitter
+	sk.scan(scanned, nil, func(hh LocalHeavyHitter, hsum uint64) {
+		if c, ok := overrides[hh.Key]; ok {
+			hh.Count = c
+		}
+		if hh.Count >= threshold {
+			rs = append(rs, rankedHitter{hh, hsum})
+		}
+	})
+	sort.Sort(rankedOrder(rs))
+
+	res := make([]LocalHeavyHitter, len(rs))
+	for i := range rs {
+		res[i] = rs[i].LocalHeavyHitter
+	}
+
+	return res
+}
@@ -0,0 +1,56 @@
+package topkapi
+
+import "testing"
+
+func TestResultWithOverrides(t *testing.T) {
+	sk := newSketch(50, 3)
+	for _, key := range zipfKeys(20000, 2000, 5) {
+		sk.Insert(key, 1)
+	}
+	res := sk.Result(100)
+	if len(res) < 3 {
+		t.Fatalf("Expected at least 3 heavy hitters, found %d", len(res))
+	}
+
+	// The top key drops to the bottom, the third rises to the top and the
+	// second falls below the threshold
+	exact := map[interface{}]uint64{
+		res[0].Key: res[len(res)-1].Count,
+		res[1].Key: 99,
+		res[2].Key: res[0].Count + 1,
+		"unseen":   1000,
+	}
+	got := sk.ResultWithOverrides(100, exact)
+	if len(got) != len(res)-1 {
+		t.Fatalf("Expected %d heavy hitters, found %v", len(res)-1, got)
+	}
+	if got[0].Key != res[2].Key || got[0].Count != res[0].Count+1 {
+		t.Errorf("Expected %v=%d first, found %v", res[2].Key, res[0].Count+1, got[0])
+	}
+	for i, hh := range got {
+		if hh.Key == res[1].Key || hh.Key == "unseen" {
+			t.Errorf("Expected %v not to be reported, found %v", hh.Key, hh)
+		}
+		if c, ok := exact[hh.Key]; ok && hh.Count != c {
+			t.Errorf("Expected the exact count %d of %v, found %d", c, hh.Key, hh.Count)
+		}
+		if i > 0 && got[i-1].Count < hh.Count {
+			t.Errorf("Expected %v to be ranked before %v", got[i-1], hh)
+		}
+	}
+
+	// An exact count can lift a candidate above the threshold
+	for _, hh := range sk.Result(1) {
+		if hh.Count < 100 {
+			lifted := sk.ResultWithOverrides(100, map[interface{}]uint64{hh.Key: 5000})
+			if len(lifted) == 0 || lifted[0].Key != hh.Key {
+				t.Errorf("Expected %v to rise to the top, found %v", hh.Key, lifted)
+			}
+			break
+		}
+	}
+
+	if plain := sk.ResultWithOverrides(100, nil); len(plain) != len(res) || plain[0] != res[0] {
+		t.Errorf("Expected the result without overrides, found %v", plain)
+	}
+}
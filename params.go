@@ -0,0 +1,163 @@
+package topkapi
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// slotSize is the memory of a bucket in a row holding candidates: its
+	// counter, residual, key hash, and the interface value of its key.
+	slotSize = 8 + 8 + 8 + 16
+
+	// minRows and minBucketsPerKey bound how far SuggestParameters shrinks
+	// a sketch to fit a budget. With fewer buckets per heavy hitter, heavy
+	// hitters rarely hold their own bucket.
+	minRows          = 2
+	minBucketsPerKey = 10
+)
+
+var insufficientBudget = newError(ErrInvalidParameter, "topkapi: memory budget too small")
+
+// Params are the dimensions of a sketch, along with their consequences.
+type Params struct {
+	B, L uint64 // buckets per row and rows, see Parse
+
+	// Memory is the expected size of the sketch in bytes, excluding the
+	// keys themselves.
+	Memory  uint64
+	Epsilon float64
+	Delta   float64
+}
+
+// SuggestParameters returns the dimensions NewTopK picks for finding the top
+// k in a corpus of about the given size, shrunk to fit in memoryBudget bytes
+// if it's not 0. Rows are dropped before buckets, down to 2 rows and 10
+// buckets per heavy hitter. If even that doesn't fit, the error reports the
+// smallest budget that does.
+func SuggestParameters(k, approxCorpusSize uint64, memoryBudget uint64) (Params, error) {
+	if k < 1 {
+		return Params{}, newError(ErrInvalidParameter, "topkapi: value of k should be >= 1")
+	}
+
+	minB := minBucketsPerKey * k
+	b, l := topKBuckets(k, approxCorpusSize), uint64(4)
+	if b < minB {
+		b = minB
+	}
+
+	if memoryBudget > 0 {
+		for l > minRows && sketchMemory(b, l) > memoryBudget {
+			l--
+		}
+		if sketchMemory(b, l) > memoryBudget {
+			if min := sketchMemory(minB, l); memoryBudget < min {
+				return Params{}, fmt.Errorf("%w: at least %d bytes are needed", insufficientBudget, min)
+			}
+			b = (memoryBudget - sketchMemory(0, l)) / (l * slotSize)
+		}
+	}
+
+	return params(b, l), nil
+}
+
+// NewFromParams creates a sketch of the dimensions in p, as suggested by
+// SuggestParameters. Only B and L are used. It returns an error wrapping
+// ErrInvalidParameter for dimensions out of range, or for an option that
+// fails.
+func NewFromParams(p Params, opts ...Option) (*Sketch, error) {
+	if p.B < 1 || p.L < 1 {
+		return nil, newError(ErrInvalidParameter, "topkapi: values of B and L should be >= 1")
+	}
+	if err := checkDimensions(p.B, p.L); err != nil {
+		return nil, err
+	}
+
+	return newSketch(p.B, p.L).apply(opts)
+}
+
+// DefaultBucketFactor and DefaultRows size the sketches of NewTopK. The
+// factor 55 was chosen through experimentation as the minimal threshold
+// where the error rates don't grow out of control on merge and our tests
+// pass; skewed streams may do with less, see WithBucketFactor.
+const (
+	DefaultBucketFactor = 55.0
+	DefaultRows         = 4
+)
+
+// Buckets returns the number of buckets per row NewTopK uses for finding the
+// top k in a corpus of about the given size with the given bucket factor,
+// which grows with k*log(corpus size).
+func Buckets(k, approxCorpusSize uint64, factor float64) uint64 {
+	// The log of an empty corpus is -Inf, and converting a float out of the
+	// range of uint64 is up to the platform, so both ends are clamped
+	b := factor * float64(k) * math.Log(float64(approxCorpusSize))
+	switch {
+	case !(b > 0):
+		return 0
+	case b >= math.MaxUint64:
+		return math.MaxUint64
+	}
+	return uint64(b)
+}
+
+// topKBuckets returns the number of buckets NewTopK uses by default.
+func topKBuckets(k, approxCorpusSize uint64) uint64 {
+	return Buckets(k, approxCorpusSize, DefaultBucketFactor)
+}
+
+// topKSizing holds the options of NewTopK that size the sketch.
+type topKSizing struct {
+	rows   uint64
+	factor float64
+}
+
+// WithRows gives the sketches of NewTopK n rows instead of DefaultRows.
+// More rows lower the chance that a heavy hitter loses all its buckets to
+// other keys, at the cost of memory and time per insert. Other constructors
+// reject it.
+func WithRows(n uint64) Option {
+	return func(sk *Sketch) error {
+		if sk.sizing == nil {
+			return newError(ErrInvalidParameter, "topkapi: WithRows only applies to NewTopK")
+		}
+		if n < 1 {
+			return newError(ErrInvalidParameter, "topkapi: value of n should be >= 1")
+		}
+		sk.sizing.rows = n
+		return nil
+	}
+}
+
+// WithBucketFactor sizes the rows of the sketches of NewTopK with factor
+// instead of DefaultBucketFactor, see Buckets. Streams more skewed than
+// those the default was chosen for keep their accuracy with a smaller
+// factor, which saves memory in proportion. Other constructors reject it.
+func WithBucketFactor(factor float64) Option {
+	return func(sk *Sketch) error {
+		if sk.sizing == nil {
+			return newError(ErrInvalidParameter, "topkapi: WithBucketFactor only applies to NewTopK")
+		}
+		if !(factor > 0) || math.IsInf(factor, 1) {
+			return newError(ErrInvalidParameter, "topkapi: value of factor should be > 0")
+		}
+		sk.sizing.factor = factor
+		return nil
+	}
+}
+
+// sketchMemory returns the expected size in bytes of a sketch of l rows of b
+// buckets.
+func sketchMemory(b, l uint64) uint64 {
+	return l*b*slotSize + uint64(len(hll{}))
+}
+
+func params(b, l uint64) Params {
+	return Params{
+		B:       b,
+		L:       l,
+		Memory:  sketchMemory(b, l),
+		Epsilon: 1 / float64(b),
+		Delta:   2 / math.Exp(float64(l)),
+	}
+}
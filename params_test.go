@@ -0,0 +1,136 @@
+package topkapi
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestSuggestParameters(t *testing.T) {
+	for _, test := range []struct {
+		k, corpus, budget uint64
+		b, l, memory      uint64
+	}{
+		// Unbounded, like NewTopK
+		{20, 1000000, 0, 15197, 4, 2435616},
+		{10, 10000, 0, 5065, 4, 814496},
+		{1, 1000, 0, 379, 4, 64736},
+		// Too small a corpus for the heuristic
+		{10, 1, 0, 100, 4, 20096},
+		// Rows go first
+		{20, 1000000, 2000000, 15197, 3, 1827736},
+		{20, 1000000, 1300000, 15197, 2, 1219856},
+		// Then buckets
+		{20, 1000000, 1000000, 12448, 2, 999936},
+		{20, 1000000, 20096, 200, 2, 20096},
+	} {
+		p, err := SuggestParameters(test.k, test.corpus, test.budget)
+		if err != nil {
+			t.Errorf("Expected parameters for k=%d of %d in %d bytes, found %v", test.k, test.corpus, test.budget, err)
+			continue
+		}
+		if p.B != test.b || p.L != test.l || p.Memory != test.memory {
+			t.Errorf("Expected k=%d of %d in %d bytes to be b=%d,l=%d taking %d bytes, found b=%d,l=%d taking %d", test.k, test.corpus, test.budget, test.b, test.l, test.memory, p.B, p.L, p.Memory)
+		}
+		if test.budget > 0 && p.Memory > test.budget {
+			t.Errorf("Expected %d bytes to fit the budget of %d", p.Memory, test.budget)
+		}
+
+		sk, err := NewFromParams(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sk.Epsilon() != p.Epsilon || sk.Delta() != p.Delta {
+			t.Errorf("Expected epsilon %f and delta %f, found %f and %f", p.Epsilon, p.Delta, sk.Epsilon(), sk.Delta())
+		}
+	}
+
+	if _, err := SuggestParameters(20, 1000000, 20095); !errors.Is(err, insufficientBudget) || err.Error() != "topkapi: memory budget too small: at least 20096 bytes are needed" {
+		t.Errorf("Expected the minimum budget to be reported, found %v", err)
+	}
+	if _, err := SuggestParameters(0, 1000000, 0); err == nil {
+		t.Error("Expected error for k=0")
+	}
+	if _, err := NewFromParams(Params{B: 100}); err == nil {
+		t.Error("Expected error for L=0")
+	}
+}
+
+func TestNewTopKSizing(t *testing.T) {
+	if b := Buckets(20, 1000000, DefaultBucketFactor); b != 15197 {
+		t.Errorf("Expected the default of 15197 buckets, found %d", b)
+	}
+
+	for _, test := range []struct {
+		opts []Option
+		b, l int
+	}{
+		{nil, 15197, DefaultRows},
+		{[]Option{WithRows(5)}, 15197, 5},
+		{[]Option{WithBucketFactor(30), WithRows(5)}, int(Buckets(20, 1000000, 30)), 5},
+		// Options needing the size of the sketch see the final one
+		{[]Option{WithTopKTracking(10), WithBucketFactor(10), WithExtraCounterRows(1)}, int(Buckets(20, 1000000, 10)), 4},
+	} {
+		sk, err := NewTopK(20, 1000000, 0.01, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := sk.Stats(); st.Buckets != test.b || st.Rows != test.l {
+			t.Errorf("Expected %d rows of %d buckets, found %+v", test.l, test.b, st)
+		}
+		sk.Insert("a", 1)
+		if top := sk.TopK(1); top[0].Key != "a" {
+			t.Errorf("Expected a working sketch, found %v", top)
+		}
+	}
+
+	for _, opt := range []Option{WithRows(0), WithBucketFactor(0), WithBucketFactor(-1), WithBucketFactor(math.NaN())} {
+		if _, err := NewTopK(20, 1000000, 0.01, opt); err == nil {
+			t.Error("Expected error for a degenerate size")
+		}
+	}
+	if _, err := New(0.01, 0.01, WithRows(3)); err == nil {
+		t.Error("Expected WithRows to be rejected by New")
+	}
+	if _, err := NewFromParams(Params{B: 100, L: 2}, WithBucketFactor(30)); err == nil {
+		t.Error("Expected WithBucketFactor to be rejected by NewFromParams")
+	}
+}
+
+// TestBucketFactorTradeOff documents what a smaller bucket factor costs on
+// the corpus of TestTheShebang: the heavy hitters still come out on top,
+// in a third less memory, but many more estimates of the other candidates are off
+// by more than epsilon.
+func TestBucketFactorTradeOff(t *testing.T) {
+	words := loadWords()
+	for _, p := range []int{2, 3, 5, 7, 11, 13, 17, 23} {
+		for i := p; i < len(words); i += p {
+			words[i] = words[p]
+		}
+	}
+	exact := exactCount(words)
+	top := exactTop(exact)
+
+	var rates []float64
+	epsilon := 1 / float64(Buckets(20, uint64(len(words)), DefaultBucketFactor))
+	for _, opts := range [][]Option{nil, {WithBucketFactor(30), WithRows(5)}} {
+		sk, _ := NewTopK(20, uint64(len(words)), 0.01, opts...)
+		for _, w := range words {
+			sk.Insert(w, 1)
+		}
+
+		res := sk.Result(1)
+		for i, w := range top[:8] {
+			if res[i].Key != w && res[i].Count != exact[w] {
+				t.Errorf("Expected top %d to be '%s'(%d), found %v(%d)", i, w, exact[w], res[i].Key, res[i].Count)
+			}
+		}
+
+		rate := errorRate(epsilon, exact, resultToMap(res))
+		t.Logf("%d rows of %d buckets, %d bytes: %.1f%% of estimates off by more than %g", sk.l, sk.b, sketchMemory(sk.b, sk.l), 100*rate, epsilon)
+		rates = append(rates, rate)
+	}
+	if rates[1] <= rates[0] {
+		t.Errorf("Expected a smaller factor to cost accuracy, found error rates %v", rates)
+	}
+}
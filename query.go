@@ -0,0 +1,137 @@
+package topkapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// QueryResult is a result along with what it was queried with and the state
+// of the sketch it was queried from, so that archived results can be told
+// apart.
+type QueryResult struct {
+	Entries []LocalHeavyHitter
+
+	Time      time.Time // when the query ran, see WithClock
+	K         int       // at most K entries, or any number if 0
+	Threshold uint64    // of the estimate of every entry
+
+	Total       uint64  // of the sketch, see Sketch.Total
+	Epsilon     float64 // of the sketch, see Sketch.Epsilon
+	Fingerprint uint64  // of the state of the sketch, see Sketch.StateHash
+}
+
+// WithClock sets the clock stamping the results of Query, and driving
+// PublishEvery and LiveTopK of a ConcurrentSketch wrapping the sketch,
+// instead of SystemClock.
+func WithClock(clock Clock) Option {
+	return func(sk *Sketch) error {
+		sk.clock = clock
+		return nil
+	}
+}
+
+// timeSource returns the clock of WithClock, or SystemClock.
+func (sk *Sketch) timeSource() Clock {
+	if sk.clock == nil {
+		return SystemClock
+	}
+	return sk.clock
+}
+
+// Query returns the top k entries with an estimate of at least threshold,
+// like TopK and Result, along with the state of the sketch they were taken
+// from. A k of 0 or below doesn't limit the number of entries.
+//
+// The fingerprint takes a pass over the sketch, like Result does.
+func (sk *Sketch) Query(k int, threshold uint64) QueryResult {
+	qr := QueryResult{
+		Time:        sk.timeSource().Now(),
+		Threshold:   threshold,
+		Total:       sk.total,
+		Epsilon:     sk.Epsilon(),
+		Fingerprint: sk.StateHash(),
+	}
+
+	if k < 1 {
+		qr.Entries = sk.Result(threshold)
+		return qr
+	}
+	qr.K = k
+	qr.Entries = sk.TopK(k)
+	for n, hh := range qr.Entries {
+		if hh.Count < threshold {
+			qr.Entries = qr.Entries[:n]
+			break
+		}
+	}
+
+	return qr
+}
+
+// queryJSON is the JSON encoding of a QueryResult. The fingerprint is a hex
+// string, as JSON numbers don't hold 64 bits in most decoders.
+type queryJSON struct {
+	Time        time.Time   `json:"time"`
+	K           int         `json:"k"`
+	Threshold   uint64      `json:"threshold"`
+	Total       uint64      `json:"total"`
+	Epsilon     float64     `json:"epsilon"`
+	Fingerprint string      `json:"fingerprint"`
+	Entries     []entryJSON `json:"entries"`
+}
+
+type entryJSON struct {
+	Key    interface{} `json:"key"`
+	Count  uint64      `json:"count"`
+	Rows   int         `json:"rows"`
+	Sample interface{} `json:"sample,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler, for archiving results. Keys and
+// samples are encoded as JSON values, so they come back from UnmarshalJSON
+// as JSON decodes them: numbers as float64, for instance.
+func (qr QueryResult) MarshalJSON() ([]byte, error) {
+	enc := queryJSON{
+		Time:        qr.Time,
+		K:           qr.K,
+		Threshold:   qr.Threshold,
+		Total:       qr.Total,
+		Epsilon:     qr.Epsilon,
+		Fingerprint: fmt.Sprintf("%016x", qr.Fingerprint),
+		Entries:     make([]entryJSON, len(qr.Entries)),
+	}
+	for n, hh := range qr.Entries {
+		enc.Entries[n] = entryJSON{Key: hh.Key, Count: hh.Count, Rows: hh.Rows, Sample: hh.Sample}
+	}
+
+	return json.Marshal(enc)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, see MarshalJSON.
+func (qr *QueryResult) UnmarshalJSON(data []byte) error {
+	var dec queryJSON
+	if err := json.Unmarshal(data, &dec); err != nil {
+		return err
+	}
+	fingerprint, err := strconv.ParseUint(dec.Fingerprint, 16, 64)
+	if err != nil {
+		return newError(ErrCorruptData, "topkapi: invalid fingerprint %q", dec.Fingerprint)
+	}
+
+	*qr = QueryResult{
+		Time:        dec.Time,
+		K:           dec.K,
+		Threshold:   dec.Threshold,
+		Total:       dec.Total,
+		Epsilon:     dec.Epsilon,
+		Fingerprint: fingerprint,
+		Entries:     make([]LocalHeavyHitter, len(dec.Entries)),
+	}
+	for n, e := range dec.Entries {
+		qr.Entries[n] = LocalHeavyHitter{Key: e.Key, Count: e.Count, Rows: e.Rows, Sample: e.Sample}
+	}
+
+	return nil
+}
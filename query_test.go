@@ -0,0 +1,57 @@
+package topkapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	clock := newFakeClock()
+	sk, _ := New(0.01, 0.001, WithClock(clock))
+	for _, word := range loadWords() {
+		sk.Insert(word, 1)
+	}
+
+	qr := sk.Query(10, 50)
+	want := QueryResult{
+		Entries:     sk.TopK(10),
+		Time:        clock.Now(),
+		K:           10,
+		Threshold:   50,
+		Total:       sk.Total(),
+		Epsilon:     sk.Epsilon(),
+		Fingerprint: sk.StateHash(),
+	}
+	if !reflect.DeepEqual(qr, want) {
+		t.Errorf("Expected %+v, found %+v", want, qr)
+	}
+
+	// The threshold cuts the top k short
+	if qr := sk.Query(10, sk.TopK(3)[2].Count); len(qr.Entries) != 3 {
+		t.Errorf("Expected the top 3 over the threshold, found %v", qr.Entries)
+	}
+	if qr := sk.Query(0, 200); !reflect.DeepEqual(qr.Entries, sk.Result(200)) {
+		t.Errorf("Expected the result over the threshold without k, found %v", qr.Entries)
+	}
+
+	data, err := json.Marshal(qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded QueryResult
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, qr) {
+		t.Errorf("Expected %+v to round-trip through %s, found %+v", qr, data, decoded)
+	}
+
+	// The state at query time, not that of later inserts
+	clock.Advance(time.Minute)
+	sk.Insert("later", 1)
+	if again := sk.Query(10, 50); again.Fingerprint == qr.Fingerprint || !again.Time.After(qr.Time) || again.Total != qr.Total+1 {
+		t.Errorf("Expected a new state and time, found %+v after %+v", again, qr)
+	}
+}
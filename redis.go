@@ -0,0 +1,331 @@
+package topkapi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+var corruptRedisDump = newError(ErrCorruptData, "topkapi: corrupt RedisBloom TopK dump")
+
+// RDB encoding of module values, as written by DUMP
+const (
+	rdbTypeModule2 = 7
+
+	rdbOpcodeEOF    = 0
+	rdbOpcodeUint   = 2
+	rdbOpcodeDouble = 4
+	rdbOpcodeString = 5
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	redisTopKType = "TopK-TYPE"
+
+	// Size of a HeavyKeeper bucket, a 32-bit fingerprint and count, and of a
+	// heap entry: fingerprint, item length, item pointer and count, padded
+	// to 8 bytes.
+	redisBucketSize     = 8
+	redisHeapBucketSize = 24
+)
+
+// FromRedisTopK builds a sketch from the DUMP of a RedisBloom TopK key, so
+// that top-k collected by Redis can be combined with those of this package.
+//
+// A RedisBloom TopK is a HeavyKeeper sketch: depth rows of width buckets of
+// key fingerprints and decayed counts, along with a heap of the k heaviest
+// keys and their counts. Only the heap carries keys, so the fingerprint
+// buckets, which are hashed differently than this package does, are
+// dropped, and the sketch is that of a stream holding every key of the heap
+// as often as its count. Keys are strings. The sketch has the dimensions
+// SuggestParameters picks for k heavy hitters of the sum of their counts.
+//
+// HeavyKeeper counts are decayed like the width and decay of the TopK
+// configured them, and never overcount, so the estimates of the sketch are
+// rather too low than too high, and its total is that of the heavy hitters
+// alone. To merge it with sketches of other dimensions, use AbsorbTopK.
+//
+// The dump is checked against its CRC-64 trailer. It must be of the TopK
+// encoding of RedisBloom 2: k, width and depth as unsigned integers, decay
+// as a double, the bucket array and the heap array as strings, then k item
+// strings, each terminated by a NUL byte and empty for unused heap entries.
+func FromRedisTopK(data []byte) (*Sketch, error) {
+	if len(data) < 10 {
+		return nil, corruptRedisDump
+	}
+	body, trailer := data[:len(data)-8], data[len(data)-8:]
+	if crc64Jones(body) != binary.LittleEndian.Uint64(trailer) {
+		return nil, fmt.Errorf("%w: checksum mismatch", corruptRedisDump)
+	}
+
+	r := &rdbReader{data: body[:len(body)-2]}
+	if t := r.byte(); t != rdbTypeModule2 {
+		return nil, fmt.Errorf("%w: value of type %d is not a module type", corruptRedisDump, t)
+	}
+	if name := moduleTypeName(r.length()); r.err == nil && name != redisTopKType {
+		return nil, fmt.Errorf("%w: module type %s is not %s", corruptRedisDump, name, redisTopKType)
+	}
+
+	k, width, depth := r.uint(), r.uint(), r.uint()
+	r.double()
+	buckets, heap := r.string(), r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if k < 1 || k > math.MaxInt32 || uint64(len(heap)) != k*redisHeapBucketSize ||
+		width*depth > math.MaxInt32 || uint64(len(buckets)) != width*depth*redisBucketSize {
+		return nil, fmt.Errorf("%w: k=%d, width=%d and depth=%d don't match the arrays", corruptRedisDump, k, width, depth)
+	}
+
+	var (
+		entries []LocalHeavyHitter
+		total   uint64
+	)
+	for i := uint64(0); i < k; i++ {
+		item := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if !strings.HasSuffix(item, "\x00") {
+			return nil, fmt.Errorf("%w: item %d is not terminated", corruptRedisDump, i)
+		}
+
+		count := uint64(binary.LittleEndian.Uint32([]byte(heap[i*redisHeapBucketSize+16:])))
+		if item = item[:len(item)-1]; item == "" || count == 0 {
+			continue
+		}
+		entries = append(entries, LocalHeavyHitter{Key: item, Count: count})
+		total += count
+	}
+	if r.length() != rdbOpcodeEOF || r.err != nil || len(r.data) > 0 {
+		return nil, fmt.Errorf("%w: trailing data", corruptRedisDump)
+	}
+
+	// Prime the heaviest first, like the sketch that saw them would hold them
+	sort.SliceStable(entries, func(a, b int) bool {
+		return entries[a].Count > entries[b].Count
+	})
+
+	p, err := SuggestParameters(k, total, 0)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := NewFromParams(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := sk.Prime(entries); err != nil {
+		return nil, err
+	}
+
+	return sk, nil
+}
+
+// moduleTypeName returns the name encoded in the upper 54 bits of a module
+// type id, 9 characters of 6 bits each.
+func moduleTypeName(id uint64) string {
+	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+	name := make([]byte, 9)
+	id >>= 10
+	for i := len(name) - 1; i >= 0; i-- {
+		name[i] = charset[id&63]
+		id >>= 6
+	}
+	return string(name)
+}
+
+// rdbReader reads RDB encoded values until the first error, which sticks.
+type rdbReader struct {
+	data []byte
+	err  error
+}
+
+func (r *rdbReader) fail(what string) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: truncated or invalid %s", corruptRedisDump, what)
+	}
+	r.data = nil
+}
+
+func (r *rdbReader) next(n uint64) []byte {
+	if r.err != nil || uint64(len(r.data)) < n {
+		r.fail("value")
+		return nil
+	}
+	p := r.data[:n]
+	r.data = r.data[n:]
+	return p
+}
+
+func (r *rdbReader) byte() byte {
+	if p := r.next(1); p != nil {
+		return p[0]
+	}
+	return 0
+}
+
+// lengthOrEncoding reads an RDB length, or the special encoding of a string
+// and true.
+func (r *rdbReader) lengthOrEncoding() (uint64, bool) {
+	b := r.byte()
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false
+	case 1:
+		return uint64(b&0x3f)<<8 | uint64(r.byte()), false
+	case 3:
+		return uint64(b & 0x3f), true
+	}
+
+	switch b {
+	case 0x80:
+		if p := r.next(4); p != nil {
+			return uint64(binary.BigEndian.Uint32(p)), false
+		}
+	case 0x81:
+		if p := r.next(8); p != nil {
+			return binary.BigEndian.Uint64(p), false
+		}
+	default:
+		r.fail("length")
+	}
+	return 0, false
+}
+
+func (r *rdbReader) length() uint64 {
+	n, enc := r.lengthOrEncoding()
+	if enc {
+		r.fail("length")
+	}
+	return n
+}
+
+// opcode reads the opcode that precedes every value saved by a module.
+func (r *rdbReader) opcode(want uint64) {
+	if op := r.length(); op != want && r.err == nil {
+		r.fail(fmt.Sprintf("opcode %d", op))
+	}
+}
+
+func (r *rdbReader) uint() uint64 {
+	r.opcode(rdbOpcodeUint)
+	return r.length()
+}
+
+func (r *rdbReader) double() float64 {
+	r.opcode(rdbOpcodeDouble)
+	if p := r.next(8); p != nil {
+		return math.Float64frombits(binary.LittleEndian.Uint64(p))
+	}
+	return 0
+}
+
+func (r *rdbReader) string() string {
+	r.opcode(rdbOpcodeString)
+	n, enc := r.lengthOrEncoding()
+	if !enc {
+		return string(r.next(n))
+	}
+
+	switch n {
+	case rdbEncInt8:
+		return fmt.Sprint(int8(r.byte()))
+	case rdbEncInt16:
+		if p := r.next(2); p != nil {
+			return fmt.Sprint(int16(binary.LittleEndian.Uint16(p)))
+		}
+	case rdbEncInt32:
+		if p := r.next(4); p != nil {
+			return fmt.Sprint(int32(binary.LittleEndian.Uint32(p)))
+		}
+	case rdbEncLZF:
+		clen, ulen := r.length(), r.length()
+		if in := r.next(clen); in != nil {
+			if out, ok := lzfDecompress(in, ulen); ok {
+				return string(out)
+			}
+			r.fail("compressed string")
+		}
+	default:
+		r.fail("string encoding")
+	}
+	return ""
+}
+
+// lzfDecompress decompresses the LZF data Redis compresses strings with into
+// exactly n bytes.
+func lzfDecompress(in []byte, n uint64) ([]byte, bool) {
+	// A back reference of 3 bytes expands to at most 264
+	if n > 88*uint64(len(in)) {
+		return nil, false
+	}
+	out := make([]byte, 0, n)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 32 {
+			ctrl++
+			if ip+ctrl > len(in) || uint64(len(out)+ctrl) > n {
+				return nil, false
+			}
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+			continue
+		}
+
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, false
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, false
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		if ref < 0 || uint64(len(out)+length+2) > n {
+			return nil, false
+		}
+		// The reference may overlap what it copies
+		for i := 0; i < length+2; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	return out, uint64(len(out)) == n
+}
+
+var crc64JonesTable = func() (t [256]uint64) {
+	for i := range t {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ 0x95ac9329ac4bc9b5
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+// crc64Jones is the CRC-64 of Redis dumps, with the Jones polynomial,
+// reflected, and neither initial nor final inversion, which hash/crc64
+// doesn't support.
+func crc64Jones(data []byte) uint64 {
+	var crc uint64
+	for _, b := range data {
+		crc = crc64JonesTable[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
@@ -0,0 +1,219 @@
+package topkapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+// redisTopKFixture is a DUMP captured from redis-stack, which
+// TestFromRedisTopK skips until it is checked in:
+//
+//	redis-cli TOPK.RESERVE topk 16 64 4 0.9
+//	redis-cli TOPK.INCRBY topk berry 3000 blunter 1500 travestied 1000 \
+//		military 750 silkworm 600 yearlings 525 stole 500 foreknowledge 428 \
+//		waited 333 Doolittle 300 Aleut 272 implacability 250
+//	redis-cli --raw DUMP topk | head -c -1 > testdata/redis-topk.dump
+//
+// For the corrupt dumps, redisTopKDump builds one of its own in the layout
+// FromRedisTopK documents.
+const redisTopKFixture = "testdata/redis-topk.dump"
+
+func appendRDBLen(buf []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(buf, byte(n))
+	case n < 1<<14:
+		return append(buf, byte(n>>8)|0x40, byte(n))
+	case n <= math.MaxUint32:
+		var tmp [4]byte
+		binary.BigEndian.PutUint32(tmp[:], uint32(n))
+		return append(append(buf, 0x80), tmp[:]...)
+	default:
+		var tmp [8]byte
+		binary.BigEndian.PutUint64(tmp[:], n)
+		return append(append(buf, 0x81), tmp[:]...)
+	}
+}
+
+func appendUint64LE(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+// lzfCompress compresses runs of a repeated byte into back references, and
+// copies everything else as literals.
+func lzfCompress(in []byte) []byte {
+	var out []byte
+	for i := 0; i < len(in); {
+		run := 1
+		for i+run < len(in) && in[i+run] == in[i] && run < 265 {
+			run++
+		}
+		if run >= 4 {
+			// A literal, then a reference to it covering the rest of the run
+			out = append(out, 0, in[i])
+			length := run - 1 - 2
+			if length < 7 {
+				out = append(out, byte(length<<5), 0)
+			} else {
+				out = append(out, 7<<5, byte(length-7), 0)
+			}
+			i += run
+			continue
+		}
+		out = append(out, 0, in[i])
+		i++
+	}
+	return out
+}
+
+type redisHeapEntry struct {
+	item  string
+	count uint32
+}
+
+func redisTopKDump(heap []redisHeapEntry, width, depth uint64) []byte {
+	id := uint64(0)
+	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	for _, c := range redisTopKType {
+		for n := range charset {
+			if rune(charset[n]) == c {
+				id = id<<6 | uint64(n)
+			}
+		}
+	}
+	id <<= 10
+
+	str := func(buf []byte, s []byte) []byte {
+		buf = appendRDBLen(buf, rdbOpcodeString)
+		if len(s) > 20 {
+			c := lzfCompress(s)
+			buf = append(buf, 0xc0|rdbEncLZF)
+			buf = appendRDBLen(appendRDBLen(buf, uint64(len(c))), uint64(len(s)))
+			return append(buf, c...)
+		}
+		return append(appendRDBLen(buf, uint64(len(s))), s...)
+	}
+
+	buf := appendRDBLen([]byte{rdbTypeModule2}, id)
+	for _, v := range []uint64{uint64(len(heap)), width, depth} {
+		buf = appendRDBLen(appendRDBLen(buf, rdbOpcodeUint), v)
+	}
+	buf = appendRDBLen(buf, rdbOpcodeDouble)
+	buf = appendUint64LE(buf, math.Float64bits(0.9))
+
+	buckets := make([]byte, width*depth*redisBucketSize)
+	for i := 0; i < len(heap) && i < int(width); i++ {
+		binary.LittleEndian.PutUint32(buckets[i*redisBucketSize:], uint32(i+1)*2654435761)
+		binary.LittleEndian.PutUint32(buckets[i*redisBucketSize+4:], heap[i].count)
+	}
+	buf = str(buf, buckets)
+
+	heapBuf := make([]byte, len(heap)*redisHeapBucketSize)
+	for i, e := range heap {
+		b := heapBuf[i*redisHeapBucketSize:]
+		binary.LittleEndian.PutUint32(b, uint32(i+1)*2654435761)
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(e.item)))
+		binary.LittleEndian.PutUint64(b[8:], 0x7f00deadbeef) // the item pointer
+		binary.LittleEndian.PutUint32(b[16:], e.count)
+	}
+	buf = str(buf, heapBuf)
+	for _, e := range heap {
+		buf = str(buf, append([]byte(e.item), 0))
+	}
+	buf = appendRDBLen(buf, rdbOpcodeEOF)
+
+	buf = append(buf, 10, 0) // RDB version
+	return appendUint64LE(buf, crc64Jones(buf))
+}
+
+func TestCRC64Jones(t *testing.T) {
+	if crc := crc64Jones([]byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Expected the check value of CRC-64/Jones, found %#x", crc)
+	}
+}
+
+func TestFromRedisTopK(t *testing.T) {
+	data, err := ioutil.ReadFile(redisTopKFixture)
+	if os.IsNotExist(err) {
+		t.Skipf("No dump captured from Redis at %s", redisTopKFixture)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, err := FromRedisTopK(data)
+	if err != nil {
+		t.Fatalf("Expected dump to load, found %v", err)
+	}
+
+	// The 12 items of the heap of 16, heaviest first, with the counts they
+	// were added, unless an item shares its bucket in all 4 rows
+	want := []redisHeapEntry{
+		{"berry", 3000}, {"blunter", 1500}, {"travestied", 1000}, {"military", 750},
+		{"silkworm", 600}, {"yearlings", 525}, {"stole", 500}, {"foreknowledge", 428},
+		{"waited", 333}, {"Doolittle", 300}, {"Aleut", 272}, {"implacability", 250},
+	}
+	top := sk.TopK(16)
+	if len(top) != len(want) {
+		t.Fatalf("Expected the %d items of the heap, found %v", len(want), top)
+	}
+	var total uint64
+	for i, e := range want {
+		if top[i].Key != e.item || top[i].Count != uint64(e.count) {
+			t.Errorf("Expected %s=%d at rank %d, found %v=%d", e.item, e.count, i, top[i].Key, top[i].Count)
+		}
+		total += uint64(e.count)
+	}
+	if sk.Total() != total {
+		t.Errorf("Expected the total of the heap, %d, found %d", total, sk.Total())
+	}
+
+	// Combined with a sketch of this package
+	local, _ := New(0.01, 0.001)
+	local.Insert("blunter", 2000)
+	local.AbsorbTopK(sk, 16)
+	if top := local.TopK(1); top[0].Key != "blunter" || top[0].Count != 3500 {
+		t.Errorf("Expected counts to add up, found %v", top)
+	}
+}
+
+func TestFromRedisTopKCorrupt(t *testing.T) {
+	heap := []redisHeapEntry{{"a", 3}, {"b", 2}}
+	good := redisTopKDump(heap, 10, 3)
+
+	flipped := append([]byte(nil), good...)
+	flipped[5] ^= 1
+	reencoded := func(mutate func([]byte) []byte) []byte {
+		body := mutate(append([]byte(nil), good[:len(good)-8]...))
+		return appendUint64LE(body, crc64Jones(body))
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":    nil,
+		"checksum": flipped,
+		"type": reencoded(func(b []byte) []byte {
+			b[0] = 0
+			return b
+		}),
+		"module": reencoded(func(b []byte) []byte {
+			b[2] ^= 0x10
+			return b
+		}),
+		"truncated": reencoded(func(b []byte) []byte {
+			return append(b[:len(b)-12], 10, 0)
+		}),
+		"k": reencoded(func(b []byte) []byte {
+			b[11] = 3 // k, after the type, the module id and its opcode
+			return b
+		}),
+	} {
+		if _, err := FromRedisTopK(data); !errors.Is(err, corruptRedisDump) {
+			t.Errorf("Expected %s dump to be rejected, found %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package topkapi
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RowLockedSketch shares a Sketch between goroutines like ConcurrentSketch,
+// but with a lock per row instead of one for the whole sketch, so that a
+// Merge only holds off inserts from the row it is merging rather than for
+// its whole duration. It suits an aggregator merging remote sketches into
+// one that keeps counting local inserts.
+//
+// Inserts and merges go through the rows in order, taking the lock of the
+// next row before releasing the one of the last, and update the totals
+// under the lock of the last row. So no write overtakes another: rows see
+// writes in the same order, and the sketch ends up as if they ran one after
+// the other in the order they reached the first row. A merged-in sketch is
+// applied a row at a time, interleaved with inserts in other rows, which
+// suits a sketch, as every row is a summary of its own. Queries take the
+// read lock of every row, and see the sketch between two writes.
+type RowLockedSketch struct {
+	seq  uint64 // inserts the sampler drew for, first to be aligned for atomics
+	sk   *Sketch
+	rows []sync.RWMutex // one per counter row
+}
+
+var rowLockedOptions = newError(ErrInvalidParameter, "topkapi: sketch should not track the top k, thresholds or spans, nor have a minimum count, to be locked per row")
+
+// NewRowLocked wraps sk, which must not track the top k, thresholds or
+// spans, nor have a minimum count: those look at all rows on every insert.
+// The caller must not use sk directly afterwards.
+func NewRowLocked(sk *Sketch) (*RowLockedSketch, error) {
+	if sk.top != nil || sk.thresholds != nil || sk.spans != nil || sk.minCount > 0 {
+		return nil, rowLockedOptions
+	}
+
+	return &RowLockedSketch{sk: sk, rows: make([]sync.RWMutex, sk.cms.rows)}, nil
+}
+
+// Insert adds count occurrences of key, see Sketch.Insert.
+func (r *RowLockedSketch) Insert(key interface{}, count uint64) {
+	sk := r.sk
+	// Inserts run in parallel, so they draw for the sampler atomically
+	if sk.sampling != 0 && count != 0 {
+		count = sk.sample(count, sk.sampleSeq+atomic.AddUint64(&r.seq, 1))
+	}
+	if count == 0 {
+		return
+	}
+
+	key, ok := sk.limit(sk.canonical(key))
+	if !ok {
+		r.pass(nil, func() { sk.rejected++ })
+		return
+	}
+	hsum := sk.hashKey(key)
+
+	var evictions uint64
+	r.pass(func(i int) {
+		if sk.insertRow(i, key, hsum, count, true) {
+			evictions++
+		}
+	}, func() {
+		sk.addTotal(count)
+		sk.addEvictions(evictions)
+		sk.distinct.add(hsum)
+	})
+}
+
+// Merge merges other into the sketch a row at a time, see Sketch.Merge.
+// other must not be modified concurrently.
+func (r *RowLockedSketch) Merge(other *Sketch) error {
+	sk := r.sk
+	if sk.incompatible(other) {
+		return sk.incompatibleMerge(other)
+	}
+	if other.Empty() {
+		r.pass(nil, func() { sk.mergeMeta(other) })
+		return nil
+	}
+
+	var evictions uint64
+	r.pass(func(i int) {
+		evictions += sk.mergeRow(other, i, func(i, j int) bool {
+			return sk.mergeCandidate(other, i, j)
+		})
+	}, func() {
+		sk.addEvictions(evictions)
+		sk.mergeMeta(other)
+	})
+
+	return nil
+}
+
+// Reset empties the sketch, see Sketch.Reset.
+func (r *RowLockedSketch) Reset() {
+	r.lock()
+	r.sk.Reset()
+	r.unlock()
+}
+
+// Result ...
+func (r *RowLockedSketch) Result(threshold uint64) []LocalHeavyHitter {
+	r.rlock()
+	defer r.runlock()
+	return r.sk.Result(threshold)
+}
+
+// TopK ...
+func (r *RowLockedSketch) TopK(k int) []LocalHeavyHitter {
+	r.rlock()
+	defer r.runlock()
+	return r.sk.TopK(k)
+}
+
+// Count ...
+func (r *RowLockedSketch) Count(key interface{}) (uint64, bool) {
+	r.rlock()
+	defer r.runlock()
+	return r.sk.Count(key)
+}
+
+// Stats ...
+func (r *RowLockedSketch) Stats() Stats {
+	r.rlock()
+	defer r.runlock()
+	return r.sk.Stats()
+}
+
+// Clone returns a copy of the sketch as of between two writes.
+func (r *RowLockedSketch) Clone() *Sketch {
+	r.rlock()
+	defer r.runlock()
+	return r.sk.Clone()
+}
+
+// pass calls row for every row in order under its lock, holding the next
+// row before releasing the last, and then done under the lock of the last
+// row. A nil row skips straight to the last row.
+func (r *RowLockedSketch) pass(row func(i int), done func()) {
+	last := len(r.rows) - 1
+	if row == nil {
+		r.rows[last].Lock()
+	} else {
+		for i := range r.rows {
+			r.rows[i].Lock()
+			if i > 0 {
+				r.rows[i-1].Unlock()
+			}
+			row(i)
+		}
+	}
+
+	done()
+	r.rows[last].Unlock()
+}
+
+func (r *RowLockedSketch) lock() {
+	for i := range r.rows {
+		r.rows[i].Lock()
+	}
+}
+
+func (r *RowLockedSketch) unlock() {
+	for i := range r.rows {
+		r.rows[i].Unlock()
+	}
+}
+
+func (r *RowLockedSketch) rlock() {
+	for i := range r.rows {
+		r.rows[i].RLock()
+	}
+}
+
+func (r *RowLockedSketch) runlock() {
+	for i := range r.rows {
+		r.rows[i].RUnlock()
+	}
+}
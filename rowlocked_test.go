@@ -0,0 +1,124 @@
+package topkapi
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestRowLockedSketch(t *testing.T) {
+	// Without concurrency it counts like the sketch it wraps
+	plain, _ := New(0.01, 0.001, WithExtraCounterRows(1))
+	other, _ := New(0.01, 0.001, WithExtraCounterRows(1))
+	sk, _ := New(0.01, 0.001, WithExtraCounterRows(1))
+	r, err := NewRowLocked(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range zipfKeys(20000, 2000, 1) {
+		plain.Insert(key, 1)
+		r.Insert(key, 1)
+	}
+	for _, key := range zipfKeys(20000, 2000, 2) {
+		other.Insert(key, 2)
+	}
+	if err := plain.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	if plain.StateHash() != r.Clone().StateHash() {
+		t.Error("Expected the same state as the plain sketch")
+	}
+
+	incompatible, _ := New(0.1, 0.1)
+	if err := r.Merge(incompatible); err != ErrIncompatibleSketches {
+		t.Errorf("Expected incompatible sketches, got %v", err)
+	}
+
+	for _, opt := range []Option{WithTopKTracking(5), WithThresholdTracking(), WithSpanTracking(), WithMinCount(2)} {
+		sk, _ := New(0.01, 0.01, opt)
+		if _, err := NewRowLocked(sk); err != rowLockedOptions {
+			t.Errorf("Expected options looking at all rows to be refused, got %v", err)
+		}
+	}
+}
+
+func TestRowLockedSketchConcurrentMerge(t *testing.T) {
+	sk, _ := New(0.01, 0.001)
+	r, _ := NewRowLocked(sk)
+
+	remotes := make([]*Sketch, 4)
+	var want uint64
+	for n := range remotes {
+		remotes[n], _ = New(0.01, 0.001)
+		for _, key := range zipfKeys(5000, 1000, int64(n+10)) {
+			remotes[n].Insert(key, 3)
+		}
+		want += uint64(len(remotes)) * remotes[n].Total()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(3)
+		go func(w int) {
+			defer wg.Done()
+			for _, key := range zipfKeys(5000, 1000, int64(w)) {
+				r.Insert(key, 1)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for _, remote := range remotes {
+				if err := r.Merge(remote); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				r.TopK(10)
+				r.Count(1)
+			}
+		}()
+	}
+	wg.Wait()
+	want += 4 * 5000
+
+	snap := r.Clone()
+	if snap.Total() != want {
+		t.Errorf("Expected a total of %d, found %d", want, snap.Total())
+	}
+	for i := 0; i < snap.cms.rows; i++ {
+		var sum uint64
+		for _, c := range snap.cms.row(i) {
+			sum += c
+		}
+		if sum != want {
+			t.Errorf("Expected row %d to add up to %d, found %d", i, want, sum)
+		}
+	}
+}
+
+func TestRowLockedSampling(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithSampling(0.1))
+	r, _ := NewRowLocked(sk)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50000; i++ {
+				r.Insert("a", 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if c, _ := r.Count("a"); math.Abs(float64(c)-200000) > 4*sk.SamplingStdDev(200000) {
+		t.Errorf("Expected a count of about 200000, found %d", c)
+	}
+}
@@ -0,0 +1,74 @@
+package topkapi
+
+// MergeRows merges other into sk like Merge, but also when they have
+// different numbers of rows, like a sketch of an edge node short of memory
+// having fewer rows than the central one. Every row hashes keys on its own,
+// by its index, so the rows both have in common line up and are merged, and
+// the rows only one of them has are dropped: sk is truncated to the rows of
+// other if it has more. Extra counter rows are dropped too, unless the
+// sketches have the same number of rows, when MergeRows is Merge.
+//
+// Fewer rows mean less confidence. Delta grows from 2/e^l to 2/e^m for the
+// m rows left, so estimates are more often off by more than Epsilon, and
+// heavy hitters have fewer rows to keep a bucket in. Both sketches must have
+// the same buckets per row, seed, hash version and bucketing, with the
+// errors of Merge otherwise, and sk is left as it is then.
+func (sk *Sketch) MergeRows(other *Sketch) error {
+	if other == nil || sk.l == other.l {
+		return sk.Merge(other)
+	}
+
+	l := sk.l
+	if other.l < l {
+		l = other.l
+	}
+	// Nothing is truncated for sketches that can't be merged
+	if sk.rowsView(l).incompatible(other.rowsView(l)) {
+		return sk.incompatibleMerge(other)
+	}
+	sk.truncateRows(l)
+
+	return sk.Merge(other.rowsView(l))
+}
+
+// truncateRows drops every row from row l on, including extra counter rows.
+func (sk *Sketch) truncateRows(l uint64) {
+	sk.l = l
+	sk.cms = sk.cms.head(int(l))
+	sk.counts = sk.counts[:l]
+	sk.objects = sk.objects[:l]
+	sk.hashes = sk.hashes[:l]
+	sk.occupied = sk.occupied[:l]
+	sk.conflicts = sk.conflicts[:l]
+	if sk.samples != nil {
+		sk.samples = sk.samples[:l]
+	}
+	if sk.spans != nil {
+		sk.spans.first, sk.spans.last = sk.spans.first[:l], sk.spans.last[:l]
+	}
+
+	if sk.top != nil {
+		sk.top.rebuild(sk)
+	}
+	if sk.thresholds != nil {
+		sk.thresholds.rebuild(sk)
+	}
+}
+
+// rowsView returns a shallow copy of sk with its first l rows only, to be
+// merged from. It shares its rows and tracking with sk.
+func (sk *Sketch) rowsView(l uint64) *Sketch {
+	v := *sk
+	v.l = l
+	v.cms = sk.cms.head(int(l))
+	v.counts = sk.counts[:l]
+	v.objects = sk.objects[:l]
+	v.hashes = sk.hashes[:l]
+	v.occupied = sk.occupied[:l]
+	v.conflicts = sk.conflicts[:l]
+	if sk.samples != nil {
+		v.samples = sk.samples[:l]
+	}
+
+	return &v
+}
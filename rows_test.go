@@ -0,0 +1,82 @@
+package topkapi
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMergeRows(t *testing.T) {
+	central := newSketch(1000, 4)
+	edge := newSketch(1000, 2)
+	whole := newSketch(1000, 2)
+	for i, key := range zipfKeys(20000, 2000, 1) {
+		if i%2 == 0 {
+			central.Insert(key, 1)
+		} else {
+			edge.Insert(key, 1)
+		}
+		whole.Insert(key, 1)
+	}
+	wide := central.Clone()
+
+	// The rows in common merge as if the stream went into one sketch
+	if err := central.MergeRows(edge); err != nil {
+		t.Fatal(err)
+	}
+	if central.l != 2 || central.cms.rows != 2 || central.Total() != whole.Total() {
+		t.Fatalf("Expected 2 rows of the whole stream, found %d with a total of %d", central.l, central.Total())
+	}
+	for i := 0; i < whole.cms.rows; i++ {
+		for j, c := range whole.cms.row(i) {
+			if found := central.cms.get(i, uint64(j)); found != c {
+				t.Fatalf("Expected counter %d of row %d to be %d, found %d", j, i, c, found)
+			}
+		}
+	}
+	for _, hh := range whole.TopK(10) {
+		if c, ok := central.Count(hh.Key); !ok || c != hh.Count {
+			t.Errorf("Expected %v=%d, found %d", hh.Key, hh.Count, c)
+		}
+	}
+
+	// A sketch with fewer rows only takes the first rows of a wide one
+	if err := edge.MergeRows(wide); err != nil {
+		t.Fatal(err)
+	}
+	if edge.l != 2 || edge.Total() != whole.Total() {
+		t.Errorf("Expected 2 rows of the whole stream, found %d with a total of %d", edge.l, edge.Total())
+	}
+	if wide.l != 4 {
+		t.Error("Expected the other sketch to keep its rows")
+	}
+
+	if err := newSketch(1000, 4).MergeRows(newSketch(500, 2)); err != ErrIncompatibleSketches {
+		t.Errorf("Expected sketches of different buckets to be incompatible, got %v", err)
+	}
+
+	// A failed merge leaves the receiver as it was
+	modulo, _ := NewFromParams(Params{B: 1000, L: 4})
+	for _, key := range zipfKeys(5000, 500, 3) {
+		modulo.Insert(key, 1)
+	}
+	before := modulo.Clone()
+	consistent, _ := NewFromParams(Params{B: 1000, L: 2}, WithConsistentBuckets())
+	if err := modulo.MergeRows(consistent); !errors.Is(err, ErrIncompatibleSketches) {
+		t.Fatalf("Expected sketches of different bucketing to be incompatible, got %v", err)
+	}
+	if modulo.l != 4 {
+		t.Errorf("Expected the receiver to keep its 4 rows, found %d", modulo.l)
+	}
+	assertSameResults(t, modulo, before)
+
+	tracked, _ := NewFromParams(Params{B: 1000, L: 4}, WithTopKTracking(5), WithSpanTracking(), WithThresholdTracking())
+	for _, key := range zipfKeys(5000, 500, 2) {
+		tracked.Insert(key, 1)
+	}
+	if err := tracked.MergeRows(newSketch(1000, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if top, scan := tracked.TopK(5), tracked.scanTopK(5); len(top) != 5 || top[0] != scan[0] {
+		t.Errorf("Expected the tracked top k to follow the truncation, found %v instead of %v", top, scan)
+	}
+}
@@ -0,0 +1,136 @@
+package topkapi
+
+// WithSamples keeps a sample value alongside every candidate, like a raw
+// log line to show with a heavy hitter, see InsertWithSample. It takes 16
+// bytes per bucket of the rows holding candidates, plus the samples
+// themselves. Samples are not part of the binary encoding, and are lost by
+// UnmarshalBinary.
+func WithSamples() Option {
+	return func(sk *Sketch) error {
+		sk.samples = make([][]interface{}, sk.l)
+		for i := range sk.samples {
+			sk.samples[i] = make([]interface{}, sk.b)
+		}
+		return nil
+	}
+}
+
+// InsertWithSample is like Insert, and stores sample with key in every row
+// where key is or becomes the candidate, replacing the sample it had there.
+// Results report the sample along with key. A bucket that changes hands
+// drops the sample of its old candidate, and Merge keeps the sample of
+// whichever candidate keeps the bucket. Without WithSamples it is Insert.
+func (sk *Sketch) InsertWithSample(key interface{}, count uint64, sample interface{}) {
+	if count = sk.sampled(count); count == 0 {
+		return
+	}
+
+	key, ok := sk.limit(sk.canonical(key))
+	if !ok {
+		sk.rejected++
+		return
+	}
+	hsum := sk.hashKey(key)
+	sk.insert(key, hsum, count)
+	sk.setSample(key, hsum, sample)
+}
+
+// setSample stores sample in every row holding key.
+func (sk *Sketch) setSample(key interface{}, hsum uint64, sample interface{}) {
+	if sk.samples == nil {
+		return
+	}
+	for i := range sk.samples {
+		if hi := sk.bucket(hsum, i); sk.holds(i, hi, key, hsum) {
+			sk.samples[i][hi] = sample
+		}
+	}
+}
+
+// sampleOf returns the sample of key from the first row from row i on that
+// holds key with a sample.
+func (sk *Sketch) sampleOf(key interface{}, hsum uint64, i int) interface{} {
+	if sk.samples == nil {
+		return nil
+	}
+	for ; i < len(sk.samples); i++ {
+		hi := sk.bucket(hsum, i)
+		if s := sk.samples[i][hi]; s != nil && sk.holds(i, hi, key, hsum) {
+			return s
+		}
+	}
+	return nil
+}
+
+// withSamples sets the samples of heavy hitters from the top-k tracker,
+// which doesn't keep them.
+func (sk *Sketch) withSamples(res []LocalHeavyHitter) []LocalHeavyHitter {
+	if sk.samples != nil {
+		for n := range res {
+			res[n].Sample = sk.sampleOf(res[n].Key, sk.hashKey(res[n].Key), 0)
+		}
+	}
+	return res
+}
+
+// mergeSample keeps the sample of the candidate sk and other share in row
+// i, bucket j, taking the sample of other if sk has none.
+func (sk *Sketch) mergeSample(other *Sketch, i, j int) {
+	if sk.samples != nil && other.samples != nil && sk.samples[i][j] == nil {
+		sk.samples[i][j] = other.samples[i][j]
+	}
+}
+
+// PayloadSketch is a Sketch that stores a payload with every insert, like
+// the last full log line of a key, and reports the latest payload of every
+// heavy hitter along with it, see InsertWithSample.
+//
+// Payloads are kept per bucket like the candidates, so they are as
+// approximate: one is only kept while its key holds the bucket, a payload
+// taken by another key is replaced by that of the new candidate, and a key
+// that loses all its buckets loses its payload even if it is counted again
+// later, until its next insert.
+type PayloadSketch struct {
+	sk *Sketch
+}
+
+// NewPayload creates a PayloadSketch counting in sk, adding WithSamples to
+// it if need be. The caller must not use sk directly afterwards.
+func NewPayload(sk *Sketch) (*PayloadSketch, error) {
+	if sk == nil {
+		return nil, nilSketch
+	}
+	if sk.samples == nil {
+		if err := WithSamples()(sk); err != nil {
+			return nil, err
+		}
+	}
+	return &PayloadSketch{sk: sk}, nil
+}
+
+// Insert adds count occurrences of key, and stores payload with it.
+func (ps *PayloadSketch) Insert(key interface{}, count uint64, payload interface{}) {
+	ps.sk.InsertWithSample(key, count, payload)
+}
+
+// Result is like Sketch.Result, with the payload of every heavy hitter as
+// its Sample.
+func (ps *PayloadSketch) Result(threshold uint64) []LocalHeavyHitter {
+	return ps.sk.Result(threshold)
+}
+
+// TopK is like Sketch.TopK, with the payload of every heavy hitter as its
+// Sample.
+func (ps *PayloadSketch) TopK(k int) []LocalHeavyHitter {
+	return ps.sk.TopK(k)
+}
+
+// Count returns the estimate of key, see Sketch.Count.
+func (ps *PayloadSketch) Count(key interface{}) (uint64, bool) {
+	return ps.sk.Count(key)
+}
+
+// Sketch returns the sketch counting the inserts.
+func (ps *PayloadSketch) Sketch() *Sketch {
+	return ps.sk
+}
@@ -0,0 +1,108 @@
+package topkapi
+
+import "testing"
+
+func TestInsertWithSample(t *testing.T) {
+	sk, _ := newSketch(1, 2).apply([]Option{WithSamples(), WithTopKTracking(2)})
+
+	sk.InsertWithSample("a", 3, "GET /a")
+	sk.Insert("a", 1)
+	if top := sk.TopK(1); top[0].Key != "a" || top[0].Sample != "GET /a" {
+		t.Errorf("Expected the sample of a to survive a plain insert, found %v", top)
+	}
+	sk.InsertWithSample("a", 1, "GET /a?v=2")
+	if res := sk.Result(1); res[0].Sample != "GET /a?v=2" {
+		t.Errorf("Expected the latest sample, found %v", res)
+	}
+
+	// A key taking over the bucket doesn't keep the sample of the old
+	// candidate, and one that doesn't get to store none
+	sk.InsertWithSample("b", 1, "GET /b")
+	if res := sk.Result(1); res[0].Key != "a" || res[0].Sample != "GET /a?v=2" {
+		t.Errorf("Expected a to keep its sample, found %v", res)
+	}
+	sk.Insert("b", 9)
+	if res := sk.Result(1); res[0].Key != "b" || res[0].Sample != nil {
+		t.Errorf("Expected b to take over without a sample, found %v", res)
+	}
+
+	plain, _ := New(0.01, 0.01)
+	plain.InsertWithSample("a", 2, "GET /a")
+	if res := plain.Result(1); res[0].Count != 2 || res[0].Sample != nil {
+		t.Errorf("Expected InsertWithSample to be Insert without WithSamples, found %v", res)
+	}
+}
+
+func TestSamplesMerge(t *testing.T) {
+	newSampled := func() *Sketch {
+		sk, _ := New(0.01, 0.01, WithSamples())
+		return sk
+	}
+	sk, other := newSampled(), newSampled()
+	sk.InsertWithSample("shared", 5, "mine")
+	other.InsertWithSample("shared", 5, "theirs")
+	other.InsertWithSample("other", 4, "other's")
+	other.Insert("unsampled", 3)
+
+	// Find a key contesting the buckets of "shared" in the first row
+	hi := sk.bucket(sk.hashKey("shared"), 0)
+	y := 0
+	for sk.bucket(sk.hashKey(y), 0) != hi {
+		y++
+	}
+	other.InsertWithSample(y, 50, "winner")
+
+	if err := sk.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	if s := sk.sampleOf("shared", sk.hashKey("shared"), 1); s != "mine" {
+		t.Errorf("Expected the receiver's sample of a shared candidate, found %v", s)
+	}
+	for key, want := range map[interface{}]interface{}{"other": "other's", y: "winner", "unsampled": nil} {
+		if s := sk.sampleOf(key, sk.hashKey(key), 0); s != want {
+			t.Errorf("Expected sample %v of %v to survive the merge, found %v", want, key, s)
+		}
+	}
+	if sk.samples[0][hi] != "winner" {
+		t.Errorf("Expected the sample of the winning candidate, found %v", sk.samples[0][hi])
+	}
+
+	cp := sk.Clone()
+	sk.Reset()
+	if s := cp.sampleOf("other", cp.hashKey("other"), 0); s != "other's" {
+		t.Errorf("Expected a clone to keep its samples after the original is reset, found %v", s)
+	}
+}
+
+func TestPayloadSketch(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	ps, err := NewPayload(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last string
+	for i, key := range zipfKeys(20000, 2000, 8) {
+		payload := key + " line " + string(rune('a'+i%26))
+		ps.Insert(key, 1, payload)
+		if key == "key0" {
+			last = payload
+		}
+	}
+
+	top := ps.TopK(1)
+	if top[0].Key != "key0" || top[0].Sample != last {
+		t.Errorf("Expected key0 with its last payload %q, found %v", last, top)
+	}
+	if res := ps.Result(top[0].Count); len(res) != 1 || res[0].Sample != last {
+		t.Errorf("Expected the payload in the result, found %v", res)
+	}
+	for _, hh := range ps.Result(1) {
+		if p, ok := hh.Sample.(string); ok && p[:len(hh.Key.(string))+1] != hh.Key.(string)+" " {
+			t.Errorf("Expected %v with a payload of its own, found %q", hh.Key, p)
+		}
+	}
+	if ps.Sketch() != sk {
+		t.Error("Expected the sketch counting the inserts")
+	}
+}
@@ -0,0 +1,86 @@
+package topkapi
+
+import "math"
+
+// WithSampling inserts into the sketch only a rate of the inserts, chosen at
+// random, for streams too fast to count every event. An insert of count
+// that is kept adds count/rate, rounded at random to an integer that is
+// count/rate on average, so Count, Result, TopK and Total estimate the full
+// stream, and sketches of different rates merge as they are. Every call is
+// kept or dropped whole, including its key, so at rate 0.01 only one in a
+// hundred calls hashes its key and updates the rows.
+//
+// Sampling adds an error of its own, see SamplingStdDev, which is small
+// next to the estimates of heavy hitters, but large for rare keys, which
+// are often not kept at all. Cardinality only counts keys that were kept,
+// and so do the rejected keys of Stats. The sampler is seeded by the seed
+// of the sketch, see WithSeed, so sketches of the same seed keep the same
+// calls of a stream. Add subtracts negative deltas in full, and Prime and
+// AbsorbTopK are not sampled. The rate must be in range of (0, 1].
+func WithSampling(rate float64) Option {
+	return func(sk *Sketch) error {
+		if !(rate > 0 && rate <= 1) {
+			return newError(ErrInvalidParameter, "topkapi: value of rate should be in range of (0, 1]")
+		}
+		if rate == 1 {
+			rate = 0
+		}
+		sk.sampling = rate
+		return nil
+	}
+}
+
+// sampled returns what an insert of count adds to the sketch, 0 if it isn't
+// kept, see WithSampling.
+func (sk *Sketch) sampled(count uint64) uint64 {
+	if sk.sampling == 0 || count == 0 {
+		return count
+	}
+	sk.sampleSeq++
+	return sk.sample(count, sk.sampleSeq)
+}
+
+// sample returns what the n-th insert of count adds: 0 with probability
+// 1-rate, and count/rate otherwise.
+func (sk *Sketch) sample(count, n uint64) uint64 {
+	// splitmix64, from the seed of the sketch
+	u := float64(mix64(sk.seed+n*0x9e3779b97f4a7c15)>>11) / (1 << 53)
+	if u >= sk.sampling {
+		return 0
+	}
+
+	// Given that u < rate, u/rate is uniform in [0, 1), and rounds up the
+	// fraction of count/rate with its probability
+	scaled := float64(count) / sk.sampling
+	if scaled >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	whole := math.Floor(scaled)
+	if u/sk.sampling < scaled-whole {
+		whole++
+	}
+	return uint64(whole)
+}
+
+// SamplingRate returns the rate of inserts the sketch keeps, 1 without
+// sampling, see WithSampling.
+func (sk *Sketch) SamplingRate() float64 {
+	if sk.sampling == 0 {
+		return 1
+	}
+	return sk.sampling
+}
+
+// SamplingStdDev returns the standard deviation that sampling adds to an
+// estimate of count, as reported by Count or Result, of a key inserted with
+// a count of 1 at a time: sqrt(count*(1-rate)/rate). The true count is
+// within twice that of the estimate in about 95% of streams, on top of the
+// error bound of the sketch. Keys inserted with larger counts vary more. It
+// is 0 without sampling, and assumes the rate of the sketch for counts
+// merged from sketches of other rates.
+func (sk *Sketch) SamplingStdDev(count uint64) float64 {
+	if sk.sampling == 0 {
+		return 0
+	}
+	return math.Sqrt(float64(count) * (1 - sk.sampling) / sk.sampling)
+}
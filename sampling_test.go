@@ -0,0 +1,117 @@
+package topkapi
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestSamplingTopK(t *testing.T) {
+	keys := zipfKeys(2000000, 100000, 1)
+	exact := exactCount(keys)
+	ranked := make([]string, 0, len(exact))
+	for key := range exact {
+		ranked = append(ranked, key)
+	}
+	sort.Slice(ranked, func(a, b int) bool { return exact[ranked[a]] > exact[ranked[b]] })
+
+	sk, _ := NewTopK(10, 100000, 0.01, WithSampling(0.01))
+	for _, key := range keys {
+		sk.Insert(key, 1)
+	}
+
+	top := sk.TopK(10)
+	found := make(map[interface{}]bool, len(top))
+	for _, hh := range top {
+		found[hh.Key] = true
+
+		// The sketch is exact for heavy hitters, leaving the error of sampling
+		want := exact[hh.Key.(string)]
+		if diff := math.Abs(float64(hh.Count) - float64(want)); diff > 4*sk.SamplingStdDev(want) {
+			t.Errorf("Expected '%s' within 4 standard deviations of %d, found %d", hh.Key, want, hh.Count)
+		}
+	}
+	for _, key := range ranked[:10] {
+		if !found[key] {
+			t.Errorf("Expected '%s' of the true top 10 in the top 10, found %v", key, top)
+		}
+	}
+	if total := float64(sk.Total()); math.Abs(total-float64(len(keys))) > 4*sk.SamplingStdDev(uint64(len(keys))) {
+		t.Errorf("Expected a total of about %d, found %.0f", len(keys), total)
+	}
+}
+
+func TestSamplingMerge(t *testing.T) {
+	keys := zipfKeys(400000, 1000, 2)
+	exact := exactCount(keys)
+
+	// Both halves of the stream estimate their full counts, whatever the rate
+	coarse, _ := New(0.01, 0.001, WithSampling(0.01), WithSeed(1))
+	fine, _ := New(0.01, 0.001, WithSampling(0.2), WithSeed(1))
+	for i, key := range keys {
+		if i%2 == 0 {
+			coarse.Insert(key, 1)
+		} else {
+			fine.Insert(key, 1)
+		}
+	}
+	if err := fine.Merge(coarse); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hh := range fine.TopK(3) {
+		want := exact[hh.Key.(string)]
+		if diff := math.Abs(float64(hh.Count) - float64(want)); diff > 4*coarse.SamplingStdDev(want/2) {
+			t.Errorf("Expected '%s' within 4 standard deviations of %d, found %d", hh.Key, want, hh.Count)
+		}
+	}
+	if fine.SamplingRate() != 0.2 {
+		t.Errorf("Expected the merge to keep the rate of the sketch, found %v", fine.SamplingRate())
+	}
+}
+
+func TestWithSampling(t *testing.T) {
+	for _, rate := range []float64{0, -0.5, 1.5, math.NaN()} {
+		if _, err := New(0.01, 0.01, WithSampling(rate)); !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("Expected a rate of %v to be invalid, found %v", rate, err)
+		}
+	}
+
+	// A rate of 1 keeps every insert, and counts stay integers
+	all, _ := New(0.01, 0.01, WithSampling(1))
+	plain, _ := New(0.01, 0.01)
+	for i := 0; i < 1000; i++ {
+		all.Insert(i%10, 3)
+		plain.Insert(i%10, 3)
+	}
+	if all.StateHash() != plain.StateHash() || all.SamplingRate() != 1 || all.SamplingStdDev(100) != 0 {
+		t.Error("Expected a rate of 1 to sample nothing out")
+	}
+
+	// Sketches of the same seed keep the same inserts
+	a, _ := New(0.01, 0.01, WithSampling(0.3), WithSeed(5))
+	b, _ := New(0.01, 0.01, WithSampling(0.3), WithSeed(5))
+	for i := 0; i < 1000; i++ {
+		a.Insert(i%10, 1)
+		b.InsertHashed(i%10, b.HashKey(i%10), 1)
+	}
+	if a.StateHash() != b.StateHash() {
+		t.Error("Expected sketches of the same seed to sample alike")
+	}
+	if c, _ := a.Count(3); math.Abs(float64(c)-100) > 4*a.SamplingStdDev(100) {
+		t.Errorf("Expected a count of about 100, found %d", c)
+	}
+
+	// Primed and absorbed counts aren't sampled
+	primed, _ := New(0.01, 0.01, WithSampling(0.001))
+	primed.Prime([]LocalHeavyHitter{{Key: "a", Count: 5}})
+	primed.AbsorbTopK(plain, 2)
+	if c, _ := primed.Count("a"); c != 5 || primed.Total() != 5+2*300 {
+		t.Errorf("Expected primed and absorbed counts as they are, found %d of %d", c, primed.Total())
+	}
+
+	if c := (&Sketch{sampling: 0.5}).sample(1<<63, 1); c != 0 && c != math.MaxUint64 {
+		t.Errorf("Expected a scaled count past the counters to saturate, found %d", c)
+	}
+}
@@ -0,0 +1,80 @@
+package topkapi
+
+import "math"
+
+// Add applies a signed correction to the count of key in one call: a
+// positive delta is inserted like Insert, and a negative one takes -delta
+// occurrences of key off its counters, its residual where it is a candidate,
+// and Total. Counts floor at zero: a key never goes below an estimate of 0,
+// and the correction is capped at the current estimate of key, so that too
+// large a correction takes as little as possible from the keys sharing its
+// buckets. A candidate whose counter drops to zero is dropped. Add returns
+// the errors of TryInsert.
+//
+// The guarantees of the sketch hold as long as corrections never take more
+// off a key than was inserted of it: counters still add up the net counts
+// of their keys, so estimates still never undercount. A correction beyond
+// the net count of a key, which the sketch can't tell from one within it
+// where keys collide, is taken off the keys sharing its buckets, which may
+// then be undercounted. Heavy negative traffic also loses more candidates:
+// a correction lowers a residual but never restores the residual of a
+// candidate that an insert of the key had lowered, so candidates are
+// evicted a little more easily than their counts deserve.
+//
+// Negative deltas are not inserts for WithSpanTracking, and the histogram of
+// WithThresholdTracking isn't lowered, so SuggestThreshold may run high
+// until the histogram is rebuilt, by Merge for instance.
+func (sk *Sketch) Add(key interface{}, delta int64) error {
+	if delta >= 0 {
+		return sk.TryInsert(key, uint64(delta))
+	}
+
+	ck, ok := sk.limit(sk.canonical(key))
+	if !ok {
+		sk.rejected++
+		return keyError(ck)
+	}
+	// -delta overflows for math.MinInt64, whose conversion is still right
+	sk.subtract(ck, sk.hashKey(ck), uint64(-delta))
+
+	return nil
+}
+
+// subtract takes n occurrences of key off its buckets, see Add.
+func (sk *Sketch) subtract(key interface{}, hsum uint64, n uint64) {
+	if est := sk.counterMin(hsum); n > est {
+		n = est
+	}
+	if n == 0 {
+		return
+	}
+
+	for i := 0; i < sk.cms.rows; i++ {
+		j := sk.bucket(hsum, i)
+		// A saturated counter has lost track of its count
+		c := sk.cms.get(i, j)
+		if c != math.MaxUint64 {
+			c -= n
+			sk.cms.set(i, j, c)
+		}
+		if i >= len(sk.counts) {
+			continue
+		}
+		if c == 0 && sk.objects[i][j] != nil {
+			sk.vacate(i, j)
+		} else if sk.holds(i, j, key, hsum) {
+			if sk.counts[i][j] -= int64(n); sk.counts[i][j] < 0 || n > math.MaxInt64 {
+				sk.counts[i][j] = 0
+			}
+		}
+	}
+
+	if n > sk.total {
+		n = sk.total
+	}
+	sk.total -= n
+
+	if sk.top != nil {
+		sk.top.inserted(sk, key, hsum)
+	}
+}
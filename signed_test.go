@@ -0,0 +1,70 @@
+package topkapi
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	sk := newSketch(1000, 4)
+	for _, delta := range []int64{10, -3, 5} {
+		if err := sk.Add("meter", delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c, ok := sk.Count("meter"); c != 12 || !ok {
+		t.Errorf("Expected an estimate of 12, found (%d, %v)", c, ok)
+	}
+	if sk.Total() != 12 {
+		t.Errorf("Expected a total of 12, found %d", sk.Total())
+	}
+	if res := sk.Result(1); len(res) != 1 || res[0].Count != 12 || res[0].Rows != 4 {
+		t.Errorf("Expected the key in every row, found %v", res)
+	}
+
+	if err := sk.Add([]int{1}, -1); !errors.Is(err, ErrUnsupportedKeyType) {
+		t.Errorf("Expected an unsupported key type, found %v", err)
+	}
+}
+
+func TestAddNetNegative(t *testing.T) {
+	sk := newSketch(1000, 4)
+	sk.Insert("other", 7)
+	sk.Add("meter", 5)
+	sk.Add("meter", -8)
+	sk.Add("absent", -2)
+	sk.Add("meter", math.MinInt64)
+
+	if c, ok := sk.Count("meter"); c != 0 || ok {
+		t.Errorf("Expected a net negative key to floor at (0, false), found (%d, %v)", c, ok)
+	}
+	if c, ok := sk.Count("other"); c != 7 || !ok {
+		t.Errorf("Expected the other key untouched at 7, found (%d, %v)", c, ok)
+	}
+	if sk.Total() != 7 {
+		t.Errorf("Expected a total of 7, found %d", sk.Total())
+	}
+
+	// The dropped candidate leaves its buckets to the next key
+	sk.Add("meter", 2)
+	if c, _ := sk.Count("meter"); c != 2 {
+		t.Errorf("Expected a new estimate of 2, found %d", c)
+	}
+}
+
+func TestAddTopKTracking(t *testing.T) {
+	sk, _ := New(0.001, 0.001, WithTopKTracking(3))
+	for n, key := range []string{"a", "b", "c", "d"} {
+		sk.Add(key, int64(10*(n+1)))
+	}
+	sk.Add("d", -35)
+
+	want := []string{"c", "b", "a"}
+	res := sk.TopK(3)
+	for n := range want {
+		if n >= len(res) || res[n].Key != want[n] {
+			t.Fatalf("Expected the top 3 %v after a correction, found %v", want, res)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package topkapi
+
+// spanTracker numbers inserts and records the first and last insert into
+// every bucket of the rows holding candidates.
+type spanTracker struct {
+	seq         uint64
+	first, last [][]uint64 // 0 for buckets never inserted into
+}
+
+// WithSpanTracking numbers every Insert, starting at 1, and records the
+// first and last insert into every bucket, so that Span can tell when a key
+// was seen. It takes 16 bytes per bucket of the rows holding candidates.
+//
+// Spans are not part of the binary encoding, and start over after
+// UnmarshalBinary. Merge numbers the inserts of the other sketch as if they
+// followed those of the receiver, which suits merging consecutive windows of
+// a stream in order; spans of an other sketch without span tracking are
+// lost.
+func WithSpanTracking() Option {
+	return func(sk *Sketch) error {
+		sk.spans = newSpanTracker(sk.l, sk.b)
+		return nil
+	}
+}
+
+// Span returns the positions of the first and last insert of key, and
+// whether key is a candidate, see Count. It returns false without span
+// tracking.
+//
+// Like the count-min estimate, a span is taken over all buckets of key,
+// where the inserts of colliding keys are recorded alongside it. first may
+// be too early and last too late, but the span always covers the inserts of
+// key.
+func (sk *Sketch) Span(key interface{}) (first, last uint64, ok bool) {
+	if sk.spans == nil {
+		return 0, 0, false
+	}
+
+	key, ok = sk.limit(sk.canonical(key))
+	if !ok || key == nil {
+		return 0, 0, false
+	}
+	hsum := sk.hashKey(key)
+	if sk.rowsHolding(key, hsum, 0) == 0 {
+		return 0, 0, false
+	}
+
+	for i := range sk.spans.first {
+		j := sk.bucket(hsum, i)
+		if f := sk.spans.first[i][j]; f > first {
+			first = f
+		}
+		if l := sk.spans.last[i][j]; i == 0 || l < last {
+			last = l
+		}
+	}
+
+	return first, last, true
+}
+
+func newSpanTracker(l, b uint64) *spanTracker {
+	s := &spanTracker{
+		first: make([][]uint64, l),
+		last:  make([][]uint64, l),
+	}
+	for i := range s.first {
+		s.first[i] = make([]uint64, b)
+		s.last[i] = make([]uint64, b)
+	}
+	return s
+}
+
+// inserted records an insert of the key hash into its buckets.
+func (s *spanTracker) inserted(sk *Sketch, hsum uint64) {
+	s.seq++
+	for i := range s.first {
+		j := sk.bucket(hsum, i)
+		if s.first[i][j] == 0 {
+			s.first[i][j] = s.seq
+		}
+		s.last[i][j] = s.seq
+	}
+}
+
+// merge appends the spans of other, see WithSpanTracking.
+func (s *spanTracker) merge(other *spanTracker) {
+	for i := range s.first {
+		for j, f := range other.first[i] {
+			if f == 0 {
+				continue
+			}
+			if s.first[i][j] == 0 {
+				s.first[i][j] = s.seq + f
+			}
+			s.last[i][j] = s.seq + other.last[i][j]
+		}
+	}
+	s.seq += other.seq
+}
+
+func (s *spanTracker) clone() *spanTracker {
+	cp := &spanTracker{
+		seq:   s.seq,
+		first: make([][]uint64, len(s.first)),
+		last:  make([][]uint64, len(s.last)),
+	}
+	for i := range s.first {
+		cp.first[i] = append([]uint64(nil), s.first[i]...)
+		cp.last[i] = append([]uint64(nil), s.last[i]...)
+	}
+	return cp
+}
+
+func (s *spanTracker) reset() {
+	s.seq = 0
+	for i := range s.first {
+		for j := range s.first[i] {
+			s.first[i][j] = 0
+			s.last[i][j] = 0
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package topkapi
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSpan(t *testing.T) {
+	sk, _ := New(0.01, 0.001, WithSpanTracking())
+
+	// Insert 1..1000, with "session" from 201 to 600 every other insert
+	for i := 1; i <= 1000; i++ {
+		if i > 200 && i <= 600 && i%2 == 1 {
+			sk.Insert("session", 1)
+			continue
+		}
+		sk.Insert(fmt.Sprint("noise", i), 1)
+	}
+
+	first, last, ok := sk.Span("session")
+	if !ok || first > 201 || last < 599 {
+		t.Fatalf("Expected span to cover [201, 599], found [%d, %d] (%v)", first, last, ok)
+	}
+	if first < 150 || last > 650 {
+		t.Errorf("Expected span close to [201, 599], found [%d, %d]", first, last)
+	}
+	if _, _, ok := sk.Span("never inserted"); ok {
+		t.Error("Expected no span for a key never inserted")
+	}
+
+	// The inserts of a merged sketch follow
+	next, _ := New(0.01, 0.001, WithSpanTracking())
+	next.Insert("late", 1)
+	next.Insert("session", 1)
+	if err := sk.Merge(next); err != nil {
+		t.Fatal(err)
+	}
+	if _, last, _ := sk.Span("session"); last < 1002 {
+		t.Errorf("Expected merged span to end at 1002, found %d", last)
+	}
+	if first, _, _ := sk.Span("late"); first > 1001 {
+		t.Errorf("Expected merged key to start at most at 1001, found %d", first)
+	}
+
+	cp := sk.Clone()
+	sk.Reset()
+	if _, _, ok := sk.Span("session"); ok {
+		t.Error("Expected no span after Reset")
+	}
+	if _, last, ok := cp.Span("session"); !ok || last < 1002 {
+		t.Errorf("Expected clone to keep its span, found %d (%v)", last, ok)
+	}
+
+	untracked, _ := New(0.01, 0.001)
+	untracked.Insert("session", 1)
+	if _, _, ok := untracked.Span("session"); ok {
+		t.Error("Expected no span without span tracking")
+	}
+}
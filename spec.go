@@ -0,0 +1,76 @@
+package topkapi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var invalidSpec = newError(ErrInvalidParameter, "topkapi: invalid sketch spec")
+
+// Parse creates a sketch from a spec describing its dimensions, like
+// "b=15197,l=4": b buckets per row and l rows holding candidates, plus
+// optionally extra plain counter rows, as in "b=15197,l=2,extra=2", and a
+// seed, see WithSeed. Every value must be a positive integer, extra and seed
+// excepted, which may be 0. Options are applied after the dimensions like
+// with the other constructors.
+func Parse(spec string, opts ...Option) (*Sketch, error) {
+	values := make(map[string]uint64)
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%w: %q is not key=value", invalidSpec, field)
+		}
+
+		key := strings.TrimSpace(kv[0])
+		switch key {
+		case "b", "l", "extra", "seed":
+		default:
+			return nil, fmt.Errorf("%w: unknown key %q", invalidSpec, key)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("%w: duplicate key %q", invalidSpec, key)
+		}
+
+		bits := 32
+		if key == "seed" {
+			bits = 64
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, bits)
+		if err != nil || v == 0 && key != "extra" && key != "seed" {
+			return nil, fmt.Errorf("%w: %s should be a positive integer, found %q", invalidSpec, key, kv[1])
+		}
+		values[key] = v
+	}
+
+	b, l := values["b"], values["l"]
+	if b == 0 || l == 0 {
+		return nil, fmt.Errorf("%w: both b and l are required", invalidSpec)
+	}
+
+	if err := checkDimensions(b, l); err != nil {
+		return nil, err
+	}
+	sk := newSketch(b, l)
+	sk.seed = values["seed"]
+	if extra := values["extra"]; extra > 0 {
+		opts = append([]Option{WithExtraCounterRows(int(extra))}, opts...)
+	}
+
+	return sk.apply(opts)
+}
+
+// Spec describes the dimensions and seed of the sketch in the form Parse
+// accepts. Options other than extra counter rows and the seed are not part
+// of it.
+func (sk *Sketch) Spec() string {
+	spec := fmt.Sprintf("b=%d,l=%d", sk.b, sk.l)
+	if extra := sk.cms.rows - int(sk.l); extra > 0 {
+		spec += fmt.Sprintf(",extra=%d", extra)
+	}
+	if sk.seed != 0 {
+		spec += fmt.Sprintf(",seed=%d", sk.seed)
+	}
+
+	return spec
+}
@@ -0,0 +1,65 @@
+package topkapi
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for spec, want := range map[string]string{
+		"b=15197,l=4":       "b=15197,l=4",
+		" l = 2 , b = 100 ": "b=100,l=2",
+		"b=100,l=2,extra=3": "b=100,l=2,extra=3",
+		"b=100,l=2,extra=0": "b=100,l=2",
+		"extra=1,l=1,b=1":   "b=1,l=1,extra=1",
+		"seed=7,b=100,l=2":  "b=100,l=2,seed=7",
+		"b=100,l=2,seed=0":  "b=100,l=2",
+	} {
+		sk, err := Parse(spec)
+		if err != nil {
+			t.Errorf("Expected %q to parse, found %v", spec, err)
+			continue
+		}
+		if got := sk.Spec(); got != want {
+			t.Errorf("Expected %q to round trip as %q, found %q", spec, want, got)
+		}
+		if again, _ := Parse(sk.Spec()); again.Spec() != sk.Spec() {
+			t.Errorf("Expected Spec of %q to parse into the same dimensions", spec)
+		}
+	}
+
+	sk, _ := NewTopK(20, 1000000, 0.01, WithExtraCounterRows(1))
+	parsed, err := Parse(sk.Spec(), WithTopKTracking(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.b != sk.b || parsed.l != sk.l || parsed.cms.rows != sk.cms.rows || parsed.top == nil {
+		t.Errorf("Expected the dimensions of %q with options, found %q", sk.Spec(), parsed.Spec())
+	}
+	if err := parsed.Merge(sk); err != nil {
+		t.Errorf("Expected parsed sketch to be compatible, found %v", err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"b=100",
+		"l=4",
+		"b=100,l=4,k=10",
+		"b=100,l=4,b=200",
+		"b=0,l=4",
+		"b=100,l=0",
+		"b=-1,l=4",
+		"b=1.5,l=4",
+		"b=100;l=4",
+		"b=100,l",
+		"b=99999999999,l=4",
+		"b=100,l=4,extra=-1",
+		"b=100,l=4,seed=-1",
+	} {
+		if _, err := Parse(spec); !errors.Is(err, invalidSpec) {
+			t.Errorf("Expected %q to be rejected as invalid, found %v", spec, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package topkapi
+
+import "hash/fnv"
+
+// tagHashed marks a key the binary encoding doesn't support, which the
+// state hash covers by its key hash instead.
+const tagHashed byte = 0xff
+
+// StateHash returns a hash of the full state of the sketch: its dimensions,
+// seed, hash version and bucketing, the counters and residuals, the
+// candidate keys in their binary encoding, the total, eviction and conflict
+// counts and the cardinality estimate. Options and derived state, like
+// tracked top-k, are not part of it.
+//
+// Two sketches have the same state hash only if they fed the same inserts
+// through the same code, so tests can pin it to catch changes in behavior,
+// see testdata/state-hash.golden. It doesn't depend on the binary format
+// version, and covers keys MarshalBinary rejects by their key hash.
+func (sk *Sketch) StateHash() uint64 {
+	h := fnv.New64a()
+
+	var buf []byte
+	write := func() {
+		h.Write(buf)
+		buf = buf[:0]
+	}
+
+	buf = appendUvarint(buf, sk.b)
+	buf = appendUvarint(buf, sk.l)
+	buf = appendUvarint(buf, uint64(sk.cms.rows))
+	buf = appendUvarint(buf, sk.seed)
+	buf = appendUvarint(buf, uint64(sk.hashVersion))
+	if sk.consistent {
+		// Only when set, so that the state hash of modulo hashing sketches
+		// is what it was before consistent bucketing
+		buf = appendUvarint(buf, 1)
+	}
+	buf = appendUvarint(buf, sk.total)
+	write()
+	for i := 0; i < sk.cms.rows; i++ {
+		for j := uint64(0); j < sk.b; j++ {
+			buf = appendUvarint(buf, sk.cms.get(i, j))
+		}
+		write()
+	}
+	for _, row := range sk.counts {
+		for _, c := range row {
+			buf = appendVarint(buf, c)
+		}
+		write()
+	}
+	for i, row := range sk.objects {
+		for j, obj := range row {
+			enc, err := appendKey(buf, obj)
+			if err != nil {
+				enc = appendUvarint(append(buf, tagHashed), sk.hashes[i][j])
+			}
+			buf = enc
+		}
+		write()
+	}
+	buf = appendUvarint(buf, sk.evictions)
+	for _, c := range sk.conflicts {
+		buf = appendUvarint(buf, c)
+	}
+	buf = append(buf, sk.distinct[:]...)
+	write()
+
+	return h.Sum64()
+}
@@ -0,0 +1,74 @@
+package topkapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const stateHashPath = "testdata/state-hash.golden"
+
+// goldenSketch feeds the fixed stream the golden state hash was taken from:
+// the fixture sketch, a merge, and a key hashed with the fallback.
+func goldenSketch() *Sketch {
+	sk := fixtureSketch(WithSeed(7))
+	other, _ := New(0.05, 0.01, WithSeed(7))
+	for i, key := range zipfKeys(2000, 300, 8) {
+		other.Insert(key, uint64(1+i%2))
+	}
+	sk.Merge(other)
+	sk.Insert(struct{ A int }{1}, 4)
+	return sk
+}
+
+// TestStateHash catches any change to what a sketch ends up holding for a
+// fixed stream. Changes in behavior that are intended must rewrite the
+// golden hash with -update.
+func TestStateHash(t *testing.T) {
+	got := fmt.Sprintf("%#016x", goldenSketch().StateHash())
+	if *update {
+		if err := ioutil.WriteFile(stateHashPath, []byte(got+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := ioutil.ReadFile(stateHashPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.TrimSpace(string(data)); got != want {
+		t.Errorf("Expected state hash %s, found %s: if the change in behavior is intended, run with -update", want, got)
+	}
+}
+
+func TestStateHashChanges(t *testing.T) {
+	sk := goldenSketch()
+	h := sk.StateHash()
+
+	if sk.Clone().StateHash() != h {
+		t.Error("Expected a clone to have the same state hash")
+	}
+	fresh := fixtureSketch(WithSeed(7), WithTopKTracking(10))
+	if fresh.StateHash() != fixtureSketch(WithSeed(7)).StateHash() {
+		t.Error("Expected options tracking derived state not to change the state hash")
+	}
+
+	sk.Insert("key0", 1)
+	if sk.StateHash() == h {
+		t.Error("Expected an insert to change the state hash")
+	}
+	if fixtureSketch(WithSeed(8)).StateHash() == fixtureSketch(WithSeed(7)).StateHash() {
+		t.Error("Expected the seed to change the state hash")
+	}
+
+	data, _ := fresh.MarshalBinary()
+	var dec Sketch
+	if err := dec.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if dec.StateHash() != fresh.StateHash() {
+		t.Error("Expected the state hash to survive a round trip")
+	}
+}
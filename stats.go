@@ -0,0 +1,265 @@
+package topkapi
+
+import (
+	"math"
+	"sort"
+)
+
+// Stats summarizes the state of a sketch.
+type Stats struct {
+	Rows        int     // rows holding candidates
+	CounterRows int     // count-min rows, including extra counter rows
+	Buckets     int     // buckets per row
+	Candidates  int     // occupied candidate slots
+	Tracked     int     // distinct candidate keys
+	Fill        float64 // fraction of candidate slots occupied
+
+	Total       uint64 // sum of all inserted counts
+	Evictions   uint64
+	Rejected    uint64 // inserts of keys over the limit, see WithMaxKeyLen
+	Cardinality uint64
+}
+
+// Empty reports whether nothing has been inserted into or merged into the
+// sketch since it was created or last Reset.
+func (sk *Sketch) Empty() bool {
+	return sk.total == 0
+}
+
+// Total returns the sum of all counts inserted into the sketch, including
+// those merged from other sketches.
+func (sk *Sketch) Total() uint64 {
+	return sk.total
+}
+
+// Share returns the estimated fraction of Total accounted for by key, and
+// whether key is a candidate. It returns (0, false) on an empty sketch.
+func (sk *Sketch) Share(key interface{}) (float64, bool) {
+	if sk.total == 0 {
+		return 0, false
+	}
+
+	count, ok := sk.Count(key)
+	if !ok {
+		return 0, false
+	}
+
+	return float64(count) / float64(sk.total), true
+}
+
+// ResetStats zeros the counters that only observe the sketch, so they can be
+// sampled per interval: Evictions, Rejected and the counts of DedupStats.
+// Counters, candidates, Total and Cardinality are kept, as estimates and
+// Share depend on them, and so are the per-row conflicts ExactIfUnsaturated
+// relies on.
+func (sk *Sketch) ResetStats() {
+	sk.evictions = 0
+	sk.rejected = 0
+	sk.accepted = 0
+	sk.deduped = 0
+}
+
+// Stats scans the candidate matrix and returns a summary of the sketch.
+func (sk *Sketch) Stats() Stats {
+	st := Stats{
+		Rows:        int(sk.l),
+		CounterRows: sk.cms.rows,
+		Buckets:     int(sk.b),
+		Total:       sk.total,
+		Evictions:   sk.evictions,
+		Rejected:    sk.rejected,
+		Cardinality: sk.Cardinality(),
+	}
+
+	seen := make(map[interface{}]struct{})
+	for _, row := range sk.objects {
+		for _, obj := range row {
+			if obj == nil {
+				continue
+			}
+			st.Candidates++
+			seen[obj] = struct{}{}
+		}
+	}
+	st.Tracked = len(seen)
+
+	if slots := st.Rows * st.Buckets; slots > 0 {
+		st.Fill = float64(st.Candidates) / float64(slots)
+	}
+
+	return st
+}
+
+// CountHistogram returns the number of distinct candidates whose estimate
+// falls in every range of the ascending boundaries: the n-th entry counts
+// estimates from buckets[n] up to, but excluding, buckets[n+1], and the last
+// entry counts those of at least the last boundary. Candidates below the
+// first boundary aren't counted, and every candidate counts once, however
+// many rows hold it.
+//
+// Only candidates are counted, so the histogram shows the shape of the head
+// of the distribution; keys in its tail are mostly not tracked.
+func (sk *Sketch) CountHistogram(buckets []uint64) []uint64 {
+	hist := make([]uint64, len(buckets))
+	if len(buckets) == 0 {
+		return hist
+	}
+
+	sk.scan(buckets[0], nil, func(hh LocalHeavyHitter, _ uint64) {
+		n := sort.Search(len(buckets), func(n int) bool { return buckets[n] > hh.Count })
+		hist[n-1]++
+	})
+
+	return hist
+}
+
+// CountPercentile returns the p-th percentile of the estimates of the
+// distinct candidates, by nearest rank, like 0.99 for a count that only the
+// hottest percent of the tracked keys exceed, which makes a key counted
+// above it anomalous. p is clamped to [0, 1], with NaN taken as 0. It
+// returns 0 on a sketch without candidates.
+//
+// Like CountHistogram, it covers the head of the distribution the sketch
+// tracks, not the keys of its tail, so the percentile is higher than that
+// of all keys of the stream.
+func (sk *Sketch) CountPercentile(p float64) uint64 {
+	counts := sk.candidateCounts()
+	if len(counts) == 0 {
+		return 0
+	}
+	if !(p > 0) {
+		p = 0
+	}
+	return nearestRank(counts, math.Min(p, 1))
+}
+
+// CountQuantiles is like CountPercentile for every quantile of qs at once,
+// from a single scan of the candidates, so that the head of the
+// distribution can be told apart from its body, like a top key counted 40
+// times the Median. It returns an error wrapping ErrInvalidParameter for a
+// quantile out of range of [0, 1], and zeros on a sketch without
+// candidates, see Median to tell those apart from counts of 0.
+func (sk *Sketch) CountQuantiles(qs []float64) ([]uint64, error) {
+	for _, q := range qs {
+		if !(q >= 0 && q <= 1) {
+			return nil, newError(ErrInvalidParameter, "topkapi: value of quantile should be in range of [0, 1], found %v", q)
+		}
+	}
+
+	quantiles := make([]uint64, len(qs))
+	if counts := sk.candidateCounts(); len(counts) > 0 {
+		for i, q := range qs {
+			quantiles[i] = nearestRank(counts, q)
+		}
+	}
+	return quantiles, nil
+}
+
+// Median returns the median of the estimates of the distinct candidates,
+// see CountQuantiles, and false on a sketch without candidates.
+func (sk *Sketch) Median() (uint64, bool) {
+	return sk.quantile(0.5)
+}
+
+// P99 returns the 99th percentile of the estimates of the distinct
+// candidates, see CountQuantiles, and false on a sketch without candidates.
+func (sk *Sketch) P99() (uint64, bool) {
+	return sk.quantile(0.99)
+}
+
+func (sk *Sketch) quantile(q float64) (uint64, bool) {
+	counts := sk.candidateCounts()
+	if len(counts) == 0 {
+		return 0, false
+	}
+	return nearestRank(counts, q), true
+}
+
+// candidateCounts returns the estimates of the distinct candidates, in
+// ascending order.
+func (sk *Sketch) candidateCounts() []uint64 {
+	var counts []uint64
+	sk.scan(1, nil, func(hh LocalHeavyHitter, _ uint64) {
+		counts = append(counts, hh.Count)
+	})
+	sort.Slice(counts, func(a, b int) bool { return counts[a] < counts[b] })
+	return counts
+}
+
+// nearestRank returns the q-quantile of the ascending counts, which must not
+// be empty, by nearest rank.
+func nearestRank(counts []uint64, q float64) uint64 {
+	n := int(math.Ceil(q*float64(len(counts)))) - 1
+	if n < 0 {
+		n = 0
+	}
+	return counts[n]
+}
+
+// ExpectedRecall estimates the probability that TopK(k) holds all of the
+// true top k keys. It is an analytical estimate, not a guarantee, and is 1
+// for an empty sketch or k below 1.
+//
+// The model takes the estimates of the current top k as their true counts.
+// A key of count c keeps its bucket in a row as long as the other keys
+// hashed there count less than c; those amount to Epsilon() × (Total() - c)
+// on average, so by Markov's inequality a row loses the key with
+// probability at most ε(N-c)/c. Rows hash independently, so the key is lost
+// in all l rows with probability (ε(N-c)/c)^l, which for c = e·ε·N is half
+// the Delta() of a sketch without extra counter rows. The estimate is the
+// product of the chances of keeping every key.
+//
+// It overstates the recall where the estimates of the top k are inflated
+// by collisions, and where keys of the top k arrive late in the stream, so
+// that they meet buckets already held by others. It understates it for
+// skewed streams, where the counts sharing a bucket are mostly far from
+// their average.
+func (sk *Sketch) ExpectedRecall(k int) float64 {
+	if k < 1 || sk.total == 0 {
+		return 1
+	}
+
+	recall := 1.0
+	for _, hh := range sk.TopK(k) {
+		if hh.Count >= sk.total {
+			continue
+		}
+		noise := sk.Epsilon() * float64(sk.total-hh.Count) / float64(hh.Count)
+		recall *= 1 - math.Pow(math.Min(1, noise), float64(sk.l))
+	}
+
+	return recall
+}
+
+// MergeError merges parts, and returns the mean relative error of the
+// estimates of the merged sketch against those of combined, a sketch of the
+// whole stream built from scratch, over the top k of combined. It is meant
+// for tests validating Merge: merging the parts of a stream should come
+// close to counting the whole stream in one sketch, though Merge keeps one
+// of the candidates of a bucket and can't replay the order of inserts.
+//
+// The parts are not modified. MergeError returns NaN if there are no parts
+// or they can't be merged, and 0 if combined holds no candidates.
+func MergeError(parts []*Sketch, combined *Sketch, k int) float64 {
+	if len(parts) == 0 {
+		return math.NaN()
+	}
+	merged := parts[0].Clone()
+	for _, part := range parts[1:] {
+		if err := merged.Merge(part); err != nil {
+			return math.NaN()
+		}
+	}
+
+	top := combined.TopK(k)
+	if len(top) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, hh := range top {
+		c, _ := merged.Count(hh.Key)
+		sum += math.Abs(float64(c)-float64(hh.Count)) / float64(hh.Count)
+	}
+
+	return sum / float64(len(top))
+}
@@ -0,0 +1,302 @@
+package topkapi
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTotalAndShare(t *testing.T) {
+	words := loadWords()
+	for _, p := range []int{2, 3, 5, 7, 11} {
+		for i := p; i < len(words); i += p {
+			words[i] = words[p]
+		}
+	}
+	sk, _ := NewTopK(10, uint64(len(words)), 0.01)
+	for _, w := range words {
+		sk.Insert(w, 1)
+	}
+	sk.Insert("never inserted", 0)
+
+	if sk.Total() != uint64(len(words)) {
+		t.Errorf("Expected total %d, found %d", len(words), sk.Total())
+	}
+
+	exact := exactCount(words)
+	for _, hh := range sk.TopK(5) {
+		share, ok := sk.Share(hh.Key)
+		want := float64(exact[hh.Key.(string)]) / float64(len(words))
+		if !ok || math.Abs(share-want) > want/100 {
+			t.Errorf("Expected share of '%s' ~%.4f, found %.4f (%v)", hh.Key, want, share, ok)
+		}
+	}
+	if _, ok := sk.Share("never inserted"); ok {
+		t.Error("Expected zero count insert to be a no-op")
+	}
+
+	other, _ := NewTopK(10, uint64(len(words)), 0.01)
+	other.Insert("a", 5)
+	if err := sk.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	if sk.Total() != uint64(len(words))+5 {
+		t.Errorf("Expected merged total %d, found %d", len(words)+5, sk.Total())
+	}
+
+	data, _ := sk.MarshalBinary()
+	var dec Sketch
+	if err := dec.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if dec.Total() != sk.Total() {
+		t.Errorf("Expected total %d to survive round trip, found %d", sk.Total(), dec.Total())
+	}
+}
+
+func TestStats(t *testing.T) {
+	sk, _ := New(0.1, 0.0001, WithExtraCounterRows(2))
+	for i := 0; i < 30; i++ {
+		sk.Insert(i, 2)
+	}
+
+	st := sk.Stats()
+	if st.Rows != 2 || st.CounterRows != 4 || st.Buckets != 10000 {
+		t.Errorf("Expected 2 of 4 rows with 10000 buckets, found %+v", st)
+	}
+	if st.Total != 60 || st.Evictions != sk.Evictions() || st.Cardinality != sk.Cardinality() {
+		t.Errorf("Expected totals to match the sketch, found %+v", st)
+	}
+	if st.Tracked != 30 || st.Candidates < 55 || st.Candidates > 60 {
+		t.Errorf("Expected ~60 candidate slots for 30 keys, found %+v", st)
+	}
+	if st.Fill != float64(st.Candidates)/20000 {
+		t.Errorf("Expected fill %f, found %f", float64(st.Candidates)/20000, st.Fill)
+	}
+}
+
+func TestCountHistogram(t *testing.T) {
+	sk, _ := New(0.01, 0.0001)
+	keys := zipfKeys(20000, 300, 3)
+	for _, k := range keys {
+		sk.Insert(k, 1)
+	}
+
+	// With far more buckets than keys, every key is a candidate with its
+	// exact count
+	buckets := []uint64{2, 10, 100, 1000}
+	want := make([]uint64, len(buckets))
+	for _, c := range exactCount(keys) {
+		for n := len(buckets) - 1; n >= 0; n-- {
+			if c >= buckets[n] {
+				want[n]++
+				break
+			}
+		}
+	}
+
+	got := sk.CountHistogram(buckets)
+	for n := range want {
+		if got[n] != want[n] {
+			t.Errorf("Expected %v keys per bucket, found %v", want, got)
+			break
+		}
+	}
+	// A Zipfian stream has few keys with large counts
+	if got[3] == 0 || got[3] >= got[2] || got[2] >= got[1] {
+		t.Errorf("Expected a skewed histogram, found %v", got)
+	}
+
+	if all := sk.CountHistogram([]uint64{0}); all[0] != uint64(sk.Stats().Tracked) {
+		t.Errorf("Expected %d candidates, found %d", sk.Stats().Tracked, all[0])
+	}
+	if len(sk.CountHistogram(nil)) != 0 {
+		t.Error("Expected an empty histogram without buckets")
+	}
+}
+
+func TestCountPercentile(t *testing.T) {
+	sk, _ := New(0.01, 0.0001)
+	keys := zipfKeys(50000, 1000, 1)
+	for _, k := range keys {
+		sk.Insert(k, 1)
+	}
+
+	// With far more buckets than keys the estimates are the exact counts
+	var counts []uint64
+	for _, c := range exactCount(keys) {
+		counts = append(counts, c)
+	}
+	sort.Slice(counts, func(a, b int) bool { return counts[a] < counts[b] })
+
+	for _, p := range []float64{0.5, 0.9, 0.99} {
+		want := counts[int(math.Ceil(p*float64(len(counts))))-1]
+		got := sk.CountPercentile(p)
+		t.Logf("p%v: %d, exact %d", p*100, got, want)
+		if float64(got) < 0.9*float64(want) || float64(got) > 1.1*float64(want) {
+			t.Errorf("Expected the p%v count near %d, found %d", p*100, want, got)
+		}
+	}
+	if c := sk.CountPercentile(-1); c != counts[0] {
+		t.Errorf("Expected p < 0 to clamp to the lowest count %d, found %d", counts[0], c)
+	}
+	if c := sk.CountPercentile(2); c != counts[len(counts)-1] {
+		t.Errorf("Expected p > 1 to clamp to the highest count %d, found %d", counts[len(counts)-1], c)
+	}
+	if c := sk.CountPercentile(math.NaN()); c != counts[0] {
+		t.Errorf("Expected NaN to count as 0, found %d", c)
+	}
+
+	if c := newSketch(100, 4).CountPercentile(0.99); c != 0 {
+		t.Errorf("Expected 0 on an empty sketch, found %d", c)
+	}
+}
+
+func TestCountQuantiles(t *testing.T) {
+	// One key 40 times as heavy as each of many small ones
+	sk, _ := New(0.0001, 0.0001)
+	sk.Insert("huge", 40000)
+	for i := 0; i < 200; i++ {
+		sk.Insert(i, 1000)
+	}
+
+	qs, err := sk.CountQuantiles([]float64{0, 0.5, 0.99, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{1000, 1000, 1000, 40000}; !reflect.DeepEqual(qs, want) {
+		t.Errorf("Expected quantiles %v, found %v", want, qs)
+	}
+	median, ok := sk.Median()
+	if !ok || median != 1000 {
+		t.Fatalf("Expected a median of 1000, found %d", median)
+	}
+	if ratio := float64(qs[3]) / float64(median); ratio != 40 {
+		t.Errorf("Expected the top key 40 times the median, found %v", ratio)
+	}
+	if p99, ok := sk.P99(); !ok || p99 != qs[2] {
+		t.Errorf("Expected the p99 of CountQuantiles, found %d", p99)
+	}
+
+	for _, q := range []float64{-0.1, 1.5, math.NaN()} {
+		if _, err := sk.CountQuantiles([]float64{0.5, q}); !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("Expected a quantile of %v to be invalid, found %v", q, err)
+		}
+	}
+
+	empty := newSketch(100, 4)
+	if qs, err := empty.CountQuantiles([]float64{0.5, 1}); err != nil || !reflect.DeepEqual(qs, []uint64{0, 0}) {
+		t.Errorf("Expected zeros on an empty sketch, found %v and %v", qs, err)
+	}
+	if _, ok := empty.Median(); ok {
+		t.Error("Expected no median of an empty sketch")
+	}
+	if _, ok := empty.P99(); ok {
+		t.Error("Expected no p99 of an empty sketch")
+	}
+}
+
+func TestExpectedRecall(t *testing.T) {
+	keys := zipfKeys(200000, 50000, 1)
+
+	last := 1.0
+	for _, b := range []uint64{20000, 5000, 1000, 200, 50} {
+		sk := newSketch(b, 4)
+		for _, key := range keys {
+			sk.Insert(key, 1)
+		}
+
+		recall := sk.ExpectedRecall(20)
+		t.Logf("%d buckets: %.4f", b, recall)
+		if recall < 0 || recall > last {
+			t.Errorf("%d buckets: expected recall %.4f below that of more buckets, %.4f", b, recall, last)
+		}
+		last = recall
+	}
+	if last > 0.5 {
+		t.Errorf("expected a low recall for 50 buckets, got %.4f", last)
+	}
+
+	sk := newSketch(100, 4)
+	if r := sk.ExpectedRecall(20); r != 1 {
+		t.Errorf("expected a recall of 1 on an empty sketch, got %v", r)
+	}
+}
+
+func TestMergeError(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		parts := make([]*Sketch, 4)
+		for n := range parts {
+			parts[n], _ = New(0.01, 0.005)
+		}
+		combined, _ := New(0.01, 0.005)
+		for i, key := range zipfKeys(100000, 10000, seed) {
+			parts[i%len(parts)].Insert(key, 1)
+			combined.Insert(key, 1)
+		}
+
+		// Counters add up exactly, so the estimates of the merge are those
+		// of the whole stream
+		if e := MergeError(parts, combined, 20); e != 0 {
+			t.Errorf("Seed %d: expected no merge error, found %f", seed, e)
+		}
+	}
+
+	if e := MergeError([]*Sketch{newSketch(10, 2), newSketch(20, 2)}, newSketch(10, 2), 5); !math.IsNaN(e) {
+		t.Errorf("Expected NaN for incompatible parts, found %f", e)
+	}
+	if e := MergeError(nil, newSketch(10, 2), 5); !math.IsNaN(e) {
+		t.Errorf("Expected NaN without parts, found %f", e)
+	}
+	if e := MergeError([]*Sketch{newSketch(10, 2)}, newSketch(10, 2), 5); e != 0 {
+		t.Errorf("Expected no error for an empty sketch, found %f", e)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	filter, _ := NewEventFilter(1000, 0.01)
+	sk, _ := New(0.05, 0.01, WithMaxKeyLen(8, RejectLongKeys), WithEventFilter(filter))
+	for i, key := range zipfKeys(20000, 5000, 1) {
+		sk.InsertOnce(uint64(i%15000), key, 1)
+	}
+	sk.Insert(strings.Repeat("a", 100), 1)
+
+	st := sk.Stats()
+	if st.Evictions == 0 || st.Rejected == 0 {
+		t.Fatalf("Expected evictions and rejected inserts, found %+v", st)
+	}
+	if _, deduped := sk.DedupStats(); deduped == 0 {
+		t.Fatal("Expected deduplicated inserts")
+	}
+	res, counts := sk.Result(1), make(map[interface{}]uint64)
+	for _, hh := range res {
+		counts[hh.Key], _ = sk.Count(hh.Key)
+	}
+
+	sk.ResetStats()
+
+	after := sk.Stats()
+	if after.Evictions != 0 || sk.Evictions() != 0 || after.Rejected != 0 {
+		t.Errorf("Expected no evictions nor rejected inserts after ResetStats, found %+v", after)
+	}
+	if accepted, deduped := sk.DedupStats(); accepted != 0 || deduped != 0 {
+		t.Errorf("Expected no dedup stats after ResetStats, found %d and %d", accepted, deduped)
+	}
+	if after.Total != st.Total || after.Cardinality != st.Cardinality || after.Candidates != st.Candidates {
+		t.Errorf("Expected the data to survive ResetStats, found %+v, was %+v", after, st)
+	}
+	if !reflect.DeepEqual(sk.Result(1), res) {
+		t.Error("Expected the same result after ResetStats")
+	}
+	for key, c := range counts {
+		if got, _ := sk.Count(key); got != c {
+			t.Errorf("Expected a count of %d for %v after ResetStats, found %d", c, key, got)
+		}
+	}
+	if _, ok := sk.ExactIfUnsaturated(); ok {
+		t.Error("Expected a saturated sketch to stay inexact after ResetStats")
+	}
+}
@@ -0,0 +1,385 @@
+// Package store keeps a directory of interval sketches, so that the heavy
+// hitters of any range of time can be answered by merging the intervals it
+// covers.
+//
+// Every interval is a file named after its time range holding the sketch in
+// the checksummed binary format of topkapi. Files are written to a temporary
+// name and renamed into place, so a crash never leaves a partial interval
+// behind, and a corrupted file fails to load rather than skewing results.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wardbekker/topkapi"
+)
+
+const (
+	ext    = ".tks"
+	tmpExt = ".tmp"
+)
+
+var (
+	emptyInterval       = errors.New("store: interval should end after it starts")
+	earlyInterval       = errors.New("store: interval should not start before 1970")
+	overlappingInterval = errors.New("store: interval overlaps a stored interval")
+)
+
+// Interval is the half-open time range [From, To) a sketch covers.
+type Interval struct {
+	From, To time.Time
+}
+
+func (iv Interval) overlaps(from, to time.Time) bool {
+	return iv.From.Before(to) && from.Before(iv.To)
+}
+
+func (iv Interval) contains(other Interval) bool {
+	return !other.From.Before(iv.From) && !iv.To.Before(other.To)
+}
+
+// Store is a directory of interval sketches. It is safe for concurrent use,
+// but only one Store should use a directory at a time.
+type Store struct {
+	dir       string
+	newSketch func() (*topkapi.Sketch, error)
+
+	mu        sync.Mutex
+	intervals []Interval // ordered by From, never overlapping
+}
+
+// Open opens the store in dir, creating dir if it doesn't exist. newSketch
+// creates the sketches intervals are decoded into; they take on the
+// dimensions of the stored sketches but keep their options.
+//
+// Temporary files and intervals contained in another one, left behind by a
+// write or a compaction that was interrupted, are removed.
+func Open(dir string, newSketch func() (*topkapi.Sketch, error)) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var intervals []Interval
+	for _, name := range names {
+		switch filepath.Ext(name) {
+		case tmpExt:
+			if err := os.Remove(name); err != nil {
+				return nil, err
+			}
+		case ext:
+			iv, err := parseName(filepath.Base(name))
+			if err != nil {
+				return nil, err
+			}
+			intervals = append(intervals, iv)
+		}
+	}
+
+	// A compacted interval sorts before the intervals it contains
+	sort.Slice(intervals, func(a, b int) bool {
+		if !intervals[a].From.Equal(intervals[b].From) {
+			return intervals[a].From.Before(intervals[b].From)
+		}
+		return intervals[a].To.After(intervals[b].To)
+	})
+
+	s := &Store{dir: dir, newSketch: newSketch}
+	for _, iv := range intervals {
+		if n := len(s.intervals); n > 0 && s.intervals[n-1].contains(iv) {
+			if err := os.Remove(s.path(iv)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.intervals = append(s.intervals, iv)
+	}
+
+	return s, nil
+}
+
+// Append stores the sketch of the interval [from, to). The interval must not
+// overlap any stored interval.
+func (s *Store) Append(from, to time.Time, sk *topkapi.Sketch) error {
+	if !from.Before(to) {
+		return emptyInterval
+	}
+	if from.UnixNano() < 0 {
+		return earlyInterval
+	}
+	// As it reads back from the file name
+	from, to = time.Unix(0, from.UnixNano()), time.Unix(0, to.UnixNano())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.find(from, to)) > 0 {
+		return fmt.Errorf("%w: [%v, %v)", overlappingInterval, from, to)
+	}
+
+	iv := Interval{From: from, To: to}
+	if err := s.write(iv, sk); err != nil {
+		return err
+	}
+	s.insert(iv)
+
+	return nil
+}
+
+// Intervals returns the stored intervals, ordered by time.
+func (s *Store) Intervals() []Interval {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Interval(nil), s.intervals...)
+}
+
+// Load merges the sketches of all stored intervals overlapping [from, to).
+// Intervals can't be split, so the result may cover more time than asked
+// for; covered is the range from the start of the first interval to the end
+// of the last. Without any overlapping interval, Load returns an empty sketch
+// and a zero covered range.
+func (s *Store) Load(from, to time.Time) (sk *topkapi.Sketch, covered Interval, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	intervals := s.find(from, to)
+	if len(intervals) == 0 {
+		sk, err = s.newSketch()
+		return sk, Interval{}, err
+	}
+
+	for i, iv := range intervals {
+		isk, err := s.read(iv)
+		if err != nil {
+			return nil, Interval{}, err
+		}
+		if i == 0 {
+			sk = isk
+			continue
+		}
+		if err := sk.Merge(isk); err != nil {
+			return nil, Interval{}, fmt.Errorf("store: merging %s: %w", s.path(iv), err)
+		}
+	}
+
+	covered = Interval{From: intervals[0].From, To: intervals[len(intervals)-1].To}
+	return sk, covered, nil
+}
+
+// Query returns the top k heavy hitters of the intervals overlapping
+// [from, to), see Load.
+func (s *Store) Query(from, to time.Time, k int) ([]topkapi.LocalHeavyHitter, error) {
+	sk, _, err := s.Load(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return sk.TopK(k), nil
+}
+
+// Compact merges the intervals ending before the given time into coarser
+// ones, one per window of the given width that holds more than one interval.
+// Windows are aligned like time.Truncate, so a width of 24 hours compacts
+// hourly intervals into days in UTC. Intervals spanning the edge of a window
+// are left alone. A compacted interval runs from the start of its first
+// interval to the end of its last.
+//
+// The compacted interval is written before the intervals it replaces are
+// removed, and Open removes any that are left, so an interrupted compaction
+// never counts an interval twice.
+func (s *Store) Compact(before time.Time, width time.Duration) error {
+	if width <= 0 {
+		return errors.New("store: width should be > 0")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var groups [][]Interval
+	for i := 0; i < len(s.intervals); {
+		iv := s.intervals[i]
+		start := iv.From.Truncate(width)
+		end := start.Add(width)
+
+		j := i
+		for j < len(s.intervals) && !s.intervals[j].To.After(end) && !s.intervals[j].To.After(before) {
+			j++
+		}
+		if j-i > 1 {
+			groups = append(groups, append([]Interval(nil), s.intervals[i:j]...))
+		}
+		if j == i {
+			j++
+		}
+		i = j
+	}
+
+	for _, group := range groups {
+		if err := s.compact(group); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compact replaces a run of intervals with their merge.
+func (s *Store) compact(group []Interval) error {
+	sk, err := s.read(group[0])
+	if err != nil {
+		return err
+	}
+	for _, iv := range group[1:] {
+		isk, err := s.read(iv)
+		if err != nil {
+			return err
+		}
+		if err := sk.Merge(isk); err != nil {
+			return fmt.Errorf("store: merging %s: %w", s.path(iv), err)
+		}
+	}
+
+	merged := Interval{From: group[0].From, To: group[len(group)-1].To}
+	if err := s.write(merged, sk); err != nil {
+		return err
+	}
+
+	for _, iv := range group {
+		if err := os.Remove(s.path(iv)); err != nil {
+			return err
+		}
+		s.remove(iv)
+	}
+	s.insert(merged)
+
+	return nil
+}
+
+// find returns the stored intervals overlapping [from, to).
+func (s *Store) find(from, to time.Time) []Interval {
+	// The first interval ending after from
+	i := sort.Search(len(s.intervals), func(i int) bool {
+		return s.intervals[i].To.After(from)
+	})
+
+	var found []Interval
+	for ; i < len(s.intervals) && s.intervals[i].overlaps(from, to); i++ {
+		found = append(found, s.intervals[i])
+	}
+
+	return found
+}
+
+func (s *Store) insert(iv Interval) {
+	i := sort.Search(len(s.intervals), func(i int) bool {
+		return !s.intervals[i].From.Before(iv.From)
+	})
+	s.intervals = append(s.intervals, Interval{})
+	copy(s.intervals[i+1:], s.intervals[i:])
+	s.intervals[i] = iv
+}
+
+func (s *Store) remove(iv Interval) {
+	for i := range s.intervals {
+		if s.intervals[i] == iv {
+			s.intervals = append(s.intervals[:i], s.intervals[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Store) read(iv Interval) (*topkapi.Sketch, error) {
+	data, err := ioutil.ReadFile(s.path(iv))
+	if err != nil {
+		return nil, err
+	}
+
+	sk, err := s.newSketch()
+	if err != nil {
+		return nil, err
+	}
+	if err := sk.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("store: reading %s: %w", s.path(iv), err)
+	}
+
+	return sk, nil
+}
+
+// write stores sk for iv, durably and atomically.
+func (s *Store) write(iv Interval, sk *topkapi.Sketch) error {
+	data, err := sk.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	path := s.path(iv)
+	tmp := strings.TrimSuffix(path, ext) + tmpExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return syncDir(s.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// path returns the file of an interval, named after its bounds in Unix
+// nanoseconds so that names sort by time.
+func (s *Store) path(iv Interval) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d-%020d%s", iv.From.UnixNano(), iv.To.UnixNano(), ext))
+}
+
+func parseName(name string) (Interval, error) {
+	bounds := strings.Split(strings.TrimSuffix(name, ext), "-")
+	if len(bounds) != 2 {
+		return Interval{}, fmt.Errorf("store: unexpected file %s", name)
+	}
+
+	from, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return Interval{}, fmt.Errorf("store: unexpected file %s", name)
+	}
+	to, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || to <= from {
+		return Interval{}, fmt.Errorf("store: unexpected file %s", name)
+	}
+
+	return Interval{From: time.Unix(0, from), To: time.Unix(0, to)}, nil
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wardbekker/topkapi"
+)
+
+var epoch = time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func newSketch() (*topkapi.Sketch, error) {
+	return topkapi.NewTopK(10, 10000, 0.01)
+}
+
+// hourly appends a sketch for each of the given hours after epoch, where
+// hour h counts key "h<h>" h+1 times and key "all" once.
+func hourly(t *testing.T, s *Store, hours ...int) {
+	t.Helper()
+
+	for _, h := range hours {
+		sk, _ := newSketch()
+		sk.Insert(fmt.Sprint("h", h), uint64(h+1))
+		sk.Insert("all", 1)
+
+		from := epoch.Add(time.Duration(h) * time.Hour)
+		if err := s.Append(from, from.Add(time.Hour), sk); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func count(t *testing.T, s *Store, from, to time.Time, key string) uint64 {
+	t.Helper()
+
+	sk, _, err := s.Load(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := sk.Count(key)
+	return c
+}
+
+func TestQueryRange(t *testing.T) {
+	s, err := Open(t.TempDir(), newSketch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hourly(t, s, 0, 1, 2, 3, 4, 5)
+
+	at := func(h int) time.Time {
+		return epoch.Add(time.Duration(h) * time.Hour)
+	}
+
+	// Ranges are half open
+	if c := count(t, s, at(2), at(4), "all"); c != 2 {
+		t.Errorf("Expected hours 2 and 3, found %d", c)
+	}
+	if c := count(t, s, at(2), at(4), "h4"); c != 0 {
+		t.Errorf("Expected hour 4 to be excluded, found h4=%d", c)
+	}
+	// An interval partially in range is included whole
+	if c := count(t, s, at(2).Add(30*time.Minute), at(3).Add(time.Minute), "all"); c != 2 {
+		t.Errorf("Expected overlapping hours 2 and 3, found %d", c)
+	}
+	_, covered, _ := s.Load(at(2).Add(30*time.Minute), at(3).Add(time.Minute))
+	if !covered.From.Equal(at(2)) || !covered.To.Equal(at(4)) {
+		t.Errorf("Expected to cover [%v, %v), found %v", at(2), at(4), covered)
+	}
+
+	res, err := s.Query(at(0), at(6), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all and h5 tie at 6
+	if len(res) != 3 || res[0].Count != 6 || res[1].Count != 6 || res[2].Key != "h4" || res[2].Count != 5 {
+		t.Errorf("Expected all, h5, h4, found %v", res)
+	}
+
+	empty, err := s.Query(at(10), at(12), 3)
+	if err != nil || empty == nil || len(empty) != 0 {
+		t.Errorf("Expected empty result outside the stored range, found %v (%v)", empty, err)
+	}
+
+	sk, _ := newSketch()
+	if err := s.Append(at(3).Add(time.Minute), at(7), sk); !errors.Is(err, overlappingInterval) {
+		t.Errorf("Expected overlapping interval to be rejected, found %v", err)
+	}
+	if err := s.Append(at(7), at(7), sk); err != emptyInterval {
+		t.Errorf("Expected empty interval to be rejected, found %v", err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, newSketch)
+	hourly(t, s, 0, 1, 2)
+
+	// A write interrupted before the rename
+	if err := ioutil.WriteFile(filepath.Join(dir, "partial.tmp"), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dir, newSketch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Intervals()); n != 3 {
+		t.Errorf("Expected 3 intervals after reopening, found %d", n)
+	}
+	if c := count(t, s, epoch, epoch.Add(3*time.Hour), "all"); c != 3 {
+		t.Errorf("Expected all=3, found %d", c)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial.tmp")); !os.IsNotExist(err) {
+		t.Error("Expected temporary file to be removed")
+	}
+}
+
+func TestCorruptInterval(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, newSketch)
+	hourly(t, s, 0)
+
+	path := s.path(s.Intervals()[0])
+	data, _ := ioutil.ReadFile(path)
+	data[len(data)/2] ^= 1
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Query(epoch, epoch.Add(time.Hour), 1); err == nil {
+		t.Error("Expected error for a corrupted interval")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s, _ := Open(t.TempDir(), newSketch)
+	var hours []int
+	for h := 0; h < 72; h++ {
+		hours = append(hours, h)
+	}
+	hourly(t, s, hours...)
+
+	before, _ := s.Query(epoch, epoch.Add(72*time.Hour), 10)
+
+	// Compact the first two days; the third stays hourly
+	if err := s.Compact(epoch.Add(48*time.Hour), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	intervals := s.Intervals()
+	if len(intervals) != 2+24 {
+		t.Fatalf("Expected 2 days and 24 hours, found %d intervals", len(intervals))
+	}
+	for d := 0; d < 2; d++ {
+		from := epoch.Add(time.Duration(d) * 24 * time.Hour)
+		if iv := intervals[d]; !iv.From.Equal(from) || !iv.To.Equal(from.Add(24*time.Hour)) {
+			t.Errorf("Expected day %d to be [%v, %v), found %v", d, from, from.Add(24*time.Hour), iv)
+		}
+	}
+
+	after, _ := s.Query(epoch, epoch.Add(72*time.Hour), 10)
+	if len(after) != len(before) {
+		t.Fatalf("Expected %d heavy hitters after compaction, found %d", len(before), len(after))
+	}
+	for i := range before {
+		if after[i] != before[i] {
+			t.Errorf("Expected %v at rank %d after compaction, found %v", before[i], i, after[i])
+		}
+	}
+
+	// A range within a compacted day now loads the whole day
+	if c := count(t, s, epoch.Add(14*time.Hour), epoch.Add(16*time.Hour), "all"); c != 24 {
+		t.Errorf("Expected the whole first day, found all=%d", c)
+	}
+	if c := count(t, s, epoch.Add(62*time.Hour), epoch.Add(64*time.Hour), "all"); c != 2 {
+		t.Errorf("Expected two hours of the third day, found all=%d", c)
+	}
+
+	// Compacting again changes nothing
+	if err := s.Compact(epoch.Add(48*time.Hour), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Intervals()); n != 26 {
+		t.Errorf("Expected compaction to be idempotent, found %d intervals", n)
+	}
+}
+
+func TestInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, newSketch)
+	hourly(t, s, 0, 1, 2, 3)
+
+	// Write the compacted interval, but leave the hours it replaces
+	merged, _, _ := s.Load(epoch, epoch.Add(4*time.Hour))
+	if err := s.write(Interval{From: epoch, To: epoch.Add(4 * time.Hour)}, merged); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(dir, newSketch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Intervals()); n != 1 {
+		t.Errorf("Expected only the compacted interval, found %d", n)
+	}
+	if c := count(t, s, epoch, epoch.Add(4*time.Hour), "all"); c != 4 {
+		t.Errorf("Expected all=4 counted once, found %d", c)
+	}
+}
@@ -0,0 +1,74 @@
+package topkapi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+var (
+	mismatchedNormalizers = newError(ErrIncompatibleSketches, "topkapi: merging sketches with different key normalizers")
+	mismatchedKeyForms    = newError(ErrIncompatibleSketches, "topkapi: merging sketches with different canonical keys")
+)
+
+// InsertString inserts a string key after normalizing it with the key
+// normalizer, see WithKeyNormalizer.
+func (sk *Sketch) InsertString(key string, count uint64) {
+	sk.Insert(sk.normalized(key), count)
+}
+
+// CountString is Count for a string key, normalized like InsertString does.
+func (sk *Sketch) CountString(key string) (uint64, bool) {
+	return sk.Count(sk.normalized(key))
+}
+
+// CountReader inserts every line read from r as a string key with a count
+// of 1, like InsertString, and returns the number of lines inserted.
+// Lines longer than 64KiB fail with bufio.ErrTooLong.
+func (sk *Sketch) CountReader(r io.Reader) (int, error) {
+	var (
+		scanner = bufio.NewScanner(r)
+		n       int
+	)
+	for scanner.Scan() {
+		sk.InsertString(scanner.Text(), 1)
+		n++
+	}
+
+	return n, scanner.Err()
+}
+
+// checkNormalizer warns when other maps keys to a different form than sk,
+// through its key normalizer, canonicalizer, case folding or numeric keys,
+// so the same key may be counted as two.
+func (sk *Sketch) checkNormalizer(other *Sketch) {
+	if sk.normalizer != other.normalizer {
+		sk.mismatchedMerge(fmt.Errorf("%w: %q and %q", mismatchedNormalizers, sk.normalizer, other.normalizer))
+	}
+	if a, b := funcName(sk.canonicalize), funcName(other.canonicalize); a != b {
+		sk.mismatchedMerge(fmt.Errorf("%w: canonicalizers %q and %q", mismatchedKeyForms, a, b))
+	}
+	if sk.foldCase != other.foldCase {
+		sk.mismatchedMerge(fmt.Errorf("%w: case folding %v and %v", mismatchedKeyForms, sk.foldCase, other.foldCase))
+	}
+	if sk.numericKeys != other.numericKeys || sk.integralFloats != other.integralFloats {
+		sk.mismatchedMerge(fmt.Errorf("%w: numeric keys %v and %v", mismatchedKeyForms, numericForm(sk), numericForm(other)))
+	}
+}
+
+// mismatchedMerge reports a mismatch of checkNormalizer.
+func (sk *Sketch) mismatchedMerge(err error) {
+	sk.event(EventMismatchedMerge, -1, -1, "%v", err)
+	sk.warning(err)
+}
+
+// numericForm describes the numeric keys option of sk.
+func numericForm(sk *Sketch) string {
+	switch {
+	case sk.integralFloats:
+		return "with floats"
+	case sk.numericKeys:
+		return "integers"
+	}
+	return "off"
+}
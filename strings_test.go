@@ -0,0 +1,106 @@
+package topkapi
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func normalizeHost(key string) string {
+	return strings.ToLower(strings.TrimSpace(key))
+}
+
+func TestWithKeyNormalizer(t *testing.T) {
+	sk, err := New(0.01, 0.01, WithKeyNormalizer(normalizeHost))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"Example.com", "EXAMPLE.COM ", " example.com", "other.org"} {
+		sk.InsertString(host, 1)
+	}
+
+	res := sk.Result(1)
+	if len(res) != 2 || res[0].Key != "example.com" || res[0].Count != 3 {
+		t.Fatalf("Expected mixed-case duplicates to collapse into example.com=3, found %v", res)
+	}
+	if c, ok := sk.CountString("ExAmPlE.com"); c != 3 || !ok {
+		t.Errorf("Expected CountString to normalize, found (%d, %v)", c, ok)
+	}
+	if _, ok := sk.Count("Example.com"); ok {
+		t.Error("Expected Count to take keys as they are")
+	}
+
+	if _, err := New(0.01, 0.01, WithKeyNormalizer(nil)); err == nil {
+		t.Error("Expected error for nil normalizer")
+	}
+}
+
+func TestCountReader(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithKeyNormalizer(normalizeHost))
+
+	n, err := sk.CountReader(strings.NewReader("Example.com\nexample.COM\n\tother.org\nexample.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("Expected 4 lines, found %d", n)
+	}
+	if res := sk.TopK(1); len(res) != 1 || res[0].Key != "example.com" || res[0].Count != 3 {
+		t.Errorf("Expected example.com=3, found %v", res)
+	}
+
+	long := strings.Repeat("x", 100000)
+	if _, err := sk.CountReader(strings.NewReader(long)); err == nil {
+		t.Error("Expected error for line over 64KiB")
+	}
+}
+
+func TestInsertHashedSkipsNormalizer(t *testing.T) {
+	var calls int
+	sk, _ := New(0.01, 0.01, WithKeyNormalizer(func(key string) string {
+		calls++
+		return strings.ToLower(key)
+	}))
+
+	key := strings.ToLower("Example.com")
+	sk.InsertHashed(key, HashKey(key), 2)
+	sk.InsertString("EXAMPLE.com", 1)
+
+	if calls != 1 {
+		t.Errorf("Expected normalizer to run once, ran %d times", calls)
+	}
+	if c, ok := sk.Count("example.com"); c != 3 || !ok {
+		t.Errorf("Expected hashed and normalized inserts to agree, found (%d, %v)", c, ok)
+	}
+}
+
+func TestMergeWarnsOnNormalizerMismatch(t *testing.T) {
+	var warnings []error
+	warn := WithWarningHandler(func(err error) {
+		warnings = append(warnings, err)
+	})
+
+	sk, _ := New(0.01, 0.01, WithKeyNormalizer(normalizeHost), warn)
+	same, _ := New(0.01, 0.01, WithKeyNormalizer(normalizeHost))
+	plain, _ := New(0.01, 0.01)
+	same.InsertString("a", 1)
+	plain.Insert("b", 1)
+
+	if err := sk.Merge(same); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Expected no warning for the same normalizer, found %v", warnings)
+	}
+
+	if err := sk.Merge(plain); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !errors.Is(warnings[0], mismatchedNormalizers) {
+		t.Errorf("Expected a normalizer mismatch warning, found %v", warnings)
+	}
+	if c, _ := sk.Count("b"); c != 1 {
+		t.Errorf("Expected the merge to go ahead, found b=%d", c)
+	}
+}
@@ -0,0 +1,152 @@
+package topkapi
+
+// TaggedHeavyHitter is a heavy hitter along with the part of its count
+// inserted by every source.
+type TaggedHeavyHitter struct {
+	LocalHeavyHitter
+
+	// Sources maps every tag to its part of Count. The part that can't be
+	// attributed, for inserts before the key took its bucket and for the
+	// counts of colliding keys, is under the empty tag, so the parts always
+	// add up to Count.
+	Sources map[string]uint64
+}
+
+// TaggedSketch is a Sketch whose inserts carry the tag of their source, like
+// the service or region a count was reported by, so that the count of a heavy
+// hitter can be broken down by source.
+//
+// Every bucket holding a candidate keeps the counts of its candidate per tag
+// in a map, which costs about 50 bytes per bucket plus 40 bytes per tag the
+// candidate was inserted with. With many tags per key that quickly outweighs
+// the sketch itself.
+type TaggedSketch struct {
+	sk    *Sketch
+	owner [][]uint64            // key hash the tags of a bucket belong to
+	tags  [][]map[string]uint64 // nil for buckets without tagged inserts
+}
+
+// NewTagged creates a TaggedSketch counting in sk, which must be empty.
+func NewTagged(sk *Sketch) (*TaggedSketch, error) {
+	if sk == nil {
+		return nil, nilSketch
+	}
+	if !sk.Empty() {
+		return nil, newError(ErrInvalidParameter, "topkapi: sketch should be empty")
+	}
+
+	ts := &TaggedSketch{
+		sk:    sk,
+		owner: make([][]uint64, sk.l),
+		tags:  make([][]map[string]uint64, sk.l),
+	}
+	for i := range ts.tags {
+		ts.owner[i] = make([]uint64, sk.b)
+		ts.tags[i] = make([]map[string]uint64, sk.b)
+	}
+
+	return ts, nil
+}
+
+// Insert adds count occurrences of key from the source tag.
+func (ts *TaggedSketch) Insert(key interface{}, tag string, count uint64) {
+	if count = ts.sk.sampled(count); count == 0 {
+		return
+	}
+
+	key, ok := ts.sk.limit(ts.sk.canonical(key))
+	if !ok {
+		ts.sk.rejected++
+		return
+	}
+	hsum := ts.sk.hashKey(key)
+	ts.sk.insert(key, hsum, count)
+
+	for i := range ts.tags {
+		j := ts.sk.bucket(hsum, i)
+		if !ts.sk.holds(i, j, key, hsum) {
+			continue
+		}
+		// The tags of a bucket that changed hands belong to the old candidate
+		if ts.tags[i][j] == nil || ts.owner[i][j] != hsum {
+			ts.tags[i][j] = make(map[string]uint64)
+			ts.owner[i][j] = hsum
+		}
+		ts.tags[i][j][tag] += count
+	}
+}
+
+// Count returns the estimate of key, see Sketch.Count.
+func (ts *TaggedSketch) Count(key interface{}) (uint64, bool) {
+	return ts.sk.Count(key)
+}
+
+// Result is like Sketch.Result, along with the sources of every heavy hitter.
+func (ts *TaggedSketch) Result(threshold uint64) []TaggedHeavyHitter {
+	return ts.withSources(ts.sk.Result(threshold))
+}
+
+// TopK is like Sketch.TopK, along with the sources of every heavy hitter.
+func (ts *TaggedSketch) TopK(k int) []TaggedHeavyHitter {
+	return ts.withSources(ts.sk.TopK(k))
+}
+
+// Sketch returns the sketch counting the inserts, regardless of tags.
+func (ts *TaggedSketch) Sketch() *Sketch {
+	return ts.sk
+}
+
+// Reset empties the sketch and forgets all tags.
+func (ts *TaggedSketch) Reset() {
+	ts.sk.Reset()
+	for i := range ts.tags {
+		for j := range ts.tags[i] {
+			ts.owner[i][j] = 0
+			ts.tags[i][j] = nil
+		}
+	}
+}
+
+func (ts *TaggedSketch) withSources(res []LocalHeavyHitter) []TaggedHeavyHitter {
+	tagged := make([]TaggedHeavyHitter, len(res))
+	for n, hh := range res {
+		tagged[n] = TaggedHeavyHitter{LocalHeavyHitter: hh, Sources: ts.sources(hh)}
+	}
+
+	return tagged
+}
+
+// sources breaks down the count of a heavy hitter, using the row where its
+// tags account for the most, which is the one it has held the longest.
+func (ts *TaggedSketch) sources(hh LocalHeavyHitter) map[string]uint64 {
+	hsum := ts.sk.hashKey(hh.Key)
+
+	var (
+		best       map[string]uint64
+		attributed uint64
+	)
+	for i := range ts.tags {
+		j := ts.sk.bucket(hsum, i)
+		if !ts.sk.holds(i, j, hh.Key, hsum) || ts.owner[i][j] != hsum {
+			continue
+		}
+
+		var sum uint64
+		for _, c := range ts.tags[i][j] {
+			sum += c
+		}
+		if best == nil || sum > attributed {
+			best, attributed = ts.tags[i][j], sum
+		}
+	}
+
+	sources := make(map[string]uint64, len(best)+1)
+	for tag, c := range best {
+		sources[tag] += c
+	}
+	if attributed < hh.Count {
+		sources[""] += hh.Count - attributed
+	}
+
+	return sources
+}
@@ -0,0 +1,52 @@
+package topkapi
+
+import "testing"
+
+func TestTaggedSketch(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	ts, err := NewTagged(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := []string{"eu", "us", "ap"}
+	for i, key := range zipfKeys(20000, 1000, 4) {
+		ts.Insert(key, sources[i%len(sources)], 1)
+	}
+	// key0 is heavy in eu only
+	ts.Insert("key0", "eu", 1000)
+
+	for _, hh := range ts.TopK(10) {
+		var sum uint64
+		for _, c := range hh.Sources {
+			sum += c
+		}
+		if sum != hh.Count {
+			t.Errorf("Expected the sources of %v to add up to %d, found %d in %v", hh.Key, hh.Count, sum, hh.Sources)
+		}
+	}
+	for _, hh := range ts.TopK(3) {
+		if hh.Sources[""] > hh.Count/10 {
+			t.Errorf("Expected most of %v to be attributed, found %v", hh.Key, hh.Sources)
+		}
+	}
+
+	top := ts.TopK(1)[0]
+	if top.Key != "key0" || top.Sources["eu"] < top.Sources["us"]+1000 {
+		t.Errorf("Expected key0 to be mostly from eu, found %v", top)
+	}
+
+	ts.Reset()
+	if res := ts.Result(1); len(res) != 0 {
+		t.Errorf("Expected no heavy hitters after Reset, found %v", res)
+	}
+
+	if _, err := NewTagged(nil); err == nil {
+		t.Error("Expected error for a nil sketch")
+	}
+	used, _ := New(0.01, 0.01)
+	used.Insert("a", 1)
+	if _, err := NewTagged(used); err == nil {
+		t.Error("Expected error for a sketch that isn't empty")
+	}
+}
@@ -0,0 +1,332 @@
+package topkapi
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// textHeader is the first line of a text dump, with its version.
+const textHeader = "topkapi text 1"
+
+var malformedDump = newError(ErrCorruptData, "topkapi: malformed sketch dump")
+
+// maxTextCounters bounds the counters of a sketch ParseText reads, as a
+// dump leaves out empty buckets, so its length doesn't bound the memory of
+// the sketch like that of a binary encoding does.
+const maxTextCounters = 1 << 24
+
+// DumpText writes the full state of the sketch to w as lines of text, to be
+// read by people, like a support engineer looking into the results of a
+// sketch, and back by ParseText. Keys must be of the types MarshalBinary
+// supports. Options are not part of the dump.
+//
+// A header line is followed by one "name value" line for every dimension,
+// statistic and the cardinality registers in hex, and then by a line for
+// every bucket with a nonzero counter or residual, or a candidate:
+//
+//	bucket <row> <bucket> <counter> <residual> [<key hash> <type> <key>]
+//
+// Keys are written as their Go type followed by the value, with strings
+// quoted, like string "GET /index.html" or int64 -3. Candidates carry their
+// key hash, so a key can be redacted by replacing its value: ParseText keeps
+// the sketch counting it in the buckets of the original key.
+func (sk *Sketch) DumpText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, textHeader)
+	fmt.Fprintln(bw, "b", sk.b)
+	fmt.Fprintln(bw, "l", sk.l)
+	fmt.Fprintln(bw, "rows", sk.cms.rows)
+	fmt.Fprintln(bw, "seed", sk.seed)
+	fmt.Fprintln(bw, "hash", int(sk.hashVersion))
+	fmt.Fprintln(bw, "bucketing", consistentBit(sk.consistent))
+	fmt.Fprintln(bw, "total", sk.total)
+	fmt.Fprintln(bw, "evictions", sk.evictions)
+	fmt.Fprint(bw, "conflicts")
+	for _, c := range sk.conflicts {
+		fmt.Fprint(bw, " ", c)
+	}
+	fmt.Fprintln(bw)
+	fmt.Fprintln(bw, "hll", hex.EncodeToString(sk.distinct[:]))
+
+	for i := 0; i < sk.cms.rows; i++ {
+		for j := uint64(0); j < sk.b; j++ {
+			c := sk.cms.get(i, j)
+			var (
+				residual int64
+				obj      interface{}
+			)
+			if i < len(sk.counts) {
+				residual, obj = sk.counts[i][j], sk.objects[i][j]
+			}
+			if c == 0 && residual == 0 && obj == nil {
+				continue
+			}
+
+			fmt.Fprint(bw, "bucket ", i, " ", j, " ", c, " ", residual)
+			if obj != nil {
+				key, err := formatKey(obj)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(bw, " %016x %s", sk.hashes[i][j], key)
+			}
+			fmt.Fprintln(bw)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ParseText reads a sketch written by DumpText, with the default options. A
+// dump that can't be parsed is an error wrapping ErrCorruptData, with the
+// line at fault.
+//
+// Dumps of sketches of more than 1<<24 counters, b times rows, are rejected
+// before anything is allocated, so that a short header can't claim
+// gigabytes; larger sketches are exchanged with MarshalBinary.
+func ParseText(r io.Reader) (*Sketch, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<24)
+
+	line := 0
+	fail := func(format string, args ...interface{}) (*Sketch, error) {
+		return nil, fmt.Errorf("%w: line %d: %s", malformedDump, line, fmt.Sprintf(format, args...))
+	}
+
+	if line++; !sc.Scan() || sc.Text() != textHeader {
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return fail("expected %q", textHeader)
+	}
+
+	var (
+		header = make(map[string]string)
+		sk     *Sketch
+	)
+	for sc.Scan() {
+		line++
+		name, value := sc.Text(), ""
+		if n := strings.IndexByte(name, ' '); n >= 0 {
+			name, value = name[:n], name[n+1:]
+		}
+
+		if name != "bucket" {
+			if sk != nil {
+				return fail("%s after buckets", name)
+			}
+			if _, ok := header[name]; ok {
+				return fail("repeated %s", name)
+			}
+			header[name] = value
+			continue
+		}
+
+		if sk == nil {
+			var err error
+			if sk, err = sketchFromHeader(header); err != nil {
+				return fail("%v", err)
+			}
+		}
+		if err := sk.parseBucket(value); err != nil {
+			return fail("%v", err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if sk == nil {
+		var err error
+		if sk, err = sketchFromHeader(header); err != nil {
+			return fail("%v", err)
+		}
+	}
+
+	return sk, nil
+}
+
+// sketchFromHeader creates an empty sketch from the header lines of a dump.
+func sketchFromHeader(header map[string]string) (*Sketch, error) {
+	number := func(name string) (uint64, error) {
+		value, ok := header[name]
+		if !ok {
+			return 0, fmt.Errorf("missing %s", name)
+		}
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		return v, nil
+	}
+
+	var (
+		values = make(map[string]uint64)
+		err    error
+	)
+	for _, name := range []string{"b", "l", "rows", "seed", "hash", "bucketing", "total", "evictions"} {
+		if values[name], err = number(name); err != nil {
+			return nil, err
+		}
+	}
+	b, l, rows := values["b"], values["l"], values["rows"]
+	if b == 0 || l == 0 || rows < l || b > maxTextCounters/rows {
+		return nil, fmt.Errorf("bad dimensions %d, %d and %d", b, l, rows)
+	}
+	if v := HashVersion(values["hash"]); v != HashStructure && v != HashV1 {
+		return nil, fmt.Errorf("unknown hash version %d", v)
+	}
+	if values["bucketing"] > 1 {
+		return nil, fmt.Errorf("unknown bucketing %d", values["bucketing"])
+	}
+
+	sk := newSketch(b, l)
+	sk.cms = newCounterMatrix(int(rows), b, RowMajor)
+	sk.seed, sk.hashVersion, sk.consistent = values["seed"], HashVersion(values["hash"]), values["bucketing"] == 1
+	sk.total, sk.evictions = values["total"], values["evictions"]
+
+	conflicts := strings.Fields(header["conflicts"])
+	if len(conflicts) != len(sk.conflicts) {
+		return nil, fmt.Errorf("expected %d conflicts, found %d", len(sk.conflicts), len(conflicts))
+	}
+	for i, c := range conflicts {
+		if sk.conflicts[i], err = strconv.ParseUint(c, 10, 64); err != nil {
+			return nil, fmt.Errorf("conflicts: %v", err)
+		}
+	}
+
+	registers, err := hex.DecodeString(header["hll"])
+	if err != nil || len(registers) != len(sk.distinct) {
+		return nil, errors.New("bad hll")
+	}
+	copy(sk.distinct[:], registers)
+
+	return sk, nil
+}
+
+// parseBucket sets a bucket from the fields of its line in a dump.
+func (sk *Sketch) parseBucket(value string) error {
+	fields := strings.SplitN(value, " ", 7)
+	if len(fields) != 4 && len(fields) != 7 {
+		return fmt.Errorf("expected 4 or 7 fields, found %d", len(fields))
+	}
+
+	i, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil || i >= uint64(sk.cms.rows) {
+		return fmt.Errorf("bad row %q", fields[0])
+	}
+	j, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil || j >= sk.b {
+		return fmt.Errorf("bad bucket %q", fields[1])
+	}
+	c, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad counter: %v", err)
+	}
+	sk.cms.set(int(i), j, c)
+	residual, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil || residual != 0 && i >= sk.l {
+		return fmt.Errorf("bad residual %q", fields[3])
+	}
+	if i >= sk.l {
+		return nil
+	}
+	sk.counts[i][j] = residual
+
+	if len(fields) == 7 {
+		hsum, err := strconv.ParseUint(fields[4], 16, 64)
+		if err != nil {
+			return fmt.Errorf("bad key hash: %v", err)
+		}
+		key, err := parseKey(fields[5], fields[6])
+		if err != nil {
+			return err
+		}
+		sk.objects[i][j], sk.hashes[i][j] = key, hsum
+		sk.occupy(int(i), j)
+	}
+
+	return nil
+}
+
+// formatKey returns the type and value of a key as written by DumpText.
+func formatKey(key interface{}) (string, error) {
+	var value string
+	switch k := key.(type) {
+	case string:
+		value = strconv.Quote(k)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		value = fmt.Sprint(k)
+	case float32:
+		value = strconv.FormatFloat(float64(k), 'g', -1, 32)
+	case float64:
+		value = strconv.FormatFloat(k, 'g', -1, 64)
+	default:
+		return "", fmt.Errorf("%w: %T", ErrUnsupportedKeyType, key)
+	}
+
+	return fmt.Sprintf("%T %s", key, value), nil
+}
+
+// parseKey parses a key of the given type as formatted by formatKey.
+func parseKey(typ, value string) (interface{}, error) {
+	var (
+		key interface{}
+		err error
+		i   int64
+		u   uint64
+		f   float64
+	)
+	switch typ {
+	case "string":
+		key, err = strconv.Unquote(value)
+	case "bool":
+		key, err = strconv.ParseBool(value)
+	case "int":
+		i, err = strconv.ParseInt(value, 10, 0)
+		key = int(i)
+	case "int8":
+		i, err = strconv.ParseInt(value, 10, 8)
+		key = int8(i)
+	case "int16":
+		i, err = strconv.ParseInt(value, 10, 16)
+		key = int16(i)
+	case "int32":
+		i, err = strconv.ParseInt(value, 10, 32)
+		key = int32(i)
+	case "int64":
+		key, err = strconv.ParseInt(value, 10, 64)
+	case "uint":
+		u, err = strconv.ParseUint(value, 10, 0)
+		key = uint(u)
+	case "uint8":
+		u, err = strconv.ParseUint(value, 10, 8)
+		key = uint8(u)
+	case "uint16":
+		u, err = strconv.ParseUint(value, 10, 16)
+		key = uint16(u)
+	case "uint32":
+		u, err = strconv.ParseUint(value, 10, 32)
+		key = uint32(u)
+	case "uint64":
+		key, err = strconv.ParseUint(value, 10, 64)
+	case "float32":
+		f, err = strconv.ParseFloat(value, 32)
+		key = float32(f)
+	case "float64":
+		key, err = strconv.ParseFloat(value, 64)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad %s key %s", typ, value)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,89 @@
+package topkapi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDumpText(t *testing.T) {
+	sk, _ := New(0.05, 0.01, WithSeed(3), WithExtraCounterRows(1), WithConsistentBuckets())
+	for i, key := range zipfKeys(5000, 300, 7) {
+		sk.Insert(key, uint64(1+i%3))
+	}
+	for _, key := range []interface{}{"with spaces and \"quotes\"\n", 42, int8(-3), uint16(7), true, 1.5, float32(0.1), -0.0} {
+		sk.Insert(key, 100)
+	}
+
+	var buf bytes.Buffer
+	if err := sk.DumpText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+	if !strings.HasPrefix(dump, textHeader+"\nb 100\nl 3\nrows 4\n") {
+		t.Errorf("Expected the header and dimensions first, found %.40q", dump)
+	}
+
+	parsed, err := ParseText(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.StateHash() != sk.StateHash() {
+		t.Error("Expected the parsed sketch to have the state of the dumped one")
+	}
+	if c, ok := parsed.Count("with spaces and \"quotes\"\n"); !ok || c < 100 {
+		t.Errorf("Expected the quoted key to be a candidate, found %d", c)
+	}
+
+	// A redacted key keeps its counts
+	top := sk.TopK(1)[0]
+	redacted := strings.Replace(dump, `"`+top.Key.(string)+`"`, `"redacted"`, -1)
+	parsed, err = ParseText(strings.NewReader(redacted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parsed.TopK(1)[0]; got.Key != "redacted" || got.Count != top.Count {
+		t.Errorf("Expected redacted=%d on top, found %v", top.Count, got)
+	}
+
+	var unsupported bytes.Buffer
+	other, _ := New(0.1, 0.1)
+	other.Insert(struct{ A int }{1}, 1)
+	if err := other.DumpText(&unsupported); !errors.Is(err, ErrUnsupportedKeyType) {
+		t.Errorf("Expected unsupported key error, found %v", err)
+	}
+}
+
+func TestParseTextMalformed(t *testing.T) {
+	sk, _ := New(0.1, 0.1)
+	sk.Insert("a", 1)
+	var buf bytes.Buffer
+	if err := sk.DumpText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+
+	for _, test := range []struct{ old, new string }{
+		{textHeader, "topkapi text 2"},
+		{"\nb 10\n", "\nb ten\n"},
+		{"\nl 2\n", "\nl 0\n"},
+		{"\nb 10\n", "\nb 16777216\n"},
+		{"\nseed 0\n", "\n"},
+		{"\nhash 1\n", "\nhash 9\n"},
+		{"\nhll ", "\nhll 00"},
+		{"bucket 0 ", "bucket 9 "},
+		{`string "a"`, `string "a`},
+		{`string "a"`, `struct "a"`},
+		{`string "a"`, `string`},
+		{"\nevictions 0\n", "\nevictions 0\nbucket 0 0 1 1\nseed 4\n"},
+	} {
+		broken := strings.Replace(dump, test.old, test.new, 1)
+		if broken == dump {
+			t.Fatalf("Expected %q in the dump", test.old)
+		}
+		if _, err := ParseText(strings.NewReader(broken)); !errors.Is(err, malformedDump) {
+			t.Errorf("Expected %q replaced by %q to be malformed, found %v", test.old, test.new, err)
+		}
+	}
+}
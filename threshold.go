@@ -0,0 +1,106 @@
+package topkapi
+
+import "math"
+
+// binsPerOctave is the resolution of the threshold histogram: bin b holds
+// estimates from 2^(b/4) up to the next bin.
+const binsPerOctave = 4
+
+// thresholdHistogram tracks the distribution of per-key estimates.
+// crossed[b] counts the keys whose estimate reached the lower bound of bin b,
+// so it only grows with b falling.
+type thresholdHistogram struct {
+	crossed [64 * binsPerOctave]uint64
+}
+
+func binOf(estimate uint64) int {
+	if b := int(binsPerOctave * math.Log2(float64(estimate))); b < len(thresholdHistogram{}.crossed) {
+		return b
+	}
+	return len(thresholdHistogram{}.crossed) - 1
+}
+
+func binFloor(b float64) float64 {
+	return math.Exp2(b / binsPerOctave)
+}
+
+// raised records that the estimate of a key rose from old to new.
+func (h *thresholdHistogram) raised(old, new uint64) {
+	from := 0
+	if old > 0 {
+		from = binOf(old) + 1
+	}
+	for b := from; b <= binOf(new); b++ {
+		h.crossed[b]++
+	}
+}
+
+func (h *thresholdHistogram) reset() {
+	*h = thresholdHistogram{}
+}
+
+// rebuild fills the histogram from the candidates of sk.
+func (h *thresholdHistogram) rebuild(sk *Sketch) {
+	h.reset()
+	sk.scan(1, nil, func(hh LocalHeavyHitter, _ uint64) {
+		h.raised(0, hh.Count)
+	})
+}
+
+// threshold estimates the k-th highest estimate, interpolating within a bin
+// as if counts were Zipf distributed.
+func (h *thresholdHistogram) threshold(k int) uint64 {
+	b := len(h.crossed) - 1
+	for b > 0 && h.crossed[b] < uint64(k) {
+		b--
+	}
+	if h.crossed[b] < uint64(k) {
+		return 1
+	}
+
+	frac := 0.0
+	if b+1 < len(h.crossed) && h.crossed[b+1] > 0 {
+		hi, lo := float64(h.crossed[b]), float64(h.crossed[b+1])
+		frac = math.Log(hi/float64(k)) / math.Log(hi/lo)
+	}
+
+	return uint64(math.Max(binFloor(float64(b)+frac), 1))
+}
+
+// WithThresholdTracking maintains a histogram of per-key estimates while
+// inserting, so that SuggestThreshold doesn't need to scan the sketch. Every
+// Insert pays for an extra estimate of the key before it is counted, which
+// reads the buckets Insert is about to update anyway, and an increment per
+// histogram bin the estimate moves up. The histogram takes 2KiB.
+//
+// Keys are counted in the histogram when their own inserts raise their
+// estimate, not when colliding keys do. After Merge or UnmarshalBinary it is
+// rebuilt from the candidates.
+func WithThresholdTracking() Option {
+	return func(sk *Sketch) error {
+		sk.thresholds = &thresholdHistogram{}
+		sk.thresholds.rebuild(sk)
+		return nil
+	}
+}
+
+// SuggestThreshold returns a threshold for Result that lets through about k
+// heavy hitters: an estimate of the k-th highest count. With
+// WithThresholdTracking it is read from the histogram in constant time;
+// otherwise it is computed exactly with a scan of the sketch. It returns 1
+// if the sketch holds fewer than k candidates.
+func (sk *Sketch) SuggestThreshold(k int) (uint64, error) {
+	if k < 1 {
+		return 0, newError(ErrInvalidParameter, "topkapi: value of k should be >= 1")
+	}
+
+	if sk.thresholds != nil {
+		return sk.thresholds.threshold(k), nil
+	}
+
+	top := sk.scanTopK(k)
+	if len(top) < k {
+		return 1, nil
+	}
+	return top[k-1].Count, nil
+}
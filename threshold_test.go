@@ -0,0 +1,69 @@
+package topkapi
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSuggestThreshold(t *testing.T) {
+	keys := zipfKeys(500000, 100000, 1)
+	tracked, _ := NewTopK(100, uint64(len(keys)), 0.01, WithThresholdTracking())
+	for _, key := range keys {
+		tracked.Insert(key, 1)
+	}
+
+	for _, k := range []int{1, 10, 50, 100, 500} {
+		want, err := tracked.Clone().withoutThresholds().SuggestThreshold(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if top := tracked.TopK(k); top[k-1].Count != want {
+			t.Fatalf("Expected scanned threshold %d to be the top-%d cutoff, found %d", want, k, top[k-1].Count)
+		}
+
+		got, _ := tracked.SuggestThreshold(k)
+		if ratio := float64(got) / float64(want); math.Abs(math.Log2(ratio)) > 0.25 {
+			t.Errorf("Expected threshold for top-%d within 20%% of %d, found %d", k, want, got)
+		}
+	}
+
+	if th, _ := tracked.SuggestThreshold(10000000); th != 1 {
+		t.Errorf("Expected threshold 1 for more keys than inserted, found %d", th)
+	}
+	if _, err := tracked.SuggestThreshold(0); err == nil {
+		t.Error("Expected error for k < 1")
+	}
+}
+
+func TestSuggestThresholdMerge(t *testing.T) {
+	keys := zipfKeys(200000, 10000, 2)
+	a, _ := NewTopK(100, uint64(len(keys)), 0.01, WithThresholdTracking())
+	b, _ := NewTopK(100, uint64(len(keys)), 0.01)
+	for i, key := range keys {
+		if i%2 == 0 {
+			a.Insert(key, 1)
+		} else {
+			b.Insert(key, 1)
+		}
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := a.TopK(20)[19].Count
+	got, _ := a.SuggestThreshold(20)
+	if ratio := float64(got) / float64(want); math.Abs(math.Log2(ratio)) > 0.25 {
+		t.Errorf("Expected merged threshold within 20%% of %d, found %d", want, got)
+	}
+
+	a.Reset()
+	if th, _ := a.SuggestThreshold(1); th != 1 {
+		t.Errorf("Expected threshold 1 after Reset, found %d", th)
+	}
+}
+
+// withoutThresholds drops the histogram, to compare against a scan.
+func (sk *Sketch) withoutThresholds() *Sketch {
+	sk.thresholds = nil
+	return sk
+}
@@ -0,0 +1,581 @@
+package topkapi
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// WithTopKTracking keeps the m highest estimates ordered while inserting, so
+// that TopK(k) for k <= m is usually answered without scanning the sketch.
+// Every Insert pays for re-estimating the tracked keys sharing a bucket with
+// the inserted key, which is rarely more than the inserted key itself.
+func WithTopKTracking(m int) Option {
+	return func(sk *Sketch) error {
+		if m < 1 {
+			return newError(ErrInvalidParameter, "topkapi: value of m should be >= 1")
+		}
+
+		sk.top = newTopTracker(m, sk.slots(m))
+		sk.top.rebuild(sk)
+
+		return nil
+	}
+}
+
+// TopK returns the k heavy hitters with the highest estimates, ordered by
+// descending count. It returns fewer than k entries if the sketch does not
+// hold that many candidates, and an empty, non-nil slice if it holds none or
+// k < 1.
+func (sk *Sketch) TopK(k int) []LocalHeavyHitter {
+	if k < 1 {
+		return []LocalHeavyHitter{}
+	}
+	if sk.top != nil {
+		if res, ok := sk.top.topK(k); ok {
+			return sk.withSamples(res)
+		}
+	}
+
+	return sk.scanTopK(k)
+}
+
+// Top1 returns the key and estimate TopK(1) would return, and false if the
+// sketch holds no candidates, without allocating. With WithTopKTracking it is
+// usually answered in constant time from the tracked keys, otherwise it
+// takes a scan of the sketch.
+func (sk *Sketch) Top1() (key interface{}, count uint64, ok bool) {
+	if sk.top != nil {
+		if tk, ok := sk.top.first(); ok {
+			return tk.Key, tk.Count, true
+		}
+	}
+
+	var best rankedHitter
+	sk.scan(1, nil, func(hh LocalHeavyHitter, hsum uint64) {
+		if r := (rankedHitter{hh, hsum}); !ok || r.before(best) {
+			best, ok = r, true
+		}
+	})
+
+	return best.Key, best.Count, ok
+}
+
+// TopKWhere is like TopK, but only reports keys for which pred returns
+// true. The predicate is applied while scanning the candidates, so it
+// returns k entries as long as the sketch holds that many matching
+// candidates. pred is called at most once per distinct candidate. A nil pred
+// accepts every key.
+func (sk *Sketch) TopKWhere(k int, pred func(key interface{}) bool) []LocalHeavyHitter {
+	if pred == nil {
+		return sk.TopK(k)
+	}
+	if k < 1 {
+		return []LocalHeavyHitter{}
+	}
+
+	return sk.selectTopK(k, pred)
+}
+
+// TopKWithRemainder returns TopK(k) along with the remainder of Total not
+// accounted for by its estimates, for an "everything else" entry that makes
+// the top k add up to Total.
+//
+// Estimates never undercount but may overcount, by about Epsilon() × Total()
+// each, so the remainder is an underestimate whenever heavy hitters collide
+// with other keys; it is floored at zero if the estimates add up to more
+// than Total.
+func (sk *Sketch) TopKWithRemainder(k int) (top []LocalHeavyHitter, remainder uint64) {
+	top = sk.TopK(k)
+
+	var sum uint64
+	for _, hh := range top {
+		sum += hh.Count
+	}
+	if sum >= sk.total {
+		return top, 0
+	}
+
+	return top, sk.total - sum
+}
+
+// KthCount returns the estimate of the k-th heavy hitter of TopK(k), or 0
+// if the sketch holds fewer than k candidates or k is below 1. A key whose
+// estimate exceeds it is in the top k. Without WithTopKTracking it scans the
+// sketch like TopK, but only keeps the k highest estimates rather than the
+// heavy hitters.
+func (sk *Sketch) KthCount(k int) uint64 {
+	if k < 1 {
+		return 0
+	}
+	if sk.top != nil {
+		if res, ok := sk.top.topK(k); ok {
+			if len(res) < k {
+				return 0
+			}
+			return res[k-1].Count
+		}
+	}
+
+	h := make(countHeap, 0, sk.slots(k))
+	sk.scan(1, nil, func(hh LocalHeavyHitter, _ uint64) {
+		switch {
+		case len(h) < k:
+			heap.Push(&h, hh.Count)
+		case hh.Count > h[0]:
+			h[0] = hh.Count
+			heap.Fix(&h, 0)
+		}
+	})
+	if len(h) < k {
+		return 0
+	}
+
+	return h[0]
+}
+
+// countHeap is a heap of estimates with the lowest on top.
+type countHeap []uint64
+
+func (h countHeap) Len() int            { return len(h) }
+func (h countHeap) Less(a, b int) bool  { return h[a] < h[b] }
+func (h countHeap) Swap(a, b int)       { h[a], h[b] = h[b], h[a] }
+func (h *countHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+
+func (h *countHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// TopKOverlap returns the intersection over union of the keys in the top k
+// of a and b: 1 if they hold the same keys, like for two time windows with
+// the same heavy hitters, and 0 if they share none. Two sketches without any
+// candidates overlap fully.
+func TopKOverlap(a, b *Sketch, k int) float64 {
+	keys := make(map[interface{}]struct{})
+	for _, hh := range a.TopK(k) {
+		keys[hh.Key] = struct{}{}
+	}
+
+	shared := 0
+	for _, hh := range b.TopK(k) {
+		if _, ok := keys[hh.Key]; ok {
+			shared++
+		}
+		keys[hh.Key] = struct{}{}
+	}
+	if len(keys) == 0 {
+		return 1
+	}
+
+	return float64(shared) / float64(len(keys))
+}
+
+// Divergence returns the Kullback-Leibler divergence, in nats, of the
+// distribution of the top k of b from that of a, like for two time windows
+// of a stream, to tell when the mix of heavy hitters shifts. It is 0 for
+// sketches with the same distribution, grows with the shift, and isn't
+// symmetric: a is taken as the truth, b as its approximation.
+//
+// The distributions are over the union of the keys in the top k of both,
+// with their estimates in each, see Count. Both are smoothed by adding one
+// to every estimate before normalizing, so that a key one sketch never saw
+// has a small but nonzero share in it instead of an infinite divergence;
+// the smoothing matters little once counts are in the hundreds. Two
+// sketches without any candidates diverge by 0.
+func Divergence(a, b *Sketch, k int) float64 {
+	var keys []interface{}
+	seen := make(map[interface{}]struct{})
+	for _, top := range [][]LocalHeavyHitter{a.TopK(k), b.TopK(k)} {
+		for _, hh := range top {
+			if _, ok := seen[hh.Key]; !ok {
+				seen[hh.Key] = struct{}{}
+				keys = append(keys, hh.Key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return 0
+	}
+
+	p := make([]float64, len(keys))
+	q := make([]float64, len(keys))
+	var sumP, sumQ float64
+	for i, key := range keys {
+		ca, _ := a.Count(key)
+		cb, _ := b.Count(key)
+		p[i], q[i] = float64(ca)+1, float64(cb)+1
+		sumP += p[i]
+		sumQ += q[i]
+	}
+
+	var d float64
+	for i := range keys {
+		pi, qi := p[i]/sumP, q[i]/sumQ
+		d += pi * math.Log(pi/qi)
+	}
+	// Rounding may leave a tiny negative sum for identical distributions
+	return math.Max(d, 0)
+}
+
+// MergeResults combines the results of sources that can't be merged as
+// sketches, like sketches of different sizes or other libraries, into the k
+// heavy hitters with the highest summed counts. The counts of identical keys
+// add up, and Rows and Sample are taken from the first result reporting a
+// key with them.
+//
+// This is an approximation without any of the guarantees of a sketch: a key
+// missing from a result contributes nothing from that source, though the
+// source may have counted it below what it reported, so keys reported by
+// fewer sources are undercounted. Entries are ordered like Result, by count,
+// then by rows, then by key hash.
+func MergeResults(k int, lists ...[]LocalHeavyHitter) []LocalHeavyHitter {
+	return MergeResultsFunc(k, nil, lists...)
+}
+
+// MergeResultsFunc is MergeResults with keys mapped to a canonical form by
+// canonicalize before they are compared, like WithCanonicalizer. A nil
+// canonicalize compares keys as they are.
+func MergeResultsFunc(k int, canonicalize func(key interface{}) interface{}, lists ...[]LocalHeavyHitter) []LocalHeavyHitter {
+	if k < 1 {
+		return []LocalHeavyHitter{}
+	}
+
+	var rs []rankedHitter
+	index := make(map[interface{}]int)
+	for _, list := range lists {
+		for _, hh := range list {
+			if canonicalize != nil {
+				hh.Key = canonicalize(hh.Key)
+			}
+			n, ok := index[hh.Key]
+			if !ok {
+				index[hh.Key] = len(rs)
+				rs = append(rs, rankedHitter{hh, HashKey(hh.Key)})
+				continue
+			}
+
+			r := &rs[n].LocalHeavyHitter
+			r.Count += hh.Count
+			if r.Rows == 0 {
+				r.Rows = hh.Rows
+			}
+			if r.Sample == nil {
+				r.Sample = hh.Sample
+			}
+		}
+	}
+	sort.Sort(rankedOrder(rs))
+
+	if len(rs) > k {
+		rs = rs[:k]
+	}
+	res := make([]LocalHeavyHitter, len(rs))
+	for n := range rs {
+		res[n] = rs[n].LocalHeavyHitter
+	}
+
+	return res
+}
+
+// slots returns k, or the number of candidate slots if smaller, which no
+// top k can outnumber, to size the buffer of a top k.
+func (sk *Sketch) slots(k int) int {
+	if n := sk.l * sk.b; uint64(k) > n {
+		return int(n)
+	}
+	return k
+}
+
+// scanTopK computes TopK from the full candidate matrix.
+func (sk *Sketch) scanTopK(k int) []LocalHeavyHitter {
+	return sk.selectTopK(k, nil)
+}
+
+// selectTopK scans the candidates accepted by pred, keeping the k highest
+// estimates in a heap. They are ordered like Result.
+func (sk *Sketch) selectTopK(k int, pred func(key interface{}) bool) []LocalHeavyHitter {
+	h := make(rankedHeap, 0, sk.slots(k))
+	sk.scan(1, pred, func(hh LocalHeavyHitter, hsum uint64) {
+		r := rankedHitter{hh, hsum}
+		switch {
+		case len(h) < k:
+			heap.Push(&h, r)
+		case r.before(h[0]):
+			h[0] = r
+			heap.Fix(&h, 0)
+		}
+	})
+
+	res := make([]LocalHeavyHitter, len(h))
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = heap.Pop(&h).(rankedHitter).LocalHeavyHitter
+	}
+
+	return res
+}
+
+// estimate returns the count and rows Result reports for key. The rows are
+// 0 if key is not a candidate in any row.
+func (sk *Sketch) estimate(key interface{}, hsum uint64) (count uint64, rows int) {
+	if rows = sk.rowsHolding(key, hsum, 0); rows == 0 {
+		return 0, 0
+	}
+
+	return sk.counterMin(hsum), rows
+}
+
+type trackedKey struct {
+	LocalHeavyHitter
+	hash uint64
+}
+
+// before reports whether tk comes before o in a result, see rankedHitter.
+func (tk trackedKey) before(o trackedKey) bool {
+	return rankedHitter{tk.LocalHeavyHitter, tk.hash}.before(rankedHitter{o.LocalHeavyHitter, o.hash})
+}
+
+// topTracker holds up to m candidates ordered by descending estimate.
+//
+// Estimates only grow as long as a key remains a candidate, and they change
+// whenever any bucket of the key does. The tracker knows the buckets of the
+// keys it holds and keeps their estimates exact. Candidates it doesn't hold
+// are bounded instead: a candidate's estimate can't exceed the counter of the
+// bucket it holds, so bound, the largest counter of any bucket held by an
+// untracked candidate, is at least all of their estimates. Tracked entries
+// are ordered like a result, and those with a count above bound are ranked
+// as a full scan would rank them: an untracked candidate may tie with a
+// count of bound, and come before them.
+type topTracker struct {
+	m       int
+	entries []trackedKey
+	index   map[interface{}]int      // key to position in entries
+	buckets map[uint64][]interface{} // row*b+bucket to tracked keys in it
+	bound   uint64
+
+	sinceRebuild uint64
+	touched      []trackedKey // scratch for inserted
+}
+
+// newTopTracker returns a tracker of the top m, with room for n keys.
+func newTopTracker(m, n int) *topTracker {
+	return &topTracker{
+		m:       m,
+		entries: make([]trackedKey, 0, n),
+		index:   make(map[interface{}]int, n),
+		buckets: make(map[uint64][]interface{}),
+	}
+}
+
+func (t *topTracker) clone() *topTracker {
+	cp := *t
+	cp.entries = append(make([]trackedKey, 0, cap(t.entries)), t.entries...)
+	cp.index = make(map[interface{}]int, len(t.index))
+	for k, v := range t.index {
+		cp.index[k] = v
+	}
+	cp.buckets = make(map[uint64][]interface{}, len(t.buckets))
+	for k, v := range t.buckets {
+		cp.buckets[k] = append([]interface{}(nil), v...)
+	}
+	cp.touched = nil
+	return &cp
+}
+
+func (t *topTracker) reset() {
+	t.entries = t.entries[:0]
+	t.index = make(map[interface{}]int, t.m)
+	t.buckets = make(map[uint64][]interface{})
+	t.bound = 0
+	t.sinceRebuild = 0
+}
+
+// rebuild repopulates the tracker from a full scan of the sketch.
+func (t *topTracker) rebuild(sk *Sketch) {
+	t.reset()
+
+	var all []trackedKey
+	sk.scan(1, nil, func(hh LocalHeavyHitter, hsum uint64) {
+		all = append(all, trackedKey{hh, hsum})
+	})
+	for _, tk := range all {
+		t.update(sk, tk)
+	}
+
+	t.bound = 0
+	for i := range sk.objects {
+		for j, obj := range sk.objects[i] {
+			if _, in := t.index[obj]; obj != nil && !in && sk.cms.get(i, uint64(j)) > t.bound {
+				t.bound = sk.cms.get(i, uint64(j))
+			}
+		}
+	}
+}
+
+// inserted updates the tracker after key was inserted into sk.
+func (t *topTracker) inserted(sk *Sketch, key interface{}, hsum uint64) {
+	t.touched = append(t.touched[:0], trackedKey{LocalHeavyHitter{Key: key}, hsum})
+	for i := 0; i < sk.cms.rows; i++ {
+		for _, k := range t.buckets[t.slot(sk, i, hsum)] {
+			if k != key {
+				t.touched = append(t.touched, t.entries[t.index[k]])
+			}
+		}
+	}
+
+	for _, tk := range t.touched {
+		if _, in := t.index[tk.Key]; in || tk.Key == key {
+			if tk.Count, tk.Rows = sk.estimate(tk.Key, tk.hash); tk.Rows > 0 {
+				t.update(sk, tk)
+			} else {
+				t.remove(sk, tk.Key)
+			}
+		}
+	}
+
+	for i := range sk.objects {
+		hi := sk.bucket(hsum, i)
+		obj := sk.objects[i][hi]
+		if _, in := t.index[obj]; obj != nil && !in && sk.cms.get(i, hi) > t.bound {
+			t.bound = sk.cms.get(i, hi)
+		}
+	}
+
+	// Once too few entries are known to be ranked correctly, start over from
+	// a full scan. Rebuilding at most once per b inserts keeps its cost at
+	// O(l) per insert.
+	t.sinceRebuild++
+	if t.sinceRebuild >= sk.b && t.trusted() < (t.m+1)/2 {
+		t.rebuild(sk)
+	}
+}
+
+// trusted returns the number of leading entries ranked correctly.
+func (t *topTracker) trusted() int {
+	n := len(t.entries)
+	for n > 0 && t.entries[n-1].Count <= t.bound {
+		n--
+	}
+
+	return n
+}
+
+func (t *topTracker) slot(sk *Sketch, i int, hsum uint64) uint64 {
+	return uint64(i)*sk.b + sk.bucket(hsum, i)
+}
+
+// update sets the estimate of a key that is a candidate in sk.
+func (t *topTracker) update(sk *Sketch, tk trackedKey) {
+	if idx, in := t.index[tk.Key]; in {
+		t.entries[idx].Count, t.entries[idx].Rows = tk.Count, tk.Rows
+		t.fix(idx)
+		return
+	}
+
+	if len(t.entries) == t.m {
+		last := t.entries[len(t.entries)-1]
+		if !tk.before(last) {
+			return
+		}
+
+		// The dropped key's buckets join the untracked ones
+		for i := range sk.objects {
+			hi := sk.bucket(last.hash, i)
+			if sk.holds(i, hi, last.Key, last.hash) && sk.cms.get(i, hi) > t.bound {
+				t.bound = sk.cms.get(i, hi)
+			}
+		}
+		t.remove(sk, last.Key)
+	}
+
+	t.entries = append(t.entries, tk)
+	t.index[tk.Key] = len(t.entries) - 1
+	for i := 0; i < sk.cms.rows; i++ {
+		slot := t.slot(sk, i, tk.hash)
+		t.buckets[slot] = append(t.buckets[slot], tk.Key)
+	}
+	t.fix(len(t.entries) - 1)
+}
+
+func (t *topTracker) remove(sk *Sketch, key interface{}) {
+	idx, in := t.index[key]
+	if !in {
+		return
+	}
+
+	hsum := t.entries[idx].hash
+	for i := 0; i < sk.cms.rows; i++ {
+		slot := t.slot(sk, i, hsum)
+		keys := t.buckets[slot]
+		for j := range keys {
+			if keys[j] == key {
+				keys = append(keys[:j], keys[j+1:]...)
+				break
+			}
+		}
+		if len(keys) == 0 {
+			delete(t.buckets, slot)
+		} else {
+			t.buckets[slot] = keys
+		}
+	}
+
+	delete(t.index, key)
+	copy(t.entries[idx:], t.entries[idx+1:])
+	t.entries = t.entries[:len(t.entries)-1]
+	for i := idx; i < len(t.entries); i++ {
+		t.index[t.entries[i].Key] = i
+	}
+}
+
+// fix moves the entry at idx to its place in the ordering.
+func (t *topTracker) fix(idx int) {
+	for idx > 0 && t.entries[idx].before(t.entries[idx-1]) {
+		t.swap(idx-1, idx)
+		idx--
+	}
+	for idx < len(t.entries)-1 && t.entries[idx+1].before(t.entries[idx]) {
+		t.swap(idx, idx+1)
+		idx++
+	}
+}
+
+func (t *topTracker) swap(a, b int) {
+	t.entries[a], t.entries[b] = t.entries[b], t.entries[a]
+	t.index[t.entries[a].Key] = a
+	t.index[t.entries[b].Key] = b
+}
+
+// first returns the first entry, and false if there is none or it can't be
+// trusted to match a full scan, see topK.
+func (t *topTracker) first() (trackedKey, bool) {
+	if len(t.entries) == 0 || t.entries[0].Count <= t.bound {
+		return trackedKey{}, false
+	}
+	return t.entries[0], true
+}
+
+// topK returns the first k entries, and false if they can't be trusted to
+// match a full scan because candidates outside the tracker may outrank them.
+func (t *topTracker) topK(k int) ([]LocalHeavyHitter, bool) {
+	if k > t.m {
+		return nil, false
+	}
+	if k > len(t.entries) {
+		if t.bound > 0 {
+			return nil, false
+		}
+		k = len(t.entries)
+	} else if k > 0 && t.entries[k-1].Count <= t.bound {
+		return nil, false
+	}
+
+	res := make([]LocalHeavyHitter, k)
+	for i := range res {
+		res[i] = t.entries[i].LocalHeavyHitter
+	}
+
+	return res, true
+}
@@ -0,0 +1,435 @@
+package topkapi
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// zipfKeys returns n keys drawn from a zipfian distribution over distinct keys.
+func zipfKeys(n int, distinct uint64, seed int64) []string {
+	rnd := rand.New(rand.NewSource(seed))
+	z := rand.NewZipf(rnd, 1.1, 1, distinct-1)
+
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprint("key", z.Uint64())
+	}
+
+	return keys
+}
+
+// assertSameTopK checks a TopK result against a full scan of the same
+// sketch, key by key: ties are ordered alike.
+func assertSameTopK(t *testing.T, sk *Sketch, k int) {
+	t.Helper()
+
+	got := sk.TopK(k)
+	want := sk.scanTopK(k)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d entries, found %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %v at rank %d, found %v", want[i], i, got[i])
+		}
+	}
+	if k >= 1 {
+		key, count, ok := sk.Top1()
+		if want1 := sk.scanTopK(1); ok != (len(want1) == 1) || ok && (key != want1[0].Key || count != want1[0].Count) {
+			t.Fatalf("Expected Top1 %v, found %v with %d", want1, key, count)
+		}
+	}
+}
+
+func TestTopKTrackingTies(t *testing.T) {
+	sk, _ := New(0.001, 0.01, WithTopKTracking(5))
+	for i := 0; i < 20; i++ {
+		for n := 0; n < 3; n++ {
+			sk.Insert(fmt.Sprint("k", i), 1)
+		}
+	}
+
+	for _, k := range []int{1, 3, 5, 10} {
+		assertSameTopK(t, sk, k)
+		if got, want := sk.KthCount(k), sk.scanTopK(k); len(want) == k && got != want[k-1].Count {
+			t.Errorf("Expected the %dth count %d, found %d", k, want[k-1].Count, got)
+		}
+	}
+}
+
+func TestTopKTrackingMatchesScan(t *testing.T) {
+	words := loadWords()
+	for _, p := range []int{2, 3, 5, 7, 11, 13, 17, 23} {
+		for i := p; i < len(words); i += p {
+			words[i] = words[p]
+		}
+	}
+
+	// A small sketch causes plenty of evictions to exercise the tracker
+	sk, err := New(0.05, 0.001, WithTopKTracking(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, w := range words {
+		sk.Insert(w, 1)
+		if i%499 == 0 {
+			assertSameTopK(t, sk, 10)
+		}
+	}
+	assertSameTopK(t, sk, 1)
+	assertSameTopK(t, sk, 10)
+	assertSameTopK(t, sk, 32)
+	assertSameTopK(t, sk, 100)
+
+	// The heavy hitters stand out from the noise in every bucket
+	if _, ok := sk.top.topK(8); !ok {
+		t.Error("Expected tracker to answer TopK(8) without a scan")
+	}
+}
+
+func TestTopKTrackingMerge(t *testing.T) {
+	words := loadWords()
+	slices := split(words, 2)
+
+	sk1, _ := NewTopK(10, uint64(len(words)), 0.01, WithTopKTracking(20))
+	sk2, _ := NewTopK(10, uint64(len(words)), 0.01)
+	for _, w := range slices[0] {
+		sk1.Insert(w, 1)
+	}
+	for _, w := range slices[1] {
+		sk2.Insert(w, 1)
+	}
+	for i := 0; i < 1000; i++ {
+		sk2.Insert("merged", 1)
+	}
+
+	if err := sk1.Merge(sk2); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTopK(t, sk1, 10)
+	if top := sk1.TopK(1); top[0].Key != "merged" {
+		t.Errorf("Expected 'merged' on top after Merge, found '%s'", top[0].Key)
+	}
+
+	// Inserts after the merge must see the merged slot hashes
+	for i := 0; i < 500; i++ {
+		sk1.Insert(fmt.Sprint("after", i%7), 1)
+	}
+	assertSameTopK(t, sk1, 10)
+}
+
+func TestTopKTrackingReset(t *testing.T) {
+	sk, _ := New(0.01, 0.01, WithTopKTracking(5))
+	for i := 0; i < 100; i++ {
+		sk.Insert(fmt.Sprint(i%10), 1)
+	}
+
+	sk.Reset()
+	if top := sk.TopK(5); len(top) != 0 {
+		t.Fatalf("Expected empty TopK after Reset, found %v", top)
+	}
+
+	sk.Insert("a", 2)
+	sk.Insert("b", 1)
+	top := sk.TopK(5)
+	if len(top) != 2 || top[0].Key != "a" || top[0].Count != 2 {
+		t.Errorf("Expected [a=2 b=1] after Reset, found %v", top)
+	}
+}
+
+func TestWithTopKTrackingInvalid(t *testing.T) {
+	if _, err := New(0.01, 0.01, WithTopKTracking(0)); err == nil {
+		t.Error("Expected error for m=0")
+	}
+}
+
+func benchmarkInsertTopK(b *testing.B, opts ...Option) {
+	keys := zipfKeys(1000000, 100000, 1)
+	sk, _ := NewTopK(10, uint64(len(keys)), 0.01, opts...)
+	for _, key := range keys[:100000] {
+		sk.Insert(key, 1)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sk.Insert(keys[i%len(keys)], 1)
+		sk.TopK(10)
+	}
+}
+
+func BenchmarkInsertTopKScan(b *testing.B) {
+	benchmarkInsertTopK(b)
+}
+
+func BenchmarkInsertTopKTracked(b *testing.B) {
+	benchmarkInsertTopK(b, WithTopKTracking(64))
+}
+
+func TestTopKWhere(t *testing.T) {
+	sk, _ := New(0.01, 0.001, WithTopKTracking(10))
+	for _, key := range zipfKeys(100000, 1000, 1) {
+		sk.Insert(key, 1)
+	}
+
+	calls := make(map[interface{}]int)
+	even := func(key interface{}) bool {
+		calls[key]++
+		var n int
+		fmt.Sscanf(key.(string), "key%d", &n)
+		return n%2 == 0
+	}
+
+	const k = 10
+	res := sk.TopKWhere(k, even)
+	if len(res) != k {
+		t.Fatalf("Expected %d entries, found %d", k, len(res))
+	}
+	for key, n := range calls {
+		if n != 1 {
+			t.Fatalf("Expected predicate to be called once for '%s', called %d times", key, n)
+		}
+	}
+
+	var want []LocalHeavyHitter
+	for _, hh := range sk.Result(1) {
+		if even(hh.Key) {
+			want = append(want, hh)
+		}
+	}
+	for i, hh := range res {
+		if !even(hh.Key) {
+			t.Errorf("Expected only even keys, found '%s'", hh.Key)
+		}
+		if hh.Count != want[i].Count {
+			t.Errorf("Expected count %d at rank %d, found %d", want[i].Count, i, hh.Count)
+		}
+	}
+
+	none := sk.TopKWhere(k, func(interface{}) bool { return false })
+	if none == nil || len(none) != 0 {
+		t.Errorf("Expected empty non-nil result, found %#v", none)
+	}
+	if all := sk.TopKWhere(k, nil); len(all) != k || all[0] != sk.TopK(1)[0] {
+		t.Errorf("Expected nil predicate to behave like TopK, found %v", all)
+	}
+}
+
+func TestTopKWithRemainder(t *testing.T) {
+	// Without collisions the estimates are exact
+	exact := newSketch(10000, 4)
+	for i := 0; i < 50; i++ {
+		exact.Insert(i, uint64(1+i))
+	}
+	top, rest := exact.TopKWithRemainder(10)
+	var sum uint64
+	for n, hh := range top {
+		if hh.Key != 49-n {
+			t.Errorf("Expected key %d at %d, found %v", 49-n, n, hh.Key)
+		}
+		sum += hh.Count
+	}
+	if sum+rest != exact.Total() || rest != 50*51/2-(41+50)*10/2 {
+		t.Errorf("Expected the top 10 and a remainder of %d to add up to %d, found %d+%d", 50*51/2-(41+50)*10/2, exact.Total(), sum, rest)
+	}
+
+	const k = 10
+	small, _ := New(0.01, 0.05)
+	for _, key := range zipfKeys(50000, 20000, 1) {
+		small.Insert(key, 1)
+	}
+	top, rest = small.TopKWithRemainder(k)
+	sum = 0
+	for _, hh := range top {
+		sum += hh.Count
+	}
+	n := float64(small.Total())
+	if float64(sum+rest) > n+k*small.Epsilon()*n || sum+rest < small.Total() {
+		t.Errorf("Expected the top %d and remainder to add up to at least %v and at most %v above, found %d+%d", k, n, k*small.Epsilon()*n, sum, rest)
+	}
+	if top, rest := newSketch(10, 2).TopKWithRemainder(k); len(top) != 0 || rest != 0 {
+		t.Errorf("Expected nothing on an empty sketch, found %v and %d", top, rest)
+	}
+}
+
+func TestKthCount(t *testing.T) {
+	plain, _ := New(0.01, 0.01)
+	tracked, _ := New(0.01, 0.01, WithTopKTracking(20))
+	for _, sk := range []*Sketch{plain, tracked} {
+		if c := sk.KthCount(1); c != 0 {
+			t.Errorf("Expected 0 on an empty sketch, found %d", c)
+		}
+		for _, key := range zipfKeys(20000, 300, 1) {
+			sk.Insert(key, 1)
+		}
+
+		for _, k := range []int{1, 2, 5, 10, 20, 50} {
+			top := sk.TopK(k)
+			if c := sk.KthCount(k); c != top[k-1].Count {
+				t.Errorf("Expected the %d-th count %d, found %d", k, top[k-1].Count, c)
+			}
+		}
+		if c := sk.KthCount(100000); c != 0 {
+			t.Errorf("Expected 0 beyond the candidates, found %d", c)
+		}
+		if c := sk.KthCount(0); c != 0 {
+			t.Errorf("Expected 0 for k = 0, found %d", c)
+		}
+	}
+}
+
+func TestTopKOverlap(t *testing.T) {
+	a, _ := New(0.01, 0.01)
+	b, _ := New(0.01, 0.01)
+	if o := TopKOverlap(a, b, 5); o != 1 {
+		t.Errorf("Expected empty sketches to overlap fully, found %f", o)
+	}
+
+	for i, key := range zipfKeys(5000, 100, 1) {
+		a.Insert(key, 1)
+		b.Insert(key, uint64(1+i%2))
+	}
+	if o := TopKOverlap(a, a.Clone(), 5); o != 1 {
+		t.Errorf("Expected identical sketches to overlap fully, found %f", o)
+	}
+
+	disjoint, _ := New(0.01, 0.01)
+	for _, key := range zipfKeys(5000, 100, 1) {
+		disjoint.Insert("other "+key, 1)
+	}
+	if o := TopKOverlap(a, disjoint, 5); o != 0 {
+		t.Errorf("Expected disjoint sketches not to overlap, found %f", o)
+	}
+
+	// Three shared keys of seven
+	partial, _ := New(0.01, 0.01)
+	for key, count := range map[string]uint64{"key0": 50, "key1": 40, "key2": 30, "x": 20, "y": 10} {
+		partial.Insert(key, count)
+	}
+	if o := TopKOverlap(partial, a, 5); math.Abs(o-3.0/7) > 1e-9 {
+		t.Errorf("Expected overlap 3/7, found %f", o)
+	}
+}
+
+func TestDivergence(t *testing.T) {
+	a, _ := New(0.01, 0.01)
+	if d := Divergence(a, a.Clone(), 10); d != 0 {
+		t.Errorf("Expected empty sketches not to diverge, found %f", d)
+	}
+
+	for _, key := range zipfKeys(20000, 200, 1) {
+		a.Insert(key, 1)
+	}
+	if d := Divergence(a, a.Clone(), 10); d > 1e-12 {
+		t.Errorf("Expected identical sketches not to diverge, found %f", d)
+	}
+
+	// Another window of the same traffic diverges little, a shifted mix a lot
+	same, _ := New(0.01, 0.01)
+	for _, key := range zipfKeys(20000, 200, 2) {
+		same.Insert(key, 1)
+	}
+	shifted, _ := New(0.01, 0.01)
+	for _, key := range zipfKeys(20000, 200, 3) {
+		shifted.Insert("new "+key, 1)
+	}
+	small, large := Divergence(a, same, 10), Divergence(a, shifted, 10)
+	if small > 0.05 || large < 1 {
+		t.Errorf("Expected a small divergence from the same traffic and a large one from shifted traffic, found %f and %f", small, large)
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	a := []LocalHeavyHitter{{Key: "x", Count: 10, Rows: 2}, {Key: "y", Count: 7, Rows: 1}, {Key: "z", Count: 3, Rows: 1}}
+	b := []LocalHeavyHitter{{Key: "y", Count: 5, Rows: 3}, {Key: "w", Count: 4, Rows: 1}, {Key: "z", Count: 1, Rows: 1}}
+
+	res := MergeResults(3, a, b)
+	want := []LocalHeavyHitter{{Key: "y", Count: 12, Rows: 1}, {Key: "x", Count: 10, Rows: 2}, {Key: "w", Count: 4, Rows: 1}, {Key: "z", Count: 4, Rows: 1}}
+	// w and z tie, and one of them makes the top 3
+	if len(res) != 3 || res[0] != want[0] || res[1] != want[1] || res[2] != want[2] && res[2] != want[3] {
+		t.Errorf("Expected %v, found %v", want, res)
+	}
+	if again := MergeResults(3, b, a); again[2].Key != res[2].Key {
+		t.Errorf("Expected ties broken regardless of the order of results, found %v and %v", res, again)
+	}
+
+	// Disjoint results are simply ranked together
+	disjoint := MergeResults(10, []LocalHeavyHitter{{Key: 1, Count: 5}}, []LocalHeavyHitter{{Key: 2, Count: 6}}, nil)
+	if len(disjoint) != 2 || disjoint[0].Key != 2 || disjoint[1].Key != 1 {
+		t.Errorf("Expected 2 then 1, found %v", disjoint)
+	}
+
+	lower := MergeResultsFunc(1, func(key interface{}) interface{} { return strings.ToLower(key.(string)) },
+		[]LocalHeavyHitter{{Key: "A", Count: 2}, {Key: "b", Count: 3}}, []LocalHeavyHitter{{Key: "a", Count: 2}})
+	if len(lower) != 1 || lower[0].Key != "a" || lower[0].Count != 4 {
+		t.Errorf("Expected a=4 after canonicalizing, found %v", lower)
+	}
+	if res := MergeResults(0, a); len(res) != 0 || res == nil {
+		t.Errorf("Expected an empty result for k = 0, found %v", res)
+	}
+}
+
+func TestTop1(t *testing.T) {
+	assertTop1 := func(sk *Sketch, stage string) {
+		t.Helper()
+		key, count, ok := sk.Top1()
+		top := sk.TopK(1)
+		if ok != (len(top) == 1) || ok && (key != top[0].Key || count != top[0].Count) {
+			t.Fatalf("Expected %v after %s, found %v=%d, %t", top, stage, key, count, ok)
+		}
+	}
+
+	for seed := int64(1); seed <= 5; seed++ {
+		for _, tracked := range []bool{false, true} {
+			var opts []Option
+			if tracked {
+				opts = append(opts, WithTopKTracking(10))
+			}
+			sk, _ := NewFromParams(Params{B: 200, L: 4}, opts...)
+			other, _ := NewFromParams(Params{B: 200, L: 4})
+
+			assertTop1(sk, "construction")
+			for i, key := range zipfKeys(5000, 1000, seed) {
+				sk.Insert(key, 1)
+				if i%500 == 0 {
+					assertTop1(sk, "inserting")
+				}
+			}
+			assertTop1(sk, "inserting")
+
+			for _, key := range zipfKeys(5000, 1000, -seed) {
+				other.Insert(strings.ToUpper(key), 2)
+			}
+			if err := sk.Merge(other); err != nil {
+				t.Fatal(err)
+			}
+			assertTop1(sk, "merging")
+
+			if err := sk.Decay(0.5); err != nil {
+				t.Fatal(err)
+			}
+			assertTop1(sk, "decaying")
+
+			sk.Reset()
+			if _, _, ok := sk.Top1(); ok {
+				t.Fatal("Expected no top key after resetting")
+			}
+		}
+	}
+}
+
+func TestTop1Allocs(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithTopKTracking(10)}} {
+		sk, _ := NewFromParams(Params{B: 200, L: 4}, opts...)
+		for _, key := range zipfKeys(5000, 1000, 1) {
+			sk.Insert(key, 1)
+		}
+
+		if allocs := testing.AllocsPerRun(100, func() { sk.Top1() }); allocs != 0 {
+			t.Errorf("Expected no allocations, found %v", allocs)
+		}
+	}
+}
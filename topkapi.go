@@ -1,38 +1,93 @@
 package topkapi
 
 import (
-	"errors"
+	"container/heap"
+	"fmt"
 	"math"
+	"math/bits"
 	"sort"
-
-	"github.com/mitchellh/hashstructure"
+	"strconv"
+	"sync"
 )
 
-var incompatibleSketches = errors.New("Incompatible sketches")
+var (
+	nilSketch     = newError(ErrInvalidParameter, "topkapi: sketch should not be nil")
+	primeOverflow = newError(ErrInvalidParameter, "topkapi: primed counts overflow the sketch")
+)
 
 type LocalHeavyHitter struct {
 	Key   interface{}
 	Count uint64
+
+	// Rows is the number of rows holding Key as a candidate. Noise that
+	// happens to hold a bucket rarely holds one in more than a single row,
+	// while a genuine heavy hitter holds its bucket in most rows.
+	Rows int
+
+	// Sample is the sample stored with Key, see InsertWithSample.
+	Sample interface{}
 }
 
 type Sketch struct {
-	l       uint64 // number of rows
-	b       uint64 // think of this as the k
-	cms     [][]uint64
-	counts  [][]int64
-	objects [][]interface{}
+	l           uint64        // number of rows
+	b           uint64        // think of this as the k
+	seed        uint64        // see WithSeed
+	hashVersion HashVersion   // see WithHashVersion
+	consistent  bool          // see WithConsistentBuckets
+	cms         counterMatrix // l rows, followed by any extra counter rows
+	counts      [][]int64
+	objects     [][]interface{}
+	hashes      [][]uint64 // key hash of each candidate
+
+	// occupied has a bit for every bucket holding a candidate, so that Merge
+	// can skip runs of empty buckets
+	occupied [][]uint64
+
+	total     uint64   // sum of all inserted counts
+	evictions uint64   // candidates displaced by another key
+	conflicts []uint64 // per row, inserts into a bucket counting another key
+	distinct  hll      // see Cardinality
+
+	canonicalize   func(interface{}) interface{} // see WithCanonicalizer
+	numericKeys    bool                          // see WithNumericKeys
+	integralFloats bool
+	foldCase       bool                // see WithCaseInsensitiveKeys
+	normalize      func(string) string // see WithKeyNormalizer
+	normalizer     string              // identity of normalize
+	warn           func(error)         // see WithWarningHandler
+	events         func(Event)         // see WithEventHandler
+	maxKeyLen      int                 // see WithMaxKeyLen
+	keyLenPolicy   KeyLenPolicy
+	rejected       uint64
+	minCount       uint64         // see WithMinCount
+	eviction       EvictionPolicy // see WithEvictionPolicy, nil for DecrementEviction
+	clock          Clock          // see WithClock, nil for SystemClock
+	sampling       float64        // see WithSampling, 0 to keep every insert
+	sampleSeq      uint64         // inserts the sampler drew for
+
+	dedup    *EventFilter // see InsertOnce
+	accepted uint64
+	deduped  uint64
+
+	top        *topTracker         // incremental top-k, see WithTopKTracking
+	thresholds *thresholdHistogram // see WithThresholdTracking
+	spans      *spanTracker        // see WithSpanTracking
+	samples    [][]interface{}     // per candidate slot, see WithSamples
+
+	sizing *topKSizing // set while NewTopK applies options, see WithRows
 }
 
 // New creates a new Topkapi Sketch with given error rate and confidence.
 // Accuracy guarantees will be made in terms of a pair of user specified parameters,
 // ε and δ, meaning that the error in answering a query is within a factor of ε with
-// probability 1-δ
-func New(delta, epsilon float64) (*Sketch, error) {
+// probability 1-δ. It returns an error wrapping ErrInvalidParameter for values
+// out of range, or for an option that fails.
+func New(delta, epsilon float64, opts ...Option) (*Sketch, error) {
 	if epsilon <= 0 || epsilon >= 1 {
-		return nil, errors.New("topkapi: value of epsilon should be in range of (0, 1)")
+		return nil, newError(ErrInvalidParameter, "topkapi: value of epsilon should be in range of (0, 1)")
 	}
 	if delta <= 0 || delta >= 1 {
-		return nil, errors.New("topkapi: value of delta should be in range of (0, 1)")
+		return nil, newError(ErrInvalidParameter, "topkapi: value of delta should be in range of (0, 1)")
 	}
 
 	var (
@@ -42,45 +97,96 @@ func New(delta, epsilon float64) (*Sketch, error) {
 
 	//fmt.Printf("b=%d, l=%d, epsilon=%f, delta=%f\n", b, l, epsilon, delta)
 
-	return newSketch(b, l), nil
+	if err := checkDimensions(b, l); err != nil {
+		return nil, err
+	}
+	return newSketch(b, l).apply(opts)
 }
 
 // NewTopK creates a sketch suitable for finding TopK in a corpus of a given size,
-// with an error rate of delta.
-func NewTopK(k, approxCorpusSize uint64, delta float64) (*Sketch, error) {
+// with an error rate of delta. It has DefaultRows rows of Buckets buckets,
+// unless WithRows or WithBucketFactor are given. It returns an error wrapping
+// ErrInvalidParameter for values out of range, like a corpus too small to
+// size the rows by, or for an option that fails.
+func NewTopK(k, approxCorpusSize uint64, delta float64, opts ...Option) (*Sketch, error) {
 	if k < 1 {
-		return nil, errors.New("topkapi: value of k should be in >= 1")
+		return nil, newError(ErrInvalidParameter, "topkapi: value of k should be in >= 1")
+	}
+
+	// The sizing options are taken from a sketch too small to matter, then
+	// all options are applied to the sketch of that size.
+	sizing := topKSizing{rows: DefaultRows, factor: DefaultBucketFactor}
+	probe := newSketch(1, 1)
+	probe.sizing = &sizing
+	if _, err := probe.apply(opts); err != nil {
+		return nil, err
 	}
 
-	// We want to grow ~ k*log(corpus size)
-	// The factor 55 was chosen through experiementation as the minimal threshold where
-	// the error rates don't grow out of control on merge and our tests pass.
-	// Example: for top-20 on a corpus of 1M we require 15197 buckets and ~475kb space.
-	numBuckets := uint64(55.0 * float64(k) * math.Log(float64(approxCorpusSize)))
-	numHashFuncs := uint64(4)
+	// Example: for top-20 on a corpus of 1M we require 15197 buckets and ~2.4MB space,
+	// see SuggestParameters.
+	b := Buckets(k, approxCorpusSize, sizing.factor)
+	if err := checkDimensions(b, sizing.rows); err != nil {
+		return nil, err
+	}
+	sk := newSketch(b, sizing.rows)
+	sk.sizing = &sizing
+	if _, err := sk.apply(opts); err != nil {
+		return nil, err
+	}
+	sk.sizing = nil
 
-	return newSketch(numBuckets, numHashFuncs), nil
+	return sk, nil
+}
+
+// maxCounters bounds the counters of a sketch, so that sizes out of all
+// proportion are an error rather than a panic of the allocation. Sizes below
+// it may still run out of memory. Where int is 32 bits wide, it is 1<<26, so
+// that the counters take at most an eighth of the address space.
+const maxCounters = 1 << (26 + 14*(strconv.IntSize/32-1))
+
+// checkDimensions returns an error unless a sketch can have l counter rows
+// of b buckets.
+func checkDimensions(b, l uint64) error {
+	if b < 1 || l < 1 || l > maxCounters || b > maxCounters/l {
+		return newError(ErrInvalidParameter, "topkapi: %d rows of %d buckets are out of range", l, b)
+	}
+	return nil
 }
 
 func newSketch(b, l uint64) *Sketch {
+	return backedSketch(b, l, make([]uint64, l*b), make([]int64, l*b), make([]interface{}, l*b))
+}
+
+// backedSketch returns a sketch of l rows of b buckets whose counters,
+// residuals and keys are the given slices of l*b zero values, row after
+// row, see NewFromBacking.
+func backedSketch(b, l uint64, cms []uint64, counts []int64, objects []interface{}) *Sketch {
 	var (
-		cms     = make([][]uint64, l)
-		counts  = make([][]int64, l)
-		objects = make([][]interface{}, l)
+		rows     = make([][]int64, l)
+		keys     = make([][]interface{}, l)
+		flat     = make([]uint64, l*b)
+		hashes   = make([][]uint64, l)
+		occupied = make([][]uint64, l)
 	)
 
-	for i := range counts {
-		cms[i] = make([]uint64, b)
-		counts[i] = make([]int64, b)
-		objects[i] = make([]interface{}, b)
+	for i := uint64(0); i < l; i++ {
+		rows[i] = counts[i*b : (i+1)*b]
+		keys[i] = objects[i*b : (i+1)*b]
+		hashes[i] = flat[i*b : (i+1)*b]
+		occupied[i] = make([]uint64, (b+63)/64)
 	}
 
 	return &Sketch{
-		l:       l,
-		b:       b,
-		counts:  counts,
-		objects: objects,
-		cms:     cms,
+		l:         l,
+		b:         b,
+		counts:    rows,
+		objects:   keys,
+		hashes:    hashes,
+		occupied:  occupied,
+		cms:       rowMajorMatrix(cms, int(l), b),
+		conflicts: make([]uint64, l),
+
+		hashVersion: DefaultHashVersion,
 	}
 }
 
@@ -91,96 +197,871 @@ func (sk *Sketch) Epsilon() float64 {
 
 // Delta is the probability for a measurement to be outside the epsilon range
 func (sk *Sketch) Delta() float64 {
-	return 2.0 / math.Exp(float64(sk.l))
+	return 2.0 / math.Exp(float64(sk.cms.rows))
+}
+
+// rowSalt returns the salt mixed into the key hash for row i, along with the
+// seed. Salts are derived from the row index only, so two sketches of the
+// same shape and seed always agree on bucket assignment and can be merged.
+func rowSalt(i int) uint64 {
+	return mix64(uint64(i+1) * 0x9e3779b97f4a7c15)
 }
 
-// Insert ...
+// mix64 is the splitmix64 finalizer. It spreads every input bit over the
+// whole output word.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// bucket returns the bucket index of a key hash in row i.
+func (sk *Sketch) bucket(hsum uint64, i int) uint64 {
+	h := mix64(hsum ^ rowSalt(i) ^ sk.seed)
+	if sk.consistent {
+		return jumpBucket(h, sk.b)
+	}
+	return h % sk.b
+}
+
+// Insert adds count occurrences of key. A count of zero is a no-op. Keys of
+// a type that can't be counted, like slices and maps, are rejected like
+// long keys are by WithMaxKeyLen; see TryInsert to tell.
 func (sk *Sketch) Insert(key interface{}, count uint64) {
-	var (
-		hsum, _ = hashstructure.Hash(key, nil)
-		h1      = uint32(hsum & 0xffffffff)
-		h2      = uint32((hsum >> 32) & 0xffffffff)
-	)
+	sk.TryInsert(key, count)
+}
 
-	for i := range sk.counts {
-		h := uint64((h1 + uint32(i)*h2))
-		hi := h % sk.b
+// TryInsert is like Insert, but returns an error wrapping
+// ErrUnsupportedKeyType if key, after the canonicalizer, is of a type that
+// can't be compared or hashed, like a slice, a map or a struct holding one.
+// Such keys are counted as rejected in Stats and never held. Byte slices
+// should be converted to strings first. A key rejected by
+// WithMaxKeyLen is not an error.
+func (sk *Sketch) TryInsert(key interface{}, count uint64) error {
+	return sk.tryInsert(key, sk.sampled(count))
+}
 
-		sk.cms[i][hi] += count
+// tryInsert is TryInsert without sampling.
+func (sk *Sketch) tryInsert(key interface{}, count uint64) error {
+	if count == 0 {
+		return nil
+	}
 
-		if sk.objects[i][hi] == key {
-			sk.counts[i][hi] += int64(count)
-		} else {
-			sk.counts[i][hi] -= int64(count)
-			if sk.counts[i][hi] <= 0 {
-				sk.objects[i][hi] = key
-				sk.counts[i][hi] = 1
+	ck, ok := sk.limit(sk.canonical(key))
+	if !ok {
+		sk.rejected++
+		return keyError(ck)
+	}
+	sk.insert(ck, sk.hashKey(ck), count)
+
+	return nil
+}
+
+// InsertHashed inserts a key that has already been canonicalized or
+// normalized, along with its hash as returned by HashKey. Neither the
+// canonicalizer nor the key normalizer is applied again.
+func (sk *Sketch) InsertHashed(key interface{}, hsum uint64, count uint64) {
+	if count = sk.sampled(count); count == 0 {
+		return
+	}
+
+	// A truncated key hashes differently
+	if limited, ok := sk.limit(key); !ok {
+		sk.rejected++
+		return
+	} else if limited != key {
+		key, hsum = limited, sk.hashKey(limited)
+	}
+
+	sk.insert(key, hsum, count)
+}
+
+func (sk *Sketch) insert(key interface{}, hsum uint64, count uint64) {
+	candidate := true
+	if sk.thresholds != nil || sk.minCount > 0 {
+		old := sk.counterMin(hsum)
+		if sk.thresholds != nil {
+			sk.thresholds.raised(old, old+count)
+		}
+		candidate = old+count >= sk.minCount
+	}
+
+	for i := 0; i < sk.cms.rows; i++ {
+		if sk.insertRow(i, key, hsum, count, candidate) {
+			sk.addEvictions(1)
+		}
+	}
+
+	sk.addTotal(count)
+	sk.distinct.add(hsum)
+
+	if sk.top != nil {
+		sk.top.inserted(sk, key, hsum)
+	}
+	if sk.spans != nil {
+		sk.spans.inserted(sk, hsum)
+	}
+}
+
+// insertRow counts an insert in row i, and contests the bucket of the key if
+// it is a candidate and row i holds candidates. It reports whether the key
+// evicted the candidate of the bucket.
+func (sk *Sketch) insertRow(i int, key interface{}, hsum uint64, count uint64, candidate bool) (evicted bool) {
+	hi := sk.bucket(hsum, i)
+
+	prior := sk.cms.get(i, hi)
+	if c := prior + count; c >= count {
+		sk.cms.set(i, hi, c)
+	} else {
+		sk.saturate(i, hi)
+	}
+
+	if i >= len(sk.counts) {
+		return false
+	}
+	if !candidate {
+		// The count joins those of other keys the counter holds already
+		if prior != 0 && !sk.holds(i, hi, key, hsum) {
+			sk.conflicts[i]++
+		}
+		return false
+	}
+	n := residual(count)
+	if sk.holds(i, hi, key, hsum) {
+		sk.counts[i][hi] = addResidual(sk.counts[i][hi], n)
+	} else if sk.eviction != nil && sk.objects[i][hi] != nil {
+		sk.conflicts[i]++
+		left, evict := sk.eviction.Contest(sk.counts[i][hi], uint64(n))
+		if evict {
+			evicted = true
+			sk.objects[i][hi] = key
+			sk.hashes[i][hi] = hsum
+			if sk.samples != nil {
+				sk.samples[i][hi] = nil
+			}
+		}
+		sk.counts[i][hi] = left
+	} else {
+		if sk.objects[i][hi] != nil || prior != 0 {
+			sk.conflicts[i]++
+		}
+		// A key outweighing the candidate takes over the bucket with the
+		// count it has left
+		sk.counts[i][hi] -= n
+		if sk.counts[i][hi] < 0 {
+			if sk.objects[i][hi] != nil {
+				evicted = true
+			} else {
+				sk.occupy(i, hi)
+			}
+			sk.objects[i][hi] = key
+			sk.hashes[i][hi] = hsum
+			sk.counts[i][hi] = -sk.counts[i][hi]
+			if sk.samples != nil {
+				sk.samples[i][hi] = nil
 			}
 		}
 	}
+
+	return evicted
 }
 
-// Result ...
+// Result returns the candidates with an estimate of at least threshold,
+// ordered by descending estimate. The estimate of a candidate is its
+// count-min estimate, as reported by Count. Candidates with the same
+// estimate are ordered by the number of rows holding them, then by key
+// hash. The result is never nil, and empty if nothing qualifies.
 func (sk *Sketch) Result(threshold uint64) []LocalHeavyHitter {
+	return sk.ResultWhere(threshold, nil)
+}
+
+// ResultWhere is like Result, but only reports keys for which pred returns
+// true. pred is called once per distinct candidate during the scan, so keys
+// it rejects never make it into the sorted result. A nil pred accepts every key.
+func (sk *Sketch) ResultWhere(threshold uint64, pred func(key interface{}) bool) []LocalHeavyHitter {
+	// The candidates are ranked in scratch space shared by all calls, so
+	// the only allocation of a query in steady state is its result
+	scratch := rankedPool.Get().(*[]rankedHitter)
+	rs := (*scratch)[:0]
+	sk.scan(threshold, pred, func(hh LocalHeavyHitter, hsum uint64) {
+		rs = append(rs, rankedHitter{hh, hsum})
+	})
+
+	sort.Sort(rankedOrder(rs))
+
+	cs := make([]LocalHeavyHitter, len(rs))
+	for i := range rs {
+		cs[i] = rs[i].LocalHeavyHitter
+		rs[i] = rankedHitter{} // no longer keeps the key alive
+	}
+	*scratch = rs[:0]
+	rankedPool.Put(scratch)
+
+	return cs
+}
+
+// rankedPool holds scratch for ResultWhere.
+var rankedPool = sync.Pool{
+	New: func() interface{} { return new([]rankedHitter) },
+}
+
+// rankedOrder sorts heavy hitters in the order of a result.
+type rankedOrder []rankedHitter
+
+func (o rankedOrder) Len() int           { return len(o) }
+func (o rankedOrder) Less(a, b int) bool { return o[a].before(o[b]) }
+func (o rankedOrder) Swap(a, b int)      { o[a], o[b] = o[b], o[a] }
+
+// streamBatch is the number of heavy hitters ResultStream selects per pass.
+const streamBatch = 256
+
+// ResultStream calls fn with the heavy hitters Result would return, one at a
+// time and in the same order, until fn returns false. It selects them in
+// passes over the sketch, a batch at a time, so memory stays bounded however
+// many candidates qualify. Taking the first few costs a single pass, while
+// taking n costs about n/256 passes; prefer Result to take most of them.
+func (sk *Sketch) ResultStream(threshold uint64, fn func(hh LocalHeavyHitter) bool) {
 	var (
-		seen = make(map[interface{}]int)
-		cs   = make([]LocalHeavyHitter, 0, sk.b)
+		batch = make(rankedHeap, 0, streamBatch)
+		last  *rankedHitter
 	)
 
+	for {
+		sk.scan(threshold, nil, func(hh LocalHeavyHitter, hsum uint64) {
+			r := rankedHitter{hh, hsum}
+			switch {
+			case last != nil && !last.before(r):
+			case len(batch) < streamBatch:
+				heap.Push(&batch, r)
+			case r.before(batch[0]):
+				batch[0] = r
+				heap.Fix(&batch, 0)
+			}
+		})
+
+		// The heap pops the last of the batch first
+		sorted := make([]rankedHitter, len(batch))
+		for i := len(sorted) - 1; i >= 0; i-- {
+			sorted[i] = heap.Pop(&batch).(rankedHitter)
+		}
+		for _, r := range sorted {
+			if !fn(r.LocalHeavyHitter) {
+				return
+			}
+		}
+
+		if len(sorted) < streamBatch {
+			return
+		}
+		last = &sorted[len(sorted)-1]
+	}
+}
+
+// rankedHeap is a heap of heavy hitters that has the last in order on top.
+type rankedHeap []rankedHitter
+
+func (h rankedHeap) Len() int            { return len(h) }
+func (h rankedHeap) Less(a, b int) bool  { return h[b].before(h[a]) }
+func (h rankedHeap) Swap(a, b int)       { h[a], h[b] = h[b], h[a] }
+func (h *rankedHeap) Push(x interface{}) { *h = append(*h, x.(rankedHitter)) }
+
+func (h *rankedHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// rankedHitter is a heavy hitter along with its key hash, which orders
+// heavy hitters with the same count.
+type rankedHitter struct {
+	LocalHeavyHitter
+	hsum uint64
+}
+
+// before reports whether r comes before o in a result: by count, then by
+// the number of rows holding the key, then by key hash.
+func (r rankedHitter) before(o rankedHitter) bool {
+	if r.Count != o.Count {
+		return r.Count > o.Count
+	}
+	if r.Rows != o.Rows {
+		return r.Rows > o.Rows
+	}
+	return r.hsum < o.hsum
+}
+
+// scan calls fn once for every distinct candidate accepted by pred whose
+// estimate is at least threshold, along with its key hash. The estimate of a
+// candidate is the count-min estimate over all counter rows, like Count.
+func (sk *Sketch) scan(threshold uint64, pred func(key interface{}) bool, fn func(hh LocalHeavyHitter, hsum uint64)) {
+	sk.scanUntil(threshold, pred, func(hh LocalHeavyHitter, hsum uint64) bool {
+		fn(hh, hsum)
+		return true
+	})
+}
+
+// scanUntil is like scan, but stops as soon as fn returns false.
+func (sk *Sketch) scanUntil(threshold uint64, pred func(key interface{}) bool, fn func(hh LocalHeavyHitter, hsum uint64) bool) {
 	for i := range sk.objects {
 		for j, obj := range sk.objects[i] {
-			count := sk.cms[i][j]
-			if count < threshold {
+			// The estimate can't exceed the counter of any bucket the key is in
+			if obj == nil || sk.cms.get(i, uint64(j)) < threshold {
 				continue
 			}
-			idx, ok := seen[obj]
-			if !ok {
-				idx = len(cs)
-				seen[obj] = idx
-				cs = append(cs, LocalHeavyHitter{
-					Key:   obj,
-					Count: count,
-				})
+			hsum := sk.hashes[i][j]
+			if sk.heldBefore(obj, hsum, i) {
+				continue
+			}
+
+			if pred != nil && !pred(obj) {
+				continue
 			}
-			if count < cs[idx].Count {
-				cs[idx].Count = count
+			if count := sk.counterMin(hsum); count >= threshold {
+				hh := LocalHeavyHitter{Key: obj, Count: count, Rows: sk.rowsHolding(obj, hsum, i), Sample: sk.sampleOf(obj, hsum, i)}
+				if !fn(hh, hsum) {
+					return
+				}
 			}
 		}
 	}
+}
 
-	sort.Slice(cs, func(a, b int) bool {
-		return cs[a].Count > cs[b].Count
-	})
+// holds reports whether the candidate in row i, bucket hi is key. The key
+// hashes are compared first, as comparing keys can be expensive, for
+// instance for long strings or structs.
+func (sk *Sketch) holds(i int, hi uint64, key interface{}, hsum uint64) bool {
+	return sk.hashes[i][hi] == hsum && sk.objects[i][hi] == key
+}
 
-	return cs
+// sameCandidate reports whether sk and other hold the same candidate in row
+// i, bucket j.
+func (sk *Sketch) sameCandidate(other *Sketch, i, j int) bool {
+	return sk.hashes[i][j] == other.hashes[i][j] && sk.objects[i][j] == other.objects[i][j]
 }
 
-// Merge ...
+// heldBefore reports whether key is a candidate in any row before row i,
+// so that a scan visits every key once without keeping track of them.
+func (sk *Sketch) heldBefore(key interface{}, hsum uint64, i int) bool {
+	for r := 0; r < i; r++ {
+		if sk.holds(r, sk.bucket(hsum, r), key, hsum) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rowsHolding returns the number of rows from row i on holding key as a
+// candidate.
+func (sk *Sketch) rowsHolding(key interface{}, hsum uint64, i int) int {
+	var rows int
+	for ; i < len(sk.objects); i++ {
+		if sk.holds(i, sk.bucket(hsum, i), key, hsum) {
+			rows++
+		}
+	}
+
+	return rows
+}
+
+// Merge merges other into sk, making sk a summary of both streams. Both
+// sketches must have the same dimensions and seed, or Merge returns
+// ErrIncompatibleSketches and leaves sk as it was; a nil other is
+// ErrInvalidParameter.
+//
+// The total and the statistics of other, like its evictions and rejected
+// keys, add to those of sk, and the cardinality becomes that of the union
+// of the streams. Sketches that map keys differently, like with different
+// key normalizers or case folding, are merged with a warning, see
+// WithWarningHandler and EventMismatchedMerge. The options of other are
+// not taken on.
 func (sk *Sketch) Merge(other *Sketch) error {
-	if sk.b != other.b || sk.l != other.l {
-		return incompatibleSketches
+	// Count-min counters simply add up. Candidates are merged like two
+	// Misra-Gries summaries: the same key adds its counts, different keys
+	// cancel out and the one with the larger residual keeps the bucket. Ties
+	// go to the smaller key hash so that merging is commutative.
+	return sk.mergeWith(other, func(i, j int) bool {
+		return sk.mergeCandidate(other, i, j)
+	})
+}
+
+// mergeCandidate merges the candidate of other in row i, bucket j into sk,
+// see Merge, and reports whether the candidate of sk was evicted.
+func (sk *Sketch) mergeCandidate(other *Sketch, i, j int) bool {
+	cnt, ocnt := sk.counts[i][j], other.counts[i][j]
+
+	switch {
+	case sk.sameCandidate(other, i, j):
+		sk.counts[i][j] = addResidual(cnt, ocnt)
+		sk.mergeSample(other, i, j)
+	case sk.objects[i][j] == nil:
+		sk.adopt(other, i, j, ocnt)
+	default:
+		sk.conflicts[i]++
+		if sk.dominates(other, i, j) {
+			sk.counts[i][j] = cnt - ocnt
+		} else {
+			sk.adopt(other, i, j, ocnt-cnt)
+		}
+		return true
 	}
 
-	// HALP: This is probably wrong - the article doesn't explain how to merge!
-	for i := range sk.counts {
-		ws := sk.objects[i]
-		ows := other.objects[i]
-		cnt := sk.counts[i]
-		ocnt := other.counts[i]
-		cms := sk.cms[i]
-		ocms := other.cms[i]
-		for j := range cnt {
-			if ws[j] == ows[j] {
-				cnt[j] += ocnt[j]
-				cms[j] += ocms[j]
-			} else if cnt[j] < ocnt[j] {
-				ws[j] = ows[j]
-				cnt[j] = ocnt[j]
-				cms[j] = ocms[j]
+	return false
+}
+
+// AddSketch adds other to sk for federation: counters and candidate
+// residuals are summed element-wise, and a bucket keeps whichever of the two
+// keys has the larger residual. Nothing cancels out, so the residual of a
+// bucket is the sum of those reported by all leaves. Both sketches must have
+// the same dimensions and seed, with the errors of Merge otherwise.
+//
+// The counters, and so every estimate, come out exactly as with Merge; only
+// the residuals differ. Prefer AddSketch where a root only sums up the
+// sketches of many leaves to be queried, as the candidates the leaves agree
+// on are kept however many other keys compete for their buckets. Prefer
+// Merge for sketches that keep ingesting or are merged further, where
+// inflated residuals would make candidates too hard to evict.
+func (sk *Sketch) AddSketch(other *Sketch) error {
+	return sk.mergeWith(other, func(i, j int) bool {
+		switch {
+		case sk.sameCandidate(other, i, j):
+			sk.counts[i][j] = addResidual(sk.counts[i][j], other.counts[i][j])
+			sk.mergeSample(other, i, j)
+		case sk.objects[i][j] == nil:
+			sk.adopt(other, i, j, other.counts[i][j])
+		default:
+			sk.conflicts[i]++
+			sum := addResidual(sk.counts[i][j], other.counts[i][j])
+			evicted := !sk.dominates(other, i, j)
+			if evicted {
+				sk.adopt(other, i, j, sum)
 			}
+			sk.counts[i][j] = sum
+			return evicted
+		}
+		return false
+	})
+}
+
+// AbsorbTopK inserts the top k heavy hitters of other into sk with their
+// estimated counts. Unlike Merge, it works for sketches of any dimensions or
+// seed, as every key is hashed again by sk, but it is lossy: everything
+// outside the top k of other is dropped, so the total of sk only grows by
+// the counts absorbed, and counts that fell to keys sharing a bucket with a
+// heavy hitter in other are absorbed as part of its estimate. Increase k for
+// a more faithful combination.
+func (sk *Sketch) AbsorbTopK(other *Sketch, k int) {
+	sk.checkNormalizer(other)
 
+	for _, hh := range other.TopK(k) {
+		sk.tryInsert(hh.Key, hh.Count)
+	}
+}
+
+// Prime inserts every entry with its count, to warm start a sketch from a
+// list of hot keys, like the TopK of a previous run, so that they are
+// reported right away instead of after the sketch has seen enough of the
+// stream again. Rows of the entries are ignored.
+//
+// Primed counts are treated as real observed weight: they are part of
+// Total, Count and Share like any insert, and a primed key holds its
+// buckets until keys inserted later outweigh it. Prime inserts nothing and
+// returns an error if an entry has a nil key, or if the counts would
+// overflow the counters of the sketch.
+func (sk *Sketch) Prime(entries []LocalHeavyHitter) error {
+	total := sk.total
+	for _, hh := range entries {
+		if hh.Key == nil {
+			return newError(ErrInvalidParameter, "topkapi: primed key should not be nil")
+		}
+		if hh.Count > math.MaxInt64 || total+hh.Count < total {
+			return fmt.Errorf("%w: %v=%d", primeOverflow, hh.Key, hh.Count)
 		}
+		total += hh.Count
+	}
+
+	for _, hh := range entries {
+		sk.tryInsert(hh.Key, hh.Count)
 	}
 
 	return nil
 }
+
+// mergeWith checks that other can be merged into sk, adds up the counters
+// and statistics of both, and calls slot for every slot holding a candidate
+// in other to merge the candidates. slot reports whether the candidate of sk
+// was evicted.
+func (sk *Sketch) mergeWith(other *Sketch, slot func(i, j int) bool) error {
+	if sk.incompatible(other) {
+		return sk.incompatibleMerge(other)
+	}
+	if other.Empty() {
+		sk.mergeMeta(other)
+		return nil
+	}
+
+	for i := 0; i < sk.cms.rows; i++ {
+		sk.addEvictions(sk.mergeRow(other, i, slot))
+	}
+	sk.mergeMeta(other)
+
+	if sk.top != nil {
+		sk.top.rebuild(sk)
+	}
+	if sk.thresholds != nil {
+		sk.thresholds.rebuild(sk)
+	}
+
+	return nil
+}
+
+// mergeRow merges row i of other into sk, see mergeWith, and returns the
+// number of candidates of sk evicted.
+func (sk *Sketch) mergeRow(other *Sketch, i int, slot func(i, j int) bool) (evictions uint64) {
+	sk.addCounters(i, other.cms, i)
+	if i >= len(sk.counts) {
+		return 0
+	}
+
+	// Buckets of other without a candidate have nothing to merge
+	for w, word := range other.occupied[i] {
+		for ; word != 0; word &= word - 1 {
+			if slot(i, w*64+bits.TrailingZeros64(word)) {
+				evictions++
+			}
+		}
+	}
+	sk.conflicts[i] += other.conflicts[i]
+
+	return evictions
+}
+
+// mergeMeta reconciles everything of other that isn't kept per row, after
+// the rows are merged, and also when other is empty. Every field of Sketch
+// is decided on here, by mergeRow, by incompatible, or left as an option of
+// sk; TestMergeMetadata fails for a field that isn't, so a new one doesn't
+// go missing in merges unnoticed:
+//
+//	total, evictions          summed, saturating, see addTotal
+//	rejected                  summed
+//	accepted, deduped         summed, see DedupStats
+//	distinct                  union of the registers
+//	spans                     appended, see WithSpanTracking
+//	key normalizer, canonicalizer, case folding and numeric keys
+//	                          a warning and EventMismatchedMerge if they
+//	                          differ, see checkNormalizer
+//
+// Rows merge in mergeRow: counters and conflicts sum, and candidates merge
+// as the method merging asks. The dimensions, seed, hash version and
+// bucketing must be equal, see incompatible. The other options of sk, like
+// its event handler, eviction policy, sampling rate or event filter, stay
+// as they are.
+func (sk *Sketch) mergeMeta(other *Sketch) {
+	sk.checkNormalizer(other)
+
+	sk.addTotal(other.total)
+	sk.addEvictions(other.evictions)
+	sk.rejected += other.rejected
+	sk.accepted += other.accepted
+	sk.deduped += other.deduped
+	sk.distinct.merge(&other.distinct)
+
+	if sk.spans != nil && other.spans != nil {
+		sk.spans.merge(other.spans)
+	}
+}
+
+// addCounters adds row r of src to the counters of row i element-wise.
+func (sk *Sketch) addCounters(i int, src counterMatrix, r int) {
+	dst, b := sk.cms, src.b
+	if b > dst.b {
+		b = dst.b
+	}
+	for j, at, from := uint64(0), uint64(i)*dst.rs, uint64(r)*src.rs; j < b; j, at, from = j+1, at+dst.cs, from+src.cs {
+		c := src.data[from]
+		if sum := dst.data[at] + c; sum >= c {
+			dst.data[at] = sum
+		} else {
+			sk.saturate(i, j)
+		}
+	}
+}
+
+// incompatible returns whether sk and other differ in dimensions, seed,
+// hash version or bucketing, and so can't be merged, or other is nil.
+func (sk *Sketch) incompatible(other *Sketch) bool {
+	return other == nil || sk.b != other.b || sk.l != other.l || sk.cms.rows != other.cms.rows || sk.seed != other.seed ||
+		sk.hashVersion != other.hashVersion || sk.consistent != other.consistent
+}
+
+// dominates reports whether the candidate of sk in row i, bucket j, beats
+// the one of other. Ties go to the smaller key hash.
+func (sk *Sketch) dominates(other *Sketch, i, j int) bool {
+	cnt, ocnt := sk.counts[i][j], other.counts[i][j]
+	return cnt > ocnt || cnt == ocnt && sk.hashes[i][j] <= other.hashes[i][j]
+}
+
+// adopt takes over the candidate of other in row i, bucket j, with the given
+// residual count.
+func (sk *Sketch) adopt(other *Sketch, i, j int, count int64) {
+	sk.objects[i][j] = other.objects[i][j]
+	sk.hashes[i][j] = other.hashes[i][j]
+	sk.counts[i][j] = count
+	sk.occupy(i, uint64(j))
+	if sk.samples != nil {
+		var sample interface{}
+		if other.samples != nil {
+			sample = other.samples[i][j]
+		}
+		sk.samples[i][j] = sample
+	}
+}
+
+// residual returns count as a residual, which saturates at the largest
+// int64 much like the counters do at the largest uint64.
+func residual(count uint64) int64 {
+	if count > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(count)
+}
+
+// addResidual returns the sum of residuals a and b, saturating.
+func addResidual(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// occupy marks bucket j of row i as holding a candidate.
+func (sk *Sketch) occupy(i int, j uint64) {
+	sk.occupied[i][j/64] |= 1 << (j % 64)
+}
+
+// vacate drops the candidate of bucket j of row i.
+func (sk *Sketch) vacate(i int, j uint64) {
+	sk.objects[i][j] = nil
+	sk.hashes[i][j] = 0
+	sk.counts[i][j] = 0
+	sk.occupied[i][j/64] &^= 1 << (j % 64)
+	if sk.samples != nil {
+		sk.samples[i][j] = nil
+	}
+}
+
+// Clone returns a deep copy of sk, including its options.
+func (sk *Sketch) Clone() *Sketch {
+	cp := *sk
+
+	cp.cms = sk.cms.clone()
+	cp.counts = make([][]int64, len(sk.counts))
+	cp.objects = make([][]interface{}, len(sk.objects))
+	cp.hashes = make([][]uint64, len(sk.hashes))
+	cp.occupied = make([][]uint64, len(sk.occupied))
+	for i := range sk.counts {
+		cp.counts[i] = append([]int64(nil), sk.counts[i]...)
+		cp.objects[i] = append([]interface{}(nil), sk.objects[i]...)
+		cp.hashes[i] = append([]uint64(nil), sk.hashes[i]...)
+		cp.occupied[i] = append([]uint64(nil), sk.occupied[i]...)
+	}
+	cp.conflicts = append([]uint64(nil), sk.conflicts...)
+
+	if sk.dedup != nil {
+		cp.dedup = sk.dedup.clone()
+	}
+	if sk.top != nil {
+		cp.top = sk.top.clone()
+	}
+	if sk.thresholds != nil {
+		h := *sk.thresholds
+		cp.thresholds = &h
+	}
+	if sk.spans != nil {
+		cp.spans = sk.spans.clone()
+	}
+	if sk.samples != nil {
+		cp.samples = make([][]interface{}, len(sk.samples))
+		for i := range sk.samples {
+			cp.samples[i] = append([]interface{}(nil), sk.samples[i]...)
+		}
+	}
+
+	return &cp
+}
+
+// Reset clears all counters and candidates, returning the sketch to the
+// state it had right after construction.
+func (sk *Sketch) Reset() {
+	sk.cms.clear()
+	for i := range sk.counts {
+		for j := range sk.counts[i] {
+			sk.counts[i][j] = 0
+			sk.objects[i][j] = nil
+			sk.hashes[i][j] = 0
+		}
+		for w := range sk.occupied[i] {
+			sk.occupied[i][w] = 0
+		}
+		sk.conflicts[i] = 0
+	}
+	sk.total = 0
+	sk.evictions = 0
+	sk.rejected = 0
+	sk.distinct.reset()
+
+	if sk.dedup != nil {
+		sk.dedup.Reset()
+	}
+	sk.accepted = 0
+	sk.deduped = 0
+
+	if sk.top != nil {
+		sk.top.reset()
+	}
+	if sk.thresholds != nil {
+		sk.thresholds.reset()
+	}
+	if sk.spans != nil {
+		sk.spans.reset()
+	}
+	for i := range sk.samples {
+		for j := range sk.samples[i] {
+			sk.samples[i][j] = nil
+		}
+	}
+}
+
+// Count returns the count-min estimate for key, the minimum over all counter
+// rows of its buckets, and whether key is currently a candidate in any row.
+// The estimate never undercounts, but may include the counts of colliding keys.
+// A nil key is never a candidate.
+func (sk *Sketch) Count(key interface{}) (uint64, bool) {
+	key, ok := sk.limit(sk.canonical(key))
+	if !ok {
+		return 0, false
+	}
+	hsum := sk.hashKey(key)
+
+	var tracked bool
+	for i := 0; key != nil && i < len(sk.objects); i++ {
+		if sk.holds(i, sk.bucket(hsum, i), key, hsum) {
+			tracked = true
+			break
+		}
+	}
+
+	return sk.counterMin(hsum), tracked
+}
+
+// PeekAfterInsert returns the estimate Count would return for key after
+// Insert(key, count), without inserting, for deciding whether to insert at
+// all. Every counter of key grows by count, so it is the current estimate
+// plus count, short of saturating. Keys Insert rejects keep an estimate of 0.
+func (sk *Sketch) PeekAfterInsert(key interface{}, count uint64) uint64 {
+	key, ok := sk.limit(sk.canonical(key))
+	if !ok {
+		return 0
+	}
+
+	est := sk.counterMin(sk.hashKey(key))
+	if est+count < est {
+		return math.MaxUint64
+	}
+	return est + count
+}
+
+// CountDetail bounds the true count of a key, see CountDetailed.
+type CountDetail struct {
+	// UpperBound is the count-min estimate Count returns, which never
+	// undercounts.
+	UpperBound uint64
+
+	// LowerBound is the largest Misra-Gries count of the key over the rows
+	// holding it, which never overcounts as long as the sketch was only
+	// inserted into and merged with Merge. It is 0 for keys that aren't
+	// candidates.
+	LowerBound uint64
+
+	// Tracked reports whether the key is a candidate in any row.
+	Tracked bool
+}
+
+// CountDetailed is like Count, along with the lower bound the candidate
+// residuals give on the count of key. For a key that isn't tracked, nothing
+// but the upper bound is known.
+//
+// AddSketch sums the residuals of different keys sharing a bucket, so the
+// lower bound of a sketch built with it may exceed the true count.
+func (sk *Sketch) CountDetailed(key interface{}) CountDetail {
+	key, ok := sk.limit(sk.canonical(key))
+	if !ok {
+		return CountDetail{}
+	}
+	hsum := sk.hashKey(key)
+
+	d := CountDetail{UpperBound: sk.counterMin(hsum)}
+	for i := 0; key != nil && i < len(sk.objects); i++ {
+		hi := sk.bucket(hsum, i)
+		if !sk.holds(i, hi, key, hsum) {
+			continue
+		}
+		d.Tracked = true
+		if c := uint64(sk.counts[i][hi]); sk.counts[i][hi] > 0 && c > d.LowerBound {
+			d.LowerBound = c
+		}
+	}
+
+	return d
+}
+
+// counterMin returns the minimum counter over the buckets of a key hash in
+// all counter rows.
+func (sk *Sketch) counterMin(hsum uint64) uint64 {
+	min := uint64(math.MaxUint64)
+	for i := 0; i < sk.cms.rows; i++ {
+		if count := sk.cms.get(i, sk.bucket(hsum, i)); count < min {
+			min = count
+		}
+	}
+
+	return min
+}
+
+// Evictions returns the number of times a candidate was displaced from its
+// bucket by another key, by Insert or Merge.
+func (sk *Sketch) Evictions() uint64 {
+	return sk.evictions
+}
+
+// ExactIfUnsaturated returns the exact count of every inserted key, and true,
+// as long as no evictions have occurred. Exactness actually requires a
+// little more than that: a key that lands in a bucket held by a heavier key
+// doesn't evict it, but its count is lost. The answer is therefore exact
+// while at least one row has never had two keys meet in a bucket; that row
+// is then a plain map of keys to counts. Otherwise it returns (nil, false).
+func (sk *Sketch) ExactIfUnsaturated() (map[interface{}]uint64, bool) {
+	if sk.evictions > 0 {
+		return nil, false
+	}
+
+	for i, conflicts := range sk.conflicts {
+		if conflicts > 0 {
+			continue
+		}
+
+		exact := make(map[interface{}]uint64)
+		for j, obj := range sk.objects[i] {
+			if obj != nil {
+				exact[obj] = sk.cms.get(i, uint64(j))
+			}
+		}
+		return exact, true
+	}
+
+	return nil, false
+}
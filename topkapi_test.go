@@ -2,9 +2,11 @@ package topkapi
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"os"
 	"sort"
 	"strings"
@@ -30,8 +32,6 @@ func loadWords() []string {
 			}
 		}
 	}
-
-	return res
 }
 
 func exactCount(words []string) map[string]uint64 {
@@ -53,8 +53,12 @@ func exactTop(m map[string]uint64) []string {
 		keys = append(keys, k)
 	}
 
+	// Ties are ordered by key, so the expected order doesn't change between runs
 	sort.Slice(keys, func(a, b int) bool {
-		return m[keys[a]] > m[keys[b]]
+		if m[keys[a]] != m[keys[b]] {
+			return m[keys[a]] > m[keys[b]]
+		}
+		return keys[a] < keys[b]
 	})
 
 	return keys
@@ -84,7 +88,7 @@ func errorRate(epsilon float64, exact, sketch map[string]uint64) float64 {
 func resultToMap(result []LocalHeavyHitter) map[string]uint64 {
 	res := make(map[string]uint64, len(result))
 	for _, lhh := range result {
-		res[lhh.Key] = lhh.Count
+		res[lhh.Key.(string)] = lhh.Count
 	}
 
 	return res
@@ -99,6 +103,38 @@ func assertErrorRate(t *testing.T, exact map[string]uint64, result []LocalHeavyH
 	}
 }
 
+// TestDegenerateDimensions checks that parameters sizing a sketch of no rows
+// or no buckets are an error of the constructor, not a sketch that divides
+// by zero on the first insert.
+func TestDegenerateDimensions(t *testing.T) {
+	for name, f := range map[string]func() (*Sketch, error){
+		"delta of no rows": func() (*Sketch, error) { return New(0.9, 0.01) },
+		"zero buckets":     func() (*Sketch, error) { return NewFromParams(Params{B: 0, L: 4}) },
+		"zero rows":        func() (*Sketch, error) { return NewFromParams(Params{B: 100, L: 0}) },
+		"empty corpus":     func() (*Sketch, error) { return NewTopK(10, 0, 0.01) },
+		"single key":       func() (*Sketch, error) { return NewTopK(10, 1, 0.01) },
+		"tiny factor":      func() (*Sketch, error) { return NewTopK(10, 1000, 0.01, WithBucketFactor(1e-300)) },
+		"spec of no rows":  func() (*Sketch, error) { return Parse("b=100,l=0") },
+		"tiny budget":      func() (*Sketch, error) { return NewBounded(1) },
+	} {
+		if sk, err := f(); sk != nil || !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("%s: expected an invalid parameter, found %v", name, err)
+		}
+	}
+
+	for _, corpus := range []uint64{0, 1} {
+		if b := Buckets(10, corpus, DefaultBucketFactor); b != 0 {
+			t.Errorf("Expected no buckets for a corpus of %d, found %d", corpus, b)
+		}
+	}
+	if b := Buckets(math.MaxUint64, math.MaxUint64, math.MaxFloat64); b != math.MaxUint64 {
+		t.Errorf("Expected the buckets to be clamped, found %d", b)
+	}
+	if _, _, err := Calibrate(func(yield func(key interface{}) bool) { yield("a") }, CalibrationTarget{K: maxInt, Recall: 1}); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("Expected a K out of range to be invalid, found %v", err)
+	}
+}
+
 func TestSingle(t *testing.T) {
 	delta := 0.05
 	topK := uint64(100)
@@ -135,6 +171,28 @@ func TestSingle(t *testing.T) {
 	}
 }
 
+func TestSaturatedResiduals(t *testing.T) {
+	// Residuals stop at the largest int64, for counts the counters still hold
+	sk, _ := New(0.1, 0.01)
+	sk.Insert("a", math.MaxUint64-1)
+	other := sk.Clone()
+	if err := sk.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	sk.Insert("a", 5)
+	sk.Insert("b", math.MaxInt64+1)
+
+	for i := range sk.counts {
+		j := sk.bucket(sk.hashKey("a"), i)
+		if sk.objects[i][j] != "a" || sk.counts[i][j] != math.MaxInt64 {
+			t.Errorf("Expected a saturated residual of a in row %d, found %v with %d", i, sk.objects[i][j], sk.counts[i][j])
+		}
+	}
+	if res := sk.Result(0); len(res) == 0 || res[0].Key != "a" || res[0].Count != math.MaxUint64 {
+		t.Errorf("Expected a with a saturated count, found %v", res)
+	}
+}
+
 func TestMerge2(t *testing.T) {
 	delta := 0.01 // FIXME: tests fail for 0.03
 	topK := uint64(20)
@@ -178,7 +236,7 @@ func TestMerge2(t *testing.T) {
 	}
 
 	for _, res := range sketch1.Result(1)[:topK] {
-		fmt.Printf("%s=%d (%d)\n", res.Key, res.Count, exactAll[res.Key])
+		fmt.Printf("%s=%d (%d)\n", res.Key, res.Count, exactAll[res.Key.(string)])
 	}
 
 	assertErrorRate(t, exactAll, sketch1.Result(1), sketch1.Delta(), sketch1.Epsilon()) // Should pass according to article, but does not
@@ -327,3 +385,679 @@ func split(words []string, splits int) [][]string {
 
 	return slices
 }
+
+// legacyBucket is the double hashing scheme Insert used before rows were salted.
+func legacyBucket(hsum uint64, i int, b uint64) uint64 {
+	h1 := uint32(hsum & 0xffffffff)
+	h2 := uint32((hsum >> 32) & 0xffffffff)
+	return uint64(h1+uint32(i)*h2) % b
+}
+
+func TestRowSaltDecorrelatesRows(t *testing.T) {
+	sketch := newSketch(1000, 4)
+
+	// Hashes with an empty upper half make every legacy row pick the same
+	// bucket, so the sketch degrades to a single row.
+	var legacySame, salted int
+	const n = 10000
+	for hsum := uint64(0); hsum < n; hsum++ {
+		if legacyBucket(hsum, 0, sketch.b) == legacyBucket(hsum, 1, sketch.b) {
+			legacySame++
+		}
+		if sketch.bucket(hsum, 0) == sketch.bucket(hsum, 1) {
+			salted++
+		}
+	}
+
+	if legacySame != n {
+		t.Fatalf("Expected legacy scheme to collapse rows on adversarial keys, got %d/%d", legacySame, n)
+	}
+	// Independent rows agree with probability 1/b
+	if salted > 5*n/int(sketch.b) {
+		t.Errorf("Expected ~%d rows in agreement, found %d", n/int(sketch.b), salted)
+	}
+
+	// Pairs of keys that collide in the first row should rarely collide in the second
+	buckets := make(map[uint64][]uint64)
+	for hsum := uint64(0); hsum < n; hsum++ {
+		hi := sketch.bucket(hsum, 0)
+		buckets[hi] = append(buckets[hi], hsum)
+	}
+	var pairs, both int
+	for _, hs := range buckets {
+		for a := range hs {
+			for b := a + 1; b < len(hs); b++ {
+				pairs++
+				if sketch.bucket(hs[a], 1) == sketch.bucket(hs[b], 1) {
+					both++
+				}
+			}
+		}
+	}
+	if both > 5*pairs/int(sketch.b)+1 {
+		t.Errorf("Expected ~%d of %d row-0 collisions to repeat in row 1, found %d", pairs/int(sketch.b), pairs, both)
+	}
+}
+
+func TestExactIfUnsaturated(t *testing.T) {
+	sketch, _ := New(0.01, 0.0001)
+
+	words := []string{"a", "b", "c", "a", "a", "b", "d"}
+	for _, w := range words {
+		sketch.Insert(w, 1)
+	}
+	sketch.Insert("e", 5)
+
+	exact, ok := sketch.ExactIfUnsaturated()
+	if !ok {
+		t.Fatal("Expected few keys in a wide sketch to be exact")
+	}
+	want := map[interface{}]uint64{"a": 3, "b": 2, "c": 1, "d": 1, "e": 5}
+	if len(exact) != len(want) {
+		t.Fatalf("Expected %d keys, found %v", len(want), exact)
+	}
+	for k, c := range want {
+		if exact[k] != c {
+			t.Errorf("Expected '%s'=%d, found %d", k, c, exact[k])
+		}
+	}
+
+	// A single bucket per row forces every key to meet
+	tiny := newSketch(1, 2)
+	tiny.Insert("a", 1)
+	tiny.Insert("a", 1)
+	tiny.Insert("b", 1)
+	if _, ok := tiny.ExactIfUnsaturated(); ok {
+		t.Error("Expected sketch with collisions in every row to be inexact")
+	}
+	if tiny.Evictions() != 0 {
+		t.Errorf("Expected no evictions, found %d", tiny.Evictions())
+	}
+	tiny.Insert("b", 5)
+	if tiny.Evictions() != 2 {
+		t.Errorf("Expected 2 evictions, found %d", tiny.Evictions())
+	}
+}
+
+func TestExactIfUnsaturatedTransition(t *testing.T) {
+	sk := newSketch(64, 2)
+	want := make(map[interface{}]uint64)
+	var inexact int
+	for i := 0; i < 200; i++ {
+		key := i % 50
+		sk.Insert(key, uint64(i%3+1))
+		want[key] += uint64(i%3 + 1)
+
+		exact, ok := sk.ExactIfUnsaturated()
+		if !ok {
+			if inexact == 0 {
+				inexact = i
+			}
+			continue
+		}
+		if inexact > 0 {
+			t.Fatalf("Expected the sketch to stay approximate after insert %d, found it exact at %d", inexact, i)
+		}
+		for key, c := range want {
+			if exact[key] != c || len(exact) != len(want) {
+				t.Fatalf("Expected exact counts after insert %d, found %v", i, exact)
+			}
+		}
+	}
+	if inexact == 0 {
+		t.Fatal("Expected 50 keys in 64 buckets to meet in both rows")
+	}
+
+	// Exact again from a reset
+	sk.Reset()
+	sk.Insert("a", 2)
+	if exact, ok := sk.ExactIfUnsaturated(); !ok || len(exact) != 1 || exact["a"] != 2 {
+		t.Errorf("Expected a reset sketch to be exact, found %v", exact)
+	}
+}
+
+// TestExactIfUnsaturatedMinCount checks that counts merged into a bucket
+// before the key reaches the floor of WithMinCount aren't reported exact.
+func TestExactIfUnsaturatedMinCount(t *testing.T) {
+	sk, _ := NewFromParams(Params{B: 1, L: 1}, WithMinCount(5))
+	sk.Insert("a", 2)
+	sk.Insert("b", 2)
+	sk.Insert("a", 3)
+	if exact, ok := sk.ExactIfUnsaturated(); ok {
+		t.Errorf("Expected counts of keys below the floor to be inexact, found %v", exact)
+	}
+
+	// A candidate taking a bucket that counts keys below the floor
+	sk, _ = NewFromParams(Params{B: 1, L: 1}, WithMinCount(5))
+	sk.Insert("a", 2)
+	sk.Insert("c", 5)
+	if exact, ok := sk.ExactIfUnsaturated(); ok {
+		t.Errorf("Expected the count of c to be inexact, found %v", exact)
+	}
+}
+
+func TestResultWhere(t *testing.T) {
+	words := loadWords()
+	sketch, _ := NewTopK(100, uint64(len(words)), 0.01)
+	for _, w := range words {
+		sketch.Insert(w, 1)
+	}
+
+	calls := make(map[interface{}]int)
+	hasPrefix := func(key interface{}) bool {
+		calls[key]++
+		return strings.HasPrefix(key.(string), "th")
+	}
+
+	res := sketch.ResultWhere(1, hasPrefix)
+	if len(res) == 0 {
+		t.Fatal("Expected keys starting with 'th'")
+	}
+	for _, hh := range res {
+		if !strings.HasPrefix(hh.Key.(string), "th") {
+			t.Errorf("Expected only keys starting with 'th', found '%s'", hh.Key)
+		}
+	}
+	for key, n := range calls {
+		if n != 1 {
+			t.Errorf("Expected predicate called once for '%s', found %d", key, n)
+		}
+	}
+
+	var want []LocalHeavyHitter
+	for _, hh := range sketch.Result(1) {
+		if strings.HasPrefix(hh.Key.(string), "th") {
+			want = append(want, hh)
+		}
+	}
+	if len(want) != len(res) {
+		t.Fatalf("Expected %d keys as filtering Result, found %d", len(want), len(res))
+	}
+	for i := range want {
+		if want[i].Count != res[i].Count {
+			t.Errorf("Expected count %d at rank %d, found %d", want[i].Count, i, res[i].Count)
+		}
+	}
+}
+
+func TestAddSketch(t *testing.T) {
+	words := loadWords()
+	for _, p := range []int{2, 3, 5, 7, 11, 13, 17, 23} {
+		for i := p; i < len(words); i += p {
+			words[i] = words[p]
+		}
+	}
+
+	whole, _ := NewTopK(20, uint64(len(words)), 0.01)
+	for _, w := range words {
+		whole.Insert(w, 1)
+	}
+
+	root, _ := NewTopK(20, uint64(len(words)), 0.01)
+	for _, slice := range split(words, 8) {
+		leaf, _ := NewTopK(20, uint64(len(words)), 0.01)
+		for _, w := range slice {
+			leaf.Insert(w, 1)
+		}
+		if err := root.AddSketch(leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if root.Total() != whole.Total() || root.Cardinality() != whole.Cardinality() {
+		t.Errorf("Expected totals of the whole stream, found %d and %d", root.Total(), root.Cardinality())
+	}
+	for i := 0; i < whole.cms.rows; i++ {
+		for j := uint64(0); j < whole.b; j++ {
+			if root.cms.get(i, j) != whole.cms.get(i, j) {
+				t.Fatalf("Expected cms[%d][%d]=%d, found %d", i, j, whole.cms.get(i, j), root.cms.get(i, j))
+			}
+		}
+	}
+
+	// Beyond the heavy hitters, ties are reported in no particular order
+	got, want := root.TopK(5), whole.TopK(5)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d heavy hitters, found %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected heavy hitter %d to be %v, found %v", i, want[i], got[i])
+		}
+	}
+	assertErrorRate(t, exactCount(words), root.Result(1), root.Delta(), root.Epsilon())
+
+	small, _ := New(0.1, 0.1)
+	if err := root.AddSketch(small); err != ErrIncompatibleSketches {
+		t.Errorf("Expected incompatible sketches, found %v", err)
+	}
+}
+
+func TestAddSketchSumsResiduals(t *testing.T) {
+	var (
+		added, _  = New(0.5, 0.5)
+		merged, _ = New(0.5, 0.5)
+		leaf1, _  = New(0.5, 0.5)
+		leaf2, _  = New(0.5, 0.5)
+	)
+
+	// Find a key sharing the single row bucket of "x"
+	y := 0
+	for added.bucket(added.hashKey(y), 0) != added.bucket(added.hashKey("x"), 0) {
+		y++
+	}
+	leaf1.Insert("x", 5)
+	leaf2.Insert(y, 3)
+
+	for _, sk := range []*Sketch{added, merged} {
+		sk.Insert("x", 2)
+	}
+	added.AddSketch(leaf1)
+	added.AddSketch(leaf2)
+	merged.Merge(leaf1)
+	merged.Merge(leaf2)
+
+	hi := added.bucket(added.hashKey("x"), 0)
+	if obj, cnt := added.objects[0][hi], added.counts[0][hi]; obj != "x" || cnt != 10 {
+		t.Errorf("Expected 'x' to keep its bucket with summed residual 10, found %v=%d", obj, cnt)
+	}
+	if obj, cnt := merged.objects[0][hi], merged.counts[0][hi]; obj != "x" || cnt != 4 {
+		t.Errorf("Expected 'x' to keep its bucket with residual 4 after Merge, found %v=%d", obj, cnt)
+	}
+	if a, m := added.Result(1), merged.Result(1); len(a) != 1 || len(m) != 1 || a[0] != m[0] {
+		t.Errorf("Expected the same estimates, found %v and %v", a, m)
+	}
+}
+
+func TestResultStream(t *testing.T) {
+	sk, _ := New(0.01, 0.0001)
+	for _, key := range zipfKeys(200000, 5000, 1) {
+		sk.Insert(key, 1)
+	}
+
+	want := sk.Result(2)
+	if len(want) < 3*streamBatch {
+		t.Fatalf("Expected more than %d candidates, found %d", 3*streamBatch, len(want))
+	}
+
+	var got []LocalHeavyHitter
+	sk.ResultStream(2, func(hh LocalHeavyHitter) bool {
+		got = append(got, hh)
+		return true
+	})
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d heavy hitters, found %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %v at rank %d, found %v", want[i], i, got[i])
+		}
+	}
+
+	var calls int
+	sk.ResultStream(2, func(hh LocalHeavyHitter) bool {
+		calls++
+		return calls < 10
+	})
+	if calls != 10 {
+		t.Errorf("Expected the stream to stop after 10 calls, found %d", calls)
+	}
+
+	// Stopping early takes a single pass, draining takes one per batch
+	take := func(n int) float64 {
+		return testing.AllocsPerRun(3, func() {
+			var i int
+			sk.ResultStream(2, func(LocalHeavyHitter) bool {
+				i++
+				return i < n
+			})
+		})
+	}
+	if first, all := take(10), take(len(want)); first*3 > all {
+		t.Errorf("Expected stopping early to skip later passes, found %.0f allocations for 10 and %.0f for all", first, all)
+	}
+}
+
+// longKeys returns n inserts of 256 byte keys drawn from distinct keys that
+// only differ at the end. Every key is a separate copy, as when parsed from
+// input.
+func longKeys(n int, distinct uint64) []string {
+	prefix := strings.Repeat("x", 240)
+	keys := zipfKeys(n, distinct, 1)
+	for i, key := range keys {
+		keys[i] = fmt.Sprintf("%s%16s", prefix, key)
+	}
+
+	return keys
+}
+
+type longKey struct {
+	Host, Path string
+	Port       int
+}
+
+func BenchmarkInsertLongKeys(b *testing.B) {
+	keys := longKeys(100000, 1000)
+	sk, _ := New(0.01, 0.001)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sk.Insert(keys[i%len(keys)], 1)
+	}
+}
+
+func BenchmarkInsertHashedLongKeys(b *testing.B) {
+	benchmarkInsertHashedLongKeys(b, 1000)
+}
+
+// Most inserts meet a bucket held by another key
+func BenchmarkInsertHashedLongKeysContested(b *testing.B) {
+	benchmarkInsertHashedLongKeys(b, 1000000)
+}
+
+func benchmarkInsertHashedLongKeys(b *testing.B, distinct uint64) {
+	keys := longKeys(100000, distinct)
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i] = HashKey(key)
+	}
+	sk, _ := New(0.01, 0.001)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sk.InsertHashed(keys[i%len(keys)], hashes[i%len(keys)], 1)
+	}
+}
+
+func BenchmarkInsertHashedStructKeys(b *testing.B) {
+	keys := make([]longKey, 100000)
+	hashes := make([]uint64, len(keys))
+	for i, key := range longKeys(len(keys), 1000) {
+		keys[i] = longKey{Host: key[:128], Path: key[128:], Port: 443}
+		hashes[i] = HashKey(keys[i])
+	}
+	sk, _ := New(0.01, 0.001)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sk.InsertHashed(keys[i%len(keys)], hashes[i%len(keys)], 1)
+	}
+}
+
+func TestCandidateHashCollision(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+
+	// Two keys forced onto the same hash are still told apart
+	sk.InsertHashed("a", 42, 5)
+	sk.InsertHashed("b", 42, 3)
+
+	for i := range sk.objects {
+		hi := sk.bucket(42, i)
+		if obj, cnt := sk.objects[i][hi], sk.counts[i][hi]; obj != "a" || cnt != 2 {
+			t.Errorf("Expected 'a' to hold row %d with residual 2, found %v=%d", i, obj, cnt)
+		}
+	}
+}
+
+func TestResultRows(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	noise, hitter := sk.hashKey("noise"), sk.hashKey("hitter")
+
+	// Take the buckets of the noise key in all rows but the first
+	for r := 1; r < int(sk.l); r++ {
+		for y := 0; ; y++ {
+			hy := sk.hashKey(y)
+			if sk.bucket(hy, r) != sk.bucket(noise, r) {
+				continue
+			}
+			var clash bool
+			for i := 0; i < int(sk.l); i++ {
+				clash = clash || i != r && sk.bucket(hy, i) == sk.bucket(noise, i) || sk.bucket(hy, i) == sk.bucket(hitter, i)
+			}
+			if !clash {
+				sk.Insert(y, 10)
+				break
+			}
+		}
+	}
+	sk.Insert("noise", 5)
+	sk.Insert("hitter", 5)
+
+	var res []LocalHeavyHitter
+	for _, hh := range sk.Result(1) {
+		if hh.Key == "noise" || hh.Key == "hitter" {
+			res = append(res, hh)
+		}
+	}
+	if len(res) != 2 || res[0].Count != 5 || res[1].Count != 5 {
+		t.Fatalf("Expected both keys with count 5, found %v", res)
+	}
+	if res[0].Key != "hitter" || res[0].Rows != int(sk.l) {
+		t.Errorf("Expected the hitter first, held in all %d rows, found %v", sk.l, res[0])
+	}
+	if res[1].Key != "noise" || res[1].Rows != 1 {
+		t.Errorf("Expected the noise key last, held in a single row, found %v", res[1])
+	}
+}
+
+func TestAbsorbTopK(t *testing.T) {
+	keys := zipfKeys(20000, 1000, 3)
+	other, _ := NewTopK(10, 20000, 0.01, WithSeed(9))
+	for _, key := range keys[:10000] {
+		other.Insert(key, 1)
+	}
+	sk, _ := New(0.01, 0.001)
+	for _, key := range keys[10000:] {
+		sk.Insert(key, 1)
+	}
+	if err := sk.Merge(other); err != ErrIncompatibleSketches {
+		t.Fatalf("Expected sketches to be incompatible, found %v", err)
+	}
+
+	before := sk.Total()
+	top := other.TopK(10)
+	sk.AbsorbTopK(other, 10)
+
+	var absorbed uint64
+	for _, hh := range top {
+		absorbed += hh.Count
+		if c, _ := sk.Count(hh.Key); c < hh.Count {
+			t.Errorf("Expected %v to be absorbed with at least %d, found %d", hh.Key, hh.Count, c)
+		}
+	}
+	if sk.Total() != before+absorbed {
+		t.Errorf("Expected total to grow by the %d absorbed, found %d", absorbed, sk.Total()-before)
+	}
+
+	res := sk.TopK(3)
+	for i, key := range []string{"key0", "key1", "key2"} {
+		if res[i].Key != key {
+			t.Errorf("Expected %s at rank %d after absorbing, found %v", key, i, res)
+		}
+	}
+}
+
+func TestPrime(t *testing.T) {
+	keys := zipfKeys(40000, 1000, 5)
+	previous, _ := NewTopK(10, 20000, 0.01)
+	for _, key := range keys[:20000] {
+		previous.Insert(key, 1)
+	}
+	top := previous.TopK(10)
+
+	// After a restart, the previous top 10 are reported right away
+	restarted, _ := NewTopK(10, 20000, 0.01)
+	if err := restarted.Prime(top); err != nil {
+		t.Fatal(err)
+	}
+	for i, hh := range restarted.TopK(10) {
+		if hh.Key != top[i].Key || hh.Count != top[i].Count {
+			t.Errorf("Expected %v=%d at rank %d after priming, found %v=%d", top[i].Key, top[i].Count, i, hh.Key, hh.Count)
+		}
+	}
+
+	// and keep their ranks as the stream goes on
+	for _, key := range keys[20000:21000] {
+		restarted.Insert(key, 1)
+	}
+	for i, hh := range restarted.TopK(3) {
+		if hh.Key != top[i].Key {
+			t.Errorf("Expected %v at rank %d, found %v", top[i].Key, i, hh.Key)
+		}
+	}
+}
+
+func TestPrimeOverflow(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	sk.Insert("a", math.MaxUint64-10)
+
+	for _, entries := range [][]LocalHeavyHitter{
+		{{Key: "b", Count: 5}, {Key: "c", Count: 6}},
+		{{Key: "b", Count: math.MaxInt64 + 1}},
+		{{Key: "b", Count: 5}, {Key: nil, Count: 1}},
+	} {
+		if err := sk.Prime(entries); err == nil {
+			t.Errorf("Expected error priming %v", entries)
+		}
+	}
+	if sk.Total() != math.MaxUint64-10 {
+		t.Errorf("Expected a failed Prime to insert nothing, found total %d", sk.Total())
+	}
+
+	if err := sk.Prime([]LocalHeavyHitter{{Key: "b", Count: 10}}); err != nil {
+		t.Errorf("Expected counts up to the limit to be primed, found %v", err)
+	}
+}
+
+func TestCountDetailedBounds(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		sk, _ := New(0.01, 0.05)
+		other, _ := New(0.01, 0.05)
+		exact := make(map[int]uint64)
+		for i := 0; i < 20000; i++ {
+			key := int(rnd.ExpFloat64() * 50)
+			count := uint64(1 + rnd.Intn(3))
+			exact[key] += count
+			if i%2 == 0 {
+				sk.Insert(key, count)
+			} else {
+				other.Insert(key, count)
+			}
+		}
+		if err := sk.Merge(other); err != nil {
+			t.Fatal(err)
+		}
+
+		var tracked int
+		for key := 0; key < 2000; key++ {
+			d := sk.CountDetailed(key)
+			if d.LowerBound > exact[key] || exact[key] > d.UpperBound {
+				t.Fatalf("Seed %d: expected %d <= %d <= %d for key %d", seed, d.LowerBound, exact[key], d.UpperBound, key)
+			}
+			if c, ok := sk.Count(key); c != d.UpperBound || ok != d.Tracked {
+				t.Errorf("Seed %d: expected Count %d (%v) to match %+v", seed, c, ok, d)
+			}
+			if !d.Tracked && d.LowerBound != 0 {
+				t.Errorf("Seed %d: expected no lower bound for untracked key %d, found %+v", seed, key, d)
+			}
+			if d.Tracked {
+				tracked++
+			}
+		}
+		if tracked == 0 {
+			t.Errorf("Seed %d: expected some keys to be tracked", seed)
+		}
+	}
+
+	sk, _ := New(0.01, 0.01)
+	if d := sk.CountDetailed(nil); d != (CountDetail{}) {
+		t.Errorf("Expected nothing known about a nil key, found %+v", d)
+	}
+}
+
+func TestPeekAfterInsert(t *testing.T) {
+	sk := newSketch(100, 3)
+	keys := zipfKeys(5000, 500, 6)
+	for _, key := range keys {
+		sk.Insert(key, 1)
+	}
+	state := sk.StateHash()
+
+	for _, key := range []string{keys[0], keys[1], "unseen"} {
+		before, _ := sk.Count(key)
+		peeked := sk.PeekAfterInsert(key, 5)
+		if c, _ := sk.Count(key); c != before || sk.StateHash() != state {
+			t.Fatalf("Expected peeking at %s to leave the sketch unchanged", key)
+		}
+
+		cp := sk.Clone()
+		cp.Insert(key, 5)
+		if c, _ := cp.Count(key); c != peeked {
+			t.Errorf("Expected %s to be peeked at %d after inserting, found %d", key, c, peeked)
+		}
+	}
+
+	if c := sk.PeekAfterInsert(keys[0], math.MaxUint64); c != math.MaxUint64 {
+		t.Errorf("Expected the estimate to saturate, found %d", c)
+	}
+}
+
+// Most buckets of both sketches are empty, as with a short window
+func BenchmarkMergeSparse(b *testing.B) {
+	benchmarkMerge(b, 1000, 100)
+}
+
+// Every bucket of both sketches is occupied
+func BenchmarkMergeDense(b *testing.B) {
+	benchmarkMerge(b, 1000000, 1000000)
+}
+
+func benchmarkMerge(b *testing.B, n int, distinct uint64) {
+	sk, _ := NewTopK(20, 1000000, 0.01)
+	other, _ := NewTopK(20, 1000000, 0.01)
+	for _, key := range zipfKeys(n, distinct, 1) {
+		sk.Insert(key, 1)
+	}
+	for _, key := range zipfKeys(n, distinct, 2) {
+		other.Insert(key, 1)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sk.Merge(other); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Every bucket of a wide sketch is occupied, and every candidate qualifies
+func BenchmarkResultFull(b *testing.B) {
+	sk := newSketch(100000, 4)
+	for i := 0; i < 2000000; i++ {
+		sk.Insert(i, 1)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sk.Result(0)
+	}
+}
+
+// A wide sketch of which only a handful of heavy hitters qualify
+func BenchmarkResultHighThreshold(b *testing.B) {
+	sk := newSketch(100000, 4)
+	for i := 0; i < 2000000; i++ {
+		sk.Insert(i, 1)
+	}
+	for i := 0; i < 10; i++ {
+		sk.Insert(-i, 1000)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sk.Result(1000)
+	}
+}
@@ -0,0 +1,156 @@
+package topkapi
+
+import (
+	"sort"
+	"time"
+)
+
+// TrendingHeavyHitter is a key along with its estimates in the current and
+// the previous interval of a TrendingSketch.
+type TrendingHeavyHitter struct {
+	Key      interface{}
+	Current  uint64
+	Previous uint64 // 0 if the key isn't a candidate of the previous interval
+
+	// Trend is Current - Previous, negative for a key counted less than
+	// before.
+	Trend int64
+}
+
+// TrendingSketch counts a stream in intervals, keeping a sketch of the
+// current interval and one of the previous, to find keys that suddenly
+// become popular rather than those that always are, see Trending.
+//
+// Intervals start with the first one at NewTrending, and the sketches
+// rotate on the first insert or query in a new interval: the sketch of the
+// current interval becomes that of the previous one, and the current one
+// starts over. After an interval without inserts or queries, the previous
+// interval is empty. A TrendingSketch is not safe for concurrent use.
+type TrendingSketch struct {
+	current, previous *Sketch
+	interval          time.Duration
+	clock             Clock
+	start             time.Time // of the current interval
+}
+
+// TrendingOption configures a TrendingSketch.
+type TrendingOption func(*TrendingSketch) error
+
+// WithTrendingClock sets the clock the intervals follow.
+func WithTrendingClock(clock Clock) TrendingOption {
+	return func(t *TrendingSketch) error {
+		if clock == nil {
+			return newError(ErrInvalidParameter, "topkapi: clock should not be nil")
+		}
+		t.clock = clock
+		return nil
+	}
+}
+
+// NewTrending creates a TrendingSketch counting every interval in sk, which
+// must be empty, and in a copy of it. The caller must not use sk directly
+// afterwards.
+func NewTrending(sk *Sketch, interval time.Duration, opts ...TrendingOption) (*TrendingSketch, error) {
+	if sk == nil {
+		return nil, nilSketch
+	}
+	if !sk.Empty() {
+		return nil, newError(ErrInvalidParameter, "topkapi: sketch should be empty")
+	}
+	if interval <= 0 {
+		return nil, newError(ErrInvalidParameter, "topkapi: value of interval should be > 0")
+	}
+
+	t := &TrendingSketch{current: sk, previous: sk.Clone(), interval: interval, clock: SystemClock}
+	for _, opt := range opts {
+		if err := opt(t); err != nil {
+			return nil, err
+		}
+	}
+	t.start = t.clock.Now()
+
+	return t, nil
+}
+
+// Insert adds count occurrences of key to the current interval.
+func (t *TrendingSketch) Insert(key interface{}, count uint64) {
+	t.rotate()
+	t.current.Insert(key, count)
+}
+
+// Trending returns the k candidates of the current interval whose estimate
+// grew the most since the previous interval, by descending Trend, then by
+// descending Current. Keys that aren't candidates of the previous interval
+// grow from 0. It returns fewer than k entries if the current interval
+// doesn't hold that many candidates, and an empty, non-nil slice if k < 1.
+//
+// Early in an interval every key has had less time to be counted than in
+// the previous one, so their trends are lower; compare trends within one
+// interval, or the ratio between Current and Previous scaled by the elapsed
+// part of the interval.
+func (t *TrendingSketch) Trending(k int) []TrendingHeavyHitter {
+	if k < 1 {
+		return []TrendingHeavyHitter{}
+	}
+	t.rotate()
+
+	type ranked struct {
+		TrendingHeavyHitter
+		hsum uint64
+	}
+	var rs []ranked
+	t.current.scan(1, nil, func(hh LocalHeavyHitter, hsum uint64) {
+		var prev uint64
+		if c, ok := t.previous.Count(hh.Key); ok {
+			prev = c
+		}
+		rs = append(rs, ranked{TrendingHeavyHitter{Key: hh.Key, Current: hh.Count, Previous: prev, Trend: int64(hh.Count) - int64(prev)}, hsum})
+	})
+	sort.Slice(rs, func(a, b int) bool {
+		if rs[a].Trend != rs[b].Trend {
+			return rs[a].Trend > rs[b].Trend
+		}
+		if rs[a].Current != rs[b].Current {
+			return rs[a].Current > rs[b].Current
+		}
+		return rs[a].hsum < rs[b].hsum
+	})
+
+	if len(rs) > k {
+		rs = rs[:k]
+	}
+	res := make([]TrendingHeavyHitter, len(rs))
+	for i := range rs {
+		res[i] = rs[i].TrendingHeavyHitter
+	}
+
+	return res
+}
+
+// Current returns the sketch of the current interval.
+func (t *TrendingSketch) Current() *Sketch {
+	t.rotate()
+	return t.current
+}
+
+// Previous returns the sketch of the previous interval.
+func (t *TrendingSketch) Previous() *Sketch {
+	t.rotate()
+	return t.previous
+}
+
+// rotate moves on to the interval the clock is in.
+func (t *TrendingSketch) rotate() {
+	elapsed := t.clock.Now().Sub(t.start)
+	if elapsed < t.interval {
+		return
+	}
+
+	n := elapsed / t.interval
+	t.previous, t.current = t.current, t.previous
+	t.current.Reset()
+	if n > 1 {
+		t.previous.Reset()
+	}
+	t.start = t.start.Add(n * t.interval)
+}
@@ -0,0 +1,58 @@
+package topkapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrending(t *testing.T) {
+	clock := newFakeClock()
+	sk, _ := New(0.01, 0.01)
+	ts, err := NewTrending(sk, time.Minute, WithTrendingClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A flat key is counted alike every interval, a spiking one suddenly
+	// much more, though still less than the flat one
+	for i := 0; i < 1000; i++ {
+		ts.Insert("flat", 10)
+		ts.Insert("spiking", 1)
+	}
+	clock.Advance(time.Minute)
+	for i := 0; i < 1000; i++ {
+		ts.Insert("flat", 10)
+		ts.Insert("spiking", 5)
+		ts.Insert("new", 1)
+	}
+
+	top := ts.Trending(2)
+	want := []TrendingHeavyHitter{
+		{Key: "spiking", Current: 5000, Previous: 1000, Trend: 4000},
+		{Key: "new", Current: 1000, Previous: 0, Trend: 1000},
+	}
+	if len(top) != 2 || top[0] != want[0] || top[1] != want[1] {
+		t.Errorf("Expected %v, found %v", want, top)
+	}
+	if all := ts.Trending(10); len(all) != 3 || all[2].Key != "flat" || all[2].Trend != 0 {
+		t.Errorf("Expected the flat key last with no trend, found %v", all)
+	}
+
+	// A quiet interval leaves nothing to compare with
+	clock.Advance(2 * time.Minute)
+	ts.Insert("flat", 10)
+	if top := ts.Trending(1); len(top) != 1 || top[0].Previous != 0 || !ts.Previous().Empty() {
+		t.Errorf("Expected an empty previous interval, found %v", top)
+	}
+	clock.Advance(time.Minute)
+	if top := ts.Trending(1); len(top) != 0 || ts.Previous().Total() != 10 {
+		t.Errorf("Expected an empty current interval, found %v", top)
+	}
+
+	if _, err := NewTrending(sk, 0); err == nil {
+		t.Error("Expected an error for an interval of 0")
+	}
+	if _, err := NewTrending(ts.Previous(), time.Minute); err == nil {
+		t.Error("Expected an error for a sketch that isn't empty")
+	}
+}
@@ -0,0 +1,26 @@
+package topkapi
+
+// Validate returns an error wrapping ErrCorruptData for the first thing about
+// the candidates of sk that no stream of inserts and merges leads to: a
+// residual out of [0, counter], a residual without a key, or a key whose
+// occupied bit or hash doesn't match it. It is nil for any sketch built by
+// the package, and meant for tests and for sketches of doubtful origin, as
+// it goes over every bucket.
+func (sk *Sketch) Validate() error {
+	for i := range sk.counts {
+		for j := uint64(0); j < sk.b; j++ {
+			c, residual, obj := sk.cms.get(i, j), sk.counts[i][j], sk.objects[i][j]
+			switch occupied := sk.occupied[i][j/64]&(1<<(j%64)) != 0; {
+			case residual < 0 || uint64(residual) > c:
+				return newError(ErrCorruptData, "topkapi: row %d, bucket %d: residual %d out of [0, %d]", i, j, residual, c)
+			case occupied != (obj != nil):
+				return newError(ErrCorruptData, "topkapi: row %d, bucket %d: occupied %v for key %v", i, j, occupied, obj)
+			case obj == nil && residual != 0:
+				return newError(ErrCorruptData, "topkapi: row %d, bucket %d: residual %d without a key", i, j, residual)
+			case obj != nil && sk.hashes[i][j] != sk.hashKey(obj):
+				return newError(ErrCorruptData, "topkapi: row %d, bucket %d: hash %x of key %v, should be %x", i, j, sk.hashes[i][j], obj, sk.hashKey(obj))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package topkapi
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	sk := fixtureSketch()
+	if err := sk.Validate(); err != nil {
+		t.Fatalf("Expected a valid sketch, found %v", err)
+	}
+
+	// Find a candidate to corrupt
+	i, j := 0, uint64(0)
+	for sk.objects[i][j] == nil {
+		j++
+	}
+	corruptions := map[string]func(sk *Sketch){
+		"negative residual": func(sk *Sketch) { sk.counts[i][j] = -1 },
+		"residual over the counter": func(sk *Sketch) {
+			sk.counts[i][j] = int64(sk.cms.get(i, j)) + 1
+		},
+		"occupied bit": func(sk *Sketch) { sk.occupied[i][j/64] &^= 1 << (j % 64) },
+		"residual without a key": func(sk *Sketch) {
+			sk.objects[i][j] = nil
+			sk.occupied[i][j/64] &^= 1 << (j % 64)
+		},
+		"hash": func(sk *Sketch) { sk.hashes[i][j]++ },
+	}
+	for name, corrupt := range corruptions {
+		c := sk.Clone()
+		corrupt(c)
+		if err := c.Validate(); !errors.Is(err, ErrCorruptData) {
+			t.Errorf("%s: expected corrupt data, found %v", name, err)
+		}
+	}
+}
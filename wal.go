@@ -0,0 +1,121 @@
+package topkapi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Write-ahead log format, a sequence of records of:
+//
+//	length   uvarint, of the payload
+//	payload  the key, encoded like in MarshalBinary, then the count as a
+//	         uvarint
+//	checksum 4 bytes little endian CRC-32C of the payload
+//
+// The log has no header, so a log can be appended to after a restart.
+
+// maxLogRecord bounds the payload of a record, so that a corrupt length
+// isn't taken for a huge key.
+const maxLogRecord = 1 << 24
+
+// LoggedSketch appends every insert to a write-ahead log before applying it
+// to a Sketch, so that the sketch can be rebuilt after a crash by replaying
+// the log into a new one, see Replay, without snapshots in between.
+//
+// Every insert is one Write of a whole record. Syncing the log to stable
+// storage is up to the caller: an insert is only as durable as the Write
+// that logged it, so for a file either sync it after every insert, or sync
+// it periodically and accept losing the inserts since. Like Sketch, a
+// LoggedSketch must not be used concurrently.
+type LoggedSketch struct {
+	sk           *Sketch
+	w            io.Writer
+	payload, rec []byte // scratch
+}
+
+// NewLogged wraps sk, logging to w. The caller must not insert into sk
+// directly afterwards, or the log won't rebuild it.
+func NewLogged(sk *Sketch, w io.Writer) *LoggedSketch {
+	return &LoggedSketch{sk: sk, w: w}
+}
+
+// Insert logs an insert of count occurrences of key, and applies it if it
+// was logged. Keys must be strings, booleans, or integer or floating point
+// numbers, as in MarshalBinary. A count of zero is a no-op and isn't logged.
+func (ls *LoggedSketch) Insert(key interface{}, count uint64) error {
+	if count == 0 {
+		return nil
+	}
+
+	payload, err := appendKey(ls.payload[:0], key)
+	if err != nil {
+		return err
+	}
+	ls.payload = appendUvarint(payload, count)
+
+	rec := appendUvarint(ls.rec[:0], uint64(len(ls.payload)))
+	ls.rec = append(append(rec, ls.payload...), checksum(ls.payload)...)
+
+	if _, err := ls.w.Write(ls.rec); err != nil {
+		return err
+	}
+	ls.sk.Insert(key, count)
+
+	return nil
+}
+
+// Sketch returns the sketch the inserts are applied to, for queries.
+func (ls *LoggedSketch) Sketch() *Sketch {
+	return ls.sk
+}
+
+var corruptLog = newError(ErrCorruptData, "topkapi: corrupt write-ahead log")
+
+// Replay inserts every record of a log written by a LoggedSketch, and
+// returns the number of records replayed. Replaying into a new sketch
+// created like the logged one rebuilds it.
+//
+// A record cut short at the end of the log is the insert a crash
+// interrupted, which was never applied, and is skipped. Any other damage is
+// an error, and the records before it have been replayed.
+func (sk *Sketch) Replay(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+
+	var payload []byte
+	for n := 0; ; n++ {
+		size, err := binary.ReadUvarint(br)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return n, nil
+		case err != nil:
+			return n, err
+		case size > maxLogRecord:
+			return n, fmt.Errorf("%w: record %d of %d bytes", corruptLog, n, size)
+		}
+
+		if uint64(cap(payload)) < size+4 {
+			payload = make([]byte, size+4)
+		}
+		payload = payload[:size+4]
+		if _, err := io.ReadFull(br, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		sum := binary.LittleEndian.Uint32(payload[size:])
+		if crc32.Checksum(payload[:size], castagnoli) != sum {
+			return n, fmt.Errorf("%w: checksum mismatch in record %d", corruptLog, n)
+		}
+		d := decoder{data: payload[:size]}
+		key, count := d.key(), d.uvarint()
+		if d.err != nil || len(d.data) != 0 {
+			return n, fmt.Errorf("%w: record %d", corruptLog, n)
+		}
+
+		sk.Insert(key, count)
+	}
+}
@@ -0,0 +1,66 @@
+package topkapi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestLoggedSketch(t *testing.T) {
+	var log bytes.Buffer
+	sk, _ := New(0.01, 0.001, WithSeed(3))
+	ls := NewLogged(sk, &log)
+
+	keys := []interface{}{"", true, int8(-3), uint16(7), 2.5, float32(1.5), int64(-1 << 40)}
+	for i, key := range zipfKeys(5000, 500, 1) {
+		if err := ls.Insert(key, uint64(1+i%3)); err != nil {
+			t.Fatal(err)
+		}
+		if i%500 == 0 {
+			ls.Insert(keys[i/500%len(keys)], 2)
+		}
+	}
+	if err := ls.Insert(struct{}{}, 1); !errors.Is(err, ErrUnsupportedKeyType) {
+		t.Errorf("Expected an unsupported key, got %v", err)
+	}
+	ls.Insert("zero", 0)
+
+	restored, _ := New(0.01, 0.001, WithSeed(3))
+	n, err := restored.Replay(bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5010 {
+		t.Errorf("Expected 5010 records, replayed %d", n)
+	}
+	if restored.StateHash() != ls.Sketch().StateHash() {
+		t.Error("Expected the replayed sketch to equal the logged one")
+	}
+
+	// A crash cut the last record short
+	torn, _ := New(0.01, 0.001, WithSeed(3))
+	if n, err := torn.Replay(bytes.NewReader(log.Bytes()[:log.Len()-2])); err != nil || n != 5009 {
+		t.Errorf("Expected the torn record to be skipped, replayed %d: %v", n, err)
+	}
+
+	corrupt := append([]byte(nil), log.Bytes()...)
+	corrupt[100] ^= 0xff
+	if _, err := sk.Clone().Replay(bytes.NewReader(corrupt)); !errors.Is(err, corruptLog) {
+		t.Errorf("Expected a corrupt log, got %v", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestLoggedSketchWriteError(t *testing.T) {
+	sk, _ := New(0.01, 0.01)
+	ls := NewLogged(sk, failingWriter{})
+	if err := ls.Insert("a", 1); err == nil {
+		t.Error("Expected the write error")
+	}
+	if !sk.Empty() {
+		t.Error("Expected an insert that wasn't logged not to be applied")
+	}
+}